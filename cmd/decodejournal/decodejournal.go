@@ -1,31 +1,123 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/zavla/upload/fsdriver"
 )
 
 var name string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	var asJSON, repair bool
+	var dataname string
 	flag.StringVar(&name, "file", "", "journal file")
-	flag.Usage = func() { println(`Decodes specified a journal file`) }
+	flag.BoolVar(&asJSON, "json", false, "print the journal, its records and anomalies as JSON")
+	flag.StringVar(&dataname, "data", "", "the actual `file` of the journal (.part) to verify checksums of blocks and the file size, \"auto\" is the journal name without .partialinfo")
+	flag.BoolVar(&repair, "repair", false, "truncate the journal to its last correct record, the original is kept as .bak")
+	flag.Usage = func() {
+		println(`Decodes specified a journal file
+decodejournal -file name [-data file|auto] [-json] [-repair]
+decodejournal migrate -file name   upgrades a version 1 or 2 journal to the latest version`)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if name == "" {
-		flag.PrintDefaults()
+		flag.Usage()
 		return
 	}
+	if dataname == "auto" {
+		dataname = strings.TrimSuffix(name, fsdriver.GetPartialJournalFileName(""))
+	}
+	var wa io.ReaderAt // nil means no verification
+	var wasize int64
+	if dataname != "" {
+		fwa, err := os.Open(dataname)
+		if err != nil {
+			log.Printf("%s\n", err)
+			return
+		}
+		defer fwa.Close()
+		wa = fwa
+		fi, err := fwa.Stat()
+		if err != nil {
+			log.Printf("%s\n", err)
+			return
+		}
+		wasize = fi.Size()
+	}
+	if repair {
+		n, err := fsdriver.RepairJournal(name, wa)
+		if err != nil {
+			log.Printf("%s\n", err)
+			return
+		}
+		fmt.Printf("%d bytes are cut from the journal\r\n", n)
+	}
+
 	f, err := os.Open(name)
 	if err != nil {
 		log.Printf("%s\n", err)
 		return
 
 	}
-	err = fsdriver.DecodePartialFile(f, os.Stdout)
+	defer f.Close()
+	if !asJSON {
+		err = fsdriver.DecodePartialFile(f, os.Stdout)
+		if err != nil {
+			log.Printf("%s\n", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Printf("%s\n", err)
+			return
+		}
+	}
+	d, err := fsdriver.DumpJournal(f, wa, wasize)
 	if err != nil {
 		log.Printf("%s\n", err)
 		return
 	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			log.Printf("%s\n", err)
+		}
+		return
+	}
+	for _, a := range d.Anomalies {
+		fmt.Printf("anomaly: %s\r\n", a)
+	}
+}
+
+// migrate upgrades a journal of version 1 or 2.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&name, "file", "", "journal file, the actual file is its name without .partialinfo")
+	fs.Parse(args)
+	if name == "" {
+		fs.PrintDefaults()
+		return
+	}
+	actual := strings.TrimSuffix(name, fsdriver.GetPartialJournalFileName(""))
+	if actual == name {
+		log.Printf("%s is not a journal name, it must end with %s\n", name, fsdriver.GetPartialJournalFileName(""))
+		return
+	}
+	if err := fsdriver.MigrateJournal(filepath.Dir(actual), filepath.Base(actual)); err != nil {
+		log.Printf("%s\n", err)
+		return
+	}
+	fmt.Printf("%s is migrated, the original is kept as %s.bak\r\n", name, name)
 }
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/zavla/upload/logins"
 )
@@ -61,3 +62,18 @@ func AbsInput(input []*string, outputnames ...*string) error {
 func gosavepassword(loginsSt logins.Logins, username string, forhttps bool) {
 	savepasswordWithDPAPI(&loginsSt, username, forhttps, constRealm)
 }
+
+// envToken is an environment variable with an API token.
+const envToken = "UPLOADER_TOKEN"
+
+// readToken returns an API token from a file, or from the envToken variable when filename is "".
+func readToken(filename string) (string, error) {
+	if filename == "" {
+		return strings.TrimSpace(os.Getenv(envToken)), nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -3,6 +3,7 @@ package main
 // substitution is
 // curl.exe -v -X POST 'http://127.0.0.1:64000/upload/zahar?&Filename="sendfile.rar"' -T .\testbackups\sendfile.rar --anyauth --user zahar
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
@@ -51,15 +52,21 @@ func main() {
 	paramLogname := flag.String("log", "", "a log `file`.")
 	paramFile := flag.String("file", "", "a `file` you want to upload.")
 	paramDirtomonitor := flag.String("dir", "", "a `directory` you want to upload.")
+	paramRecursive := flag.Bool("recursive", false, "upload files of subdirectories of -dir too, with their paths relative to -dir (the service must run with -keepDirs to keep them).")
 	username := flag.String("username", "", "a `user` in Upload service.")
 	uploadServerURL := flag.String("service", `https://127.0.0.1:64000/upload`, "`URL` of the Upload service: https://..., ftp://....")
 	paramPasswordfile := flag.String("passwordfile", "", "a `file` with password.")
+	paramTokenfile := flag.String("tokenfile", "", "a `file` with an API token of the user, it is used instead of -passwordfile. The token may be in "+envToken+" environment variable too.")
 	paramCAcert := flag.String("cacert", "", "a PEM file with a CA public `certificate` that singed service's certificate")
+	paramClientCert := flag.String("clientcert", "", "a PEM `file` with a client certificate of the user, a service that maps it to the user needs no password.")
+	paramClientKey := flag.String("clientkey", "", "a PEM `file` with a private key of -clientcert.")
 	savepassword := flag.Bool("savepassword", false, "save a user password to a file specified with passwordfile.")
 	forHttps := flag.Bool("forhttps", false, "to use for https.")
 	paramSkipCertVerify := flag.Bool("skipcertverify", false, "skips cert verification (use it if service's cert is self signed).")
 	paramVersion := flag.Bool("version", false, "print `version`")
 	paramSkipMarkAsUploaded := flag.Bool("skipmarkAsUploaded", false, "Skips marking of a file as uploaded.")
+	paramHash := flag.String("hash", "sha1", "a hash `algorithm` the service checks a file with: "+strings.Join(fsdriver.HashAlgorithms, ", ")+". Old services know only sha1.")
+	paramParallel := flag.Int("parallel", 1, "a `number` of parallel requests that send ranges of a big file.")
 
 	flag.Parse()
 	flag.Usage = Usage
@@ -78,6 +85,14 @@ func main() {
 	where.DontUseFileAttribute = *paramSkipMarkAsUploaded
 	where.ToURL = *uploadServerURL
 	where.InsecureSkipVerify = *paramSkipCertVerify
+	alg, err := fsdriver.ParseHashAlgorithm(*paramHash)
+	if err != nil {
+		log.WithField("hash", *paramHash).Error("-hash is not supported.\r\n")
+		os.Exit(1)
+		return
+	}
+	where.HashAlgorithm = alg
+	where.Parallel = *paramParallel
 
 	// check required parameters: either 'file' or 'dir'
 	if *paramFile == "" && *paramDirtomonitor == "" && !*savepassword && !*forHttps {
@@ -94,10 +109,10 @@ func main() {
 	}
 
 	// absolutize and clean input file paths
-	var logfile, file, dirtomonitor, passwordfile, cacert string = "", "", "", "", ""
-	inputFilenames := []*string{paramLogname, paramFile, paramDirtomonitor, paramPasswordfile, paramCAcert}
+	var logfile, file, dirtomonitor, passwordfile, cacert, clientcert, clientkey string = "", "", "", "", "", "", ""
+	inputFilenames := []*string{paramLogname, paramFile, paramDirtomonitor, paramPasswordfile, paramCAcert, paramClientCert, paramClientKey}
 
-	if err := AbsInput(inputFilenames, &logfile, &file, &dirtomonitor, &passwordfile, &cacert); err != nil {
+	if err := AbsInput(inputFilenames, &logfile, &file, &dirtomonitor, &passwordfile, &cacert, &clientcert, &clientkey); err != nil {
 		log.WithField("error", err).Error("A file name is incorrect after Abs()")
 		os.Exit(1)
 		return
@@ -137,8 +152,21 @@ func main() {
 	log.SetOutput(flog)
 	defer func() { _ = flog.Close() }()
 
-	// passwords only if there is a specified user
-	if *username != "" {
+	token, err := readToken(*paramTokenfile)
+	if err != nil {
+		log.WithField("file", *paramTokenfile).WithField("error", err).Error("Can't read a token.")
+		os.Exit(1)
+		return
+	}
+	if *username != "" && token != "" && !*savepassword {
+		// scheduled jobs use a token instead of a password
+		where.Username = *username
+		where.Token = token
+	} else if *username != "" && clientcert != "" && passwordfile == "" && !*savepassword {
+		// the service maps a client certificate to the user
+		where.Username = *username
+	} else if *username != "" {
+		// passwords only if there is a specified user
 		where.Username = *username
 
 		loginsSt := logins.Logins{}
@@ -180,6 +208,23 @@ func main() {
 		// holds hash in memory
 		where.PasswordHash = string(decryptedPasswordHash)
 
+		// hashes of stronger digest algorithms, a login saved by an older uploader has none
+		for alg, h := range loginFromFile.Passwordhashes {
+			hashBytes, err := hex.DecodeString(h)
+			if err == nil {
+				hashBytes, err = decryptByOs(hashBytes)
+			}
+			if err != nil {
+				log.WithField("error", err).WithField("username", where.Username).Errorf("Password decryption of %s hash from file with DPAPI failed.\r\n", alg)
+				os.Exit(1)
+				return
+			}
+			if where.PasswordHashes == nil {
+				where.PasswordHashes = make(map[string]string)
+			}
+			where.PasswordHashes[alg] = string(hashBytes)
+		}
+
 	} /* else there is no password specified*/
 
 	serviceUrl, err := url.ParseRequestURI(where.ToURL)
@@ -223,25 +268,19 @@ Example: %v`, exampleRun)
 		return
 	}
 
-	// TODO(zavla): load user certificate. For the user to authanticate to the service.
-	//var certSl []tls.Certificate
-	// if *paramuserCert != "" {
-	// 	pemCerts, err := ioutil.ReadFile(certFile)
-	// 	if err == nil {
-	// 		pBlock, _ := pem.Decode(pemCerts)
-	// 		if pBlock == nil {
-	// 			log.Printf("PEM encoding of service Certificate read from file %s are bad.", certFile)
-	// 		} else {
-	// 			serviceCA, err := x509.ParseCertificate(pBlock.Bytes)
-	// 			if err != nil {
-	// 				log.Printf("Parse of CA Certificate from file %s failed.", certFile)
-	// 			} else {
-	// 				certSl = []tls.Certificate{tls.Certificate{Leaf: serviceCA}}
-	// 			}
-	// 		}
-	// 	}
-	// }
-	//where.Certs = certSl
+	// load a user certificate for the user to authenticate to the service.
+	if clientcert != "" {
+		if clientkey == "" {
+			clientkey = clientcert // a PEM file may hold both
+		}
+		cert, err := tls.LoadX509KeyPair(clientcert, clientkey)
+		if err != nil {
+			log.WithField("file", clientcert).WithField("error", err).Error("Can't load a client certificate.\r\n")
+			os.Exit(1)
+			return
+		}
+		where.Certs = []tls.Certificate{cert}
+	}
 
 	where.CApool = certpool // CA == certification authority that signed the service's certificate.
 
@@ -253,8 +292,11 @@ Example: %v`, exampleRun)
 		chNames <- file
 	}
 	if dirtomonitor != "" {
+		if *paramRecursive {
+			where.BaseDir = dirtomonitor
+		}
 		// walk a dir, send names to chNames
-		go getFilenames(dirtomonitor, chNames) // closes chNames after adding all files
+		go getFilenames(dirtomonitor, *paramRecursive, chNames) // closes chNames after adding all files
 	} else {
 		close(chNames)
 	}
@@ -357,19 +399,19 @@ func prepareAndSendAFile(ctx context.Context, filename string, config *uploadcli
 	storagepath := filepath.Dir(fullfilename)
 	name := filepath.Base(fullfilename)
 
-	//compute SHA1 of a file
-	bsha1, err := fsdriver.GetFileSha1(storagepath, name)
+	//compute a hash of a file
+	bhash, err := fsdriver.GetFileHash(storagepath, name, config.HashAlgorithm)
 	if err != nil {
-		log.WithField("file", name).WithField("error", Error.E(op, err, errCantOpenFileForReading, 0, "")).Error("Can't compute SHA1 of a file.")
+		log.WithField("file", name).WithField("error", Error.E(op, err, errCantOpenFileForReading, 0, "")).Errorf("Can't compute %s of a file.", config.HashAlgorithm)
 		return err
 	}
 
 	// figure out the scheme: https, ftp
 	serviceURL, _ := url.ParseRequestURI(config.ToURL) // ignore error because we test in early in main()
 	if serviceURL.Scheme == "ftp" || serviceURL.Scheme == "ftps" {
-		err = uploadclient.FtpAFile(ctx, config, fullfilename, bsha1)
+		err = uploadclient.FtpAFile(ctx, config, fullfilename, bhash)
 	} else {
-		err = uploadclient.SendAFile(ctx, config, fullfilename, jar, bsha1)
+		err = uploadclient.SendAFile(ctx, config, fullfilename, jar, bhash)
 	}
 
 	if err == nil {
@@ -392,7 +434,8 @@ func prepareAndSendAFile(ctx context.Context, filename string, config *uploadcli
 // getFilenames collects files names in a directory and sends them to channel chNames.
 // If "archive" file attribute on Windows and FS_NODUMP_FL file attribute on linux is set
 // then the file will be chosen.
-func getFilenames(dir string, chNames chan<- string) {
+// With recursive it walks subdirectories except those starting with a dot.
+func getFilenames(dir string, recursive bool, chNames chan<- string) {
 	const op = "uploader.getFilenamesToupload()"
 	defer close(chNames)
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
@@ -409,6 +452,9 @@ func getFilenames(dir string, chNames chan<- string) {
 			if dir == path { //first file
 				return nil
 			}
+			if recursive && !strings.HasPrefix(info.Name(), ".") {
+				return nil
+			}
 			//println("skipping ", path)
 			return filepath.SkipDir // no reqursion
 		}
@@ -447,19 +493,35 @@ func savepasswordWithDPAPI(loginsmanager logins.Manager, username string, usedIn
 	if usedInHTTPDigest {
 		hashUsernameRealmPassword = httpDigestAuthentication.HashUsernameRealmPassword(loginobj.Login, realm, string(password))
 	}
-	DPAPIpasswordBytes, err := encryptByOs([]byte(hashUsernameRealmPassword))
+	DPAPIpasswordText, err := encryptToHex(hashUsernameRealmPassword)
 	if err != nil {
 		log.Printf("%s", Error.E(op, err, errDPAPIfailed, 0, ""))
 		return
 	}
-
-	DPAPIpasswordText := make([]byte, hex.EncodedLen(len(DPAPIpasswordBytes)))
-	_ = hex.Encode(DPAPIpasswordText, DPAPIpasswordBytes)
-	_, err = loginsmanager.Add(loginobj.Login, "", string(DPAPIpasswordText))
+	_, err = loginsmanager.Add(loginobj.Login, "", DPAPIpasswordText)
 	if err != nil {
 		log.Printf("%s", err)
 		return
 	}
+	if usedInHTTPDigest {
+		// hashes of stronger digest algorithms
+		hashes := make(map[string]string)
+		for _, alg := range httpDigestAuthentication.Algorithms {
+			if alg == httpDigestAuthentication.AlgorithmMD5 {
+				continue
+			}
+			h, _ := httpDigestAuthentication.HashUsernameRealmPasswordWith(alg, loginobj.Login, realm, string(password))
+			hashes[alg], err = encryptToHex(h)
+			if err != nil {
+				log.Printf("%s", Error.E(op, err, errDPAPIfailed, 0, ""))
+				return
+			}
+		}
+		if err := loginsmanager.SetPasswordhashes(loginobj.Login, hashes); err != nil {
+			log.Printf("%s", err)
+			return
+		}
+	}
 	err = loginsmanager.Save()
 	if err != nil {
 		log.Printf("Saving password file failed: %s\n", err)
@@ -471,6 +533,15 @@ func savepasswordWithDPAPI(loginsmanager logins.Manager, username string, usedIn
 
 }
 
+// encryptToHex encrypts s with DPAPI and returns hex of it.
+func encryptToHex(s string) (string, error) {
+	b, err := encryptByOs([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func savepasswordExit(loginsSt logins.Manager, username string) {
 	loginobj := logins.Login{Login: username}
 	err := logins.AskAndSavePasswordForHTTPDigest(loginsSt, loginobj, constRealm)
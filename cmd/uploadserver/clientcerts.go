@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/logins"
+	"github.com/zavla/upload/uploadserver"
+)
+
+// certCheck grants a login to a request over TLS with a verified client certificate
+// mapped to the login in logins.json. It returns false otherwise, the request is to be authorized by other means.
+// A disabled login gets 403 before its password or token is checked.
+func certCheck(c *gin.Context, username string, loginsmap map[string]logins.Login) bool {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false
+	}
+	currlogin, ok := loginsmap[username]
+	if !ok || currlogin.Disabled || !currlogin.MatchesCertificate(state.VerifiedChains[0][0]) {
+		return false
+	}
+	//granted
+	c.Set(gin.AuthUserKey, username)
+	c.Set(uploadserver.KeyQuota, currlogin.Quota)
+	c.Set(uploadserver.KeyVersions, currlogin.Versions)
+	return true
+}
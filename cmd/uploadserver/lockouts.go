@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/uploadserver"
+)
+
+// lockedOut answers 429 to a request of a login or from an IP locked out or delayed after failed logins.
+func lockedOut(c *gin.Context, username string) bool {
+	until := uploadserver.Lockouts.Locked(username, c.ClientIP(), time.Now())
+	if until.IsZero() {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(until)/time.Second)+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, retry later"})
+	c.Abort()
+	return true
+}
+
+// loginFailed counts a failed login, next attempts get 429 with Retry-After until a delay ends.
+// An unknown login counts for the source IP only.
+func loginFailed(c *gin.Context, username string) {
+	delay := uploadserver.Lockouts.Fail(c, username)
+	c.Header("Retry-After", strconv.Itoa(int((delay+time.Second-1)/time.Second)))
+}
+
+// loginDisabled answers 403 to a request of a login disabled in logins.json.
+func loginDisabled(c *gin.Context, username string) {
+	const op = "cmd/uploadserver.loginDisabled()"
+	c.JSON(http.StatusForbidden, gin.H{"error": "login is disabled"})
+	c.Abort()
+	c.Error(Error.E(op, nil, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("login is disabled: %s", username)))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/logins"
+	"github.com/zavla/upload/uploadserver"
+)
+
+// tokenCheck authorizes a request by an API token of a login in "Authorization: Bearer ID.SECRET".
+// A token with a limited scope gets 403 for other requests.
+func tokenCheck(c *gin.Context, username string, loginsmap map[string]logins.Login) {
+	const op = "cmd/uploadserver.tokenCheck()"
+	bearer := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	currlogin, ok := loginsmap[username]
+	if ok && currlogin.Disabled {
+		loginDisabled(c, username)
+		return
+	}
+	token, valid := currlogin.CheckToken(bearer, time.Now())
+	if !ok || !valid {
+		failed := username
+		if !ok {
+			failed = "" // an unknown login counts for the IP only
+		}
+		loginFailed(c, failed)
+		c.Header("WWW-Authenticate", `Bearer realm="upload", error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token failed"})
+		c.Abort()
+		c.Error(Error.E(op, nil, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("token failed for user: %s", username)))
+		return
+	}
+	uploadserver.Lockouts.Succeed(username)
+	if !token.Scope.Allows(c.Request.Method, c.FullPath()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("token scope %s doesn't allow %s %s", token.Scope, c.Request.Method, c.FullPath())})
+		c.Abort()
+		return
+	}
+	//granted
+	c.Set(gin.AuthUserKey, username)
+	c.Set(uploadserver.KeyQuota, currlogin.Quota)
+	c.Set(uploadserver.KeyVersions, currlogin.Versions)
+}
+
+// addToken creates a token of a login and prints it, the token is shown only once.
+func addToken(w io.Writer, loginsSt *logins.Logins, username, scope string, expiresIn time.Duration, comment string) error {
+	tokenscope, err := logins.ParseTokenScope(scope)
+	if err != nil {
+		return err
+	}
+	var expires time.Time
+	if expiresIn > 0 {
+		expires = time.Now().Add(expiresIn).UTC().Truncate(time.Second)
+	}
+	t, bearer, err := loginsSt.AddToken(username, tokenscope, expires, comment)
+	if err != nil {
+		return err
+	}
+	if err := loginsSt.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "token %s of login '%s' is created, keep it, it is shown only once:\r\n%s\r\n", t.ID, username, bearer)
+	return nil
+}
+
+// listTokens prints tokens of a login.
+func listTokens(w io.Writer, loginsSt *logins.Logins, username string) error {
+	l, _, err := loginsSt.Find(username, false)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, t := range l.Tokens {
+		scope, expires, state := string(t.Scope), "never", ""
+		if scope == "" {
+			scope = "all"
+		}
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		if t.Expired(now) {
+			state = " expired"
+		}
+		fmt.Fprintf(w, "%s scope %s created %s expires %s%s %s\r\n", t.ID, scope, t.Created.Format(time.RFC3339), expires, state, t.Comment)
+	}
+	return nil
+}
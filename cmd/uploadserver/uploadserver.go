@@ -5,9 +5,6 @@
 package main
 
 import (
-	"crypto/md5"
-	"crypto/tls"
-	"encoding/hex"
 	"fmt"
 	"os/signal"
 	"runtime"
@@ -15,6 +12,7 @@ import (
 	"sync"
 
 	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
 	"github.com/zavla/upload/httpDigestAuthentication"
 	"github.com/zavla/upload/logins"
 	"github.com/zavla/upload/uploadserver"
@@ -35,6 +33,12 @@ import (
 
 var gitCommit string
 
+// environment variables with object storage keys
+const (
+	envS3AccessKey = "UPLOADSERVER_S3_ACCESS_KEY"
+	envS3SecretKey = "UPLOADSERVER_S3_SECRET_KEY"
+)
+
 func main() {
 
 	const op = "uploadserver.main()"
@@ -53,12 +57,47 @@ func main() {
 	paramStorageroot := flag.String("root", "", "storage root `path` for files.")
 	flag.StringVar(&bindToAddress, "listenOn", "127.0.0.1:64000", "listen on specified `address:port`.")
 	flag.StringVar(&bindToAddress2, "listenOn2", "", "listen on specified `address:port`.")
+	paramClientCerts := flag.String("clientCerts", "none", "TLS client certificates on -listenOn: `mode` none, accept (verify if sent) or require. CAs of client certificates are in "+uploadserver.ClientCAFile+" in -config dir.")
+	paramClientCerts2 := flag.String("clientCerts2", "none", "TLS client certificates on -listenOn2: `mode` none, accept or require.")
 	paramConfigdir := flag.String("config", "", "`directory` with logins.json and certificates PEM files for -listenOn IP (required).")
 	flag.BoolVar(&asService, "asService", false, "use it in ImagePath of a Windows service when you launch uploadserver as a service.")
 	adduser := flag.String("adduser", "", "will add a login and save a password to logins.json file in -config dir.")
+	paramAddtoken := flag.String("addtoken", "", "create an API token of a `login` in logins.json file in -config dir and print it.")
+	paramListtokens := flag.String("listtokens", "", "print API tokens of a `login`.")
+	paramRevoketoken := flag.String("revoketoken", "", "delete an API token `login:id`.")
+	paramTokenScope := flag.String("tokenScope", "all", "with -addtoken a `scope` of the token: all, upload (uploads only) or read (lists and downloads only).")
+	paramTokenExpires := flag.Duration("tokenExpires", 0, "with -addtoken the token expires after this `duration`, ex. 8760h, 0 never expires.")
+	paramTokenComment := flag.String("tokenComment", "", "with -addtoken a `text` about the token, ex. where it is used.")
 	paramAllowAnonymous := false //flag.Bool("allowAnonymous", false, "`true/false` to allow anonymous uploads.")
 	paramVersion := flag.Bool("version", false, "print `version`.")
 	paramUsepprof := flag.Bool("debug", false, "debug, make available /debug/pprof/* URLs in service for profiling.")
+	paramS3endpoint := flag.String("s3endpoint", "", "S3-compatible object storage `URL`, e.x. https://127.0.0.1:9000. Completed files go to the bucket, -root keeps files being uploaded. Keys are in "+envS3AccessKey+" and "+envS3SecretKey+" environment variables.")
+	paramS3bucket := flag.String("s3bucket", "", "object storage `bucket` name.")
+	paramS3region := flag.String("s3region", "us-east-1", "object storage `region`.")
+	paramDedup := flag.Bool("dedup", false, "store completed files with the same content once in -root/.blobs, user files become hard links.")
+	paramRetention := flag.Bool("retention", false, "apply retention rules from "+uploadserver.RetentionRulesFile+" in -config dir to files in -root now and exit.")
+	paramDryrun := flag.Bool("dryrun", false, "with -retention print which files would be deleted and delete nothing.")
+	paramFsck := flag.Bool("fsck", false, "check partial uploads and completed files in -root and exit, run it when the service is stopped.")
+	paramRepair := flag.Bool("repair", false, "with -fsck truncate damaged partial uploads to their last verified records and rename complete ones.")
+	paramJSON := flag.Bool("json", false, "with -fsck print a report as JSON.")
+	paramStaleAfter := flag.Duration("staleAfter", 0, "remove partial uploads not written for this `duration`, ex. 720h, 0 keeps them.")
+	paramStaleUsers := flag.String("staleUsers", "", "-staleAfter for logins, ex. `name1=168h,name2=0`, 0 keeps partial uploads of a login.")
+	paramQuarantine := flag.Bool("quarantine", false, "move stale partial uploads to -root/"+uploadserver.QuarantineDir+" instead of deleting them.")
+	paramDurability := flag.String("durability", "periodic", "when written blocks are synced to disk: `mode` none, block (each block), periodic (-syncEveryMB or -syncEvery) or dsync (files opened with O_DSYNC).")
+	paramSyncEveryMB := flag.Int64("syncEveryMB", 16, "with -durability periodic sync files of an upload every `N` megabytes written, 0 disables it.")
+	paramSyncEvery := flag.Duration("syncEvery", 5*time.Second, "with -durability periodic sync files of an upload every `interval`, 0 disables it.")
+	paramFreeSpaceReserveMB := flag.Int64("freeSpaceReserveMB", 0, "new uploads must leave `N` megabytes free on the volume of -root, otherwise they get 507 Insufficient Storage.")
+	paramPreallocate := flag.Bool("preallocate", false, "reserve disk space for the whole file of a new upload.")
+	paramKeepDirs := flag.Bool("keepDirs", false, "recreate directories of relative file names from clients (uploader -recursive) beneath user directories, otherwise only base names of files are used.")
+	paramBufferMB := flag.Int("bufferMB", 32, "`N` megabytes of memory for recieved bytes all uploads share, uploads wait for it when it is in use.")
+	paramNonceLifetime := flag.Duration("nonceLifetime", 10*time.Minute, "`duration` of digest authentication nonces, clients get a new nonce with stale=true after it.")
+	flag.BoolVar(&legacyDigest, "legacyDigest", false, "accept MD5 digest authorization of old uploaders: they send a query as uri, may omit qop and repeat one nonce count, so their captured requests may be replayed until -nonceLifetime ends.")
+	paramLockAfter := flag.Int("lockAfter", 5, "lock a login out after `N` failed logins in a row, 0 never locks.")
+	paramLockAfterIP := flag.Int("lockAfterIP", 20, "lock a source IP out after `N` failed logins in a row, 0 never locks.")
+	paramLockFor := flag.Duration("lockFor", time.Minute, "`duration` of the first lockout, every next failed login doubles it up to -lockForMax.")
+	paramLockForMax := flag.Duration("lockForMax", time.Hour, "the longest lockout `duration`.")
+	paramFailDelay := flag.Duration("failDelay", 500*time.Millisecond, "`delay` before the next attempt after a failed login, every next failure doubles it.")
+	paramRetentionEvery := flag.Duration("retentionEvery", 24*time.Hour, "`interval` of applying retention rules by the service, 0 disables it.")
 
 	flag.Parse()
 	flag.CommandLine.SetOutput(os.Stdout)
@@ -125,6 +164,39 @@ func main() {
 		return
 	}
 
+	if *paramAddtoken != "" || *paramListtokens != "" || *paramRevoketoken != "" {
+		loginsSt := logins.Logins{}
+
+		loginsfilename := filepath.Join(configdir, "logins.json")
+		err := loginsSt.OpenDB(loginsfilename)
+		if err != nil {
+			log.Printf("Can't open logins.json file : %s\r\n", err)
+			return
+		}
+		switch {
+		case *paramAddtoken != "":
+			err = addToken(os.Stdout, &loginsSt, *paramAddtoken, *paramTokenScope, *paramTokenExpires, *paramTokenComment)
+		case *paramListtokens != "":
+			err = listTokens(os.Stdout, &loginsSt, *paramListtokens)
+		default:
+			username, id := *paramRevoketoken, ""
+			if i := strings.LastIndexByte(username, ':'); i >= 0 {
+				username, id = username[:i], username[i+1:]
+			}
+			err = loginsSt.RevokeToken(username, id)
+			if err == nil {
+				err = loginsSt.Save()
+			}
+			if err == nil {
+				log.Printf("Token %s of login '%s' is revoked, restart the service to apply it.\r\n", id, username)
+			}
+		}
+		if err != nil {
+			log.Printf("%s\r\n", err)
+		}
+		return
+	}
+
 	// check required params
 	if *paramStorageroot == "" {
 		flag.Usage()
@@ -146,15 +218,111 @@ func main() {
 		defer froot.Close()
 	}
 	sladdr := make([]string, 0, 2) //cap==2
-	if bindToAddress != "" {
-		sladdr = append(sladdr, bindToAddress)
-	}
-	if bindToAddress2 != "" {
-		sladdr = append(sladdr, bindToAddress2)
+	clientCerts := make(map[string]uploadserver.ClientCerts, 2)
+	for _, v := range [...]struct{ addr, mode string }{{bindToAddress, *paramClientCerts}, {bindToAddress2, *paramClientCerts2}} {
+		if v.addr == "" {
+			continue
+		}
+		mode, err := uploadserver.ParseClientCerts(v.mode)
+		if err != nil {
+			log.Printf("%s\r\n", err)
+			return
+		}
+		sladdr = append(sladdr, v.addr)
+		clientCerts[v.addr] = mode
 	}
 	uploadserver.ConfigThisService.Logfile = logfile
 	uploadserver.ConfigThisService.BindAddress = sladdr      // creates a slice of listenon addresses
 	uploadserver.ConfigThisService.Storageroot = storageroot // the root directory
+	uploadserver.ConfigThisService.ClientCerts = clientCerts
+	// upload sessions survive restarts of the service
+	uploadserver.Sessions = &uploadserver.DiskSessions{Dir: filepath.Join(storageroot, ".sessions")}
+	go uploadserver.SweepSessions(time.Hour, nil)
+
+	if *paramS3endpoint != "" {
+		if *paramS3bucket == "" {
+			flag.Usage()
+			return
+		}
+		fsdriver.Store = &fsdriver.S3Storage{
+			Endpoint:  *paramS3endpoint,
+			Bucket:    *paramS3bucket,
+			Region:    *paramS3region,
+			AccessKey: os.Getenv(envS3AccessKey),
+			SecretKey: os.Getenv(envS3SecretKey),
+			Root:      storageroot,
+			Staging:   fsdriver.LocalStorage{},
+		}
+		log.Printf("completed files are stored in bucket %s at %s\r\n", *paramS3bucket, *paramS3endpoint)
+	}
+	if *paramDedup {
+		if _, ok := fsdriver.Store.(fsdriver.Linker); !ok {
+			log.Printf("-dedup needs hard links, the storage can't make them.\r\n")
+			return
+		}
+		uploadserver.ConfigThisService.Dedup = true
+	}
+	durabilitymode, err := fsdriver.ParseDurabilityMode(*paramDurability)
+	if err != nil {
+		log.Printf("-durability: %s\r\n", err)
+		return
+	}
+	uploadserver.ConfigThisService.Durability = fsdriver.Durability{
+		Mode:       durabilitymode,
+		EveryBytes: *paramSyncEveryMB << 20,
+		Every:      *paramSyncEvery,
+	}
+	uploadserver.ConfigThisService.FreeSpaceReserve = *paramFreeSpaceReserveMB << 20
+	uploadserver.ConfigThisService.Preallocate = *paramPreallocate
+	uploadserver.ConfigThisService.RecieveBuffer = int64(*paramBufferMB) << 20
+	uploadserver.ConfigThisService.KeepDirs = *paramKeepDirs
+	nonces.Lifetime = *paramNonceLifetime
+	uploadserver.Lockouts.LoginThreshold = *paramLockAfter
+	uploadserver.Lockouts.IPThreshold = *paramLockAfterIP
+	uploadserver.Lockouts.Lockout = *paramLockFor
+	uploadserver.Lockouts.MaxLockout = *paramLockForMax
+	uploadserver.Lockouts.Delay = *paramFailDelay
+	if *paramFsck {
+		if *paramJSON && *paramLogname == "" {
+			log.SetOutput(os.Stderr) // keeps JSON in stdout clean
+		}
+		results, err := uploadserver.Fsck(storageroot, *paramRepair)
+		if errprint := uploadserver.PrintFsckReport(os.Stdout, results, *paramJSON); errprint != nil {
+			log.Printf("%s\r\n", errprint)
+		}
+		if err != nil {
+			log.Printf("%s\r\n", err)
+		}
+		return
+	}
+	retentionrules := filepath.Join(configdir, uploadserver.RetentionRulesFile)
+	if *paramRetention {
+		rules, err := uploadserver.ReadRetentionRules(retentionrules)
+		if err != nil {
+			log.Printf("%s\r\n", err)
+			return
+		}
+		actions, err := uploadserver.ApplyRetention(rules, storageroot, time.Now(), *paramDryrun)
+		uploadserver.PrintRetentionReport(logwriter, actions)
+		if err != nil {
+			log.Printf("%s\r\n", err)
+		}
+		return
+	}
+	if *paramRetentionEvery > 0 {
+		go uploadserver.RunRetention(retentionrules, storageroot, *paramRetentionEvery, nil)
+	}
+	stalepartials := uploadserver.StalePartials{After: *paramStaleAfter, Quarantine: *paramQuarantine}
+	if stalepartials.Users, err = parseStaleUsers(*paramStaleUsers); err != nil {
+		log.Printf("-staleUsers: %s\r\n", err)
+		return
+	}
+	if stalepartials.After > 0 || len(stalepartials.Users) > 0 {
+		go uploadserver.RunStalePartialsSweeper(stalepartials, storageroot, time.Hour, nil)
+	}
+	if uploadserver.ConfigThisService.Dedup {
+		go uploadserver.RunBlobsSweeper(storageroot, time.Hour, nil)
+	}
 
 	// where we started from?
 	rundir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -202,6 +370,26 @@ func main() {
 
 }
 
+// parseStaleUsers parses "name1=168h,name2=0".
+func parseStaleUsers(s string) (map[string]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	users := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("want name=duration, got %q", pair)
+		}
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		users[strings.TrimSpace(pair[:i])] = d
+	}
+	return users, nil
+}
+
 func stackPrintOnPanic(where string) {
 	// on panic we will write to log file
 	if err := recover(); err != nil {
@@ -230,30 +418,78 @@ func openStoragerootRw(storageroot string) (*os.File, error) {
 	return d, nil
 }
 
+// nonces are nonces of digest challenges of the service.
+var nonces = httpDigestAuthentication.NewNonces(10 * time.Minute)
+
+// legacyDigest accepts MD5 digest authorization of uploaders older than RFC 7616 support:
+// their uri is the query of a request, qop may be absent and they repeat nonce count 00000001 until the nonce expires.
+var legacyDigest bool
+
+// isLegacyDigest says credentials come from an old uploader and legacyDigest accepts them.
+func isLegacyDigest(c *gin.Context, creds *httpDigestAuthentication.CredentialsFromClient, algorithm string) bool {
+	return legacyDigest && algorithm == httpDigestAuthentication.AlgorithmMD5 &&
+		(creds.Qop == "" || creds.URI == c.Request.URL.RawQuery)
+}
+
+// challengeClient aborts a request with 401 and a challenge with a new nonce for every digest algorithm
+// a login has a password hash of, the strongest first. A login == nil gets challenges of all algorithms.
+// stale == true tells the client its credentials were right but its nonce has expired.
+// With legacyDigest the MD5 challenge goes first and without userhash, old uploaders read only the first one.
+func challengeClient(c *gin.Context, login *logins.Login, stale bool) {
+	nonce := nonces.New()
+	algorithms := httpDigestAuthentication.Algorithms
+	if legacyDigest {
+		algorithms = []string{httpDigestAuthentication.AlgorithmMD5}
+		for _, alg := range httpDigestAuthentication.Algorithms {
+			if alg != httpDigestAuthentication.AlgorithmMD5 {
+				algorithms = append(algorithms, alg)
+			}
+		}
+	}
+	for _, alg := range algorithms {
+		if login != nil && login.PasswordhashOf(alg) == "" {
+			continue
+		}
+		challenge := httpDigestAuthentication.ChallengeToClient{
+			Realm:     "upload",
+			Domain:    "upload.com",
+			Nonce:     nonce,
+			Algorithm: alg,
+			Qop:       "auth",
+			Userhash:  "true",
+		}
+		if legacyDigest && alg == httpDigestAuthentication.AlgorithmMD5 {
+			challenge.Userhash = "" // old uploaders reject unknown parameters
+		}
+		if stale {
+			challenge.Stale = "true"
+		}
+		c.Writer.Header().Add("WWW-Authenticate", httpDigestAuthentication.GenerateWWWAuthenticate(&challenge))
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
 // loginCheck implements HTTP digest authorization scheme with additional header from server
 // that proves that the server has the right password hash of a user password.
 // Clients may check this additional header to distinguish fake servers.
+// Every request must be authorized with a nonce the service issued and a new nonce count.
+// Failed passwords are counted by uploadserver.Lockouts, next attempts are refused during a delay.
 func loginCheck(c *gin.Context, username string, loginsmap map[string]logins.Login) {
 	const op = "cmd/uploadserver.loginCheck()"
-	h := md5.New()
-	yyyy, mm, dd := time.Now().Date()
-	io.WriteString(h, fmt.Sprintf("%d:%d:%d", yyyy, mm, dd))
-	currentNonce := hex.EncodeToString(h.Sum(nil))
 
-	challenge := httpDigestAuthentication.ChallengeToClient{
-		Realm:     "upload",
-		Domain:    "upload.com",
-		Nonce:     currentNonce,
-		Opaque:    "",
-		Stale:     "",
-		Algorithm: "MD5",
-		Qop:       "auth",
+	currlogin, ok := loginsmap[username]
+	if ok && currlogin.Disabled {
+		// before any challenge, passwords of a disabled login are never checked
+		loginDisabled(c, username)
+		return
+	}
+	var login *logins.Login // nil for an unknown login, it gets all challenges
+	if ok {
+		login = &currlogin
 	}
 	authorization := c.GetHeader("Authorization")
 	if authorization == "" {
-		wwwauthenticate := httpDigestAuthentication.GenerateWWWAuthenticate(&challenge)
-		c.Header("WWW-Authenticate", wwwauthenticate)
-		c.AbortWithStatus(http.StatusUnauthorized)
+		challengeClient(c, login, false)
 		return
 	}
 	// here we have "Authorization" from client with some text.
@@ -264,51 +500,84 @@ func loginCheck(c *gin.Context, username string, loginsmap map[string]logins.Log
 
 		return
 	}
+	algorithm := httpDigestAuthentication.CanonicalAlgorithm(creds.Algorithm)
+	legacy := isLegacyDigest(c, creds, algorithm)
+	if algorithm == "" || (creds.Qop != "auth" && !legacy) {
+		// nonce counts are required, they come with qop auth only
+		challengeClient(c, login, false)
+		return
+	}
 
 	// we use login name from the URL and username from HTTP authentication
 	// don't allow stale HTTP authorization to access another user's profile
-	if username != creds.Username {
-		wwwauthenticate := httpDigestAuthentication.GenerateWWWAuthenticate(&challenge)
-		c.Header("WWW-Authenticate", wwwauthenticate)
-		c.AbortWithStatus(http.StatusUnauthorized)
+	wantusername := username
+	if creds.Userhash == "true" {
+		wantusername = httpDigestAuthentication.Userhash(algorithm, username, creds.Realm)
+	}
+	if wantusername != creds.Username || (creds.URI != c.Request.RequestURI && !legacy) {
+		challengeClient(c, login, false)
 		return
 	}
 
 	creds.Method = c.Request.Method // client uses its Method in its hash, according to specification
 
-	currlogin := logins.Login{}
-	currlogin, ok := loginsmap[creds.Username]
 	if !ok {
+		loginFailed(c, "")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Username not fount"})
 		c.Abort()
-		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("username not found: %s", creds.Username)))
+		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("username not found: %s", username)))
 
 		return
 	}
-	access, err := httpDigestAuthentication.CheckCredentialsFromClient(&challenge, creds, currlogin.Passwordhash)
+	passwordhash := currlogin.PasswordhashOf(algorithm)
+	if passwordhash == "" {
+		// the login has no password hash of this algorithm, the client is to choose another one
+		challengeClient(c, login, false)
+		return
+	}
+	issued, stale := nonces.Check(creds.Nonce)
+	if !issued {
+		challengeClient(c, login, false)
+		return
+	}
+	challenge := httpDigestAuthentication.ChallengeToClient{
+		Realm: "upload",
+		Nonce: creds.Nonce,
+	}
+	access, err := httpDigestAuthentication.CheckCredentialsFromClient(&challenge, creds, passwordhash)
 	if err != nil {
 		c.AbortWithStatus(http.StatusUnauthorized)
-		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("HTTP digest authorization method failed for user: %s", creds.Username)))
+		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("HTTP digest authorization method failed for user: %s", username)))
 
 		return
 	}
 	if !access {
+		loginFailed(c, username)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "password failed"})
 		c.Abort()
-		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("password failed for user: %s", creds.Username)))
+		c.Error(Error.E(op, err, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("password failed for user: %s", username)))
 		return
 	}
-	//granted
-
-	// server proves it has write password.
-	// TODO(zavla): prove on every client's request???
-	responsewant, _ := httpDigestAuthentication.GenerateResponseAuthorizationParameter(currlogin.Passwordhash, creds)
-	// no error, otherwise we can't be here
+	if stale {
+		// the password is right, the client repeats the request with a new nonce
+		challengeClient(c, login, true)
+		return
+	}
+	if !legacy && !nonces.UseCount(creds.Nonce, creds.NonceCount) {
+		challengeClient(c, login, false)
+		c.Error(Error.E(op, nil, uploadserver.ErrAuthorizationFailed, 0, fmt.Sprintf("a replayed nonce count %s of user: %s", creds.NonceCount, username)))
+		return
+	}
+	uploadserver.Lockouts.Succeed(username)
+	// server proves it has write password on every request.
 	c.Header(httpDigestAuthentication.KeyProvePeerHasRightPasswordhash,
-		httpDigestAuthentication.ProveThatPeerHasRightPasswordhash(currlogin.Passwordhash, responsewant))
+		httpDigestAuthentication.ProveThatPeerHasRightPasswordhashWith(algorithm, passwordhash, creds.Response))
+	//granted
 
-	c.Set(gin.AuthUserKey, creds.Username) // grants a login
-	return                                 // normal exits and calls other handlers
+	c.Set(gin.AuthUserKey, username) // grants a login
+	c.Set(uploadserver.KeyQuota, currlogin.Quota)
+	c.Set(uploadserver.KeyVersions, currlogin.Versions)
+	return // normal exits and calls other handlers
 }
 
 // fnginLogFormater is almost a copy of gin.defaultLogFormatter
@@ -365,7 +634,8 @@ func createOneHTTPHandler(config *uploadserver.Config) *gin.Engine {
 		if loginFromURL != "" ||
 			// /debug/pprof is a fixed prefig from package net/http/pprof
 			strings.HasPrefix(c.Request.RequestURI, "/debug/pprof") ||
-			strings.HasPrefix(c.Request.RequestURI, "/log") {
+			strings.HasPrefix(c.Request.RequestURI, "/log") ||
+			strings.HasPrefix(c.Request.RequestURI, "/lockouts") {
 			// authorization.
 			username := loginFromURL
 			if username == "" {
@@ -378,7 +648,16 @@ func createOneHTTPHandler(config *uploadserver.Config) *gin.Engine {
 					}
 				}
 			}
-			loginCheck(c, username, config.LoginsMap)
+			switch {
+			case certCheck(c, username, config.LoginsMap):
+				// a client certificate of the login needs no digest round trip
+			case lockedOut(c, username):
+				// too many failed logins
+			case strings.HasPrefix(c.GetHeader("Authorization"), "Bearer "):
+				tokenCheck(c, username, config.LoginsMap)
+			default:
+				loginCheck(c, username, config.LoginsMap)
+			}
 
 			c.Next()
 			return
@@ -402,11 +681,23 @@ func createOneHTTPHandler(config *uploadserver.Config) *gin.Engine {
 		iserve.ServeHTTP(c.Writer, c.Request)
 	})
 	router.Handle("GET", "/log", uploadserver.GetLogContent)
+	router.Handle("GET", "/lockouts", uploadserver.GetLockouts)
 	router.Handle("GET", "/upload/:login/*path", uploadserver.GetFileList)
+	router.Handle("HEAD", "/upload/:login/*path", uploadserver.GetFileList)
+	router.Handle("DELETE", "/upload/:login/*path", uploadserver.DeleteStoredFile)
+	router.Handle("MOVE", "/upload/:login/*path", uploadserver.MoveStoredFile)
 	router.Handle("GET", "/upload/:login", uploadserver.GetFileList)
 
 	router.Handle("POST", "/upload/:login", uploadserver.ServeAnUpload)
 
+	// tus.io resumable upload protocol for off-the-shelf clients
+	router.Handle("OPTIONS", "/files/:login", uploadserver.TusOptions)
+	router.Handle("OPTIONS", "/files/:login/:id", uploadserver.TusOptions)
+	router.Handle("POST", "/files/:login", uploadserver.TusCreate)
+	router.Handle("HEAD", "/files/:login/:id", uploadserver.TusHead)
+	router.Handle("PATCH", "/files/:login/:id", uploadserver.TusPatch)
+	router.Handle("DELETE", "/files/:login/:id", uploadserver.TusDelete)
+
 	if config.Usepprof {
 
 		router.Handle("GET", "/debug/pprof/*profiletype", func(c *gin.Context) {
@@ -448,7 +739,11 @@ func endlessRunHTTPserver(config *uploadserver.Config) {
 			if err != nil {
 
 				pemfilename := config.FilenamefromNetInterface(netinterface)
-				log.Printf("service didn't found files with certificates: %s.pem, %s-key.pem at %s\r\n", pemfilename, pemfilename, config.Configdir)
+				clientCAfilename := ""
+				if config.ClientCerts[netinterface] != uploadserver.ClientCertsNone {
+					clientCAfilename = ", " + uploadserver.ClientCAFile
+				}
+				log.Printf("service didn't found files with certificates: %s.pem, %s-key.pem%s at %s\r\n", pemfilename, pemfilename, clientCAfilename, config.Configdir)
 				time.Sleep(20 * time.Second)
 
 				continue
@@ -476,11 +771,15 @@ func runHTTPserver(wa *sync.WaitGroup, handler http.Handler, config *uploadserve
 	defer wa.Done() // after exit WorkGroup will be done.
 	defer stackPrintOnPanic(op)
 
-	var tlsConfig *tls.Config //not used so far
-
 	// here we specified certificates files names.
 	interfaceConfig := config.IfConfigs[listenon]
 
+	tlsConfig, err := interfaceConfig.TLSConfig() // asks for client certificates
+	if err != nil {
+		log.Println(Error.E(op, err, errServiceExitedAbnormally, 0, "client CA certificates"))
+		return
+	}
+
 	s := &http.Server{
 		Addr:      interfaceConfig.Listenon,
 		Handler:   handler,
@@ -496,7 +795,7 @@ func runHTTPserver(wa *sync.WaitGroup, handler http.Handler, config *uploadserve
 	}
 
 	log.Printf("service is going to listen on %s now\r\n", interfaceConfig.Listenon)
-	err := s.ListenAndServeTLS(interfaceConfig.CertFile, interfaceConfig.KeyFile)
+	err = s.ListenAndServeTLS(interfaceConfig.CertFile, interfaceConfig.KeyFile)
 	if err != http.ErrServerClosed { // expects this error
 		// other errors go to log
 		log.Println(Error.E(op, err, errServiceExitedAbnormally, 0, ""))
@@ -510,8 +809,17 @@ func usage() {
 
 Example usage:
 uploadserver.exe -root dir -config dir -listenOn ip:port [-listenOn2 ip:port] [-log file] [-debug] [-asService]
+	[-clientCerts none|accept|require] [-clientCerts2 none|accept|require]
+	[-s3endpoint URL -s3bucket name [-s3region region]]
 or
 uploadserver.exe -adduser name -config dir
+or
+uploadserver.exe -addtoken name [-tokenScope all|upload|read] [-tokenExpires duration] [-tokenComment text] -config dir
+uploadserver.exe -listtokens name -config dir
+uploadserver.exe -revoketoken name:id -config dir
+
+Failed logins lock a login out after -lockAfter failures and a source IP after -lockAfterIP failures,
+the 'debug' login sees locked out logins and IPs at https://ip:port/lockouts.
 
 `, gitCommit)
 
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/httpDigestAuthentication"
+	"github.com/zavla/upload/logins"
+)
+
+// oldAuthorization answers the MD5 challenge of resp as uploaders before RFC 7616 support did:
+// uri is the query of a request, nonce count is always 00000001 and values are not quoted.
+// Returns the Authorization header and a prove the service must answer with.
+func oldAuthorization(t *testing.T, resp *http.Response, req *http.Request, qop, password string) (string, string) {
+	var creds *httpDigestAuthentication.CredentialsFromClient
+	for _, wwwauth := range resp.Header.Values("WWW-Authenticate") {
+		if ch, err := httpDigestAuthentication.ParseStringIntoStruct(wwwauth); err == nil && ch.Algorithm == "MD5" {
+			creds = ch
+		}
+	}
+	if creds == nil {
+		t.Fatalf("no MD5 challenge: %v", resp.Header.Values("WWW-Authenticate"))
+	}
+	creds.Qop = qop
+	creds.Cnonce = "6bedbcd39a03430202a75c2e6602725b"
+	creds.Method = req.Method
+	creds.URI = req.URL.RawQuery
+	creds.NonceCount = "00000001"
+	hash := httpDigestAuthentication.HashUsernameRealmPassword("zahar", creds.Realm, password)
+	response, err := httpDigestAuthentication.GenerateResponseAuthorizationParameter(hash, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization := fmt.Sprintf("Digest username=zahar, realm=%s, nonce=%s, uri=%s, cnonce=%s, nc=%s, algorithm=MD5, response=%s, qop=%s",
+		creds.Realm, creds.Nonce, creds.URI, creds.Cnonce, creds.NonceCount, response, qop)
+	return authorization, httpDigestAuthentication.ProveThatPeerHasRightPasswordhash(hash, response)
+}
+
+func Test_loginCheckOfOldUploaders(t *testing.T) {
+	defer func(saved bool) { legacyDigest = saved }(legacyDigest)
+	sha256hash, _ := httpDigestAuthentication.HashUsernameRealmPasswordWith(httpDigestAuthentication.AlgorithmSHA256, "zahar", "upload", "secret")
+	loginsmap := map[string]logins.Login{
+		"zahar": {
+			Login:          "zahar",
+			Passwordhash:   httpDigestAuthentication.HashUsernameRealmPassword("zahar", "upload", "secret"),
+			Passwordhashes: map[string]string{httpDigestAuthentication.AlgorithmSHA256: sha256hash},
+		},
+	}
+	router := gin.New()
+	router.POST("/upload/:login", func(c *gin.Context) {
+		loginCheck(c, c.Param("login"), loginsmap)
+		if !c.IsAborted() {
+			c.Status(http.StatusOK)
+		}
+	})
+	do := func(authorization string) (*http.Request, *http.Response) {
+		req := httptest.NewRequest(http.MethodPost, "/upload/zahar?filename=a.bak&hash=00ff", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return req, w.Result()
+	}
+
+	tests := []struct {
+		name   string
+		legacy bool
+		qop    string
+		want   int
+	}{
+		{"rejected by default", false, "auth", http.StatusUnauthorized},
+		{"with -legacyDigest", true, "auth", http.StatusOK},
+		{"without qop", true, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		legacyDigest = tt.legacy
+		req, resp := do("")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: a request without authorization = %d", tt.name, resp.StatusCode)
+		}
+		// old uploaders read the first challenge, it must be MD5 without parameters they don't know
+		if wwwauth := resp.Header.Get("WWW-Authenticate"); tt.legacy &&
+			(!strings.Contains(wwwauth, "algorithm=MD5") || strings.Contains(wwwauth, "userhash")) {
+			t.Errorf("%s: old uploaders can't answer the first challenge: %s", tt.name, wwwauth)
+		}
+		authorization, prove := oldAuthorization(t, resp, req, tt.qop, "secret")
+		// old uploaders send the same header with every request of an upload
+		for i := 0; i < 2; i++ {
+			_, resp = do(authorization)
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s: request %d of an old uploader = %d, want %d", tt.name, i, resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusOK && resp.Header.Get(httpDigestAuthentication.KeyProvePeerHasRightPasswordhash) != prove {
+				t.Errorf("%s: the service didn't prove the password hash to an old uploader", tt.name)
+			}
+		}
+	}
+
+	// a wrong password of an old uploader
+	legacyDigest = true
+	req, resp := do("")
+	authorization, _ := oldAuthorization(t, resp, req, "auth", "wrong")
+	if _, resp = do(authorization); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a wrong password of an old uploader = %d", resp.StatusCode)
+	}
+}
+
+func Test_loginCheckOfDisabledLogin(t *testing.T) {
+	loginsmap := map[string]logins.Login{
+		"zahar": {
+			Login:        "zahar",
+			Passwordhash: httpDigestAuthentication.HashUsernameRealmPassword("zahar", "upload", "secret"),
+			Disabled:     true,
+		},
+	}
+	router := gin.New()
+	router.POST("/upload/:login", func(c *gin.Context) {
+		loginCheck(c, c.Param("login"), loginsmap)
+		if !c.IsAborted() {
+			c.Status(http.StatusOK)
+		}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/upload/zahar?filename=a.bak", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	// no challenge, a disabled login can't check its passwords
+	if w.Code != http.StatusForbidden || w.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("a request of a disabled login = %d, %v", w.Code, w.Header().Values("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,254 @@
+package fsdriver
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// BlobsDir is a directory in a storage root with blobs of completed files.
+// A blob is named by a hash of its content, files of users with the same content are hard links to one blob.
+const BlobsDir = ".blobs"
+
+// blobOwnersSuffix names a file near a blob with logins that uploaded its content, one per line.
+const blobOwnersSuffix = ".owners"
+
+// BlobName returns a full name of a blob with a hash of the algorithm alg.
+func BlobName(storageroot string, alg HashAlgorithm, hash []byte) string {
+	strhash := hex.EncodeToString(hash)
+	subdir := "00"
+	if len(strhash) >= 2 {
+		subdir = strhash[:2]
+	}
+	return filepath.Join(storageroot, BlobsDir, alg.String(), subdir, strhash)
+}
+
+// StoreBlob makes a completed file name one of the names of a blob with its hash.
+// Without such a blob the file becomes the blob, otherwise the file is replaced with a hard link to the blob.
+// A non empty owner is a login that uploaded the file, it becomes one of the owners of the blob.
+// Returns true when the file content was already stored.
+// Store must be a Linker.
+func StoreBlob(storageroot, name, owner string, alg HashAlgorithm, hash []byte) (deduplicated bool, err error) {
+	const op = "fsdriver.StoreBlob()"
+	l, ok := Store.(Linker)
+	if !ok {
+		return false, Error.E(op, nil, errStorageCantLink, 0, "")
+	}
+	if IsEmptyHash(hash) {
+		return false, Error.E(op, nil, errHashAlgorithmUnsupported, 0, "no hash")
+	}
+	blob := BlobName(storageroot, alg, hash)
+	if err := Store.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	err = l.Link(name, blob)
+	if err == nil {
+		// a new blob
+		if err := addBlobOwner(blob, owner); err != nil {
+			return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+		}
+		return false, nil
+	}
+	if !os.IsExist(err) {
+		return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	// the same content is stored already
+	fstat, err := Store.Stat(name)
+	if err != nil {
+		return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	bstat, err := Store.Stat(blob)
+	if err != nil {
+		return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	if !os.SameFile(fstat, bstat) {
+		if fstat.Size() != bstat.Size() {
+			return false, Error.E(op, nil, errBlobDiffers, 0, blob)
+		}
+		if err := linkBlob(l, blob, name); err != nil {
+			return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+		}
+	}
+	// the owner has sent the content
+	if err := addBlobOwner(blob, owner); err != nil {
+		return true, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	return true, nil
+}
+
+// StatBlob returns a stored blob with the hash uploaded by the owner.
+// An absent blob and a blob the owner never uploaded are errors satisfying os.IsNotExist.
+func StatBlob(storageroot, owner string, alg HashAlgorithm, hash []byte) (os.FileInfo, error) {
+	blob := BlobName(storageroot, alg, hash)
+	if IsEmptyHash(hash) || owner == "" {
+		return nil, &os.PathError{Op: "stat", Path: blob, Err: os.ErrNotExist}
+	}
+	stat, err := Store.Stat(blob)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := blobOwners(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !owners[owner] {
+		return nil, &os.PathError{Op: "stat", Path: blob, Err: os.ErrNotExist}
+	}
+	return stat, nil
+}
+
+// LinkBlob creates a file name as a hard link to a stored blob with the hash.
+// The blob must be uploaded by the owner before, a hash doesn't prove a client has the content.
+// An absent blob is an error satisfying os.IsNotExist.
+func LinkBlob(storageroot, name, owner string, alg HashAlgorithm, hash []byte) error {
+	const op = "fsdriver.LinkBlob()"
+	l, ok := Store.(Linker)
+	if !ok {
+		return Error.E(op, nil, errStorageCantLink, 0, "")
+	}
+	if _, err := StatBlob(storageroot, owner, alg, hash); err != nil {
+		return err
+	}
+	return linkBlob(l, BlobName(storageroot, alg, hash), name)
+}
+
+// blobOwners returns logins that uploaded the content of a blob.
+func blobOwners(blob string) (map[string]bool, error) {
+	owners := make(map[string]bool)
+	f, err := Store.OpenFile(blob+blobOwnersSuffix, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return owners, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			owners[scanner.Text()] = true
+		}
+	}
+	return owners, scanner.Err()
+}
+
+// addBlobOwner appends a login to owners of a blob, an empty owner is not added.
+func addBlobOwner(blob, owner string) error {
+	if owner == "" {
+		return nil
+	}
+	owners, err := blobOwners(blob)
+	if err != nil || owners[owner] {
+		return err
+	}
+	f, err := Store.OpenFile(blob+blobOwnersSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(owner + "\n")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// linkBlob replaces name with a hard link to blob.
+// The link is made with a temporary name near the blob and renamed, so name is never absent.
+func linkBlob(l Linker, blob, name string) error {
+	tmp := blob + "." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := l.Link(blob, tmp); err != nil {
+		return err
+	}
+	if err := Store.Rename(tmp, name); err != nil {
+		_ = Store.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReleaseBlob removes a blob with the hash when no file of users is a hard link to it anymore.
+// A file linked to the blob at the same moment keeps its content, it is just not deduplicated.
+// Returns true when the blob is removed.
+func ReleaseBlob(storageroot string, alg HashAlgorithm, hash []byte) (bool, error) {
+	const op = "fsdriver.ReleaseBlob()"
+	if IsEmptyHash(hash) {
+		return false, nil
+	}
+	removed, err := releaseBlob(BlobName(storageroot, alg, hash))
+	if err != nil {
+		return false, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	return removed, nil
+}
+
+// SweepBlobs removes blobs of storageroot no file of users is a hard link to.
+// Returns names of removed blobs.
+func SweepBlobs(storageroot string) ([]string, error) {
+	const op = "fsdriver.SweepBlobs()"
+	var removed []string
+	algs, err := Store.ReadDir(filepath.Join(storageroot, BlobsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	for _, a := range algs {
+		if !a.IsDir() {
+			continue
+		}
+		subdirs, err := Store.ReadDir(filepath.Join(storageroot, BlobsDir, a.Name()))
+		if err != nil {
+			return removed, Error.E(op, err, Error.ErrFileIO, 0, "")
+		}
+		for _, sub := range subdirs {
+			if !sub.IsDir() {
+				continue
+			}
+			dir := filepath.Join(storageroot, BlobsDir, a.Name(), sub.Name())
+			blobs, err := Store.ReadDir(dir)
+			if err != nil {
+				return removed, Error.E(op, err, Error.ErrFileIO, 0, "")
+			}
+			for _, b := range blobs {
+				// owners and temporary links have a dot in their names
+				if b.IsDir() || strings.Contains(b.Name(), ".") {
+					continue
+				}
+				ok, err := releaseBlob(filepath.Join(dir, b.Name()))
+				if err != nil {
+					return removed, Error.E(op, err, Error.ErrFileIO, 0, "")
+				}
+				if ok {
+					removed = append(removed, filepath.Join(dir, b.Name()))
+				}
+			}
+		}
+	}
+	return removed, nil
+}
+
+// releaseBlob removes a blob and its owners when the blob is the only name of its content.
+// A blob with an unknown count of links is kept.
+func releaseBlob(blob string) (bool, error) {
+	n, ok := linkCount(blob)
+	if !ok || n != 1 {
+		return false, nil
+	}
+	if err := Store.Remove(blob); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := Store.Remove(blob + blobOwnersSuffix); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
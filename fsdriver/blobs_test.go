@@ -0,0 +1,119 @@
+package fsdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreBlob(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	content := []byte("the same nightly dump")
+	h := SHA256.New()
+	h.Write(content)
+	hash := h.Sum(nil)
+
+	names := []string{filepath.Join(root, "user1", "a.bak"), filepath.Join(root, "user2", "b.bak")}
+	for i, name := range names {
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		dedup, err := StoreBlob(root, name, filepath.Base(filepath.Dir(name)), SHA256, hash)
+		if err != nil || dedup != (i > 0) {
+			t.Errorf("StoreBlob(%s) = %v, %v, want %v", name, dedup, err, i > 0)
+		}
+	}
+	s1, _ := os.Stat(names[0])
+	s2, _ := os.Stat(names[1])
+	if !os.SameFile(s1, s2) {
+		t.Errorf("files with the same content are not links to one blob")
+	}
+
+	// a new file of a stored content
+	name := filepath.Join(root, "user2", "c.bak")
+	if err := LinkBlob(root, name, "user2", SHA256, hash); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(name); string(got) != string(content) {
+		t.Errorf("LinkBlob() content = %q", got)
+	}
+	if err := LinkBlob(root, name+"2", "user2", BLAKE2b, hash); !os.IsNotExist(err) {
+		t.Errorf("LinkBlob() of an absent blob error = %v", err)
+	}
+	// a login that knows a hash only
+	other3 := filepath.Join(root, "user3", "c.bak")
+	os.MkdirAll(filepath.Dir(other3), 0700)
+	if _, err := StatBlob(root, "user3", SHA256, hash); !os.IsNotExist(err) {
+		t.Errorf("StatBlob() of a blob of other logins error = %v", err)
+	}
+	if err := LinkBlob(root, other3, "user3", SHA256, hash); !os.IsNotExist(err) {
+		t.Errorf("LinkBlob() of a blob of other logins error = %v", err)
+	}
+	if _, err := os.Stat(other3); !os.IsNotExist(err) {
+		t.Errorf("LinkBlob() linked a blob of other logins")
+	}
+
+	// a file with the same hash but another size is not replaced
+	other := filepath.Join(root, "user1", "d.bak")
+	ioutil.WriteFile(other, []byte("another content"), 0600)
+	if dedup, err := StoreBlob(root, other, "user1", SHA256, hash); dedup || err == nil {
+		t.Errorf("StoreBlob() of a different content = %v, %v", dedup, err)
+	}
+}
+
+func TestReleaseBlob(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := func(name, content string) []byte {
+		h := SHA256.New()
+		h.Write([]byte(content))
+		hash := h.Sum(nil)
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := StoreBlob(root, name, "user1", SHA256, hash); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	a, b := filepath.Join(root, "user1", "a.bak"), filepath.Join(root, "user2", "a.bak")
+	hash := store(a, "the same nightly dump")
+	store(b, "the same nightly dump")
+	blob := BlobName(root, SHA256, hash)
+
+	os.Remove(a)
+	if removed, err := ReleaseBlob(root, SHA256, hash); removed || err != nil {
+		t.Errorf("ReleaseBlob() of a blob with a link = %v, %v", removed, err)
+	}
+	os.Remove(b)
+	if removed, err := ReleaseBlob(root, SHA256, hash); !removed || err != nil {
+		t.Errorf("ReleaseBlob() of a blob without links = %v, %v", removed, err)
+	}
+	for _, name := range []string{blob, blob + blobOwnersSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is not removed", filepath.Base(name))
+		}
+	}
+
+	kept, gone := filepath.Join(root, "user1", "b.bak"), filepath.Join(root, "user1", "c.bak")
+	store(kept, "kept")
+	hash = store(gone, "gone")
+	os.Remove(gone)
+	removed, err := SweepBlobs(root)
+	if err != nil || len(removed) != 1 || removed[0] != BlobName(root, SHA256, hash) {
+		t.Errorf("SweepBlobs() = %v, %v, want a blob of c.bak", removed, err)
+	}
+	if got, _ := ioutil.ReadFile(kept); string(got) != "kept" {
+		t.Errorf("SweepBlobs() changed a linked file: %q", got)
+	}
+}
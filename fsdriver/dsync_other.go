@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !netbsd && !openbsd
+// +build !linux,!darwin,!netbsd,!openbsd
+
+package fsdriver
+
+import "os"
+
+// oDSYNC is O_SYNC where there is no O_DSYNC, on Windows it is FILE_FLAG_WRITE_THROUGH.
+const oDSYNC = os.O_SYNC
@@ -0,0 +1,8 @@
+//go:build linux || darwin || netbsd || openbsd
+// +build linux darwin netbsd openbsd
+
+package fsdriver
+
+import "syscall"
+
+const oDSYNC = syscall.O_DSYNC
@@ -0,0 +1,96 @@
+package fsdriver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DurabilityMode tells when written blocks of an actual file and its journal are flushed to disk.
+type DurabilityMode int
+
+const (
+	// DurabilityNone leaves flushing to the OS, files are synced only when an upload ends.
+	DurabilityNone DurabilityMode = iota
+	// DurabilityBlock syncs the actual file before each 'write ended' record and the journal after it.
+	DurabilityBlock
+	// DurabilityPeriodic syncs both files every EveryBytes written or every Every.
+	DurabilityPeriodic
+	// DurabilityDsync opens both files with O_DSYNC, every write returns when data is on disk.
+	DurabilityDsync
+)
+
+var durabilityNames = [...]string{"none", "block", "periodic", "dsync"}
+
+func (m DurabilityMode) String() string {
+	if m < 0 || int(m) >= len(durabilityNames) {
+		return fmt.Sprintf("DurabilityMode(%d)", int(m))
+	}
+	return durabilityNames[m]
+}
+
+// ParseDurabilityMode returns a mode by its name: none, block, periodic or dsync.
+func ParseDurabilityMode(s string) (DurabilityMode, error) {
+	for i, n := range durabilityNames {
+		if strings.EqualFold(s, n) {
+			return DurabilityMode(i), nil
+		}
+	}
+	return DurabilityNone, fmt.Errorf("unknown durability mode %q, use one of %s", s, strings.Join(durabilityNames[:], ", "))
+}
+
+// Durability is a durability setting of one upload.
+// A nil *Durability is DurabilityNone.
+type Durability struct {
+	Mode DurabilityMode
+	// EveryBytes and Every are the period of DurabilityPeriodic, zero is no limit.
+	EveryBytes int64
+	Every      time.Duration
+
+	unsynced int64     // bytes written since the last sync
+	synced   time.Time // the time of the last sync
+}
+
+// openflag is an additional flag to open files with.
+func (d *Durability) openflag() int {
+	if d != nil && d.Mode == DurabilityDsync {
+		return oDSYNC
+	}
+	return 0
+}
+
+// syncBlock syncs a block of the actual file before its 'write ended' record is written.
+func (d *Durability) syncBlock(wa File) error {
+	if d == nil || d.Mode != DurabilityBlock {
+		return nil
+	}
+	return wa.Sync()
+}
+
+// syncRecord syncs the journal after a 'write ended' record of a block of n bytes,
+// with DurabilityPeriodic it syncs both files when the period is over.
+func (d *Durability) syncRecord(wa, wp File, n int) error {
+	if d == nil {
+		return nil
+	}
+	switch d.Mode {
+	case DurabilityBlock:
+		return wp.Sync()
+	case DurabilityPeriodic:
+		d.unsynced += int64(n)
+		now := time.Now()
+		if d.synced.IsZero() {
+			d.synced = now
+		}
+		if (d.EveryBytes <= 0 || d.unsynced < d.EveryBytes) && (d.Every <= 0 || now.Sub(d.synced) < d.Every) {
+			return nil
+		}
+		d.unsynced = 0
+		d.synced = now
+		if err := wa.Sync(); err != nil {
+			return err
+		}
+		return wp.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package fsdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// syncCounter is a File that counts calls to Sync.
+type syncCounter struct {
+	File
+	syncs int
+}
+
+func (f *syncCounter) Sync() error {
+	f.syncs++
+	return f.File.Sync()
+}
+
+func TestAddBytesToFileDurability(t *testing.T) {
+	content := make([]byte, 5*constwriteblocklen)
+	tests := []struct {
+		d            *Durability
+		wantA, wantP int // syncs of the actual file and of the journal
+	}{
+		{nil, 0, 0},
+		{&Durability{Mode: DurabilityNone}, 0, 0},
+		{&Durability{Mode: DurabilityBlock}, 5, 5},
+		{&Durability{Mode: DurabilityPeriodic, EveryBytes: 2 * constwriteblocklen}, 2, 2},
+		{&Durability{Mode: DurabilityPeriodic}, 0, 0},
+		{&Durability{Mode: DurabilityDsync}, 0, 0},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "durability")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := CreateNewPartialJournalFile(dir, "f.part", int64(len(content))+10, SHA1, nil); err != nil {
+			t.Fatal(err)
+		}
+		ver, wp, wa, errwp, errwa := OpenTwoCorrespondentFiles(dir, "f.part", GetPartialJournalFileName("f.part"), tt.d)
+		if errwp != nil || errwa != nil {
+			t.Fatal(errwp, errwa)
+		}
+		sa, sp := &syncCounter{File: wa}, &syncCounter{File: wp}
+		n, err := AddBytesToFile(sa, sp, content, ver, &JournalRecord{}, nil, tt.d)
+		wa.Close()
+		wp.Close()
+		if err != nil || n != int64(len(content)) {
+			t.Fatalf("AddBytesToFile(%+v) = %d, %v", tt.d, n, err)
+		}
+		if sa.syncs != tt.wantA || sp.syncs != tt.wantP {
+			t.Errorf("AddBytesToFile(%+v) synced the actual file %d times and the journal %d times, want %d and %d",
+				tt.d, sa.syncs, sp.syncs, tt.wantA, tt.wantP)
+		}
+		if state, err := MayUpload(dir, "f", "f.part"); err != nil || state.Startoffset != int64(len(content)) {
+			t.Errorf("MayUpload() after AddBytesToFile(%+v) = %d, %v", tt.d, state.Startoffset, err)
+		}
+	}
+}
+
+func TestParseDurabilityMode(t *testing.T) {
+	for _, m := range []DurabilityMode{DurabilityNone, DurabilityBlock, DurabilityPeriodic, DurabilityDsync} {
+		if got, err := ParseDurabilityMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseDurabilityMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseDurabilityMode("always"); err == nil {
+		t.Errorf("ParseDurabilityMode(\"always\") must fail")
+	}
+}
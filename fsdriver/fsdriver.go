@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -22,17 +23,28 @@ const (
 	noaction       currentAction = 0
 	startedwriting currentAction = 1
 	successwriting currentAction = 2
+	hashcheckpoint currentAction = 3 // since structversion4
 )
 
 // VERSIONS of journal
 const (
 	structversion1 uint32 = 0x00000022 + iota // defines log records version, if version changes between downloads
 	structversion2
+	structversion3 // 'write ended' records hold CRC32C of a block
+	structversion4 // journal holds checkpoints of a hash of the actual file
+	structversion5 // header holds a hash algorithm and a hash of up to 64 bytes
+	structversion6 // blocks may be written at any offset, by parallel uploads of ranges
 )
 
 // This fsdriver supports:
 // Must be set by programmer in case of journal version change.
-const supportsLatestVer uint32 = structversion2
+const supportsLatestVer uint32 = structversion6
+
+// WritesAtOffsets says blocks of a journal version ver are written at their offsets
+// and the actual file size is not the end of written bytes.
+func WritesAtOffsets(ver uint32) bool {
+	return ver >= structversion6
+}
 
 // JournalRecord is a record in log file.
 // This struct always can hold all old versions of journal records.
@@ -50,37 +62,74 @@ type JournalRecord struct {
 type startstruct struct {
 	VersionBytes            uint32
 	TotalExpectedFileLength int64
-	Sha1                    [20]byte
+	Sha1                    [20]byte               // before structversion5
+	Algorithm               HashAlgorithm          // since structversion5
+	Hash                    [constmaxhashsize]byte // since structversion5
 	VersionBytesEnd         uint32
 }
 
-// newStartStruct returns header for new journal file, which will be of the last version.
-func newStartStruct() *startstruct {
-	return &startstruct{
-		VersionBytes:    supportsLatestVer,
-		VersionBytesEnd: supportsLatestVer,
-	}
+type fileProperties struct {
+	FileSize  int64
+	Hash      []byte        // expected hash of the whole actual file, may be empty
+	Algorithm HashAlgorithm // of Hash, SHA1 before structversion5
 }
 
-type fileProperties struct {
-	FileSize int64
-	Sha1     []byte
+// HashCheckpoint is a saved state of a hash of the first Offset bytes of an actual file.
+type HashCheckpoint struct {
+	Offset int64
+	State  []byte // from encoding.BinaryMarshaler of the hash
+}
+
+// Range is a range of bytes of an actual file.
+type Range struct {
+	Startoffset int64
+	Count       int64
+}
+
+// End is the offset after the range.
+func (r Range) End() int64 { return r.Startoffset + r.Count }
+
+// Overlaps says two ranges have common bytes.
+func (r Range) Overlaps(o Range) bool {
+	return r.Startoffset < o.End() && o.Startoffset < r.End()
 }
 
 // FileState used to return state of a file to other packages
 type FileState struct {
 	fileProperties
-	Startoffset int64
+	Startoffset int64          // the actual file is written from the beginning up to Startoffset
+	Checkpoint  HashCheckpoint // last hash checkpoint not after Startoffset, since structversion4
+	// Missing are ranges not written yet, sorted by offset. Since structversion6 ranges of
+	// a file may be uploaded in parallel, before that Missing is nil.
+	Missing []Range
+}
+
+// InMissing says the range r may be written: it lies inside one of missing ranges.
+func (s *FileState) InMissing(r Range) bool {
+	for _, m := range s.Missing {
+		if r.Startoffset >= m.Startoffset && r.End() <= m.End() {
+			return r.Count > 0
+		}
+	}
+	return false
 }
 
 // NewFileState creates FileState with parameters. A kind of constructor.
-func NewFileState(filesize int64, bsha1 []byte, startoffset int64) *FileState {
+func NewFileState(filesize int64, bhash []byte, startoffset int64) *FileState {
 	return &FileState{
-		fileProperties: fileProperties{FileSize: filesize, Sha1: bsha1},
+		fileProperties: fileProperties{FileSize: filesize, Hash: bhash},
 		Startoffset:    startoffset,
 	}
 }
 
+// withSizes returns a state with the hash of s and other sizes.
+func (s FileState) withSizes(filesize, startoffset int64) *FileState {
+	ret := NewFileState(filesize, s.Hash, startoffset)
+	ret.Algorithm = s.Algorithm
+	ret.Missing = s.Missing
+	return ret
+}
+
 // Setoffset is a setter
 func (s *FileState) Setoffset(offset int64) *FileState {
 	//reciever is modified
@@ -95,53 +144,72 @@ func GetPartialJournalFileName(name string) string {
 }
 
 // CreateNewPartialJournalFile creates new journal file and writes a journal header.
+// bytesHash is an expected hash of the actual file computed with alg, may be empty.
 // dir must be created before.
-func CreateNewPartialJournalFile(dir, name string, lcontent int64, bytessha1 []byte) error {
+func CreateNewPartialJournalFile(dir, name string, lcontent int64, alg HashAlgorithm, bytesHash []byte) error {
+	return createPartialJournalFile(dir, name, supportsLatestVer, lcontent, alg, bytesHash)
+}
+
+// createPartialJournalFile creates a journal file of version ver.
+// Journals before structversion5 have only SHA1.
+func createPartialJournalFile(dir, name string, ver uint32, lcontent int64, alg HashAlgorithm, bytesHash []byte) error {
 	const op = "fsdriver.CreateNewPartialJournalFile()"
 
 	namepart := GetPartialJournalFileName(name)
-	wp, err := os.OpenFile(filepath.Join(dir, namepart), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	wp, err := Store.OpenFile(filepath.Join(dir, namepart), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
 	if err != nil {
 		return Error.E(op, err, errPartialFileCreate, 0, "")
 	}
 
 	defer wp.Close()
 	// version of journal file
-	err = binary.Write(wp, binary.LittleEndian, supportsLatestVer)
+	err = binary.Write(wp, binary.LittleEndian, ver)
 	if err != nil {
 		return Error.E(op, err, errPartialFileWritingError, 0, "")
 	}
 	// fills header of journal file
-	aLogHeader := newStartStruct()
+	aLogHeader := &startstruct{VersionBytes: ver, VersionBytesEnd: ver}
 	aLogHeader.TotalExpectedFileLength = lcontent
-	copy(aLogHeader.Sha1[:], bytessha1)
+	aLogHeader.Algorithm = alg
+	copy(aLogHeader.Hash[:], bytesHash)
+	if alg == SHA1 {
+		copy(aLogHeader.Sha1[:], bytesHash)
+	}
 
-	err = binary.Write(wp, binary.LittleEndian, *aLogHeader)
+	switch {
+	case ver >= structversion5:
+		err = binary.Write(wp, binary.LittleEndian, aLogHeader.Ver5())
+	case ver >= structversion3:
+		err = binary.Write(wp, binary.LittleEndian, aLogHeader.Ver3())
+	default:
+		return Error.E(op, nil, errPartialFileVersionTagUnsupported, 0, "")
+	}
 	if err != nil {
 		return Error.E(op, err, errPartialFileWritingError, 0, "")
 	}
 	return nil
 }
 
-func openToRead(dir, name string) (*os.File, error) {
-	f, err := os.Open(filepath.Join(dir, name))
+func openToRead(dir, name string) (File, error) {
+	f, err := Store.OpenFile(filepath.Join(dir, name), os.O_RDONLY, 0)
 	return f, err
 }
 
-func openToAppend(dir, name string) (*os.File, error) {
+func openToAppend(dir, name string, flag int) (File, error) {
 	// seeks END
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	f, err := Store.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_APPEND|os.O_CREATE|flag, 0660)
 	return f, err
 }
-func openToWrite(dir, name string) (*os.File, error) {
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR, 0660)
+func openToWrite(dir, name string, flag int) (File, error) {
+	f, err := Store.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR|flag, 0660)
 	return f, err
 }
 
 // openJournalFile opens journal(log) file and seeks offset 0 to read a version struct and then seeks END of the file.
-func openJournalFile(dir, name string) (*os.File, uint32, error) {
+// Records are always appended, a journal may be appended by parallel uploads of ranges.
+func openJournalFile(dir, name string, flag int) (File, uint32, error) {
 	// opens at the BEGINING
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR, 0660)
+	f, err := Store.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR|os.O_APPEND|flag, 0660)
 	if err != nil {
 		return f, 0, err
 	}
@@ -159,22 +227,27 @@ func openJournalFile(dir, name string) (*os.File, uint32, error) {
 }
 
 // OpenTwoCorrespondentFiles opens two files for writing.
-func OpenTwoCorrespondentFiles(dir, name, namepart string) (ver uint32, wp, wa *os.File, errwp, errwa error) {
+// With DurabilityDsync both files are opened with O_DSYNC, d may be nil.
+func OpenTwoCorrespondentFiles(dir, name, namepart string, d *Durability) (ver uint32, wp, wa File, errwp, errwa error) {
 	wa, wp = nil, nil // named return, wa=actual, wp=partial(that is log file)
-	wp, ver, errwp = openJournalFile(dir, namepart)
+	wp, ver, errwp = openJournalFile(dir, namepart, d.openflag())
 	if errwp != nil {
 		return
 	}
 
 	itsnew := false
 	waname := filepath.Join(dir, name)
-	_, errstat := os.Lstat(waname)
+	_, errstat := Store.Stat(waname)
 	if os.IsNotExist(errstat) {
 		itsnew = true
 		// looks like we need to flush to disk after OpenFile.
 		// If uploadserver and uploader are on the same computer then the new file can't be written at once.
 	}
-	wa, errwa = openToAppend(dir, name)
+	if ver >= structversion6 {
+		wa, errwa = openToWrite(dir, name, d.openflag()) // blocks are written at their offsets
+	} else {
+		wa, errwa = openToAppend(dir, name, d.openflag())
+	}
 	if errwa != nil {
 		return
 	}
@@ -187,8 +260,13 @@ func OpenTwoCorrespondentFiles(dir, name, namepart string) (ver uint32, wp, wa *
 
 // AddBytesToFile writes to journal file then appends newbytes to the actual file.
 // Writes to actual file using blocks (hunks). Write each block. Block is a write unit.
+// Written blocks are added to the hash h, if h != nil. Since structversion4 the state of h
+// is saved into the journal every checkpointbytes.
+// Since structversion6 blocks are written at destinationrecord.Startoffset of the actual file
+// and other uploads of ranges of the file may append the journal at the same time.
+// d tells when files are synced, it may be nil.
 // Used by package uploadserver.
-func AddBytesToFile(wa, wp *os.File, newbytes []byte, ver uint32, destinationrecord *JournalRecord) (int64, error) {
+func AddBytesToFile(wa, wp File, newbytes []byte, ver uint32, destinationrecord *JournalRecord, h hash.Hash, d *Durability) (int64, error) {
 	// ver is a journal file version
 	l := len(newbytes)
 	lenhunk := constwriteblocklen // the size of block
@@ -207,17 +285,23 @@ func AddBytesToFile(wa, wp *os.File, newbytes []byte, ver uint32, destinationrec
 			// newbytes[from:to] into actual file
 			from := i * lenhunk
 			to := from + curlen
-			// TODO(zavla): may be CRC32 or sha1 newbytes[from:to]
-
 			// add step1 into journal, "write begin"
 			destinationrecord.Count = int64(curlen)
+			destinationrecord.Crc32 = 0
+			unlock := lockJournalOfVer(wp, ver)
 			err := addRecordToJournalFile(wp, startedwriting, ver, *destinationrecord)
+			unlock()
 			if err != nil {
 				return totalbyteswritten, err
 			}
 
 			// write to actual file
-			nhavewritten, err := wa.Write(newbytes[from:to])
+			var nhavewritten int
+			if ver >= structversion6 {
+				nhavewritten, err = wa.WriteAt(newbytes[from:to], destinationrecord.Startoffset)
+			} else {
+				nhavewritten, err = wa.Write(newbytes[from:to])
+			}
 
 			// may be that err == nil, it is when FSD (file system driver) accepted data but still holds it in memory till flush
 			if err != nil {
@@ -226,17 +310,43 @@ func AddBytesToFile(wa, wp *os.File, newbytes []byte, ver uint32, destinationrec
 
 				return totalbyteswritten + int64(nhavewritten), err // file will be reverted, continue after disk error elimination (disk space freed for e.x.).
 			}
+			// the journal must not claim a block that is not on disk yet
+			if err := d.syncBlock(wa); err != nil {
+				return totalbyteswritten, err
+			}
 
 			// add step2 into journal = "write end"
 			// whatIsInFile.Startoffset looks like transaction number
 			destinationrecord.Count = int64(nhavewritten)
+			if ver >= structversion3 {
+				destinationrecord.Crc32 = blockCrc32(newbytes[from : from+nhavewritten])
+			}
+			// a checkpoint follows its 'write ended' record, so the journal is unlocked after it
+			unlock = lockJournalOfVer(wp, ver)
 			err = addRecordToJournalFile(wp, successwriting, ver, *destinationrecord)
 			if err != nil {
+				unlock()
 				destinationrecord.Count = 0
 				return totalbyteswritten, err // log file failure. (no free disk space for e.x.)
 			}
 			destinationrecord.Startoffset += int64(nhavewritten) // finally adds written bytes count to offset
 			totalbyteswritten += int64(nhavewritten)
+
+			if h != nil {
+				h.Write(newbytes[from : from+nhavewritten])
+				if ver >= structversion4 &&
+					(destinationrecord.Startoffset-int64(nhavewritten))/checkpointbytes != destinationrecord.Startoffset/checkpointbytes {
+					// a checkpoint boundary is crossed
+					if err := addCheckpointToJournalFile(wp, destinationrecord.Startoffset, h); err != nil {
+						unlock()
+						return totalbyteswritten, err
+					}
+				}
+			}
+			unlock()
+			if err := d.syncRecord(wa, wp, nhavewritten); err != nil {
+				return totalbyteswritten, err
+			}
 		}
 
 	}
@@ -253,6 +363,9 @@ func addRecordToJournalFile(pfi io.Writer, step currentAction, ver uint32, info
 
 	var err error
 	switch ver {
+	case structversion3, structversion4, structversion5, structversion6:
+		infoVer3 := info.ver3()
+		err = binary.Write(pfi, binary.LittleEndian, &infoVer3)
 	case structversion2:
 		infoVer2 := info.ver2()
 		err = binary.Write(pfi, binary.LittleEndian, &infoVer2)
@@ -296,6 +409,16 @@ func GetJournalFileVersion(wp io.Reader) (uint32, error) {
 // Upload allowed when there is no such file OR when such file exists and has correspondent journal file.
 // MayUpload analize journal file for current state.
 func MayUpload(storagepath string, origname string, nameNotComplete string) (FileState, error) {
+	return mayUpload(storagepath, origname, nameNotComplete, false)
+}
+
+// MayUploadOver is MayUpload of a new version of a complete file origname.
+// The upload is allowed when origname exists, the new version replaces it when the upload completes.
+func MayUploadOver(storagepath string, origname string, nameNotComplete string) (FileState, error) {
+	return mayUpload(storagepath, origname, nameNotComplete, true)
+}
+
+func mayUpload(storagepath string, origname string, nameNotComplete string, over bool) (FileState, error) {
 	const op = "fsdriver.MayUpload()"
 	const inlog = "MayUpload error: "
 
@@ -303,20 +426,23 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 
 	name := nameNotComplete
 
-	_, errOrig := os.Stat(filepath.Join(storagepath, origname))
-	if !os.IsNotExist(errOrig) {
+	// parallel uploads of ranges append the journal, it is read and repaired without them
+	defer lockJournal(filepath.Join(storagepath, namepart))()
+
+	_, errOrig := Store.Stat(filepath.Join(storagepath, origname))
+	if !over && !os.IsNotExist(errOrig) {
 		// Original file exists, we do not allow upload
 		return *NewFileState(0, nil, 0),
 			Error.E(op, errOrig, errForbidenToUpdateAFile, Error.ErrKindInfoForUsers, "a file is already complete.")
 	}
 
-	wastat, err := os.Stat(filepath.Join(storagepath, name))
+	wastat, err := Store.Stat(filepath.Join(storagepath, name))
 	if os.IsNotExist(err) {
 		// no actual file, client may upload
 		return *NewFileState(0, nil, 0), nil
 	}
 	if err != nil {
-		log.Printf(inlog+"file os.Stat() error: %s, error=%s.\r\n", name, err)
+		log.Printf(inlog+"file Stat() error: %s, error=%s.\r\n", name, err)
 
 		// can't get stat for actual file. Who knows why, error.
 		return *NewFileState(0, nil, 0),
@@ -357,6 +483,51 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 	case structversion2:
 		// here we read journal file
 		journal, journaloffset, errlog = ReadCurrentStateFromJournalVer2(ver, wp)
+	case structversion6:
+		// here we read journal file and verify last written blocks of actual file
+		wa, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDONLY, 0)
+		if err != nil {
+			log.Printf(inlog+"file open error: %s, error=%s.\r\n", name, err)
+
+			return *NewFileState(0, nil, 0),
+				Error.E(op, err, errForbidenToUpdateAFile, 0, "")
+		}
+		journal, journaloffset, errlog = ReadCurrentStateFromJournalVer6(ver, wp, wa)
+		wa.Close()
+		return mayUploadVer6(storagepath, namepart, name, journal, journaloffset, wastat.Size(), errlog)
+	case structversion3, structversion4, structversion5:
+		// here we read journal file and verify last blocks of actual file
+		wa, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDONLY, 0)
+		if err != nil {
+			log.Printf(inlog+"file open error: %s, error=%s.\r\n", name, err)
+
+			return *NewFileState(0, nil, 0),
+				Error.E(op, err, errForbidenToUpdateAFile, 0, "")
+		}
+		switch ver {
+		case structversion3:
+			journal, journaloffset, errlog = ReadCurrentStateFromJournalVer3(ver, wp, wa)
+		case structversion4:
+			journal, journaloffset, errlog = ReadCurrentStateFromJournalVer4(ver, wp, wa)
+		default:
+			journal, journaloffset, errlog = ReadCurrentStateFromJournalVer5(ver, wp, wa)
+		}
+		wa.Close()
+		if errlog, err = repairVer3(storagepath, namepart, name, journal, journaloffset, wastat.Size(), errlog); err != nil {
+			log.Printf(inlog+"can't truncate files to the last verified block: %s, error=%s, journal=%#v.\r\n", name, err, journal)
+
+			return *journal.withSizes(wastat.Size(), journal.Startoffset),
+				Error.E(op, err, errActualFileNeedsRepare, 0, "")
+		}
+		if errlogError, _ := errlog.(*Error.Error); errlogError != nil && errlogError.Code == errActualFileNeedsRepare {
+			log.Printf(inlog+"actual file has no verified blocks at the end: %s, wastat.Size()=%d bytes, journal=%#v.\r\n", name, wastat.Size(), journal)
+
+			return *journal.withSizes(wastat.Size(), journal.Startoffset), errlog
+		}
+		if wastat, err = Store.Stat(filepath.Join(storagepath, name)); err != nil {
+			return *NewFileState(0, nil, 0),
+				Error.E(op, err, errForbidenToUpdateAFile, Error.ErrKindInfoForUsers, "")
+		}
 	default: // unknown version
 		log.Printf(inlog+"journal has bad version: %s, journal=%#v.\r\n", namepart, journal)
 
@@ -373,7 +544,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 			// Or we can't trust journal at all.
 			log.Printf(inlog+"journal read error: %s, error=%s, journal=%#v.\r\n", namepart, errlog, journal)
 
-			return *NewFileState(journal.FileSize, journal.Sha1, journal.FileSize),
+			return *journal.withSizes(journal.FileSize, journal.FileSize),
 				errlog
 		}
 
@@ -395,7 +566,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 				// May be that uploadserver was shutted down in the process of writing to the journal file.
 				// try to repair journal file to continue upload
 				wp.Close() // wp was opened for read
-				wp, err := os.OpenFile(filepath.Join(storagepath, namepart), os.O_RDWR, 0660)
+				wp, err := Store.OpenFile(filepath.Join(storagepath, namepart), os.O_RDWR, 0660)
 				if err == nil {
 					defer wp.Close()
 					if err := wp.Truncate(journaloffset); err == nil {
@@ -405,13 +576,13 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 							// One may continue to upload the actual file.
 							if journal.Startoffset == wastat.Size() {
 								// journal repaired. Actual file os OK.
-								return *NewFileState(journal.FileSize, journal.Sha1, journal.Startoffset), nil
+								return *journal.withSizes(journal.FileSize, journal.Startoffset), nil
 
 							}
 
 							if journal.Startoffset < wastat.Size() { // a case when journal file doesn't have 'write ended' record.
 								// the last block of actual file may not be trusted ??
-								wa, err := os.OpenFile(filepath.Join(storagepath, name), os.O_RDWR, 0660)
+								wa, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDWR, 0660)
 								if err == nil { // if we opened actual file (err==nil)
 									defer wa.Close() // second Close on a file is allowed
 									if err = wa.Truncate(journal.Startoffset); err == nil {
@@ -419,7 +590,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 										if err == nil {
 											// we truncated actual file.
 											// we recovered from uncertainty.
-											return *NewFileState(journal.FileSize, journal.Sha1, journal.Startoffset), nil
+											return *journal.withSizes(journal.FileSize, journal.Startoffset), nil
 										}
 									}
 								}
@@ -434,7 +605,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 
 				// lets recompute sha1, check it, and call eventOnSuccess
 
-				return *NewFileState(journal.FileSize, journal.Sha1, journal.Startoffset),
+				return *journal.withSizes(journal.FileSize, journal.Startoffset),
 					Error.E(op, err, errActualFileIsAlreadyCompleteButJournalFileExists, 0, "")
 			}
 
@@ -446,7 +617,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 
 		// here journal file is considered to be in corrupted state
 		// This error in journal file blocks updates to actual file
-		return *NewFileState(wastat.Size(), journal.Sha1, wastat.Size()),
+		return *journal.withSizes(wastat.Size(), wastat.Size()),
 			Error.E(op, err, errPartialFileCorrupted, 0, "")
 	}
 
@@ -458,7 +629,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 		// actual file already bigger then expected!
 		// Impossible unless a user has intervened or journal file is bad.
 		log.Printf(inlog+"actual file is already bigger then expected: %s, wastat.Size()=%d bytes, journal.Startoffset()=%d bytes.\r\n", name, wastat.Size(), journal.Startoffset)
-		return *NewFileState(wastat.Size(), journal.Sha1, journal.Startoffset),
+		return *journal.withSizes(wastat.Size(), journal.Startoffset),
 			Error.E(op, err, errActualFileAlreadyBiggerThanExpacted, 0, "")
 	}
 
@@ -471,7 +642,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 
 		// lets recompute sha1, check it, and call eventOnSuccess
 
-		return *NewFileState(journal.FileSize, journal.Sha1, journal.Startoffset),
+		return *journal.withSizes(journal.FileSize, journal.Startoffset),
 			Error.E(op, err, errActualFileIsAlreadyCompleteButJournalFileExists, 0, "")
 
 	}
@@ -482,7 +653,7 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 		// OK
 		// Upload may continue, current actual file size corresponds to saved offset in journal file.
 		// Return no error.
-		return *NewFileState(journal.FileSize, journal.Sha1, journal.Startoffset),
+		return *journal.withSizes(journal.FileSize, journal.Startoffset),
 			nil
 	}
 	// Otherwise we need to read content of actual file and
@@ -492,14 +663,14 @@ func MayUpload(storagepath string, origname string, nameNotComplete string) (Fil
 	// TODO(zavla): run thorough content compare with MD5 cheksums of blocks
 	log.Printf(inlog+"actual file correctness in doubt, journal has strange values: %s, wastat.Size()=%d bytes, journal=%#v.\r\n", name, wastat.Size(), journal)
 
-	return *NewFileState(wastat.Size(), journal.Sha1, journal.Startoffset),
+	return *journal.withSizes(wastat.Size(), journal.Startoffset),
 		Error.E(op, err, errActualFileNeedsRepare, 0, "")
 }
 
 // GetFileSha1 gets sha1 of a file as a []byte
 func GetFileSha1(storagepath, name string) ([]byte, error) {
 	var ret []byte
-	f, err := os.Open(filepath.Join(storagepath, name))
+	f, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDONLY, 0)
 	if err != nil {
 		return ret, err
 	}
@@ -548,6 +719,12 @@ func DecodePartialFile(r io.Reader, w io.Writer) error {
 	}
 	fmt.Fprintf(w, "File has a header with version: %x\r\n", ver)
 	switch ver {
+	case structversion5, structversion6:
+		err = decodePartialFileVer5(r, w)
+	case structversion4:
+		err = decodePartialFileVer4(r, w)
+	case structversion3:
+		err = decodePartialFileVer3(r, w)
 	case structversion2:
 		err = decodePartialFileVer2(r, w)
 	case structversion1:
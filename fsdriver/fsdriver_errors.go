@@ -15,6 +15,12 @@ const (
 	errActualFileAlreadyBiggerThanExpacted
 	errActualFileIsAlreadyCompleteButJournalFileExists
 	errActualFileIsAlreadyCompleteButJournalFileIsInconsistent
+	errStorageRequestFailed
+	errStorageObjectIsReadOnly
+	errHashAlgorithmUnsupported
+	errStorageCantLink
+	errBlobDiffers
+	errJournalNeedsNoMigration
 )
 
 func init() {
@@ -29,4 +35,10 @@ func init() {
 	Error.I18[errActualFileAlreadyBiggerThanExpacted] = "Actual file is already bigger then expected."
 	Error.I18[errActualFileIsAlreadyCompleteButJournalFileExists] = "Actual file is already complete but a journal file still exists."
 	Error.I18[errActualFileIsAlreadyCompleteButJournalFileIsInconsistent] = "Actual file is completed but journal file still exists."
+	Error.I18[errStorageRequestFailed] = "Object storage request failed."
+	Error.I18[errStorageObjectIsReadOnly] = "Object in object storage can only be read."
+	Error.I18[errHashAlgorithmUnsupported] = "Hash algorithm is not supported."
+	Error.I18[errStorageCantLink] = "Storage can't link files."
+	Error.I18[errBlobDiffers] = "A stored blob with the same hash differs from the file."
+	Error.I18[errJournalNeedsNoMigration] = "Journal has a version that needs no migration."
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -36,6 +37,13 @@ type towrite struct {
 }
 
 func TestReadCurrentStateFromPartialFileVer1(t *testing.T) {
+	if err := os.MkdirAll(testdata, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// empty log file
+	if err := ioutil.WriteFile(filepath.Join(testdata, "log1.partialinfo"), nil, 0660); err != nil {
+		t.Fatal(err)
+	}
 
 	// here we create files
 	datainfiles, err := createtestdata(t)
@@ -57,7 +65,7 @@ func TestReadCurrentStateFromPartialFileVer1(t *testing.T) {
 			wantRetState: FileState{Startoffset: 0, fileProperties: fileProperties{FileSize: 0}},
 			wantErr:      false,
 			errkind:      nil,
-			wantVer:      structversion2,
+			wantVer:      supportsLatestVer,
 		},
 	}
 
@@ -123,6 +131,14 @@ func TestReadCurrentStateFromPartialFileVer1(t *testing.T) {
 
 			case structversion2:
 				gotRetState, offsetinjournal, err = ReadCurrentStateFromJournalVer2(structversion2, tt.args.wp)
+			case structversion3:
+				gotRetState, offsetinjournal, err = ReadCurrentStateFromJournalVer3(structversion3, tt.args.wp, nil)
+			case structversion4:
+				gotRetState, offsetinjournal, err = ReadCurrentStateFromJournalVer4(structversion4, tt.args.wp, nil)
+			case structversion5:
+				gotRetState, offsetinjournal, err = ReadCurrentStateFromJournalVer5(structversion5, tt.args.wp, nil)
+			case structversion6:
+				gotRetState, offsetinjournal, err = ReadCurrentStateFromJournalVer6(structversion6, tt.args.wp, nil)
 			default:
 				t.Errorf("unexpected ver in file %x", ver)
 				return
@@ -316,7 +332,7 @@ func createtestdata(t *testing.T) (map[string]towrite, error) {
 	// loop writes to test files
 	for _, addtofile := range data {
 
-		f, err := os.OpenFile(filepath.Join(testdata, addtofile.name), os.O_CREATE|os.O_TRUNC, 0)
+		f, err := os.OpenFile(filepath.Join(testdata, addtofile.name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
 		if err != nil {
 			t.Errorf("%s", err)
 			return ret, err
@@ -490,7 +506,7 @@ func createtestdataVer2(t *testing.T) (map[string]towrite, error) {
 	for k := range data {
 		data[k].wantVer = structversion2
 		data[k].name = data[k].name + "Ver2"
-		data[k].wantRetState.Sha1 = emptySha1[:]
+		data[k].wantRetState.Hash = emptySha1[:]
 	}
 	//
 	ret := make(map[string]towrite) // a return, map[filename]towrite
@@ -503,7 +519,7 @@ func createtestdataVer2(t *testing.T) (map[string]towrite, error) {
 	// loop writes to test files
 	for _, addtofile := range data {
 		// CREATES testdata files
-		f, err := os.OpenFile(filepath.Join(testdata, addtofile.name), os.O_CREATE|os.O_TRUNC, 0)
+		f, err := os.OpenFile(filepath.Join(testdata, addtofile.name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
 		if err != nil {
 			t.Errorf("%s", err)
 			return ret, err
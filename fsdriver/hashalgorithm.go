@@ -0,0 +1,129 @@
+package fsdriver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	Error "github.com/zavla/upload/errstr"
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm is an algorithm of a hash of an actual file.
+// Clients and the service agree on it, old clients use SHA1.
+type HashAlgorithm uint8
+
+// Hash algorithms. Values are stored in journals.
+const (
+	SHA1    HashAlgorithm = 0
+	SHA256  HashAlgorithm = 1
+	BLAKE2b HashAlgorithm = 2 // BLAKE2b-512
+)
+
+// constmaxhashsize is the biggest hash size of all algorithms.
+const constmaxhashsize = 64
+
+var hashAlgorithmNames = [...]string{
+	SHA1:    "sha1",
+	SHA256:  "sha256",
+	BLAKE2b: "blake2b",
+}
+
+// HashAlgorithms lists names of supported algorithms, the preferred first.
+var HashAlgorithms = []string{"sha256", "blake2b", "sha1"}
+
+// String returns a name of the algorithm used in headers and in names of completed journals.
+func (a HashAlgorithm) String() string {
+	if int(a) < len(hashAlgorithmNames) {
+		return hashAlgorithmNames[a]
+	}
+	return "unknown"
+}
+
+// ParseHashAlgorithm returns an algorithm by its name.
+// An empty name means SHA1, as old clients send only a "sha1" header.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	const op = "fsdriver.ParseHashAlgorithm()"
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "sha1", "sha-1":
+		return SHA1, nil
+	case "sha256", "sha-256":
+		return SHA256, nil
+	case "blake2b", "blake2b-512":
+		return BLAKE2b, nil
+	}
+	return SHA1, Error.E(op, nil, errHashAlgorithmUnsupported, Error.ErrKindInfoForUsers, name)
+}
+
+// Valid says the algorithm is supported.
+func (a HashAlgorithm) Valid() bool {
+	return int(a) < len(hashAlgorithmNames)
+}
+
+// Size is a size of a hash sum in bytes.
+func (a HashAlgorithm) Size() int {
+	switch a {
+	case SHA256:
+		return sha256.Size
+	case BLAKE2b:
+		return blake2b.Size
+	}
+	return sha1.Size
+}
+
+// New returns a new hash of the algorithm.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case BLAKE2b:
+		h, _ := blake2b.New512(nil) // error is only for a long key
+		return h
+	}
+	return sha1.New()
+}
+
+// GetFileHash gets a hash of a file as a []byte.
+func GetFileHash(storagepath, name string, alg HashAlgorithm) ([]byte, error) {
+	var ret []byte
+	f, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDONLY, 0)
+	if err != nil {
+		return ret, err
+	}
+	defer f.Close()
+
+	h := alg.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ret, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CompareHash says the file has the hash want.
+// Returns false when want is empty, as nothing to compare with.
+func CompareHash(storagepath, name string, alg HashAlgorithm, want []byte) (bool, error) {
+	if IsEmptyHash(want) {
+		return false, nil
+	}
+	fact, err := GetFileHash(storagepath, name, alg)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(fact, want), nil
+}
+
+// IsEmptyHash says a client didn't give a hash.
+func IsEmptyHash(h []byte) bool {
+	for _, b := range h {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
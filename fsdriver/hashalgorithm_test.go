@@ -0,0 +1,87 @@
+package fsdriver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    HashAlgorithm
+		wantErr bool
+	}{
+		{"", SHA1, false},
+		{"sha1", SHA1, false},
+		{"SHA-256", SHA256, false},
+		{"blake2b", BLAKE2b, false},
+		{"blake2b-512", BLAKE2b, false},
+		{"md5", SHA1, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHashAlgorithm(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseHashAlgorithm(%q) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+		if err == nil && tt.name != "" {
+			if back, _ := ParseHashAlgorithm(got.String()); back != got {
+				t.Errorf("ParseHashAlgorithm(%q.String()) = %s", got, back)
+			}
+		}
+	}
+}
+
+func TestGetFileHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashalgorithm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "abc"), []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		alg  HashAlgorithm
+		want string
+	}{
+		{SHA1, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{BLAKE2b, "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+	}
+	for _, tt := range tests {
+		want, _ := hex.DecodeString(tt.want)
+		got, err := GetFileHash(dir, "abc", tt.alg)
+		if err != nil || !bytes.Equal(got, want) || len(got) != tt.alg.Size() {
+			t.Errorf("GetFileHash(%s) = %x, %v, want %s", tt.alg, got, err, tt.want)
+		}
+		if ok, err := CompareHash(dir, "abc", tt.alg, want); !ok || err != nil {
+			t.Errorf("CompareHash(%s) = %v, %v, want true", tt.alg, ok, err)
+		}
+	}
+}
+
+func TestCreateNewPartialJournalFileVer5(t *testing.T) {
+	want, _ := hex.DecodeString("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	dir, err := ioutil.TempDir("", "hashalgorithm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := CreateNewPartialJournalFile(dir, "f.part", 3, SHA256, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "f.part"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	state, err := MayUpload(dir, "f", "f.part")
+	if err != nil {
+		t.Fatalf("MayUpload() error = %v", err)
+	}
+	if state.Algorithm != SHA256 || !bytes.Equal(state.Hash, want) || state.FileSize != 3 {
+		t.Errorf("MayUpload() got = %s %x %d, want %s %x %d", state.Algorithm, state.Hash, state.FileSize, SHA256, want, 3)
+	}
+}
@@ -0,0 +1,414 @@
+package fsdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// JournalDump is a decoded journal for people and tools that investigate incidents.
+type JournalDump struct {
+	Version   uint32              `json:"version"`
+	Size      int64               `json:"size"` // of the journal
+	FileSize  int64               `json:"filesize"`
+	Algorithm string              `json:"algorithm"`
+	Hash      string              `json:"hash,omitempty"` // hex, empty when a client didn't give it
+	Records   []JournalDumpRecord `json:"records"`
+	// Anomalies are problems found in the journal and, when given, in the actual file.
+	Anomalies []string `json:"anomalies,omitempty"`
+	// Startoffset and Missing are the state MayUpload would see.
+	Startoffset int64   `json:"startoffset"`
+	Missing     []Range `json:"missing,omitempty"`
+	// CleanSize is the size of the journal without bad records at the end, RepairJournal truncates the journal to it.
+	CleanSize int64 `json:"cleansize"`
+}
+
+// JournalDumpRecord is a record of a journal.
+type JournalDumpRecord struct {
+	Offset      int64  `json:"offset"` // in the journal
+	Action      string `json:"action"` // begin, end or checkpoint
+	Startoffset int64  `json:"startoffset"`
+	Count       int64  `json:"count,omitempty"`
+	Crc32       uint32 `json:"crc32,omitempty"`
+	State       string `json:"state,omitempty"` // hex of a hash state of a checkpoint
+	// CrcOK is set when the actual file was given and the block has a checksum, since structversion3.
+	CrcOK *bool `json:"crcok,omitempty"`
+}
+
+var actionNames = map[currentAction]string{
+	startedwriting: "begin",
+	successwriting: "end",
+	hashcheckpoint: "checkpoint",
+}
+
+// countingReader counts bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readJournalHeader reads a header of any journal version into the universal startstruct.
+func readJournalHeader(r io.Reader, ver uint32) (startstruct, error) {
+	var s startstruct
+	var err error
+	switch {
+	case ver >= structversion5:
+		var h startstructver5
+		err = binary.Read(r, binary.LittleEndian, &h)
+		s = startstruct{VersionBytes: h.VersionBytes, TotalExpectedFileLength: h.TotalExpectedFileLength,
+			Algorithm: h.Algorithm, Hash: h.Hash, VersionBytesEnd: h.VersionBytesEnd}
+	case ver >= structversion2:
+		var h startstructver3 // the same as version 2
+		err = binary.Read(r, binary.LittleEndian, &h)
+		s = startstruct{VersionBytes: h.VersionBytes, TotalExpectedFileLength: h.TotalExpectedFileLength,
+			Sha1: h.Sha1, VersionBytesEnd: h.VersionBytesEnd}
+		copy(s.Hash[:], h.Sha1[:])
+	default:
+		var h startstructver1
+		err = binary.Read(r, binary.LittleEndian, &h)
+		s = startstruct{VersionBytes: h.VersionBytes, TotalExpectedFileLength: h.TotalExpectedFileLength,
+			VersionBytesEnd: h.VersionBytesEnd}
+	}
+	return s, err
+}
+
+// readJournalRecord reads a record of any journal version.
+// cp is not nil for a checkpoint record.
+func readJournalRecord(r io.Reader, ver uint32) (rec JournalRecord, cp *journalcheckpointver4, err error) {
+	switch ver {
+	case structversion1:
+		var r1 journalrecordver1
+		err = binary.Read(r, binary.LittleEndian, &r1)
+		return JournalRecord{Action: r1.Action, Startoffset: r1.Startoffset, Count: r1.Count}, nil, err
+	case structversion2:
+		var r2 journalrecordver2
+		err = binary.Read(r, binary.LittleEndian, &r2)
+		return JournalRecord(r2), nil, err
+	}
+	if err = binary.Read(r, binary.LittleEndian, &rec.Action); err != nil {
+		return rec, nil, err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // a part of a record
+		}
+	}()
+	if rec.Action == hashcheckpoint && ver >= structversion4 {
+		cp = &journalcheckpointver4{Action: hashcheckpoint}
+		err = binary.Read(r, binary.LittleEndian, &cp.Offset)
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &cp.StateLen)
+		}
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &cp.State)
+		}
+		return rec, cp, err
+	}
+	var r3 journalrecordver3
+	err = binary.Read(r, binary.LittleEndian, &r3.Startoffset)
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &r3.Count)
+	}
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &r3.Crc32)
+	}
+	rec.Startoffset, rec.Count, rec.Crc32 = r3.Startoffset, r3.Count, int32(r3.Crc32)
+	return rec, nil, err
+}
+
+// readJournalState reads a journal the way MayUpload does. wa may be nil.
+func readJournalState(ver uint32, wp io.Reader, wa io.ReaderAt) (FileState, int64, error) {
+	switch ver {
+	case structversion1:
+		return ReadCurrentStateFromJournalVer1(ver, wp)
+	case structversion2:
+		return ReadCurrentStateFromJournalVer2(ver, wp)
+	case structversion3, structversion4, structversion5:
+		return readJournalWithChecksums("fsdriver.readJournalState()", ver, wp, wa)
+	}
+	return ReadCurrentStateFromJournalVer6(ver, wp, wa)
+}
+
+// DumpJournal decodes a journal and looks for anomalies in it.
+// wa is the actual file of wasize bytes, it may be nil. Its blocks are verified with checksums from the journal.
+func DumpJournal(journal io.Reader, wa io.ReaderAt, wasize int64) (JournalDump, error) {
+	const op = "fsdriver.DumpJournal()"
+	var d JournalDump
+	b, err := ioutil.ReadAll(journal)
+	if err != nil {
+		return d, Error.E(op, err, errPartialFileReadingError, 0, "")
+	}
+	d.Size = int64(len(b))
+	r := &countingReader{r: bytes.NewReader(b)}
+	if d.Version, err = GetJournalFileVersion(r); err != nil {
+		return d, err
+	}
+	header, err := readJournalHeader(r, d.Version)
+	if err != nil {
+		d.Anomalies = append(d.Anomalies, "no journal header")
+		return d, nil
+	}
+	if header.VersionBytes != d.Version || header.VersionBytesEnd != d.Version {
+		d.Anomalies = append(d.Anomalies, fmt.Sprintf("header version tags %x and %x differ from version %x", header.VersionBytes, header.VersionBytesEnd, d.Version))
+		return d, nil
+	}
+	d.FileSize = header.TotalExpectedFileLength
+	d.Algorithm = header.Algorithm.String()
+	if hash := header.Hash[:header.Algorithm.Size()]; !IsEmptyHash(hash) {
+		d.Hash = hex.EncodeToString(hash)
+	}
+
+	anomaly := func(offset int64, format string, args ...interface{}) {
+		d.Anomalies = append(d.Anomalies, fmt.Sprintf("offset %d: ", offset)+fmt.Sprintf(format, args...))
+	}
+	pending := make(map[int64]int64) // Startoffset of a 'write begin' record -> its journal offset
+	var prev JournalRecord
+	written := int64(0) // the end of the last block, before structversion6 blocks are contiguous
+	buf := make([]byte, constwriteblocklen)
+	for {
+		offset := r.n
+		rec, cp, err := readJournalRecord(r, d.Version)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			anomaly(offset, "%d bytes of an incomplete record", r.n-offset)
+			break
+		}
+		if err != nil {
+			return d, Error.E(op, err, errPartialFileReadingError, 0, "")
+		}
+		name, ok := actionNames[rec.Action]
+		if !ok || (rec.Action == hashcheckpoint && cp == nil) {
+			anomaly(offset, "unknown record action %d, %d bytes are not decoded", rec.Action, d.Size-offset)
+			break
+		}
+		dr := JournalDumpRecord{Offset: offset, Action: name, Startoffset: rec.Startoffset, Count: rec.Count, Crc32: uint32(rec.Crc32)}
+		switch {
+		case cp != nil:
+			dr.Startoffset = cp.Offset
+			if int(cp.StateLen) <= len(cp.State) {
+				dr.State = hex.EncodeToString(cp.State[:cp.StateLen])
+			}
+			if prev.Action != successwriting || (!WritesAtOffsets(d.Version) && cp.Offset != written) {
+				anomaly(offset, "a checkpoint of %d bytes doesn't follow its block", cp.Offset)
+			}
+			rec.Action = hashcheckpoint
+		case rec.Startoffset < 0 || rec.Count < 0 || rec.Count > constwriteblocklen || rec.Startoffset+rec.Count > d.FileSize:
+			anomaly(offset, "a block of %d bytes at %d is out of the file of %d bytes", rec.Count, rec.Startoffset, d.FileSize)
+		case rec.Action == startedwriting:
+			if !WritesAtOffsets(d.Version) {
+				if prev.Action == startedwriting {
+					anomaly(offset, "the previous block at %d has no 'write ended' record", prev.Startoffset)
+				}
+				if rec.Startoffset != written {
+					anomaly(offset, "a block at %d doesn't follow the written %d bytes", rec.Startoffset, written)
+				}
+			}
+			pending[rec.Startoffset] = offset
+		default: // successwriting
+			if _, found := pending[rec.Startoffset]; !found {
+				anomaly(offset, "a 'write ended' record of a block at %d has no 'write begin' record", rec.Startoffset)
+			}
+			delete(pending, rec.Startoffset)
+			written = rec.Startoffset + rec.Count
+			if wa != nil && d.Version >= structversion3 {
+				n, _ := wa.ReadAt(buf[:rec.Count], rec.Startoffset)
+				crcok := int64(n) == rec.Count && blockCrc32(buf[:n]) == rec.Crc32
+				dr.CrcOK = &crcok
+				if !crcok {
+					anomaly(offset, "a block of %d bytes at %d of the actual file has a wrong checksum", rec.Count, rec.Startoffset)
+				}
+			}
+		}
+		d.Records = append(d.Records, dr)
+		prev = rec
+	}
+	unended := make([]int64, 0, len(pending))
+	for startoffset := range pending {
+		if WritesAtOffsets(d.Version) || startoffset == prev.Startoffset { // others are reported already
+			unended = append(unended, startoffset)
+		}
+	}
+	sort.Slice(unended, func(i, j int) bool { return pending[unended[i]] < pending[unended[j]] })
+	for _, startoffset := range unended {
+		anomaly(pending[startoffset], "a block at %d has no 'write ended' record", startoffset)
+	}
+	if wa != nil {
+		switch {
+		case wasize > d.FileSize:
+			d.Anomalies = append(d.Anomalies, fmt.Sprintf("the actual file has %d bytes, more than %d bytes expected", wasize, d.FileSize))
+		case !WritesAtOffsets(d.Version) && wasize != written:
+			d.Anomalies = append(d.Anomalies, fmt.Sprintf("the actual file has %d bytes, the journal has %d bytes written", wasize, written))
+		}
+	}
+
+	// the state MayUpload would see
+	state, clean, _ := readJournalState(d.Version, bytes.NewReader(b[binary.Size(d.Version):]), wa)
+	d.Startoffset, d.Missing, d.CleanSize = state.Startoffset, state.Missing, clean
+	if d.CleanSize < d.Size {
+		d.Anomalies = append(d.Anomalies, fmt.Sprintf("%d bytes at the end of the journal are not trusted", d.Size-d.CleanSize))
+	}
+	return d, nil
+}
+
+// RepairJournal truncates a journal to its last correct record, the way MayUpload does.
+// wa is the actual file, it may be nil, then the last written blocks are not verified.
+// The original journal is kept with a suffix ".bak". The actual file is not changed.
+// Returns a number of cut bytes.
+func RepairJournal(journalname string, wa io.ReaderAt) (int64, error) {
+	const op = "fsdriver.RepairJournal()"
+	b, err := readFileOfStore(journalname)
+	if err != nil {
+		return 0, Error.E(op, err, errPartialFileReadingError, 0, journalname)
+	}
+	ver, err := GetJournalFileVersion(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	_, clean, errlog := readJournalState(ver, bytes.NewReader(b[binary.Size(ver):]), wa)
+	if errlog != nil {
+		if errlogError, _ := errlog.(*Error.Error); errlogError == nil || errlogError.Code != errPartialFileCorrupted {
+			// the journal can't be read or blocks can't be trusted
+			return 0, errlog
+		}
+	}
+	if clean <= int64(binary.Size(ver)) || clean >= int64(len(b)) {
+		return 0, nil // no header or nothing to cut
+	}
+	if err := writeFileOfStore(journalname+".bak", b); err != nil {
+		return 0, Error.E(op, err, errPartialFileWritingError, 0, journalname)
+	}
+	if err := Truncate(journalname, clean); err != nil {
+		return 0, Error.E(op, err, errPartialFileWritingError, 0, journalname)
+	}
+	return int64(len(b)) - clean, nil
+}
+
+// MigrateJournal rewrites a version 1 or 2 journal of the actual file name in dir to the latest version.
+// Blocks written according to the old journal get checksums from the actual file and hash checkpoints.
+// The original journal is kept with a suffix ".bak".
+func MigrateJournal(dir, name string) error {
+	const op = "fsdriver.MigrateJournal()"
+	namepart := GetPartialJournalFileName(name)
+	b, err := readFileOfStore(filepath.Join(dir, namepart))
+	if err != nil {
+		return Error.E(op, err, errPartialFileReadingError, 0, namepart)
+	}
+	ver, err := GetJournalFileVersion(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if ver > structversion2 {
+		return Error.E(op, nil, errJournalNeedsNoMigration, 0, fmt.Sprintf("version %x", ver))
+	}
+	state, _, errlog := readJournalState(ver, bytes.NewReader(b[binary.Size(ver):]), nil)
+	if errlog != nil {
+		if errlogError, _ := errlog.(*Error.Error); errlogError == nil || errlogError.Code != errPartialFileCorrupted {
+			return errlog
+		}
+		// records after the last correct one are dropped
+	}
+	wa, err := Store.OpenFile(filepath.Join(dir, name), os.O_RDONLY, 0)
+	if err != nil {
+		return Error.E(op, err, Error.ErrFileIO, 0, name)
+	}
+	defer wa.Close()
+	wastat, err := wa.Stat()
+	if err != nil {
+		return Error.E(op, err, Error.ErrFileIO, 0, name)
+	}
+	written := state.Startoffset
+	if wastat.Size() < written {
+		written = wastat.Size()
+	}
+
+	tmp := name + ".migrate"
+	tmppart := GetPartialJournalFileName(tmp)
+	if err := createPartialJournalFile(dir, tmp, supportsLatestVer, state.FileSize, SHA1, state.Hash); err != nil {
+		return err
+	}
+	err = writeMigratedRecords(dir, tmppart, wa, written)
+	if err == nil {
+		if err = Store.Rename(filepath.Join(dir, namepart), filepath.Join(dir, namepart+".bak")); err == nil {
+			err = Store.Rename(filepath.Join(dir, tmppart), filepath.Join(dir, namepart))
+		}
+	}
+	if err != nil {
+		Store.Remove(filepath.Join(dir, tmppart))
+		return Error.E(op, err, errPartialFileWritingError, 0, namepart)
+	}
+	return nil
+}
+
+// writeMigratedRecords appends records of the first written bytes of wa to a new journal.
+func writeMigratedRecords(dir, namepart string, wa io.ReaderAt, written int64) error {
+	wp, ver, err := openJournalFile(dir, namepart, 0)
+	if err != nil {
+		return err
+	}
+	defer wp.Close()
+	h := SHA1.New()
+	buf := make([]byte, constwriteblocklen)
+	for offset := int64(0); offset < written; {
+		count := written - offset
+		if count > constwriteblocklen {
+			count = constwriteblocklen
+		}
+		n, err := wa.ReadAt(buf[:count], offset)
+		if int64(n) != count {
+			return err
+		}
+		rec := JournalRecord{Startoffset: offset, Count: count}
+		if err := addRecordToJournalFile(wp, startedwriting, ver, rec); err != nil {
+			return err
+		}
+		rec.Crc32 = blockCrc32(buf[:n])
+		if err := addRecordToJournalFile(wp, successwriting, ver, rec); err != nil {
+			return err
+		}
+		h.Write(buf[:n])
+		if offset/checkpointbytes != (offset+count)/checkpointbytes {
+			if err := addCheckpointToJournalFile(wp, offset+count, h); err != nil {
+				return err
+			}
+		}
+		offset += count
+	}
+	return wp.Close()
+}
+
+func readFileOfStore(name string) ([]byte, error) {
+	f, err := Store.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func writeFileOfStore(name string, b []byte) error {
+	f, err := Store.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return f.Close()
+}
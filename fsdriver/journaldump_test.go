@@ -0,0 +1,131 @@
+package fsdriver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func dumpTestJournal(t *testing.T, dir string, withdata bool) JournalDump {
+	wp, err := os.Open(filepath.Join(dir, GetPartialJournalFileName("f.part")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wp.Close()
+	if !withdata {
+		d, err := DumpJournal(wp, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	wa, err := os.Open(filepath.Join(dir, "f.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wa.Close()
+	fi, _ := wa.Stat()
+	d, err := DumpJournal(wp, wa, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDumpJournal(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), (3*constwriteblocklen+100)/10)
+	size := int64(len(content))
+	for _, ver := range []uint32{structversion3, structversion5, structversion6} {
+		dir := writeTestUpload(t, ver, content, size+10, SHA1, nil)
+		defer os.RemoveAll(dir)
+		journalname := filepath.Join(dir, GetPartialJournalFileName("f.part"))
+
+		d := dumpTestJournal(t, dir, true)
+		if len(d.Anomalies) != 0 || len(d.Records) != 8 || d.Startoffset != size || d.CleanSize != d.Size {
+			t.Errorf("ver %x: DumpJournal() of a clean journal = %+v", ver, d)
+		}
+		for _, r := range d.Records {
+			if r.Action == "end" && (r.CrcOK == nil || !*r.CrcOK) {
+				t.Errorf("ver %x: DumpJournal() didn't verify a block %+v", ver, r)
+			}
+		}
+
+		// garbage at the end of the journal
+		f, _ := os.OpenFile(journalname, os.O_APPEND|os.O_WRONLY, 0)
+		f.Write([]byte{byte(startedwriting), 1, 2})
+		f.Close()
+		d = dumpTestJournal(t, dir, false)
+		if len(d.Anomalies) == 0 || d.CleanSize != d.Size-3 || !strings.Contains(d.Anomalies[0], "3 bytes of an incomplete record") {
+			t.Errorf("ver %x: DumpJournal() of a journal with garbage = %v, cleansize %d of %d", ver, d.Anomalies, d.CleanSize, d.Size)
+		}
+		// a bad last block
+		corruptByte(t, filepath.Join(dir, "f.part"), size-1)
+		d = dumpTestJournal(t, dir, true)
+		if last := d.Records[len(d.Records)-1]; last.CrcOK == nil || *last.CrcOK {
+			t.Errorf("ver %x: DumpJournal() didn't find a bad block: %+v", ver, last)
+		}
+
+		n, err := RepairJournal(journalname, nil)
+		if err != nil || n != 3 {
+			t.Errorf("ver %x: RepairJournal() = %d, %v, want 3 bytes", ver, n, err)
+		}
+		if _, err := os.Stat(journalname + ".bak"); err != nil {
+			t.Errorf("ver %x: RepairJournal() didn't keep the original: %s", ver, err)
+		}
+		d = dumpTestJournal(t, dir, false)
+		if len(d.Anomalies) != 0 || len(d.Records) != 8 {
+			t.Errorf("ver %x: DumpJournal() of a repaired journal = %v", ver, d.Anomalies)
+		}
+	}
+}
+
+func TestMigrateJournal(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), (3*constwriteblocklen+100)/10)
+	written := int64(2*constwriteblocklen + 7)
+	dir := writeTestUpload(t, structversion3, content[:written], int64(len(content)), SHA1, nil)
+	defer os.RemoveAll(dir)
+	journalname := filepath.Join(dir, GetPartialJournalFileName("f.part"))
+
+	// a version 1 journal of the same upload, with a block without its 'write ended' record
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, structversion1)
+	binary.Write(&b, binary.LittleEndian, startstructver1{VersionBytes: structversion1, TotalExpectedFileLength: int64(len(content)), VersionBytesEnd: structversion1})
+	for offset := int64(0); offset < written; offset += constwriteblocklen {
+		count := written - offset
+		if count > constwriteblocklen {
+			count = constwriteblocklen
+		}
+		binary.Write(&b, binary.LittleEndian, journalrecordver1{Action: startedwriting, Startoffset: offset, Count: count})
+		binary.Write(&b, binary.LittleEndian, journalrecordver1{Action: successwriting, Startoffset: offset, Count: count})
+	}
+	binary.Write(&b, binary.LittleEndian, journalrecordver1{Action: startedwriting, Startoffset: written, Count: 10})
+	if err := writeFileOfStore(journalname, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateJournal(dir, "f.part"); err != nil {
+		t.Fatal(err)
+	}
+	state, err := MayUpload(dir, "f", "f.part")
+	if err != nil || state.Startoffset != written || state.FileSize != int64(len(content)) {
+		t.Errorf("MayUpload() after MigrateJournal() = %d of %d, %v, want %d", state.Startoffset, state.FileSize, err, written)
+	}
+	d := dumpTestJournal(t, dir, true)
+	if d.Version != supportsLatestVer || len(d.Anomalies) != 0 {
+		t.Errorf("DumpJournal() after MigrateJournal() = version %x, %v", d.Version, d.Anomalies)
+	}
+	h, err := RestoreHash(dir, "f.part", d.Version, written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha1.Sum(content[:written]); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("RestoreHash() after MigrateJournal() = %x, want %x", h.Sum(nil), want)
+	}
+	if err := MigrateJournal(dir, "f.part"); err == nil {
+		t.Errorf("MigrateJournal() of the latest version must fail")
+	}
+}
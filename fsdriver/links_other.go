@@ -0,0 +1,9 @@
+//go:build plan9
+// +build plan9
+
+package fsdriver
+
+// linkCount returns false, a count of hard links is unknown on this OS.
+func linkCount(name string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package fsdriver
+
+import "syscall"
+
+// linkCount returns a count of hard links of a file, false when it is unknown.
+func linkCount(name string) (uint64, bool) {
+	fi, err := Store.Stat(name)
+	if err != nil {
+		return 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
@@ -0,0 +1,20 @@
+package fsdriver
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns a count of hard links of a local file, false when it is unknown.
+func linkCount(name string) (uint64, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info); err != nil {
+		return 0, false
+	}
+	return uint64(info.NumberOfLinks), true
+}
@@ -84,7 +84,7 @@ func ReadCurrentStateFromJournalVer2(ver uint32, wp io.Reader) (retState FileSta
 
 		correctrecordoffset += headersize
 		retState.FileSize = startstruct.TotalExpectedFileLength
-		retState.Sha1 = startstruct.Sha1[:]
+		retState.Hash = startstruct.Sha1[:]
 
 		currrecord := journalrecordver2{} // current log record
 
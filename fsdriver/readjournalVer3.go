@@ -0,0 +1,330 @@
+package fsdriver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// constverifyblocks is a number of last blocks of an actual file verified on resume.
+const constverifyblocks = 8
+
+// crc32cTable is used to compute checksums of blocks in journal version 3.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// startstructver3 is a header of version 3 journal
+type startstructver3 struct {
+	VersionBytes            uint32
+	TotalExpectedFileLength int64
+	Sha1                    [20]byte
+	VersionBytesEnd         uint32
+}
+
+// universal StartStruct -> to StartStructVer3
+func (s startstruct) Ver3() startstructver3 {
+	return startstructver3{
+		VersionBytes:            s.VersionBytes,
+		VersionBytesEnd:         s.VersionBytesEnd,
+		TotalExpectedFileLength: s.TotalExpectedFileLength,
+		Sha1:                    s.Sha1,
+	}
+
+}
+
+// journalrecordver3 this is a record version 3.
+// A 'write ended' record holds CRC32C (Castagnoli) of the written block.
+type journalrecordver3 struct {
+	Action      currentAction
+	Startoffset int64
+	Count       int64
+	Crc32       uint32
+}
+
+// ver3 translates JournalRecord to version 3
+func (r JournalRecord) ver3() journalrecordver3 {
+	return journalrecordver3{
+		Action:      r.Action,
+		Startoffset: r.Startoffset,
+		Count:       r.Count,
+		Crc32:       uint32(r.Crc32),
+	}
+}
+
+// blockCrc32 is a checksum of a block for journal version 3.
+func blockCrc32(b []byte) int32 {
+	return int32(crc32.Checksum(b, crc32cTable))
+}
+
+// ReadCurrentStateFromJournalVer3 reads version 3 of journal file.
+// Records are read as in version 2, then up to constverifyblocks last blocks of the actual file wa
+// are verified with checksums from the journal, starting from the end.
+// The returned offset is rolled back to the end of the last verified block and
+// correctrecordoffset points to the end of its 'write ended' record.
+// wa == nil means no verification.
+// May return errors: nil, errPartialFileReadingError, errPartialFileVersionTagReadError, errPartialFileCorrupted,
+// errActualFileNeedsRepare when no block at the end of the actual file has a correct checksum.
+func ReadCurrentStateFromJournalVer3(ver uint32, wp io.Reader, wa io.ReaderAt) (retState FileState, correctrecordoffset int64, errInLog error) {
+	return readJournalWithChecksums("fsdriver.ReadCurrentStateFromJournalVer3()", structversion3, wp, wa)
+}
+
+// readJournalWithChecksums reads journals of version 3 and later.
+// Since structversion4 the journal has hash checkpoint records.
+// Since structversion5 the journal header has a hash algorithm.
+func readJournalWithChecksums(op string, ver uint32, wp io.Reader, wa io.ReaderAt) (retState FileState, correctrecordoffset int64, errInLog error) {
+	var startstruct startstructver5 // version 3 header is read into it
+	var headersize = int64(binary.Size(startstructver3{}))
+	if ver >= structversion5 {
+		headersize = int64(binary.Size(startstructver5{}))
+	}
+	var recordsize = int64(binary.Size(journalrecordver3{}))
+	var checkpointsize = int64(binary.Size(journalcheckpointver4{}))
+
+	// correctrecordoffset points to the end of the last correct record
+	correctrecordoffset = int64(binary.Size(ver)) // holds journal file offset
+
+	retState = *NewFileState(0, nil, 0)
+
+	// reads start bytes in file
+	var err error
+	if ver >= structversion5 {
+		err = binary.Read(wp, binary.LittleEndian, &startstruct)
+	} else {
+		var header3 startstructver3
+		err = binary.Read(wp, binary.LittleEndian, &header3)
+		startstruct = header3.ver5()
+	}
+	if err != nil {
+		if err == io.EOF {
+			// empty file. No error.
+			return retState,
+				0,
+				nil
+		}
+		// No startstruct in header. error. File created but somehow without a startstruct header.
+		return retState,
+			correctrecordoffset,
+			Error.E(op, err, errPartialFileVersionTagReadError, 0, "")
+	}
+	if startstruct.VersionBytes != ver || startstruct.VersionBytesEnd != ver {
+		// incorrect header
+		return retState, correctrecordoffset, Error.E(op, err, errPartialFileVersionTagReadError, 0, "")
+	}
+
+	correctrecordoffset += headersize
+	retState.FileSize = startstruct.TotalExpectedFileLength
+	if !startstruct.Algorithm.Valid() {
+		return retState, correctrecordoffset, Error.E(op, nil, errPartialFileVersionTagReadError, 0, "unknown hash algorithm.")
+	}
+	retState.Algorithm = startstruct.Algorithm
+	retState.Hash = startstruct.Hash[:startstruct.Algorithm.Size()]
+
+	tail := make([]journalblock, 0, constverifyblocks) // last blocks, the oldest first
+	// two last checkpoints, checkpoints are much farther from each other than the tail
+	checkpoints := [2]HashCheckpoint{}
+
+	currrecord := journalrecordver3{} // current log record
+
+	// initial value for prevrecord wil never be a match to currrecord
+	prevrecord := journalrecordver3{
+		Startoffset: -1,
+		Action:      successwriting} // forced to do not make a match
+
+	lastsuccessrecord := journalrecordver3{} // should not be a pointer
+	maybeErr := false
+
+loop:
+	for { // reading records one by one
+		// the first byte of every record is an action
+		err := binary.Read(wp, binary.LittleEndian, &currrecord.Action)
+		if err == nil && currrecord.Action == hashcheckpoint && ver >= structversion4 {
+			var cp journalcheckpointver4
+			err = binary.Read(wp, binary.LittleEndian, &cp.Offset)
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &cp.StateLen)
+			}
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &cp.State)
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				if prevrecord.Action != successwriting ||
+					cp.Offset != lastsuccessrecord.Startoffset+lastsuccessrecord.Count ||
+					int(cp.StateLen) > len(cp.State) {
+					// a checkpoint must follow a 'write ended' record
+					errInLog = Error.E(op, nil, errPartialFileCorrupted, 0, "bad hash checkpoint.")
+					break
+				}
+				checkpoints[0] = checkpoints[1]
+				checkpoints[1] = HashCheckpoint{Offset: cp.Offset, State: append([]byte{}, cp.State[:cp.StateLen]...)}
+				correctrecordoffset += checkpointsize
+				continue
+			}
+		} else if err == nil {
+			err = binary.Read(wp, binary.LittleEndian, &currrecord.Startoffset)
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &currrecord.Count)
+			}
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &currrecord.Crc32)
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err == io.ErrUnexpectedEOF { // read ended unexpectedly
+			errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "")
+			break
+		} else if err != nil && err != io.EOF { // read failed, use lastsuccessrecord
+			// we dont know why we cant read journal, blocks are not verified.
+			return *retState.Setoffset(lastsuccessrecord.Startoffset + lastsuccessrecord.Count),
+				correctrecordoffset,
+				Error.E(op, err, errPartialFileReadingError, 0, "")
+		}
+
+		switch {
+		case err == io.EOF:
+			if maybeErr {
+				// Journal file doesn't have a 'write ended' record.
+				errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "")
+			}
+			break loop
+		case currrecord.Startoffset > retState.FileSize:
+			// current record do not correspond to expected file size
+			errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "Startoffset in journal size already exceeded expected file size.")
+			break loop
+		case currrecord.Startoffset == prevrecord.Startoffset &&
+			currrecord.Action == successwriting &&
+			prevrecord.Action == startedwriting:
+
+			// current record found a pair.
+			if len(tail) == constverifyblocks {
+				copy(tail, tail[1:])
+				tail = tail[:len(tail)-1]
+			}
+			tail = append(tail, journalblock{rec: currrecord, journaloffset: correctrecordoffset})
+			correctrecordoffset += recordsize * 2
+			lastsuccessrecord = currrecord
+			maybeErr = false
+		case currrecord.Startoffset >= prevrecord.Startoffset &&
+			currrecord.Action == startedwriting &&
+			prevrecord.Action == successwriting:
+			// a "start to write" record. Wait for its "pair" record.
+			maybeErr = true
+		default:
+			// current record is bad.
+			errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "")
+			break loop
+		}
+		prevrecord = currrecord
+	}
+	retState.Setoffset(lastsuccessrecord.Startoffset + lastsuccessrecord.Count)
+
+	if wa != nil && len(tail) != 0 {
+		errInLog = verifyTail(op, tail, wa, &retState, &correctrecordoffset, errInLog)
+	}
+	// the last checkpoint that is not after the (rolled back) offset
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if checkpoints[i].State != nil && checkpoints[i].Offset <= retState.Startoffset {
+			retState.Checkpoint = checkpoints[i]
+			break
+		}
+	}
+	return retState, correctrecordoffset, errInLog
+}
+
+// journalblock is a written block of the actual file
+type journalblock struct {
+	rec           journalrecordver3 // 'write ended' record
+	journaloffset int64             // journal offset of its 'write begin' record
+}
+
+// verifyTail verifies blocks from the end of the actual file.
+// Rolls back state offset and journal offset to the beginning of the first bad block after the last correct one.
+func verifyTail(op string, tail []journalblock, wa io.ReaderAt, state *FileState, journaloffset *int64, errInLog error) error {
+	buf := make([]byte, constwriteblocklen)
+	for i := len(tail) - 1; i >= 0; i-- {
+		b := tail[i]
+		if b.rec.Count <= int64(len(buf)) { // blocks are never bigger
+			n, err := wa.ReadAt(buf[:b.rec.Count], b.rec.Startoffset)
+			if err != nil && err != io.EOF {
+				return Error.E(op, err, errActualFileNeedsRepare, 0, "")
+			}
+			if int64(n) == b.rec.Count && blockCrc32(buf[:n]) == int32(b.rec.Crc32) {
+				// this block is correct
+				return errInLog
+			}
+		}
+		// rolls back to the beginning of the bad block
+		state.Setoffset(b.rec.Startoffset)
+		*journaloffset = b.journaloffset
+	}
+	if state.Startoffset != 0 {
+		// there are older blocks but they can't be trusted either
+		return Error.E(op, nil, errActualFileNeedsRepare, 0, "no correct blocks at the end of the actual file.")
+	}
+	return errInLog
+}
+
+// repairVer3 truncates a journal and an actual file to the last verified block.
+// Blocks of the actual file were verified by ReadCurrentStateFromJournalVer3 so
+// journal.Startoffset is trusted whatever the difference with the actual file size is.
+// Returns errlog that remains after the repair.
+func repairVer3(storagepath, namepart, name string, journal FileState, journaloffset, actualsize int64, errlog error) (error, error) {
+	if errlog != nil {
+		errlogError, _ := errlog.(*Error.Error)
+		if errlogError == nil || errlogError.Code != errPartialFileCorrupted {
+			// journal can't be read or blocks can't be trusted
+			return errlog, nil
+		}
+	}
+	if journal.FileSize == 0 {
+		// empty journal, nothing to repair
+		return errlog, nil
+	}
+	if err := Truncate(filepath.Join(storagepath, namepart), journaloffset); err != nil {
+		return errlog, err
+	}
+	if actualsize > journal.Startoffset {
+		if err := Truncate(filepath.Join(storagepath, name), journal.Startoffset); err != nil {
+			return errlog, err
+		}
+	}
+	return nil, nil
+}
+
+func decodePartialFileVer3(r io.Reader, w io.Writer) error {
+	startstruct := startstructver3{}
+	record := journalrecordver3{}
+
+	err := binary.Read(r, binary.LittleEndian, &startstruct)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%#v\r\n", startstruct)
+
+	for {
+		err := binary.Read(r, binary.LittleEndian, &record)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// there are some bytes
+			b := make([]byte, binary.Size(record))
+			r.Read(b)
+			fmt.Fprintf(w, "%x\r\n", b)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%#v\r\n", record)
+
+	}
+
+}
@@ -0,0 +1,149 @@
+package fsdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestUpload writes content through a journal of version ver and returns the storage dir.
+// h must be of the algorithm alg.
+func writeTestUpload(t *testing.T, ver uint32, content []byte, expected int64, alg HashAlgorithm, h hash.Hash) string {
+	dir, err := ioutil.TempDir("", "journalver3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createPartialJournalFile(dir, "f.part", ver, expected, alg, nil); err != nil {
+		t.Fatal(err)
+	}
+	gotver, wp, wa, errwp, errwa := OpenTwoCorrespondentFiles(dir, "f.part", GetPartialJournalFileName("f.part"), nil)
+	if errwp != nil || errwa != nil {
+		t.Fatal(errwp, errwa)
+	}
+	if gotver != ver {
+		t.Fatalf("new journal version got = %x, want %x", gotver, ver)
+	}
+	if _, err := AddBytesToFile(wa, wp, content, ver, &JournalRecord{}, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	wa.Close()
+	wp.Close()
+	return dir
+}
+
+func readTestJournal(t *testing.T, dir string) (FileState, int64, error) {
+	wp, err := os.Open(filepath.Join(dir, GetPartialJournalFileName("f.part")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wp.Close()
+	wa, err := os.Open(filepath.Join(dir, "f.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wa.Close()
+	ver, err := GetJournalFileVersion(wp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch ver {
+	case structversion3:
+		return ReadCurrentStateFromJournalVer3(ver, wp, wa)
+	case structversion4:
+		return ReadCurrentStateFromJournalVer4(ver, wp, wa)
+	case structversion5:
+		return ReadCurrentStateFromJournalVer5(ver, wp, wa)
+	}
+	return ReadCurrentStateFromJournalVer6(ver, wp, wa)
+}
+
+func corruptByte(t *testing.T, name string, offset int64) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCurrentStateFromJournalVer3(t *testing.T) {
+	const blocks = 3
+	content := bytes.Repeat([]byte("0123456789"), (blocks*constwriteblocklen-100)/10)
+	lastblock := int64(2 * constwriteblocklen)
+	recordsize := int64(binary.Size(journalrecordver3{}))
+	journalsize := int64(binary.Size(structversion3)+binary.Size(startstructver3{})) + 2*blocks*recordsize
+
+	tests := []struct {
+		name     string
+		corrupt  int64 // offset in actual file to corrupt, -1 means none
+		append   []byte
+		wantOff  int64
+		wantJOff int64
+	}{
+		{"intact", -1, nil, int64(len(content)), journalsize},
+		{"last block corrupted", lastblock + 10, nil, lastblock, journalsize - 2*recordsize},
+		{"first block corrupted, tail is verified", 10, nil, int64(len(content)), journalsize},
+		{"bytes without journal records", -1, []byte("garbage"), int64(len(content)), journalsize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTestUpload(t, structversion3, content, 1<<30, SHA1, nil)
+			defer os.RemoveAll(dir)
+			if tt.corrupt >= 0 {
+				corruptByte(t, filepath.Join(dir, "f.part"), tt.corrupt)
+			}
+			if tt.append != nil {
+				f, _ := os.OpenFile(filepath.Join(dir, "f.part"), os.O_APPEND|os.O_WRONLY, 0)
+				f.Write(tt.append)
+				f.Close()
+			}
+			got, joff, err := readTestJournal(t, dir)
+			if err != nil {
+				t.Fatalf("ReadCurrentStateFromJournalVer3() error = %v", err)
+			}
+			if got.Startoffset != tt.wantOff || joff != tt.wantJOff {
+				t.Errorf("ReadCurrentStateFromJournalVer3() got offset = %d, journal offset = %d, want %d, %d",
+					got.Startoffset, joff, tt.wantOff, tt.wantJOff)
+			}
+		})
+	}
+}
+
+func TestMayUploadVer3RollsBack(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), (3*constwriteblocklen-100)/10)
+	dir := writeTestUpload(t, structversion3, content, 1<<30, SHA1, nil)
+	defer os.RemoveAll(dir)
+
+	// a torn write at the end of the actual file: the last block differs and some bytes follow
+	lastblock := int64(2 * constwriteblocklen)
+	corruptByte(t, filepath.Join(dir, "f.part"), lastblock+1)
+	f, _ := os.OpenFile(filepath.Join(dir, "f.part"), os.O_APPEND|os.O_WRONLY, 0)
+	f.Write(bytes.Repeat([]byte{1}, 3*constwriteblocklen))
+	f.Close()
+
+	state, err := MayUpload(dir, "f", "f.part")
+	if err != nil {
+		t.Fatalf("MayUpload() error = %v", err)
+	}
+	if state.Startoffset != lastblock {
+		t.Errorf("MayUpload() Startoffset = %d, want %d", state.Startoffset, lastblock)
+	}
+	stat, _ := os.Stat(filepath.Join(dir, "f.part"))
+	if stat.Size() != lastblock {
+		t.Errorf("actual file size after MayUpload() = %d, want %d", stat.Size(), lastblock)
+	}
+	// journal is repaired: the next read gives the same state without errors
+	got, _, err := readTestJournal(t, dir)
+	if err != nil || got.Startoffset != lastblock {
+		t.Errorf("journal after MayUpload() got offset = %d, err = %v", got.Startoffset, err)
+	}
+}
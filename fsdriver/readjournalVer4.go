@@ -0,0 +1,175 @@
+package fsdriver
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// constmaxhashstate is a maximum size of a marshaled hash state in a checkpoint.
+const constmaxhashstate = 256
+
+// checkpointbytes is a distance between hash checkpoints in the actual file.
+// A resumed upload rereads less than checkpointbytes of the actual file to restore its hash.
+var checkpointbytes int64 = 64 << 20
+
+// Version 4 journal has the header and the records of version 3.
+// After some 'write ended' records there is a checkpoint record.
+
+// journalcheckpointver4 is a checkpoint record with a state of a hash of the actual file.
+type journalcheckpointver4 struct {
+	Action   currentAction // hashcheckpoint
+	Offset   int64         // the hash is of the first Offset bytes of the actual file
+	StateLen uint16
+	State    [constmaxhashstate]byte // encoding.BinaryMarshaler representation of the hash
+}
+
+// ReadCurrentStateFromJournalVer4 reads version 4 of journal file.
+// It works as ReadCurrentStateFromJournalVer3 and also returns the last hash checkpoint
+// that is not after the returned Startoffset.
+func ReadCurrentStateFromJournalVer4(ver uint32, wp io.Reader, wa io.ReaderAt) (retState FileState, correctrecordoffset int64, errInLog error) {
+	return readJournalWithChecksums("fsdriver.ReadCurrentStateFromJournalVer4()", structversion4, wp, wa)
+}
+
+// addCheckpointToJournalFile writes a state of the hash h of the first offset bytes of the actual file.
+// Hashes that can't be marshaled are not saved.
+func addCheckpointToJournalFile(wp io.Writer, offset int64, h hash.Hash) error {
+	const op = "fsdriver.addCheckpointToJournalFile()"
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil || len(state) > constmaxhashstate {
+		return nil // no checkpoint, the hash will be computed from the beginning
+	}
+	cp := journalcheckpointver4{Action: hashcheckpoint, Offset: offset, StateLen: uint16(len(state))}
+	copy(cp.State[:], state)
+	if err := binary.Write(wp, binary.LittleEndian, &cp); err != nil {
+		return Error.E(op, err, errPartialFileWritingError, 0, "")
+	}
+	return nil
+}
+
+// RestoreHash returns a hash of the first startoffset bytes of the actual file name.
+// The hash algorithm is the one from the journal header.
+// It starts from the last checkpoint in the journal and reads only the rest of the actual file.
+// Returns nil hash for journal versions without checkpoints and when the first startoffset bytes
+// are not written yet.
+func RestoreHash(storagepath, name string, ver uint32, startoffset int64) (hash.Hash, error) {
+	const op = "fsdriver.RestoreHash()"
+	if ver < structversion4 {
+		return nil, nil
+	}
+	wp, err := Store.OpenFile(filepath.Join(storagepath, GetPartialJournalFileName(name)), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, Error.E(op, err, errPartialFileReadingError, 0, "")
+	}
+	defer wp.Close()
+	if _, err := GetJournalFileVersion(wp); err != nil {
+		return nil, err
+	}
+	var journal FileState
+	var errlog error
+	if ver >= structversion6 {
+		unlock := lockJournal(wp.Name())
+		journal, _, errlog = ReadCurrentStateFromJournalVer6(ver, wp, nil)
+		unlock()
+	} else {
+		journal, _, errlog = readJournalWithChecksums(op, ver, wp, nil)
+	}
+	if errlogError, _ := errlog.(*Error.Error); errlogError != nil && errlogError.Code != errPartialFileCorrupted {
+		return nil, errlog // the header and the hash algorithm are unknown
+	}
+	if ver >= structversion6 && journal.Startoffset < startoffset && journal.FileSize != 0 {
+		// the beginning of the file is not written yet, ranges are uploaded in parallel
+		return nil, nil
+	}
+	h := journal.Algorithm.New()
+	from := int64(0)
+	cp := journal.Checkpoint
+	if u, ok := h.(encoding.BinaryUnmarshaler); ok && startoffset > 0 && cp.State != nil && cp.Offset <= startoffset {
+		if err := u.UnmarshalBinary(cp.State); err == nil {
+			from = cp.Offset
+		} else {
+			h = journal.Algorithm.New()
+		}
+	}
+	if from == startoffset {
+		return h, nil
+	}
+	wa, err := Store.OpenFile(filepath.Join(storagepath, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer wa.Close()
+	n, err := io.Copy(h, io.NewSectionReader(wa, from, startoffset-from))
+	if err != nil {
+		return nil, err
+	}
+	if n != startoffset-from {
+		return nil, Error.E(op, io.ErrUnexpectedEOF, errActualFileNeedsRepare, 0, "")
+	}
+	return h, nil
+}
+
+func decodePartialFileVer4(r io.Reader, w io.Writer) error {
+	startstruct := startstructver3{}
+
+	err := binary.Read(r, binary.LittleEndian, &startstruct)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%#v\r\n", startstruct)
+
+	return decodeRecordsVer4(r, w)
+}
+
+// decodeRecordsVer4 prints records and checkpoints that follow a journal header.
+func decodeRecordsVer4(r io.Reader, w io.Writer) error {
+	record := journalrecordver3{}
+	cp := journalcheckpointver4{}
+
+	for {
+		var action currentAction
+		err := binary.Read(r, binary.LittleEndian, &action)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if action == hashcheckpoint {
+			err = binary.Read(r, binary.LittleEndian, &cp.Offset)
+			if err == nil {
+				err = binary.Read(r, binary.LittleEndian, &cp.StateLen)
+			}
+			if err == nil {
+				err = binary.Read(r, binary.LittleEndian, &cp.State)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "checkpoint{Offset:%d, State:%x}\r\n", cp.Offset, cp.State[:cp.StateLen])
+			continue
+		}
+		record.Action = action
+		err = binary.Read(r, binary.LittleEndian, &record.Startoffset)
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &record.Count)
+		}
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &record.Crc32)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%#v\r\n", record)
+	}
+}
@@ -0,0 +1,67 @@
+package fsdriver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreHash(t *testing.T) {
+	saved := checkpointbytes
+	checkpointbytes = 3 * constwriteblocklen
+	defer func() { checkpointbytes = saved }()
+
+	content := bytes.Repeat([]byte("0123456789"), 8*constwriteblocklen/10)
+	sum := func(alg HashAlgorithm, b []byte) []byte {
+		h := alg.New()
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	for _, alg := range []HashAlgorithm{SHA1, SHA256, BLAKE2b} {
+		t.Run(alg.String(), func(t *testing.T) {
+			h := alg.New()
+			dir := writeTestUpload(t, structversion5, content, 1<<30, alg, h)
+			defer os.RemoveAll(dir)
+			if want := sum(alg, content); !bytes.Equal(h.Sum(nil), want) {
+				t.Fatalf("running hash got = %x, want %x", h.Sum(nil), want)
+			}
+
+			state, _, err := readTestJournal(t, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.Algorithm != alg {
+				t.Errorf("journal Algorithm got = %s, want %s", state.Algorithm, alg)
+			}
+			if state.Checkpoint.Offset != 6*constwriteblocklen {
+				t.Errorf("last checkpoint Offset got = %d, want %d", state.Checkpoint.Offset, 6*constwriteblocklen)
+			}
+
+			// a checkpoint after a rolled back offset is not used
+			for _, block := range []int64{5, 6, 7} {
+				corruptByte(t, filepath.Join(dir, "f.part"), block*constwriteblocklen+1)
+			}
+			state, _, err = readTestJournal(t, dir)
+			if err != nil || state.Startoffset != 5*constwriteblocklen || state.Checkpoint.Offset != 3*constwriteblocklen {
+				t.Errorf("after rollback got offset = %d, checkpoint = %d, err = %v", state.Startoffset, state.Checkpoint.Offset, err)
+			}
+			for _, block := range []int64{5, 6, 7} {
+				corruptByte(t, filepath.Join(dir, "f.part"), block*constwriteblocklen+1)
+			}
+
+			for _, offset := range []int64{0, 100, 6 * constwriteblocklen, int64(len(content))} {
+				got, err := RestoreHash(dir, "f.part", structversion5, offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := sum(alg, content[:offset]); !bytes.Equal(got.Sum(nil), want) {
+					t.Errorf("RestoreHash(%d) got = %x, want %x", offset, got.Sum(nil), want)
+				}
+			}
+			if h, _ := RestoreHash(dir, "f.part", structversion3, 100); h != nil {
+				t.Errorf("RestoreHash() wants nil hash for journals without checkpoints")
+			}
+		})
+	}
+}
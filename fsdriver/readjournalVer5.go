@@ -0,0 +1,61 @@
+package fsdriver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Version 5 journal has the records of version 4.
+// Its header holds a hash algorithm and a hash of any supported algorithm.
+
+// startstructver5 is a header of version 5 journal
+type startstructver5 struct {
+	VersionBytes            uint32
+	TotalExpectedFileLength int64
+	Algorithm               HashAlgorithm
+	Hash                    [constmaxhashsize]byte // the first Algorithm.Size() bytes are used
+	VersionBytesEnd         uint32
+}
+
+// universal StartStruct -> to StartStructVer5
+func (s startstruct) Ver5() startstructver5 {
+	return startstructver5{
+		VersionBytes:            s.VersionBytes,
+		VersionBytesEnd:         s.VersionBytesEnd,
+		TotalExpectedFileLength: s.TotalExpectedFileLength,
+		Algorithm:               s.Algorithm,
+		Hash:                    s.Hash,
+	}
+}
+
+// ver5 translates a version 3 header, it always has SHA1.
+func (s startstructver3) ver5() startstructver5 {
+	ret := startstructver5{
+		VersionBytes:            s.VersionBytes,
+		VersionBytesEnd:         s.VersionBytesEnd,
+		TotalExpectedFileLength: s.TotalExpectedFileLength,
+		Algorithm:               SHA1,
+	}
+	copy(ret.Hash[:], s.Sha1[:])
+	return ret
+}
+
+// ReadCurrentStateFromJournalVer5 reads version 5 of journal file.
+// It works as ReadCurrentStateFromJournalVer4 and also returns the hash algorithm of the journal.
+func ReadCurrentStateFromJournalVer5(ver uint32, wp io.Reader, wa io.ReaderAt) (retState FileState, correctrecordoffset int64, errInLog error) {
+	return readJournalWithChecksums("fsdriver.ReadCurrentStateFromJournalVer5()", structversion5, wp, wa)
+}
+
+func decodePartialFileVer5(r io.Reader, w io.Writer) error {
+	startstruct := startstructver5{}
+
+	err := binary.Read(r, binary.LittleEndian, &startstruct)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "startstructver5{TotalExpectedFileLength:%d, Algorithm:%s, Hash:%x}\r\n",
+		startstruct.TotalExpectedFileLength, startstruct.Algorithm, startstruct.Hash[:startstruct.Algorithm.Size()])
+
+	return decodeRecordsVer4(r, w)
+}
@@ -0,0 +1,298 @@
+package fsdriver
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// Version 6 journal has the header of version 5 and the records of version 4.
+// Blocks are written at their offsets of the actual file, so ranges of a file may be uploaded in parallel.
+// Records of blocks written in parallel are interleaved: a 'write begin' record is paired with
+// a later 'write ended' record with the same Startoffset. A 'write begin' record without a pair
+// is a block that was not written.
+
+// journalLocks are locks of journals appended by parallel uploads of ranges of a file.
+var journalLocks = struct {
+	sync.Mutex
+	m map[string]*journalLock
+}{m: make(map[string]*journalLock)}
+
+type journalLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockJournal locks a journal with a full path name.
+// Returns a function to unlock it.
+func lockJournal(name string) (unlock func()) {
+	journalLocks.Lock()
+	l := journalLocks.m[name]
+	if l == nil {
+		l = &journalLock{}
+		journalLocks.m[name] = l
+	}
+	l.refs++
+	journalLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		journalLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(journalLocks.m, name)
+		}
+		journalLocks.Unlock()
+	}
+}
+
+// lockJournalOfVer locks an opened journal if it may be appended in parallel.
+func lockJournalOfVer(wp File, ver uint32) (unlock func()) {
+	if ver < structversion6 {
+		return func() {}
+	}
+	return lockJournal(wp.Name())
+}
+
+// journalcheckpoint is a checkpoint and an offset of its record in a journal.
+type journalcheckpoint struct {
+	HashCheckpoint
+	journaloffset int64
+}
+
+// ReadCurrentStateFromJournalVer6 reads version 6 of journal file.
+// Up to constverifyblocks last written blocks of the actual file wa are verified with checksums from the journal.
+// A bad block and every block written after it are considered missing, correctrecordoffset then points to
+// the 'write begin' record of the bad block and errInLog is errPartialFileCorrupted.
+// retState.Startoffset is the end of the written beginning of the actual file, retState.Missing are not written ranges.
+// wa == nil means no verification.
+// May return errors: nil, errPartialFileReadingError, errPartialFileVersionTagReadError, errPartialFileCorrupted,
+// errActualFileNeedsRepare when the actual file can't be read.
+func ReadCurrentStateFromJournalVer6(ver uint32, wp io.Reader, wa io.ReaderAt) (retState FileState, correctrecordoffset int64, errInLog error) {
+	const op = "fsdriver.ReadCurrentStateFromJournalVer6()"
+	var startstruct startstructver5
+	var headersize = int64(binary.Size(startstructver5{}))
+	var recordsize = int64(binary.Size(journalrecordver3{}))
+	var checkpointsize = int64(binary.Size(journalcheckpointver4{}))
+
+	// correctrecordoffset points to the end of the last correct record
+	correctrecordoffset = int64(binary.Size(ver)) // holds journal file offset
+
+	retState = *NewFileState(0, nil, 0)
+
+	err := binary.Read(wp, binary.LittleEndian, &startstruct)
+	if err != nil {
+		if err == io.EOF {
+			// empty file. No error.
+			return retState, 0, nil
+		}
+		return retState, correctrecordoffset, Error.E(op, err, errPartialFileVersionTagReadError, 0, "")
+	}
+	if startstruct.VersionBytes != structversion6 || startstruct.VersionBytesEnd != structversion6 ||
+		!startstruct.Algorithm.Valid() {
+		// incorrect header
+		return retState, correctrecordoffset, Error.E(op, nil, errPartialFileVersionTagReadError, 0, "")
+	}
+	correctrecordoffset += headersize
+	retState.FileSize = startstruct.TotalExpectedFileLength
+	retState.Algorithm = startstruct.Algorithm
+	retState.Hash = startstruct.Hash[:startstruct.Algorithm.Size()]
+
+	pending := make(map[int64]int64) // Startoffset of a 'write begin' record -> its journal offset
+	blocks := make([]journalblock, 0, 64)
+	checkpoints := make([]journalcheckpoint, 0, 2)
+
+loop:
+	for { // reading records one by one
+		var action currentAction
+		err := binary.Read(wp, binary.LittleEndian, &action)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return retState, correctrecordoffset, Error.E(op, err, errPartialFileReadingError, 0, "")
+		}
+		switch action {
+		case hashcheckpoint:
+			var cp journalcheckpointver4
+			err = binary.Read(wp, binary.LittleEndian, &cp.Offset)
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &cp.StateLen)
+			}
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &cp.State)
+			}
+			if err != nil || cp.Offset < 0 || cp.Offset > retState.FileSize || int(cp.StateLen) > len(cp.State) {
+				errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "bad hash checkpoint.")
+				break loop
+			}
+			checkpoints = append(checkpoints, journalcheckpoint{
+				HashCheckpoint: HashCheckpoint{Offset: cp.Offset, State: append([]byte{}, cp.State[:cp.StateLen]...)},
+				journaloffset:  correctrecordoffset,
+			})
+			correctrecordoffset += checkpointsize
+
+		case startedwriting, successwriting:
+			rec := journalrecordver3{Action: action}
+			err = binary.Read(wp, binary.LittleEndian, &rec.Startoffset)
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &rec.Count)
+			}
+			if err == nil {
+				err = binary.Read(wp, binary.LittleEndian, &rec.Crc32)
+			}
+			if err != nil || rec.Startoffset < 0 || rec.Count < 0 || rec.Count > constwriteblocklen ||
+				rec.Startoffset+rec.Count > retState.FileSize {
+				errInLog = Error.E(op, err, errPartialFileCorrupted, 0, "")
+				break loop
+			}
+			if action == startedwriting {
+				pending[rec.Startoffset] = correctrecordoffset
+			} else {
+				beginoffset, found := pending[rec.Startoffset]
+				if !found {
+					// a 'write ended' record must have a pair
+					errInLog = Error.E(op, nil, errPartialFileCorrupted, 0, "")
+					break loop
+				}
+				delete(pending, rec.Startoffset)
+				blocks = append(blocks, journalblock{rec: rec, journaloffset: beginoffset})
+			}
+			correctrecordoffset += recordsize
+
+		default:
+			// current record is bad.
+			errInLog = Error.E(op, nil, errPartialFileCorrupted, 0, "")
+			break loop
+		}
+	}
+
+	if wa != nil {
+		cut, err := verifyLastBlocks(blocks, wa)
+		if err != nil {
+			errInLog = Error.E(op, err, errActualFileNeedsRepare, 0, "")
+		} else if cut >= 0 {
+			// blocks and checkpoints after the bad block are not trusted
+			correctrecordoffset = cut
+			i := 0
+			for _, b := range blocks {
+				if b.journaloffset < cut {
+					blocks[i] = b
+					i++
+				}
+			}
+			blocks = blocks[:i]
+			i = 0
+			for _, cp := range checkpoints {
+				if cp.journaloffset < cut {
+					checkpoints[i] = cp
+					i++
+				}
+			}
+			checkpoints = checkpoints[:i]
+			errInLog = Error.E(op, nil, errPartialFileCorrupted, 0, "bad blocks at the end of the actual file.")
+		}
+	}
+
+	retState.Missing = missingRanges(blocks, retState.FileSize)
+	retState.Startoffset = retState.FileSize
+	if len(retState.Missing) != 0 {
+		retState.Startoffset = retState.Missing[0].Startoffset
+	}
+	// the farthest checkpoint that is not after the written beginning of the file
+	for _, cp := range checkpoints {
+		if cp.Offset <= retState.Startoffset && cp.Offset >= retState.Checkpoint.Offset {
+			retState.Checkpoint = cp.HashCheckpoint
+		}
+	}
+	return retState, correctrecordoffset, errInLog
+}
+
+// verifyLastBlocks verifies up to constverifyblocks last written blocks.
+// Returns the journal offset of the earliest bad block or -1.
+func verifyLastBlocks(blocks []journalblock, wa io.ReaderAt) (int64, error) {
+	cut := int64(-1)
+	buf := make([]byte, constwriteblocklen)
+	from := len(blocks) - constverifyblocks
+	if from < 0 {
+		from = 0
+	}
+	for _, b := range blocks[from:] {
+		n, err := wa.ReadAt(buf[:b.rec.Count], b.rec.Startoffset)
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+		if int64(n) != b.rec.Count || blockCrc32(buf[:n]) != int32(b.rec.Crc32) {
+			if cut < 0 || b.journaloffset < cut {
+				cut = b.journaloffset
+			}
+		}
+	}
+	return cut, nil
+}
+
+// missingRanges returns ranges of [0, filesize) not covered by blocks.
+func missingRanges(blocks []journalblock, filesize int64) []Range {
+	sorted := make([]journalrecordver3, len(blocks))
+	for i, b := range blocks {
+		sorted[i] = b.rec
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Startoffset < sorted[j].Startoffset })
+
+	missing := make([]Range, 0, 1)
+	offset := int64(0) // everything before offset is written
+	for _, rec := range sorted {
+		if rec.Startoffset > offset {
+			missing = append(missing, Range{Startoffset: offset, Count: rec.Startoffset - offset})
+		}
+		if end := rec.Startoffset + rec.Count; end > offset {
+			offset = end
+		}
+	}
+	if offset < filesize {
+		missing = append(missing, Range{Startoffset: offset, Count: filesize - offset})
+	}
+	return missing
+}
+
+// mayUploadVer6 is MayUpload for version 6 journals.
+// Bad records and records of bad blocks are cut from the journal, the actual file is not truncated
+// as missing ranges are written at their offsets.
+func mayUploadVer6(storagepath, namepart, name string, journal FileState, journaloffset, actualsize int64, errlog error) (FileState, error) {
+	const op = "fsdriver.MayUpload()"
+	const inlog = "MayUpload error: "
+
+	if errlog != nil {
+		errlogError, _ := errlog.(*Error.Error)
+		if errlogError == nil || errlogError.Code != errPartialFileCorrupted {
+			// can't read journal or actual file
+			log.Printf(inlog+"journal read error: %s, error=%s, journal=%#v.\r\n", namepart, errlog, journal)
+
+			return *journal.withSizes(journal.FileSize, journal.FileSize), errlog
+		}
+		if err := Truncate(filepath.Join(storagepath, namepart), journaloffset); err != nil {
+			log.Printf(inlog+"can't cut bad records from journal: %s, error=%s.\r\n", namepart, err)
+
+			return *journal.withSizes(actualsize, actualsize),
+				Error.E(op, err, errPartialFileCorrupted, 0, "")
+		}
+		log.Printf("journal records after offset %d are cut: %s, error=%s.\r\n", journaloffset, namepart, errlog)
+	}
+
+	if actualsize > journal.FileSize {
+		log.Printf(inlog+"actual file is already bigger then expected: %s, wastat.Size()=%d bytes, journal.FileSize=%d bytes.\r\n", name, actualsize, journal.FileSize)
+		return *journal.withSizes(actualsize, journal.Startoffset),
+			Error.E(op, nil, errActualFileAlreadyBiggerThanExpacted, 0, "")
+	}
+	if len(journal.Missing) == 0 {
+		// every range is written, lets recompute hash, check it, and call eventOnSuccess
+		return journal, Error.E(op, nil, errActualFileIsAlreadyCompleteButJournalFileExists, 0, "")
+	}
+	return journal, nil
+}
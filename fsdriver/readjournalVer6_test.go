@@ -0,0 +1,112 @@
+package fsdriver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// writeTestRange writes a range of content to an upload created by createPartialJournalFile.
+func writeTestRange(t *testing.T, dir string, content []byte, r Range) {
+	ver, wp, wa, errwp, errwa := OpenTwoCorrespondentFiles(dir, "f.part", GetPartialJournalFileName("f.part"), nil)
+	if errwp != nil || errwa != nil {
+		t.Error(errwp, errwa)
+		return
+	}
+	defer wp.Close()
+	defer wa.Close()
+	if _, err := AddBytesToFile(wa, wp, content[r.Startoffset:r.End()], ver, &JournalRecord{Startoffset: r.Startoffset}, nil, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadCurrentStateFromJournalVer6(t *testing.T) {
+	const b = constwriteblocklen
+	content := bytes.Repeat([]byte("0123456789"), (5*b+100)/10)
+	size := int64(len(content))
+
+	dir, err := ioutil.TempDir("", "journalver6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := createPartialJournalFile(dir, "f.part", structversion6, size, SHA256, nil); err != nil {
+		t.Fatal(err)
+	}
+	// ranges are written not in order
+	for _, r := range []Range{{3 * b, b}, {0, b}, {b, b}} {
+		writeTestRange(t, dir, content, r)
+	}
+	// a block that was not written
+	wp, _ := os.OpenFile(filepath.Join(dir, GetPartialJournalFileName("f.part")), os.O_APPEND|os.O_WRONLY, 0)
+	addRecordToJournalFile(wp, startedwriting, structversion6, JournalRecord{Startoffset: 4 * b, Count: b})
+	wp.Close()
+
+	got, _, err := readTestJournal(t, dir)
+	want := []Range{{2 * b, b}, {4 * b, size - 4*b}}
+	if err != nil || got.Startoffset != 2*b || !reflect.DeepEqual(got.Missing, want) || got.Algorithm != SHA256 {
+		t.Errorf("ReadCurrentStateFromJournalVer6() got = %d %v %s, err = %v, want %d %v", got.Startoffset, got.Missing, got.Algorithm, err, 2*b, want)
+	}
+	if !got.InMissing(Range{2 * b, 10}) || got.InMissing(Range{b, 2 * b}) {
+		t.Errorf("InMissing() is wrong for %v", got.Missing)
+	}
+
+	// the last written block is bad
+	corruptByte(t, filepath.Join(dir, "f.part"), b+1)
+	state, err := MayUpload(dir, "f", "f.part")
+	want = []Range{{b, 2 * b}, {4 * b, size - 4*b}}
+	if err != nil || !reflect.DeepEqual(state.Missing, want) {
+		t.Errorf("MayUpload() got = %v, err = %v, want %v", state.Missing, err, want)
+	}
+	// the journal is repaired
+	got, _, err = readTestJournal(t, dir)
+	if err != nil || !reflect.DeepEqual(got.Missing, want) {
+		t.Errorf("journal after MayUpload() got = %v, err = %v", got.Missing, err)
+	}
+
+	// RestoreHash needs the written beginning of the file
+	if h, err := RestoreHash(dir, "f.part", structversion6, 3*b); h != nil || err != nil {
+		t.Errorf("RestoreHash() wants nil hash for not written ranges, got err = %v", err)
+	}
+	if h, err := RestoreHash(dir, "f.part", structversion6, b); h == nil || err != nil {
+		t.Errorf("RestoreHash() wants a hash of the written beginning, got err = %v", err)
+	}
+}
+
+func TestParallelRangesVer6(t *testing.T) {
+	const b = constwriteblocklen
+	content := bytes.Repeat([]byte("abcdefghij"), (8*b+30)/10)
+	size := int64(len(content))
+
+	dir, err := ioutil.TempDir("", "journalver6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := CreateNewPartialJournalFile(dir, "f.part", size, SHA1, nil); err != nil {
+		t.Fatal(err)
+	}
+	ranges := []Range{{0, 3 * b}, {3 * b, 3 * b}, {6 * b, size - 6*b}}
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(r Range) {
+			defer wg.Done()
+			writeTestRange(t, dir, content, r)
+		}(r)
+	}
+	wg.Wait()
+
+	_, err = MayUpload(dir, "f", "f.part")
+	if !MayRepare(err) {
+		t.Fatalf("MayUpload() of a complete file error = %v", err)
+	}
+	written, _ := ioutil.ReadFile(filepath.Join(dir, "f.part"))
+	if !bytes.Equal(written, content) {
+		t.Errorf("the actual file differs from the content")
+	}
+}
@@ -0,0 +1,696 @@
+package fsdriver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// s3DefaultPartSize is a size of a part of a multipart upload.
+// Objects not bigger than this are sent with one PUT.
+const s3DefaultPartSize = 64 << 20
+
+// s3MaxParts is the maximum number of parts in a multipart upload.
+const s3MaxParts = 10000
+
+// s3MaxCopySize is the biggest object one CopyObject request copies, it is also a part size of bigger copies.
+var s3MaxCopySize int64 = 5 << 30
+
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage is a Storage on an S3-compatible object storage (Amazon S3, MinIO and others).
+// Objects can't be appended to, so actual files being uploaded and their journals
+// are kept in Staging. Rename of a staged file puts it into the bucket,
+// that is how a completed upload lands in the object storage.
+// Requests use path-style URLs and AWS Signature Version 4.
+type S3Storage struct {
+	Endpoint  string // e.x. https://127.0.0.1:9000
+	Bucket    string
+	Region    string // e.x. us-east-1
+	AccessKey string
+	SecretKey string
+	// Root is a local path that corresponds to the root of the bucket.
+	// Names outside Root are rejected.
+	Root string
+	// Staging keeps files that are being written.
+	Staging Storage
+	// Client is used for requests, nil means http.DefaultClient.
+	Client *http.Client
+	// PartSize is a part size of a multipart upload, 0 means 64MB.
+	PartSize int64
+}
+
+// key converts a full path name into an object key.
+func (s *S3Storage) key(name string) (string, error) {
+	rel, err := filepath.Rel(s.Root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "key", Path: name, Err: os.ErrInvalid}
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// isStaged says a file with this name is in Staging.
+func (s *S3Storage) isStaged(name string) bool {
+	_, err := s.Staging.Stat(name)
+	return err == nil
+}
+
+// OpenFile opens a staged file. Any writing flag opens a file in Staging.
+// Read only opening of a file that is not staged opens an object.
+func (s *S3Storage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 || s.isStaged(name) {
+		return s.Staging.OpenFile(name, flag, perm)
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	key, _ := s.key(name)
+	return &s3ObjectFile{s: s, name: name, key: key, info: info}, nil
+}
+
+// Stat returns info of a staged file, of an object or of a common prefix as a directory.
+func (s *S3Storage) Stat(name string) (os.FileInfo, error) {
+	if info, err := s.Staging.Stat(name); err == nil {
+		return info, nil
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return &s3FileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	resp, err := s.do("HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		modtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &s3FileInfo{name: path.Base(key), size: resp.ContentLength, modtime: modtime}, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return nil, s.responseError("Stat", key, resp)
+	}
+	// may be a directory
+	list, err := s.list(key+"/", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &s3FileInfo{name: path.Base(key), dir: true}, nil
+}
+
+// Rename puts a staged file into the bucket or copies an object to a new key.
+// Objects bigger than a CopyObject limit of 5GB are copied by parts.
+func (s *S3Storage) Rename(oldname, newname string) error {
+	const op = "fsdriver.S3Storage.Rename()"
+	newkey, err := s.key(newname)
+	if err != nil {
+		return err
+	}
+	if s.isStaged(oldname) {
+		if err := s.putFile(oldname, newkey); err != nil {
+			return err
+		}
+		return s.Staging.Remove(oldname)
+	}
+	oldkey, err := s.key(oldname)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s3MaxCopySize {
+		if err := s.copyMultipart(oldkey, newkey, info.Size()); err != nil {
+			return err
+		}
+		return s.deleteObject(oldkey)
+	}
+	h := http.Header{}
+	h.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+s3Escape(oldkey, false))
+	resp, err := s.do("PUT", newkey, nil, h, nil, 0)
+	if err != nil {
+		return Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError("Rename", newkey, resp)
+	}
+	return s.deleteObject(oldkey)
+}
+
+// Remove removes a staged file or an object.
+func (s *S3Storage) Remove(name string) error {
+	if s.isStaged(name) {
+		return s.Staging.Remove(name)
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	return s.deleteObject(key)
+}
+
+// MkdirAll makes directories in Staging. Buckets do not have directories.
+func (s *S3Storage) MkdirAll(path string, perm os.FileMode) error {
+	return s.Staging.MkdirAll(path, perm)
+}
+
+// ReadDir lists staged files and objects with a common prefix.
+func (s *S3Storage) ReadDir(dirname string) ([]os.FileInfo, error) {
+	infos := make(map[string]os.FileInfo)
+	staged, err := s.Staging.ReadDir(dirname)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range staged {
+		infos[info.Name()] = info
+	}
+	key, err := s.key(dirname)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	token := ""
+	for {
+		list, err := s.list(prefix, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range list.CommonPrefixes {
+			name := path.Base(p.Prefix)
+			if _, has := infos[name]; !has {
+				infos[name] = &s3FileInfo{name: name, dir: true}
+			}
+		}
+		for _, o := range list.Contents {
+			name := path.Base(o.Key)
+			if _, has := infos[name]; !has && o.Key != prefix {
+				infos[name] = &s3FileInfo{name: name, size: o.Size, modtime: o.LastModified}
+			}
+		}
+		if !list.IsTruncated {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	ret := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, nil
+}
+
+// putFile sends a staged file into the bucket.
+func (s *S3Storage) putFile(name, key string) error {
+	const op = "fsdriver.S3Storage.putFile()"
+	f, err := s.Staging.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	partsize := s.PartSize
+	if partsize <= 0 {
+		partsize = s3DefaultPartSize
+	}
+	if size <= partsize {
+		resp, err := s.do("PUT", key, nil, nil, f, size)
+		if err != nil {
+			return Error.E(op, err, errStorageRequestFailed, 0, "")
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s.responseError("PUT", key, resp)
+		}
+		return nil
+	}
+	if min := (size + s3MaxParts - 1) / s3MaxParts; partsize < min {
+		partsize = min
+	}
+	return s.putMultipart(f, size, partsize, key)
+}
+
+func (s *S3Storage) putMultipart(f File, size, partsize int64, key string) error {
+	const op = "fsdriver.S3Storage.putMultipart()"
+	return s.multipart(key, size, partsize, func(q url.Values, offset, n int64) (string, error) {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		resp, err := s.do("PUT", key, q, nil, io.LimitReader(f, n), n)
+		if err != nil {
+			return "", Error.E(op, err, errStorageRequestFailed, 0, "")
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", s.responseError("UploadPart", key, resp)
+		}
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+// copyMultipart copies an object of size bytes by parts with UploadPartCopy.
+func (s *S3Storage) copyMultipart(oldkey, newkey string, size int64) error {
+	const op = "fsdriver.S3Storage.copyMultipart()"
+	return s.multipart(newkey, size, s3MaxCopySize, func(q url.Values, offset, n int64) (string, error) {
+		h := http.Header{}
+		h.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+s3Escape(oldkey, false))
+		h.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+		resp, err := s.do("PUT", newkey, q, h, nil, 0)
+		if err != nil {
+			return "", Error.E(op, err, errStorageRequestFailed, 0, "")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", s.responseError("UploadPartCopy", newkey, resp)
+		}
+		var result struct {
+			ETag string
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return "", Error.E(op, err, errStorageRequestFailed, 0, "")
+		}
+		return result.ETag, nil
+	})
+}
+
+// multipart makes a multipart upload of size bytes into key by parts of partsize.
+// sendpart sends a part of n bytes at offset with a query of the part and returns its ETag.
+func (s *S3Storage) multipart(key string, size, partsize int64, sendpart func(q url.Values, offset, n int64) (string, error)) error {
+	const op = "fsdriver.S3Storage.multipart()"
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return s.responseError("CreateMultipartUpload", key, resp)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	abort := func(err error) error {
+		if resp, errabort := s.do("DELETE", key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, 0); errabort == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	for number, offset := 1, int64(0); offset < size; number++ {
+		n := partsize
+		if size-offset < n {
+			n = size - offset
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		etag, err := sendpart(q, offset, n)
+		if err != nil {
+			return abort(err)
+		}
+		complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: etag})
+		offset += n
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do("POST", key, url.Values{"uploadId": {initiated.UploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return abort(Error.E(op, err, errStorageRequestFailed, 0, ""))
+	}
+	defer resp.Body.Close()
+	// CompleteMultipartUpload may answer 200 OK with an error in the body
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || bytes.Contains(b, []byte("<Error>")) {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		return abort(s.responseError("CompleteMultipartUpload", key, resp))
+	}
+	return nil
+}
+
+func (s *S3Storage) deleteObject(key string) error {
+	const op = "fsdriver.S3Storage.deleteObject()"
+	resp, err := s.do("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// s3ListResult is a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Storage) list(prefix, token string, maxkeys int) (*s3ListResult, error) {
+	const op = "fsdriver.S3Storage.list()"
+	q := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	if maxkeys > 0 {
+		q.Set("max-keys", strconv.Itoa(maxkeys))
+	}
+	resp, err := s.do("GET", "", q, nil, nil, 0)
+	if err != nil {
+		return nil, Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("ListObjectsV2", prefix, resp)
+	}
+	var list s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, Error.E(op, err, errStorageRequestFailed, 0, "")
+	}
+	return &list, nil
+}
+
+// do sends a signed request about an object with key.
+// Empty key means a request about the bucket.
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	u.RawPath = "/" + s3Escape(s.Bucket, true)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, false)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	} else {
+		req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	}
+	signV4(req, s.AccessKey, s.SecretKey, s.Region, "s3", time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// responseError makes an error from an S3 error response.
+func (s *S3Storage) responseError(action, key string, resp *http.Response) error {
+	const op = "fsdriver.S3Storage.responseError()"
+	var e struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	return Error.E(op, fmt.Errorf("%s %s: %s %s %s", action, key, resp.Status, e.Code, e.Message), errStorageRequestFailed, 0, "")
+}
+
+// signV4 signs a request with AWS Signature Version 4.
+// Host, Range and X-Amz-* headers are signed.
+// The X-Amz-Content-Sha256 header must be set before.
+func signV4(req *http.Request, accesskey, secretkey, region, service string, t time.Time) {
+	amzdate := t.UTC().Format("20060102T150405Z")
+	day := amzdate[:8]
+	req.Header.Set("X-Amz-Date", amzdate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	names := []string{"host"}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		headers.String(),
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hashcanonical := sha256.Sum256([]byte(canonical))
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hashcanonical[:])
+
+	key := []byte("AWS4" + secretkey)
+	for _, v := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, tosign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accesskey+"/"+scope+
+		",SignedHeaders="+signed+",Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery is a query string sorted by keys with all values escaped.
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes all bytes except unreserved ones.
+// Slashes are kept unless escapeslash.
+func s3Escape(s string, escapeslash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeslash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// s3FileInfo is an os.FileInfo of an object or of a common prefix.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modtime time.Time
+	dir     bool
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modtime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+func (fi *s3FileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// s3ObjectFile is a File opened for reading of an object.
+// It reads with a ranged GET from the current offset.
+type s3ObjectFile struct {
+	s      *S3Storage
+	name   string
+	key    string
+	info   os.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3ObjectFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		resp, err := f.s.do("GET", f.key, nil, h, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return 0, f.s.responseError("GET", f.key, resp)
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ReadAt reads with a separate ranged GET.
+func (f *s3ObjectFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := f.s.do("GET", f.key, nil, h, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, f.s.responseError("GET", f.key, resp)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3ObjectFile) Seek(offset int64, whence int) (int64, error) {
+	newoffset := offset
+	switch whence {
+	case io.SeekCurrent:
+		newoffset += f.offset
+	case io.SeekEnd:
+		newoffset += f.info.Size()
+	}
+	if newoffset < 0 {
+		return f.offset, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if newoffset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = newoffset
+	return newoffset, nil
+}
+
+func (f *s3ObjectFile) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+func (f *s3ObjectFile) Write(p []byte) (int, error) {
+	return 0, Error.E("fsdriver.s3ObjectFile.Write()", nil, errStorageObjectIsReadOnly, 0, f.name)
+}
+
+func (f *s3ObjectFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, Error.E("fsdriver.s3ObjectFile.WriteAt()", nil, errStorageObjectIsReadOnly, 0, f.name)
+}
+
+func (f *s3ObjectFile) Truncate(size int64) error {
+	return Error.E("fsdriver.s3ObjectFile.Truncate()", nil, errStorageObjectIsReadOnly, 0, f.name)
+}
+
+func (f *s3ObjectFile) Name() string               { return f.name }
+func (f *s3ObjectFile) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *s3ObjectFile) Sync() error                { return nil }
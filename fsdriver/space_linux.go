@@ -0,0 +1,19 @@
+package fsdriver
+
+import "syscall"
+
+const fallocKeepSize = 0x01 // FALLOC_FL_KEEP_SIZE
+
+// FreeSpace returns bytes available to the service on a volume of path, -1 when it is unknown.
+func FreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return -1, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// preallocate reserves disk blocks of a file, the size of the file is not changed.
+func preallocate(fd uintptr, size int64) error {
+	return syscall.Fallocate(int(fd), fallocKeepSize, 0, size)
+}
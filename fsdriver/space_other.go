@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package fsdriver
+
+// FreeSpace returns -1, the free space is unknown on this OS.
+func FreeSpace(path string) (int64, error) {
+	return -1, nil
+}
+
+// preallocate does nothing on this OS.
+func preallocate(fd uintptr, size int64) error {
+	return nil
+}
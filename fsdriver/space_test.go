@@ -0,0 +1,36 @@
+package fsdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpaceAndPreallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	free, err := FreeSpace(dir)
+	if err != nil || free == 0 {
+		t.Errorf("FreeSpace() = %d, %v", free, err)
+	}
+	if _, err := FreeSpace(filepath.Join(dir, "absent")); err == nil && free >= 0 {
+		t.Errorf("FreeSpace() of an absent directory must fail")
+	}
+
+	f, err := Store.OpenFile(filepath.Join(dir, "f.part"), os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Preallocate(f, 1<<20); err != nil {
+		t.Skipf("Preallocate() is not supported here: %s", err)
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != 0 {
+		t.Errorf("Preallocate() changed the size of a file: %v, %v", fi.Size(), err)
+	}
+}
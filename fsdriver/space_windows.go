@@ -0,0 +1,37 @@
+package fsdriver
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceExW        = kernel32.NewProc("GetDiskFreeSpaceExW")
+	procSetFileInformationByHandle = kernel32.NewProc("SetFileInformationByHandle")
+)
+
+const fileAllocationInfo = 5 // FILE_INFO_BY_HANDLE_CLASS
+
+// FreeSpace returns bytes available to the service on a volume of path, -1 when it is unknown.
+func FreeSpace(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	var avail uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		return -1, err
+	}
+	return int64(avail), nil
+}
+
+// preallocate reserves disk space of a file, the end of the file is not changed.
+func preallocate(fd uintptr, size int64) error {
+	r, _, err := procSetFileInformationByHandle.Call(fd, fileAllocationInfo, uintptr(unsafe.Pointer(&size)), unsafe.Sizeof(size))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package fsdriver
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// File is an opened file of a Storage.
+// *os.File implements File.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Storage is a place where actual files and their journals are kept.
+// Names are full paths, as the service builds them from its storage root.
+// Errors about absent files must satisfy os.IsNotExist.
+type Storage interface {
+	// OpenFile opens a file like os.OpenFile does. Use it to create, append, read files.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir lists a directory sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// Linker is a Storage that can make hard links of files.
+type Linker interface {
+	// Link creates newname as a hard link to oldname. An existing newname is an error satisfying os.IsExist.
+	Link(oldname, newname string) error
+}
+
+// Store is a storage used by this package and by the upload service.
+// The default is a local disk.
+var Store Storage = LocalStorage{}
+
+// LocalStorage is a Storage on a local disk.
+type LocalStorage struct{}
+
+// OpenFile is os.OpenFile.
+func (LocalStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// do not return a typed nil *os.File inside an interface
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat is os.Stat.
+func (LocalStorage) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// Rename is os.Rename.
+func (LocalStorage) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+// Remove is os.Remove.
+func (LocalStorage) Remove(name string) error { return os.Remove(name) }
+
+// MkdirAll is os.MkdirAll.
+func (LocalStorage) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+// Link is os.Link.
+func (LocalStorage) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+// ReadDir is ioutil.ReadDir.
+func (LocalStorage) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+
+// Preallocate reserves size bytes of disk space for a file of a local disk, the size of the file is not changed.
+// Files of other storages and files on OSes without preallocation are left as they are.
+func Preallocate(f File, size int64) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok || size <= 0 {
+		return nil
+	}
+	return preallocate(fd.Fd(), size)
+}
+
+// Truncate changes the size of a file in Store.
+func Truncate(name string, size int64) error {
+	f, err := Store.OpenFile(name, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Close()
+}
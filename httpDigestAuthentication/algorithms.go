@@ -0,0 +1,73 @@
+package httpDigestAuthentication
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Digest algorithms.
+const (
+	AlgorithmMD5        = "MD5"
+	AlgorithmSHA256     = "SHA-256"
+	AlgorithmSHA512_256 = "SHA-512-256"
+)
+
+// Algorithms are digest algorithms of this package, the strongest first.
+var Algorithms = []string{AlgorithmSHA512_256, AlgorithmSHA256, AlgorithmMD5}
+
+// CanonicalAlgorithm returns a name of a supported algorithm as in Algorithms, or "" when it is unsupported.
+// Names are case insensitive, an empty name is MD5 by rfc2617.
+// Session variants (-sess) are not supported.
+func CanonicalAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return AlgorithmMD5
+	}
+	for _, a := range Algorithms {
+		if strings.EqualFold(a, algorithm) {
+			return a
+		}
+	}
+	return ""
+}
+
+// strength is a place of an algorithm in Algorithms from the weakest, 0 is unsupported.
+func strength(algorithm string) int {
+	a := CanonicalAlgorithm(algorithm)
+	for i := range Algorithms {
+		if Algorithms[i] == a {
+			return len(Algorithms) - i
+		}
+	}
+	return 0
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch CanonicalAlgorithm(algorithm) {
+	case AlgorithmSHA256:
+		return sha256.New()
+	case AlgorithmSHA512_256:
+		return sha512.New512_256()
+	}
+	return md5.New()
+}
+
+// hashhex is H(s) of rfc7616 of an algorithm.
+func hashhex(algorithm, s string) string {
+	h := newHash(algorithm)
+	_, _ = io.WriteString(h, s)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func md5hex(s string) string {
+	return hashhex(AlgorithmMD5, s)
+}
+
+// h2 is KD(s1, s2) of rfc7616 of an algorithm.
+func h2(algorithm, s1, s2 string) string {
+	return hashhex(algorithm, fmt.Sprintf("%s:%s", s1, s2))
+}
@@ -0,0 +1,97 @@
+package httpDigestAuthentication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// StrongestChallenge parses challenges of WWW-Authenticate header values and returns the one
+// with the strongest algorithm that usable says a client can answer. Challenges without qop "auth" are skipped.
+// A server sends a challenge for every algorithm it supports.
+func StrongestChallenge(wwwauthenticate []string, usable func(algorithm string) bool) (*ChallengeToClient, error) {
+	const op = "httpDigestAuthentication.StrongestChallenge()"
+	var best *CredentialsFromClient
+	for _, v := range wwwauthenticate {
+		if !strings.HasPrefix(v, "Digest ") {
+			continue
+		}
+		ch, err := ParseStringIntoStruct(v)
+		if err != nil || strength(ch.Algorithm) == 0 || !usable(CanonicalAlgorithm(ch.Algorithm)) {
+			continue
+		}
+		hasauth := false
+		for _, q := range strings.Split(ch.Qop, ",") {
+			hasauth = hasauth || strings.TrimSpace(q) == "auth"
+		}
+		if !hasauth {
+			continue
+		}
+		ch.Qop = "auth"
+		if best == nil || strength(ch.Algorithm) > strength(best.Algorithm) {
+			best = ch
+		}
+	}
+	if best == nil {
+		return nil, Error.E(op, nil, errBadDigestAlgorithm, 0, "no usable digest challenge")
+	}
+	best.Algorithm = CanonicalAlgorithm(best.Algorithm)
+	return &best.ChallengeToClient, nil
+}
+
+// ClientAuthorization answers a digest challenge in requests of a client.
+// Every request gets the next nonce count and a new cnonce. It is safe for concurrent use.
+type ClientAuthorization struct {
+	challenge                 ChallengeToClient
+	username                  string
+	hashUsernameRealmPassword string
+
+	mu sync.Mutex
+	nc uint32
+}
+
+// NewClientAuthorization returns a ClientAuthorization of a user with a hash of the password for the challenge algorithm.
+func NewClientAuthorization(challenge *ChallengeToClient, username, hashUsernameRealmPassword string) *ClientAuthorization {
+	return &ClientAuthorization{challenge: *challenge, username: username, hashUsernameRealmPassword: hashUsernameRealmPassword}
+}
+
+// Algorithm is the algorithm of the challenge.
+func (a *ClientAuthorization) Algorithm() string {
+	return a.challenge.Algorithm
+}
+
+// Authorize returns an Authorization header of a request with method and uri (a request target, ex. /upload/zahar?filename=a)
+// and a prove a server must send back in KeyProvePeerHasRightPasswordhash.
+func (a *ClientAuthorization) Authorize(method, uri string) (authorization, prove string, err error) {
+	a.mu.Lock()
+	a.nc++
+	nc := a.nc
+	a.mu.Unlock()
+
+	cnonce := make([]byte, 16)
+	if _, err := rand.Read(cnonce); err != nil {
+		return "", "", err
+	}
+	creds := CredentialsFromClient{
+		ChallengeToClient: a.challenge,
+		Username:          a.username,
+		URI:               uri,
+		NonceCount:        fmt.Sprintf("%08x", nc),
+		Cnonce:            hex.EncodeToString(cnonce),
+		Method:            method,
+	}
+	creds.Domain, creds.Stale, creds.Userhash = "", "", ""
+	if a.challenge.Userhash == "true" {
+		creds.Username = Userhash(creds.Algorithm, a.username, creds.Realm)
+		creds.Userhash = "true"
+	}
+	creds.Response, err = GenerateResponseAuthorizationParameter(a.hashUsernameRealmPassword, &creds)
+	if err != nil {
+		return "", "", err
+	}
+	return GenerateAuthorization(&creds), ProveThatPeerHasRightPasswordhashWith(creds.Algorithm, a.hashUsernameRealmPassword, creds.Response), nil
+}
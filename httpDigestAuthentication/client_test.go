@@ -0,0 +1,72 @@
+package httpDigestAuthentication
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStrongestChallenge(t *testing.T) {
+	challenges := []string{
+		`Basic realm="upload"`,
+		`Digest realm="upload", nonce="n", algorithm=MD5, qop="auth"`,
+		`Digest realm="upload", nonce="n", algorithm=SHA-256, userhash=true, qop="auth-int, auth"`,
+		`Digest realm="upload", nonce="n", algorithm=SHA-512-256, qop="auth-int"`,
+		`Digest realm="upload", nonce="n", algorithm=SHA-512-256-sess, qop="auth"`,
+	}
+	all := func(string) bool { return true }
+	tests := []struct {
+		name    string
+		usable  func(string) bool
+		want    string
+		wantErr bool
+	}{
+		{"strongest with qop auth", all, AlgorithmSHA256, false},
+		{"md5 only", func(alg string) bool { return alg == AlgorithmMD5 }, AlgorithmMD5, false},
+		{"none usable", func(string) bool { return false }, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StrongestChallenge(challenges, tt.usable)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StrongestChallenge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Algorithm != tt.want || got.Qop != "auth") {
+				t.Errorf("StrongestChallenge() = %+v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAuthorization(t *testing.T) {
+	nonces := NewNonces(time.Minute)
+	for _, alg := range Algorithms {
+		challenge := ChallengeToClient{Realm: "upload", Nonce: nonces.New(), Algorithm: alg, Qop: "auth", Userhash: "true"}
+		ha1, _ := HashUsernameRealmPasswordWith(alg, "zahar", "upload", "pass")
+		auth := NewClientAuthorization(&challenge, "zahar", ha1)
+		for i := 1; i <= 2; i++ {
+			authorization, prove, err := auth.Authorize("POST", "/upload/zahar?filename=a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds, err := ParseStringIntoStruct(authorization)
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds.Method = "POST"
+			if creds.Username != Userhash(alg, "zahar", "upload") || creds.NonceCount != fmt.Sprintf("%08x", i) {
+				t.Errorf("%s: Authorize() sent username %s and nc %s", alg, creds.Username, creds.NonceCount)
+			}
+			ok, err := CheckCredentialsFromClient(&challenge, creds, ha1)
+			if !ok || err != nil {
+				t.Errorf("%s: CheckCredentialsFromClient() of Authorize() = %v, %v", alg, ok, err)
+			}
+			if want := ProveThatPeerHasRightPasswordhashWith(alg, ha1, creds.Response); prove != want {
+				t.Errorf("%s: Authorize() prove = %s, want %s", alg, prove, want)
+			}
+			if !nonces.UseCount(creds.Nonce, creds.NonceCount) {
+				t.Errorf("%s: UseCount(%s) of a new count = false", alg, creds.NonceCount)
+			}
+		}
+	}
+}
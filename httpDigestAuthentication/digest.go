@@ -1,13 +1,11 @@
-// Package httpDigestAuthentication implements server side of rfc2617: HTTP Authentication: Digest Access Authentication.
+// Package httpDigestAuthentication implements rfc7616 (and older rfc2617): HTTP Digest Access Authentication.
+// Algorithms are MD5, SHA-256 and SHA-512-256, qop is "auth".
 package httpDigestAuthentication
 
 // to debug run: ./uploader.exe --file ./testbackups/sendfile.rar
 import (
 	"bytes"
-	"crypto/md5"
 	"fmt"
-	"io"
-	"math/rand"
 	"strings"
 
 	Error "github.com/zavla/upload/errstr"
@@ -22,6 +20,9 @@ type ChallengeToClient struct {
 	Stale     string
 	Algorithm string
 	Qop       string
+	// Userhash "true" in a challenge says a server supports hashed user names,
+	// in credentials it says Username is a hash of username:realm.
+	Userhash string
 }
 
 // CredentialsFromClient is used to hold digest parameters that a client returned us.
@@ -35,6 +36,13 @@ type CredentialsFromClient struct {
 	Response   string
 }
 
+// quoted writes a quoted string value of a parameter.
+func quoted(b *bytes.Buffer, v string) {
+	b.WriteByte('"')
+	b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v))
+	b.WriteByte('"')
+}
+
 // GenerateAuthorization creates a http digest Authorization header at client side.
 func GenerateAuthorization(c *CredentialsFromClient) string {
 	//Digest username="zahar",realm="upload",nonce="72e86b2fb36b49f5521600618fee56bb",uri="/upload/zahar",cnonce="6bedbcd39a03430202a75c2e6602725b",nc=00000001,algorithm=MD5,response="cc03ba528bd9b48981689a7941fb9c91",qop="auth"
@@ -42,22 +50,22 @@ func GenerateAuthorization(c *CredentialsFromClient) string {
 	b.WriteString("Digest ")
 
 	b.WriteString("username=")
-	b.WriteString(c.Username)
+	quoted(b, c.Username)
 
 	b.WriteString(", realm=")
-	b.WriteString(c.Realm)
+	quoted(b, c.Realm)
 
 	if c.Nonce != "" {
 		b.WriteString(", nonce=")
-		b.WriteString(c.Nonce)
+		quoted(b, c.Nonce)
 	}
 	if c.URI != "" {
 		b.WriteString(", uri=")
-		b.WriteString(c.URI)
+		quoted(b, c.URI)
 	}
 
 	b.WriteString(", cnonce=")
-	b.WriteString(c.Cnonce)
+	quoted(b, c.Cnonce)
 
 	if c.NonceCount != "" {
 		b.WriteString(", nc=")
@@ -65,18 +73,18 @@ func GenerateAuthorization(c *CredentialsFromClient) string {
 	}
 	if c.Opaque != "" {
 		b.WriteString(", opaque=")
-		b.WriteString(c.Opaque)
-	}
-	if c.Stale != "" {
-		b.WriteString(", stale=")
-		b.WriteString(c.Stale)
+		quoted(b, c.Opaque)
 	}
 	if c.Algorithm != "" {
 		b.WriteString(", algorithm=")
 		b.WriteString(c.Algorithm)
 	}
+	if c.Userhash != "" {
+		b.WriteString(", userhash=")
+		b.WriteString(c.Userhash)
+	}
 	b.WriteString(", response=")
-	b.WriteString(c.Response)
+	quoted(b, c.Response)
 
 	b.WriteString(", qop=")
 	b.WriteString(c.Qop)
@@ -85,10 +93,25 @@ func GenerateAuthorization(c *CredentialsFromClient) string {
 }
 
 // HashUsernameRealmPassword returns a string that one may save to a password database.
+// It is a hash for the MD5 algorithm.
 func HashUsernameRealmPassword(username, realm, password string) string {
 	return md5hex(fmt.Sprintf("%s:%s:%s", username, realm, password))
 }
 
+// HashUsernameRealmPasswordWith returns a hash of a password for a digest algorithm.
+func HashUsernameRealmPasswordWith(algorithm, username, realm, password string) (string, error) {
+	const op = "httpDigestAuthentication.HashUsernameRealmPasswordWith()"
+	if CanonicalAlgorithm(algorithm) == "" {
+		return "", Error.E(op, nil, errBadDigestAlgorithm, 0, algorithm)
+	}
+	return hashhex(algorithm, fmt.Sprintf("%s:%s:%s", username, realm, password)), nil
+}
+
+// Userhash returns a hashed user name: H(username:realm).
+func Userhash(algorithm, username, realm string) string {
+	return hashhex(algorithm, fmt.Sprintf("%s:%s", username, realm))
+}
+
 // GenerateWWWAuthenticate 	generates the "WWW-Authenticate" header that holds http digest authentication challenge.
 // Used on server side.
 // Returns for example: 'Digest realm=qweqwe, nonce=qweqwe, opaque=qweqwe, stale=qweqwe, algorithm=md5, domain=qweqwe, qop=qweqwe'
@@ -97,18 +120,18 @@ func GenerateWWWAuthenticate(c *ChallengeToClient) string {
 	b := &bytes.Buffer{}
 	b.WriteString("Digest ")
 	b.WriteString("realm=")
-	b.WriteString(c.Realm)
+	quoted(b, c.Realm)
 	if c.Domain != "" {
 		b.WriteString(", domain=")
-		b.WriteString(c.Domain)
+		quoted(b, c.Domain)
 	}
 	if c.Nonce != "" {
 		b.WriteString(", nonce=")
-		b.WriteString(c.Nonce)
+		quoted(b, c.Nonce)
 	}
 	if c.Opaque != "" {
 		b.WriteString(", opaque=")
-		b.WriteString(c.Opaque)
+		quoted(b, c.Opaque)
 	}
 	if c.Stale != "" {
 		b.WriteString(", stale=")
@@ -118,9 +141,13 @@ func GenerateWWWAuthenticate(c *ChallengeToClient) string {
 		b.WriteString(", algorithm=")
 		b.WriteString(c.Algorithm)
 	}
+	if c.Userhash != "" {
+		b.WriteString(", userhash=")
+		b.WriteString(c.Userhash)
+	}
 	// We require c.Qop, this gives us that a client side returns a cnonce value.
 	b.WriteString(", qop=")
-	b.WriteString(c.Qop)
+	quoted(b, c.Qop)
 
 	return b.String()
 }
@@ -129,8 +156,8 @@ func GenerateWWWAuthenticate(c *ChallengeToClient) string {
 // It is used at server side.
 func CheckCredentialsFromClient(c *ChallengeToClient, creds *CredentialsFromClient, hashUsernameRealmPassword string) (bool, error) {
 	const op = "httpDigestAuthentication.CheckCredentialsFromClient()"
-	if creds.Algorithm != "MD5" {
-		return false, Error.E(op, nil, errBadDigestAlgorithm, 0, "")
+	if CanonicalAlgorithm(creds.Algorithm) == "" {
+		return false, Error.E(op, nil, errBadDigestAlgorithm, 0, creds.Algorithm)
 	}
 
 	if c.Nonce != creds.Nonce || c.Opaque != creds.Opaque || c.Realm != creds.Realm {
@@ -148,12 +175,39 @@ func CheckCredentialsFromClient(c *ChallengeToClient, creds *CredentialsFromClie
 	return true, nil
 }
 
+// splitParameters splits parameters of a header by commas outside of quoted strings.
+// Quotes of values are removed.
+func splitParameters(s string) []string {
+	var ret []string
+	b := &strings.Builder{}
+	inquotes, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case inquotes && r == '\\':
+			escaped = true
+			continue
+		case r == '"':
+			inquotes = !inquotes
+			continue
+		case r == ',' && !inquotes:
+			ret = append(ret, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return append(ret, b.String())
+}
+
 // ParseStringIntoStruct extracts digest parameters from string.
 // It is used both at server and client side to create a struct with extracted parameters.
+// Unknown parameters are ignored.
 func ParseStringIntoStruct(input string) (*CredentialsFromClient, error) {
 	const op = "httpDigestAuthentication.parseStringToCredentialsFromClient()"
 	ret := &CredentialsFromClient{}
-	const quote = `"'`
+	const quote = `'`
 	if !strings.HasPrefix(input, "Digest ") {
 		return ret, Error.E(op, nil, errBadAuthorization, 0, "")
 	}
@@ -165,12 +219,12 @@ func ParseStringIntoStruct(input string) (*CredentialsFromClient, error) {
 		return r
 	}, input[7:])
 
-	sl := strings.Split(s, ",")
+	sl := splitParameters(s)
 	for _, kv := range sl {
 		posEq := strings.IndexRune(kv, '=')
 		if posEq >= 0 {
-			k := strings.TrimSpace(kv[:posEq])
-			v := strings.Trim(kv[posEq+1:], quote)
+			k := strings.ToLower(strings.TrimSpace(kv[:posEq]))
+			v := strings.Trim(strings.TrimSpace(kv[posEq+1:]), quote)
 			switch k {
 			case "realm":
 				ret.Realm = v
@@ -199,33 +253,25 @@ func ParseStringIntoStruct(input string) (*CredentialsFromClient, error) {
 				ret.Username = v
 			case "method":
 				ret.Method = v
-
-			default:
-				return ret, Error.E(op, nil, errBadAuthorization, 0, "")
+			case "userhash":
+				ret.Userhash = v
 			}
 		}
 	}
 	return ret, nil
 }
 
-func md5hex(s string) string {
-	h := md5.New()
-	_, _ = io.WriteString(h, s)
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-func h2(s1, s2 string) string {
-	return md5hex(fmt.Sprintf("%s:%s", s1, s2))
-}
-
 // GenerateResponseAuthorizationParameter creates 'response' parameter.
 // Server side uses it to validate clients response.
 // Client side uses it to create 'response' parameter.
 // On server side the cr *CredentialsFromClient is used to get all input parameters and _must_ be previously checked against ChallengeToClient.
 func GenerateResponseAuthorizationParameter(hashUsernameRealmPassword string, cr *CredentialsFromClient) (string, error) {
 	const op = "httpDigestAuthentication.GenerateAuthorizationString()"
+	if CanonicalAlgorithm(cr.Algorithm) == "" {
+		return "", Error.E(op, nil, errBadDigestAlgorithm, 0, cr.Algorithm)
+	}
 	// don't forget to fill cr.Method
-	hashOfMethodAndURI := h2(cr.Method, cr.URI)
+	hashOfMethodAndURI := h2(cr.Algorithm, cr.Method, cr.URI)
 	s2 := ""
 	switch cr.Qop {
 	case "auth":
@@ -235,11 +281,11 @@ func GenerateResponseAuthorizationParameter(hashUsernameRealmPassword string, cr
 	case "":
 		s2 = fmt.Sprintf("%s:%s", cr.Nonce, hashOfMethodAndURI)
 	default:
-		return string(rand.Int()), Error.E(op, nil, errUnsupportedMessageQop, 0, "")
+		return "", Error.E(op, nil, errUnsupportedMessageQop, 0, "")
 
 	}
 
-	return h2(hashUsernameRealmPassword, s2), nil
+	return h2(cr.Algorithm, hashUsernameRealmPassword, s2), nil
 
 }
 
@@ -248,6 +294,12 @@ var KeyProvePeerHasRightPasswordhash = "X-ProveThatPeerHasTheRightHash"
 
 // ProveThatPeerHasRightPasswordhash is used by clients to ask the server to prove that it has the write passwordhash.
 // That is the server didn't just answered 'OK' on our authorization.
+// It is the prove of the MD5 algorithm.
 func ProveThatPeerHasRightPasswordhash(hashUsernameRealmPassword, ResponseFromClient string) string {
-	return h2(hashUsernameRealmPassword, ResponseFromClient)
+	return h2(AlgorithmMD5, hashUsernameRealmPassword, ResponseFromClient)
+}
+
+// ProveThatPeerHasRightPasswordhashWith is ProveThatPeerHasRightPasswordhash of a digest algorithm.
+func ProveThatPeerHasRightPasswordhashWith(algorithm, hashUsernameRealmPassword, ResponseFromClient string) string {
+	return h2(algorithm, hashUsernameRealmPassword, ResponseFromClient)
 }
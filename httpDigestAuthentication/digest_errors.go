@@ -8,6 +8,8 @@ const (
 	errClientHasMangledChallenge
 	errBadDigestResponse
 	errUnsupportedMessageQop
+	// ErrServerDidntProvePasswordhash is returned by Transport when a response has a wrong prove.
+	ErrServerDidntProvePasswordhash
 )
 
 func init() {
@@ -16,4 +18,5 @@ func init() {
 	Error.I18[errClientHasMangledChallenge] = "Client returned mangled challenge parameters."
 	Error.I18[errBadDigestResponse] = "Bad authorization string from client."
 	Error.I18[errUnsupportedMessageQop] = "Bad Qop field from client."
+	Error.I18[ErrServerDidntProvePasswordhash] = "Server didn't prove it has the right password hash."
 }
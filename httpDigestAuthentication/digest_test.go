@@ -96,6 +96,27 @@ func TestGenerateAuthorizationResponseParameter(t *testing.T) {
 			want:    "6629fae49393a05397450978507c4ef1",
 			wantErr: false,
 		},
+		{name: "rfc7616 MD5",
+			args: args{
+				hashUsernameRealmPassword: HashUsernameRealmPassword("Mufasa", "http-auth@example.org", "Circle of Life"),
+				cr:                        rfc7616Credentials(AlgorithmMD5),
+			},
+			want: "8ca523f5e9506fed4657c9700eebdbec",
+		},
+		{name: "rfc7616 SHA-256",
+			args: args{
+				hashUsernameRealmPassword: rfc7616Hash(AlgorithmSHA256),
+				cr:                        rfc7616Credentials(AlgorithmSHA256),
+			},
+			want: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+		{name: "unknown algorithm",
+			args: args{
+				hashUsernameRealmPassword: rfc7616Hash(AlgorithmSHA256),
+				cr:                        rfc7616Credentials("SHA-256-sess"),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -110,3 +131,43 @@ func TestGenerateAuthorizationResponseParameter(t *testing.T) {
 		})
 	}
 }
+
+// rfc7616Credentials are credentials of the example of rfc7616 3.9.1.
+func rfc7616Credentials(algorithm string) CredentialsFromClient {
+	return CredentialsFromClient{
+		ChallengeToClient: ChallengeToClient{
+			Realm:     "http-auth@example.org",
+			Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			Opaque:    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+			Algorithm: algorithm,
+			Qop:       "auth",
+		},
+		Username:   "Mufasa",
+		URI:        "/dir/index.html",
+		NonceCount: "00000001",
+		Cnonce:     "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		Method:     "GET",
+	}
+}
+
+func rfc7616Hash(algorithm string) string {
+	h, _ := HashUsernameRealmPasswordWith(algorithm, "Mufasa", "http-auth@example.org", "Circle of Life")
+	return h
+}
+
+func TestGenerateAuthorizationRoundTrip(t *testing.T) {
+	cr := rfc7616Credentials(AlgorithmSHA512_256)
+	cr.Username = `Mu"fa\sa`
+	cr.Userhash = "true"
+	cr.Response = "abc"
+	got, err := ParseStringIntoStruct(GenerateAuthorization(&cr))
+	cr.Method = "" // is not sent
+	if err != nil || !reflect.DeepEqual(*got, cr) {
+		t.Errorf("ParseStringIntoStruct(GenerateAuthorization()) \n\tgot = %+v, %v\n\twant %+v", got, err, cr)
+	}
+	ch := ChallengeToClient{Realm: "a, b", Domain: "upload.com", Nonce: "n", Stale: "true", Algorithm: AlgorithmSHA256, Qop: "auth", Userhash: "true"}
+	gotch, err := ParseStringIntoStruct(GenerateWWWAuthenticate(&ch))
+	if err != nil || gotch.ChallengeToClient != ch {
+		t.Errorf("ParseStringIntoStruct(GenerateWWWAuthenticate()) = %+v, %v, want %+v", gotch, err, ch)
+	}
+}
@@ -0,0 +1,132 @@
+package httpDigestAuthentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ncWindowLen is a count of the last nonce counts Nonces remembers, requests may come out of order within it.
+const ncWindowLen = 64
+
+// Nonces issues random server nonces with a limited lifetime and tracks nonce counts of them.
+// A nonce holds its time of issue and is signed by a secret of Nonces,
+// so a server keeps state only for nonces clients have authorized with.
+type Nonces struct {
+	// Lifetime of a nonce, after it a client gets stale=true and must use a new nonce.
+	Lifetime time.Duration
+
+	secret []byte
+	mu     sync.Mutex
+	used   map[string]*ncWindow
+	swept  time.Time // the time of the last sweep of expired nonces
+}
+
+// ncWindow holds nonce counts used with a nonce: the maximum one and a bit for each of ncWindowLen counts below it.
+type ncWindow struct {
+	max     uint64
+	seen    uint64
+	expires time.Time
+}
+
+// NewNonces returns Nonces with a new random secret.
+func NewNonces(lifetime time.Duration) *Nonces {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err) // no randomness, no security
+	}
+	return &Nonces{Lifetime: lifetime, secret: secret, used: make(map[string]*ncWindow)}
+}
+
+// sign is a signature of a nonce body.
+func (n *Nonces) sign(body []byte) []byte {
+	m := hmac.New(sha256.New, n.secret)
+	m.Write(body)
+	return m.Sum(nil)[:16]
+}
+
+// New returns a new nonce: hex of a time of issue, random bytes and a signature.
+func (n *Nonces) New() string {
+	b := make([]byte, 16, 32)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	if _, err := rand.Read(b[8:16]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(append(b, n.sign(b)...))
+}
+
+// issued returns a time a nonce was issued by n, ok is false for nonces of others.
+func (n *Nonces) issued(nonce string) (t time.Time, ok bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 32 || !hmac.Equal(b[16:], n.sign(b[:16])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// Check says a nonce was issued by n, stale is true when its lifetime is over.
+func (n *Nonces) Check(nonce string) (issued, stale bool) {
+	t, ok := n.issued(nonce)
+	if !ok {
+		return false, false
+	}
+	return true, time.Since(t) > n.Lifetime
+}
+
+// UseCount records a nonce count nc (8 hex digits) of a nonce issued by n.
+// Returns false when the count was used already, is too old or is not a count.
+func (n *Nonces) UseCount(nonce, nc string) bool {
+	count, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || len(nc) != 8 || count == 0 {
+		return false
+	}
+	t, ok := n.issued(nonce)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.swept) > n.Lifetime {
+		for k, w := range n.used {
+			if now.After(w.expires) {
+				delete(n.used, k)
+			}
+		}
+		n.swept = now
+	}
+	w := n.used[nonce]
+	if w == nil {
+		w = &ncWindow{expires: t.Add(n.Lifetime)}
+		n.used[nonce] = w
+	}
+	return w.use(count)
+}
+
+// use records a count, returns false when it is seen already or is older then the window.
+func (w *ncWindow) use(count uint64) bool {
+	switch {
+	case count > w.max:
+		if shift := count - w.max; shift >= ncWindowLen {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.max = count
+		return true
+	case w.max-count >= ncWindowLen:
+		return false
+	}
+	bit := uint64(1) << (w.max - count)
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
@@ -0,0 +1,59 @@
+package httpDigestAuthentication
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNoncesCheck(t *testing.T) {
+	n := NewNonces(time.Minute)
+	nonce := n.New()
+	if nonce == n.New() {
+		t.Errorf("New() returned the same nonce twice")
+	}
+	if issued, stale := n.Check(nonce); !issued || stale {
+		t.Errorf("Check() of a new nonce = %v, %v", issued, stale)
+	}
+	if issued, _ := NewNonces(time.Minute).Check(nonce); issued {
+		t.Errorf("Check() of a nonce of another secret = issued")
+	}
+	forged := []byte(nonce)
+	forged[0] ^= 1
+	if issued, _ := n.Check(string(forged)); issued {
+		t.Errorf("Check() of a changed nonce = issued")
+	}
+	n.Lifetime = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if issued, stale := n.Check(nonce); !issued || !stale {
+		t.Errorf("Check() of an expired nonce = %v, %v", issued, stale)
+	}
+}
+
+func TestNoncesUseCount(t *testing.T) {
+	n := NewNonces(time.Minute)
+	nonce := n.New()
+	tests := []struct {
+		nc   string
+		want bool
+	}{
+		{"00000001", true},
+		{"00000001", false}, // replay
+		{"00000003", true},
+		{"00000002", true}, // out of order
+		{"00000002", false},
+		{"00000000", false},
+		{"1", false},
+		{"0000000g", false},
+		{"00000100", true},
+		{"00000004", false}, // older then the window
+		{"000000c1", true},
+	}
+	for _, tt := range tests {
+		if got := n.UseCount(nonce, tt.nc); got != tt.want {
+			t.Errorf("UseCount(%s) = %v, want %v", tt.nc, got, tt.want)
+		}
+	}
+	if n.UseCount("00"+nonce[2:], "00000001") {
+		t.Errorf("UseCount() of a nonce not issued = true")
+	}
+}
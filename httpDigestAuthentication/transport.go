@@ -0,0 +1,135 @@
+package httpDigestAuthentication
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// Transport is an http.RoundTripper that answers digest challenges of a server.
+// After the first challenge every request is authorized with the cached challenge and the next nonce count,
+// a new challenge (ex. stale=true) replaces the cached one.
+// Responses to authorized requests must carry KeyProvePeerHasRightPasswordhash,
+// a wrong prove is an error. Responses to requests that were not authorized lose this header,
+// so a response with it is a verified one.
+type Transport struct {
+	Username string
+	// Password or PasswordHashes, hashes of username:realm:password by algorithm, ex. "SHA-256".
+	Password       string
+	PasswordHashes map[string]string
+
+	// Base makes actual requests, http.DefaultTransport when nil.
+	Base http.RoundTripper
+
+	mu   sync.Mutex
+	auth *ClientAuthorization
+}
+
+// NewTransport returns a Transport of a user with a password over base.
+func NewTransport(base http.RoundTripper, username, password string) *Transport {
+	return &Transport{Username: username, Password: password, Base: base}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// usable says if the Transport can answer a challenge of an algorithm.
+func (t *Transport) usable(algorithm string) bool {
+	return t.Password != "" || t.PasswordHashes[algorithm] != ""
+}
+
+// passwordhashOf is a hash of the password for a challenge.
+func (t *Transport) passwordhashOf(challenge *ChallengeToClient) string {
+	if t.Password != "" {
+		h, _ := HashUsernameRealmPasswordWith(challenge.Algorithm, t.Username, challenge.Realm, t.Password)
+		return h
+	}
+	return t.PasswordHashes[challenge.Algorithm]
+}
+
+func (t *Transport) cached() *ClientAuthorization {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.auth
+}
+
+// RoundTrip sends a request, it repeats it once with a new challenge after 401 Unauthorized.
+// A request with a body is repeated only when its GetBody is set, otherwise the 401 response is returned.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := t.cached()
+	resp, err := t.send(req, auth)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge, errch := StrongestChallenge(resp.Header.Values("WWW-Authenticate"), t.usable)
+	if errch != nil {
+		return resp, nil // not our challenge, a caller decides
+	}
+	newauth := NewClientAuthorization(challenge, t.Username, t.passwordhashOf(challenge))
+	t.mu.Lock()
+	if t.auth == auth {
+		t.auth = newauth // other requests may have replaced it already
+	}
+	t.mu.Unlock()
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil // the body is consumed, a caller repeats the request
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return t.send(req, newauth)
+}
+
+// send sends a request authorized by auth, when it is not nil, and checks a prove of the server.
+// A refusal the server sends before it checks a password has no prove, it is returned without one,
+// ex. 429 Too Many Requests of a lockout or 403 Forbidden of a disabled login.
+func (t *Transport) send(req *http.Request, auth *ClientAuthorization) (*http.Response, error) {
+	const op = "httpDigestAuthentication.Transport.RoundTrip()"
+	if auth == nil {
+		resp, err := t.base().RoundTrip(req)
+		if err == nil {
+			resp.Header.Del(KeyProvePeerHasRightPasswordhash) // nothing to prove
+		}
+		return resp, err
+	}
+	authorization, prove, err := auth.Authorize(req.Method, req.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	areq := req.Clone(req.Context()) // a RoundTripper must not modify a request, the clone keeps its Body
+	areq.Header.Set("Authorization", authorization)
+	resp, err := t.base().RoundTrip(areq)
+	if err != nil || resp.StatusCode == http.StatusUnauthorized {
+		return resp, err
+	}
+	if resp.Header.Get(KeyProvePeerHasRightPasswordhash) != prove {
+		if refusedBeforeAuthorization(resp.StatusCode) {
+			resp.Header.Del(KeyProvePeerHasRightPasswordhash)
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+		return nil, Error.E(op, nil, ErrServerDidntProvePasswordhash, 0, req.URL.Path)
+	}
+	return resp, nil
+}
+
+// refusedBeforeAuthorization says a status may come from a server before it checks a password:
+// anything but a success and 409 Conflict, clients act on those, so they must be proved.
+func refusedBeforeAuthorization(status int) bool {
+	return (status < 200 || status >= 300) && status != http.StatusConflict
+}
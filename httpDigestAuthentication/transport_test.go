@@ -0,0 +1,131 @@
+package httpDigestAuthentication
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// digestServer is a server of a user "zahar" with a password "pass" that counts 401 responses.
+type digestServer struct {
+	nonces       *Nonces
+	unauthorized int
+	badprove     bool
+	lockedOut    bool // authorized requests get 429 before their passwords are checked
+	expire       bool // the next nonce is stale
+}
+
+func (s *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	challenge := func(stale bool) {
+		for _, alg := range Algorithms {
+			ch := ChallengeToClient{Realm: "upload", Nonce: s.nonces.New(), Algorithm: alg, Qop: "auth", Userhash: "true"}
+			if stale {
+				ch.Stale = "true"
+			}
+			w.Header().Add("WWW-Authenticate", GenerateWWWAuthenticate(&ch))
+		}
+		s.unauthorized++
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if s.lockedOut && r.Header.Get("Authorization") != "" {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	creds, err := ParseStringIntoStruct(r.Header.Get("Authorization"))
+	if err != nil {
+		challenge(false)
+		return
+	}
+	creds.Method = r.Method
+	ha1, _ := HashUsernameRealmPasswordWith(creds.Algorithm, "zahar", "upload", "pass")
+	issued, stale := s.nonces.Check(creds.Nonce)
+	ok, _ := CheckCredentialsFromClient(&ChallengeToClient{Realm: "upload", Nonce: creds.Nonce}, creds, ha1)
+	if !issued || !ok || creds.Username != Userhash(creds.Algorithm, "zahar", "upload") || creds.URI != r.RequestURI {
+		challenge(false)
+		return
+	}
+	if stale || s.expire {
+		s.expire = false
+		challenge(true)
+		return
+	}
+	if !s.nonces.UseCount(creds.Nonce, creds.NonceCount) {
+		challenge(false)
+		return
+	}
+	prove := ProveThatPeerHasRightPasswordhashWith(creds.Algorithm, ha1, creds.Response)
+	if s.badprove {
+		prove = "bad"
+	}
+	w.Header().Set(KeyProvePeerHasRightPasswordhash, prove)
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Write(body)
+}
+
+func TestTransport(t *testing.T) {
+	s := &digestServer{nonces: NewNonces(time.Minute)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	tr := NewTransport(nil, "zahar", "pass")
+	cli := &http.Client{Transport: tr}
+
+	for i := 0; i < 3; i++ {
+		resp, err := cli.Post(srv.URL+"/upload/zahar?filename=a", "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "body" || resp.Header.Get(KeyProvePeerHasRightPasswordhash) == "" {
+			t.Errorf("request %d: %s %q", i, resp.Status, body)
+		}
+	}
+	if s.unauthorized != 1 || tr.auth.Algorithm() != AlgorithmSHA512_256 {
+		t.Errorf("Transport got %d challenges, answers with %s, want 1 and %s", s.unauthorized, tr.auth.Algorithm(), AlgorithmSHA512_256)
+	}
+
+	// a nonce expires, the request is repeated with a new one
+	s.expire = true
+	resp, err := cli.Get(srv.URL + "/upload/zahar")
+	if err != nil || resp.StatusCode != http.StatusOK || s.unauthorized != 2 {
+		t.Fatalf("a request with a stale nonce = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// a body without GetBody is not repeated
+	tr.auth = nil
+	req, _ := http.NewRequest("POST", srv.URL+"/upload/zahar", ioutil.NopCloser(strings.NewReader("body")))
+	if resp, err := cli.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a request with a consumed body = %v, %v, want 401", resp, err)
+	}
+
+	s.badprove = true
+	_, err = cli.Get(srv.URL + "/upload/zahar")
+	var errProve *Error.Error
+	if !errors.As(err, &errProve) || errProve.Code != ErrServerDidntProvePasswordhash {
+		t.Errorf("a request to a server with a wrong prove = %v", err)
+	}
+
+	// a lockout comes before a password check, without a prove
+	s.badprove = false
+	s.lockedOut = true
+	resp, err = cli.Get(srv.URL + "/upload/zahar")
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Fatalf("an authorized request of a locked out login = %v, %v, want 429", resp, err)
+	}
+	resp.Body.Close()
+	s.lockedOut = false
+
+	// a wrong password
+	wrong := &http.Client{Transport: NewTransport(nil, "zahar", "wrong")}
+	if resp, err := wrong.Get(srv.URL + "/upload/zahar"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a request with a wrong password = %v, %v, want 401", resp, err)
+	}
+}
@@ -13,15 +13,21 @@ const KeysessionID = "sessionId"
 const (
 	ErrSuccessfullUpload = iota + Error.ErrorsCodesPackageLiteImp
 	ErrUploadIsNotAllowed
+	// ErrQuotaExceeded comes with http.StatusInsufficientStorage, clients must not retry.
+	ErrQuotaExceeded
+	// ErrNoFreeSpace comes with http.StatusInsufficientStorage when a volume of the service has no space for a new file.
+	ErrNoFreeSpace
 )
 
 type RequestForUpload struct {
 	Filename string `json:"filename" form:"filename"` // Url Query parameter
+	Filesize int64  `json:"filesize" form:"filesize"` // optional, a new upload is created at once
 }
 type QueryParamsToContinueUpload struct {
 	Filename    string `json:"filename" form:"filename"`
 	Startoffset int64  `json:"startoffset" form:"startoffset"`
 	Count       int64  `json:"count" form:"count"`
+	Filesize    int64  `json:"filesize" form:"filesize"` // optional, Startoffset and Count may be a range of the file
 }
 
 type JsonResponse struct {
@@ -29,9 +35,24 @@ type JsonResponse struct {
 	Count       int64 // expected bytes count
 }
 
+// Range is a range of bytes of a file.
+type Range struct {
+	Startoffset int64
+	Count       int64
+}
+
 // JsonFileStatus is used by clients
 type JsonFileStatus struct {
 	JsonResponse
+	// Missing are ranges the service has not got yet. Clients may send them in parallel.
+	// Old services do not send Missing.
+	Missing []Range `json:",omitempty"`
+}
+
+// JsonError is a response with an error, Code is one of errstr codes.
+type JsonError struct {
+	Error string `json:"error"`
+	Code  int16  `json:"code"`
 }
 
 //  RequestForlist defines how to ask for list of files.
@@ -7,4 +7,6 @@ import (
 func init() {
 	Error.I18[ErrUploadIsNotAllowed] = "Service doesn't allow to update the file."
 	Error.I18[ErrSuccessfullUpload] = "Upload successfull."
+	Error.I18[ErrQuotaExceeded] = "Storage quota of the user is exceeded."
+	Error.I18[ErrNoFreeSpace] = "Storage of the service has not enough free space for the file."
 }
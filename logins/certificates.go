@@ -0,0 +1,39 @@
+package logins
+
+import (
+	"crypto/x509"
+	"strings"
+)
+
+// CertificateNames returns names of a client certificate a login may be mapped to in Login.Certificates:
+// "CN=" with the subject common name, "DNS:", "email:" and "URI:" with subject alternative names.
+func CertificateNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		names = append(names, "CN="+cert.Subject.CommonName)
+	}
+	for _, n := range cert.DNSNames {
+		names = append(names, "DNS:"+n)
+	}
+	for _, n := range cert.EmailAddresses {
+		names = append(names, "email:"+n)
+	}
+	for _, u := range cert.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	return names
+}
+
+// MatchesCertificate says a client certificate is mapped to the login by one of its names.
+// DNS names and emails are compared case insensitive.
+func (l *Login) MatchesCertificate(cert *x509.Certificate) bool {
+	for _, n := range CertificateNames(cert) {
+		for _, want := range l.Certificates {
+			if n == want ||
+				(!strings.HasPrefix(n, "CN=") && !strings.HasPrefix(n, "URI:") && strings.EqualFold(n, want)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package logins
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestMatchesCertificate(t *testing.T) {
+	uri, _ := url.Parse("spiffe://backup/agent1")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "agent1"},
+		DNSNames:       []string{"agent1.example.com"},
+		EmailAddresses: []string{"Backup@example.com"},
+		URIs:           []*url.URL{uri},
+	}
+	tests := []struct {
+		certificates []string
+		want         bool
+	}{
+		{nil, false},
+		{[]string{"CN=agent1"}, true},
+		{[]string{"CN=Agent1"}, false},
+		{[]string{"agent1"}, false},
+		{[]string{"DNS:AGENT1.example.com"}, true},
+		{[]string{"email:backup@example.com"}, true},
+		{[]string{"URI:spiffe://backup/agent1"}, true},
+		{[]string{"URI:spiffe://backup/agent2", "CN=agent2"}, false},
+		{[]string{"CN=agent2", "DNS:agent1.example.com"}, true},
+	}
+	for _, tt := range tests {
+		l := Login{Login: "zahar", Certificates: tt.certificates}
+		if got := l.MatchesCertificate(cert); got != tt.want {
+			t.Errorf("MatchesCertificate() of a login with %q = %v, want %v", tt.certificates, got, tt.want)
+		}
+	}
+}
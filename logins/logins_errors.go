@@ -17,6 +17,8 @@ const (
 	errReadPassword
 	errLoginsManagerCantAdd
 	errLoginsManagerCantSave
+	errTokenCreationFailed
+	errTokenNotFound
 )
 
 func init() {
@@ -29,4 +31,6 @@ func init() {
 	Error.I18[errReadPassword] = "Error while reading password."
 	Error.I18[errLoginsManagerCantAdd] = "Can't add a login."
 	Error.I18[errLoginsManagerCantSave] = "Can't save a login."
+	Error.I18[errTokenCreationFailed] = "Can't create a token."
+	Error.I18[errTokenNotFound] = "Token not found."
 }
@@ -20,6 +20,7 @@ var PasswordForTest string
 type Manager interface {
 	Save() error
 	Add(login string, email string, password string) (Login, error)
+	SetPasswordhashes(login string, hashes map[string]string) error
 	Find(login string, lockX bool) (*Login, int, error)
 	OpenDB(path string) error
 }
@@ -33,9 +34,57 @@ type Login struct {
 	Login        string `json:"id"` // unique id
 	Email        string `json:"email"`
 	Passwordhash string //md5hex("%s:%s:%s", username,realm,password)
-	Disabled     bool   `json:"disabled"`
-	mu           *sync.Mutex
+	// Passwordhashes are hashes of username:realm:password by other digest algorithms, ex. "SHA-256".
+	Passwordhashes map[string]string `json:"passwordhashes,omitempty"`
+	Disabled       bool              `json:"disabled"`
+	Quota          Quota             `json:"quota"`
+	Versions       Versions          `json:"versions,omitempty"`     // what an upload of an existing file name does
+	Tokens         []Token           `json:"tokens,omitempty"`       // API tokens for automation
+	Certificates   []string          `json:"certificates,omitempty"` // names of TLS client certificates, see CertificateNames
+	mu             *sync.Mutex
 }
+
+// PasswordhashOf returns a password hash of the login for a digest algorithm, "" when the login has none.
+func (l *Login) PasswordhashOf(algorithm string) string {
+	switch a := httpDigestAuthentication.CanonicalAlgorithm(algorithm); a {
+	case "":
+		return ""
+	case httpDigestAuthentication.AlgorithmMD5:
+		return l.Passwordhash
+	default:
+		return l.Passwordhashes[a]
+	}
+}
+
+// Versions is a policy of uploads of existing file names.
+type Versions string
+
+const (
+	// VersionsReject denies an upload of an existing file, it is the default.
+	VersionsReject Versions = ""
+	// VersionsKeep keeps a former file as a version when a new one completes.
+	VersionsKeep Versions = "keep"
+	// VersionsOverwrite replaces a former file when a new one completes.
+	VersionsOverwrite Versions = "overwrite"
+)
+
+// Quota limits a storage of a login. Zero values mean no limit.
+type Quota struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Files int64 `json:"files,omitempty"`
+}
+
+// Allows says a login with a storage of usedbytes in usedfiles files may add a file of size filesize.
+func (q Quota) Allows(usedbytes, usedfiles, filesize int64) bool {
+	if q.Files > 0 && usedfiles+1 > q.Files {
+		return false
+	}
+	if q.Bytes > 0 && usedbytes+filesize > q.Bytes {
+		return false
+	}
+	return true
+}
+
 type Logins struct {
 	Version      string  `json:"version"`
 	Logins       []Login `json:"logins"` // goes to disk
@@ -99,6 +148,18 @@ func (ls *Logins) Add(login string, email string, newhash string) (Login, error)
 
 }
 
+// SetPasswordhashes replaces password hashes of other digest algorithms than MD5 of an existing login.
+func (ls *Logins) SetPasswordhashes(login string, hashes map[string]string) error {
+	const op = "logins.SetPasswordhashes()"
+	l, _, err := ls.Find(login, true) // locks mu
+	if err != nil {
+		return Error.E(op, err, errLoginNotFound, 0, login)
+	}
+	l.Passwordhashes = hashes
+	l.mu.Unlock()
+	return nil
+}
+
 func (ls *Logins) Save() error {
 	return ls.writeLoginsJSON()
 }
@@ -148,13 +209,7 @@ func AskPassword(username string) ([]byte, error) {
 }
 func AskAndSavePasswordForHTTPDigest(loginsmanager Manager, loginobj Login, realm string) error {
 	const op = "logins.AskAndSavePasswordForHTTPDigest()"
-	fmt.Printf("\nEnter user '%s' password: ", loginobj.Login)
-	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	//DEBUG!!!
-	// password = []byte("pass")
-	// err = nil
-
-	fmt.Println("")
+	password, err := AskPassword(loginobj.Login)
 	if err != nil {
 		return Error.E(op, err, errReadPassword, 0, "")
 	}
@@ -163,6 +218,16 @@ func AskAndSavePasswordForHTTPDigest(loginsmanager Manager, loginobj Login, real
 	if err != nil {
 		return Error.E(op, err, errLoginsManagerCantAdd, 0, "")
 	}
+	// hashes of stronger algorithms
+	hashes := make(map[string]string)
+	for _, alg := range httpDigestAuthentication.Algorithms {
+		if alg != httpDigestAuthentication.AlgorithmMD5 {
+			hashes[alg], _ = httpDigestAuthentication.HashUsernameRealmPasswordWith(alg, loginobj.Login, realm, string(password))
+		}
+	}
+	if err := loginsmanager.SetPasswordhashes(loginobj.Login, hashes); err != nil {
+		return Error.E(op, err, errLoginsManagerCantAdd, 0, "")
+	}
 	err = loginsmanager.Save()
 	if err != nil {
 		return Error.E(op, err, errLoginsManagerCantSave, 0, "")
@@ -2,7 +2,9 @@ package logins
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/zavla/upload/httpDigestAuthentication"
@@ -150,3 +152,58 @@ func TestAskAndSavePasswordForHTTPDigest(t *testing.T) {
 		})
 	}
 }
+
+func TestAskAndSavePasswordForHTTPDigestAllAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "logins.json")
+	ls, _ := ReadLoginsJSON(filename) // not existent yet
+
+	PasswordForTest = "pass"
+	defer func() { PasswordForTest = "" }()
+	if err := AskAndSavePasswordForHTTPDigest(&ls, Login{Login: "zahar"}, "upload"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadLoginsJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _, err := saved.Find("zahar", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range httpDigestAuthentication.Algorithms {
+		want, _ := httpDigestAuthentication.HashUsernameRealmPasswordWith(alg, "zahar", "upload", "pass")
+		if got := l.PasswordhashOf(alg); got != want {
+			t.Errorf("PasswordhashOf(%s) = %q, want %q", alg, got, want)
+		}
+	}
+	if got := l.PasswordhashOf("MD5-sess"); got != "" {
+		t.Errorf("PasswordhashOf(MD5-sess) = %q, want none", got)
+	}
+}
+
+func TestQuotaAllows(t *testing.T) {
+	tests := []struct {
+		name                          string
+		quota                         Quota
+		usedbytes, usedfiles, newsize int64
+		want                          bool
+	}{
+		{"no quota", Quota{}, 1 << 40, 1000, 1 << 30, true},
+		{"bytes fit", Quota{Bytes: 100}, 60, 1, 40, true},
+		{"bytes exceeded", Quota{Bytes: 100}, 60, 1, 41, false},
+		{"files exceeded", Quota{Files: 2}, 0, 2, 0, false},
+		{"files fit", Quota{Files: 2, Bytes: 100}, 10, 1, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.quota.Allows(tt.usedbytes, tt.usedfiles, tt.newsize); got != tt.want {
+				t.Errorf("Quota.Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
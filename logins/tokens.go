@@ -0,0 +1,146 @@
+package logins
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// TokenScope limits requests an API token authorizes.
+type TokenScope string
+
+const (
+	// ScopeAll allows everything the login may do, it is the default.
+	ScopeAll TokenScope = ""
+	// ScopeUpload allows uploads only: POST, and HEAD, PATCH, OPTIONS of tus.io routes /files/.
+	ScopeUpload TokenScope = "upload"
+	// ScopeRead allows lists and downloads of files only: GET, HEAD, OPTIONS.
+	ScopeRead TokenScope = "read"
+)
+
+// ParseTokenScope returns a scope by its name: all, upload or read.
+func ParseTokenScope(s string) (TokenScope, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return ScopeAll, nil
+	case string(ScopeUpload):
+		return ScopeUpload, nil
+	case string(ScopeRead):
+		return ScopeRead, nil
+	}
+	return ScopeAll, fmt.Errorf("unknown token scope %q, use one of all, upload, read", s)
+}
+
+// Allows says a request with a method to a route of the service is in the scope, ex. route "/files/:login/:id".
+// HEAD of other routes than tus.io ones lists and probes stored files, so it is not an upload.
+func (s TokenScope) Allows(method, route string) bool {
+	switch s {
+	case ScopeAll:
+		return true
+	case ScopeUpload:
+		if strings.HasPrefix(route, "/files/") {
+			return method == "POST" || method == "PATCH" || method == "HEAD" || method == "OPTIONS"
+		}
+		return method == "POST"
+	case ScopeRead:
+		return method == "GET" || method == "HEAD" || method == "OPTIONS"
+	}
+	return false
+}
+
+// Token is an API token of a login, it goes in a header "Authorization: Bearer ID.SECRET".
+// Only a hash of the secret is stored.
+type Token struct {
+	ID      string     `json:"id"`
+	Hash    string     `json:"hash"` // hex of sha256 of the secret
+	Scope   TokenScope `json:"scope,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires time.Time  `json:"expires"` // zero time never expires
+}
+
+// Expired says the token can't be used at the time now.
+func (t *Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+func tokenHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AddToken creates a new token of an existing login. expires zero means the token never expires.
+// Returns the token and its bearer credential, the credential can't be restored later.
+func (ls *Logins) AddToken(login string, scope TokenScope, expires time.Time, comment string) (Token, string, error) {
+	const op = "logins.AddToken()"
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", Error.E(op, err, errTokenCreationFailed, 0, "")
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", Error.E(op, err, errTokenCreationFailed, 0, "")
+	}
+	l, _, err := ls.Find(login, true) // locks mu
+	if err != nil {
+		return Token{}, "", Error.E(op, err, errLoginNotFound, 0, login)
+	}
+	t := Token{
+		ID:      id,
+		Hash:    tokenHash(secret),
+		Scope:   scope,
+		Comment: comment,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Expires: expires,
+	}
+	l.Tokens = append(l.Tokens, t)
+	l.mu.Unlock()
+	return t, id + "." + secret, nil
+}
+
+// RevokeToken deletes a token of a login by its ID.
+func (ls *Logins) RevokeToken(login, id string) error {
+	const op = "logins.RevokeToken()"
+	l, _, err := ls.Find(login, true) // locks mu
+	if err != nil {
+		return Error.E(op, err, errLoginNotFound, 0, login)
+	}
+	defer l.mu.Unlock()
+	for i := range l.Tokens {
+		if l.Tokens[i].ID == id {
+			l.Tokens = append(l.Tokens[:i], l.Tokens[i+1:]...)
+			return nil
+		}
+	}
+	return Error.E(op, nil, errTokenNotFound, 0, id)
+}
+
+// CheckToken returns a token of the login a bearer credential "ID.SECRET" belongs to.
+// ok is false for unknown and expired tokens.
+func (l *Login) CheckToken(bearer string, now time.Time) (t Token, ok bool) {
+	dot := strings.IndexByte(bearer, '.')
+	if dot < 0 {
+		return Token{}, false
+	}
+	id, hash := bearer[:dot], tokenHash(bearer[dot+1:])
+	for _, tk := range l.Tokens {
+		if tk.ID == id && subtle.ConstantTimeCompare([]byte(tk.Hash), []byte(hash)) == 1 {
+			return tk, !tk.Expired(now)
+		}
+	}
+	return Token{}, false
+}
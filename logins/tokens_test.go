@@ -0,0 +1,110 @@
+package logins
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "logins.json")
+	ls, _ := ReadLoginsJSON(filename)
+	ls.Add("zahar", "", "hash")
+
+	now := time.Now()
+	forever, bearer, err := ls.AddToken("zahar", ScopeUpload, time.Time{}, "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, bearer2, _ := ls.AddToken("zahar", ScopeAll, now.Add(time.Hour), "")
+	if _, _, err := ls.AddToken("nobody", ScopeAll, time.Time{}, ""); err == nil {
+		t.Errorf("AddToken() of an unknown login must fail")
+	}
+	if err := ls.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ReadLoginsJSON(filename)
+	l, _, _ := saved.Find("zahar", false)
+
+	tests := []struct {
+		name   string
+		bearer string
+		now    time.Time
+		want   string // ID of a token, "" when none
+	}{
+		{"valid", bearer, now, forever.ID},
+		{"never expires", bearer, now.Add(100000 * time.Hour), forever.ID},
+		{"before expiry", bearer2, now, expiring.ID},
+		{"expired", bearer2, now.Add(time.Hour), ""},
+		{"wrong secret", forever.ID + ".00", now, ""},
+		{"secret of another token", forever.ID + bearer2[len(expiring.ID):], now, ""},
+		{"no id", "secret", now, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := l.CheckToken(tt.bearer, tt.now)
+			if ok != (tt.want != "") || ok && got.ID != tt.want {
+				t.Errorf("CheckToken() = %v, %v, want %q", got.ID, ok, tt.want)
+			}
+		})
+	}
+	if got, _ := l.CheckToken(bearer, now); got.Scope != ScopeUpload || got.Comment != "backups" || got.Hash == "" {
+		t.Errorf("CheckToken() = %+v after Save()", got)
+	}
+
+	if err := saved.RevokeToken("zahar", forever.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.CheckToken(bearer, now); ok {
+		t.Errorf("CheckToken() of a revoked token = true")
+	}
+	if err := saved.RevokeToken("zahar", forever.ID); err == nil {
+		t.Errorf("RevokeToken() of a revoked token must fail")
+	}
+}
+
+func TestTokenScopeAllows(t *testing.T) {
+	// requests are a method and a route
+	tests := []struct {
+		scope   string
+		allowed []string
+		denied  []string
+	}{
+		{"all", []string{"GET /upload/:login/*path", "POST /upload/:login", "DELETE /upload/:login/*path", "MOVE /upload/:login/*path"}, nil},
+		{"upload",
+			[]string{"POST /upload/:login", "POST /files/:login", "PATCH /files/:login/:id", "HEAD /files/:login/:id", "OPTIONS /files/:login"},
+			[]string{"GET /upload/:login/*path", "HEAD /upload/:login/*path", "DELETE /upload/:login/*path", "MOVE /upload/:login/*path", "DELETE /files/:login/:id"}},
+		{"read",
+			[]string{"GET /upload/:login/*path", "HEAD /upload/:login/*path", "OPTIONS /files/:login"},
+			[]string{"POST /upload/:login", "PATCH /files/:login/:id", "DELETE /upload/:login/*path", "MOVE /upload/:login/*path"}},
+	}
+	for _, tt := range tests {
+		scope, err := ParseTokenScope(tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range tt.allowed {
+			m := strings.SplitN(r, " ", 2)
+			if !scope.Allows(m[0], m[1]) {
+				t.Errorf("scope %s doesn't allow %s", tt.scope, r)
+			}
+		}
+		for _, r := range tt.denied {
+			m := strings.SplitN(r, " ", 2)
+			if scope.Allows(m[0], m[1]) {
+				t.Errorf("scope %s allows %s", tt.scope, r)
+			}
+		}
+	}
+	if _, err := ParseTokenScope("write"); err == nil {
+		t.Errorf("ParseTokenScope(\"write\") must fail")
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
@@ -25,14 +26,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
 
 	"github.com/zavla/upload/httpDigestAuthentication"
 	"github.com/zavla/upload/liteimp"
 
-	"github.com/google/uuid"
 	"github.com/secsy/goftp"
 )
 
@@ -44,7 +46,11 @@ type ConnectConfig struct {
 	Password string // TODO(zavla): check the cyrillic passwords
 	// OR you may specify a hash
 	PasswordHash string // one may already store a hash of password
-	Username     string
+	// PasswordHashes are hashes of a password for digest algorithms other then MD5, ex. "SHA-256".
+	PasswordHashes map[string]string
+	Username       string
+	// Token is an API token "ID.SECRET" of Username, it is used instead of a password.
+	Token string
 
 	// Certs is used in TLSConfig for the client to identify itself.
 	Certs []tls.Certificate
@@ -59,15 +65,70 @@ type ConnectConfig struct {
 	// DontUseFileAttribute allows scheme where there are two services that recieves the same files simultaniously.
 	// But one service is a master.
 	DontUseFileAttribute bool
+
+	// HashAlgorithm is an algorithm of a hash of a file the service checks after upload.
+	// The default SHA1 is understood by old services.
+	HashAlgorithm fsdriver.HashAlgorithm
+
+	// Parallel is a number of requests that send ranges of a big file at the same time.
+	// Values less then 2 mean a file is sent sequentially.
+	Parallel int
+
+	// BaseDir makes files beneath it be sent with their paths relative to it, ex. sub/file.bak.
+	// Services started with -keepDirs recreate these directories, others keep only file names.
+	BaseDir string
 }
 
+// nameOnService returns a name of a file the service gets: the base name
+// or a slash separated path relative to BaseDir.
+func (where *ConnectConfig) nameOnService(fullfilename string) string {
+	if where.BaseDir != "" {
+		rel, err := filepath.Rel(where.BaseDir, fullfilename)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(fullfilename)
+}
+
+// authTransport authorizes requests to a service over base with Token or answers digest challenges.
+func (where *ConnectConfig) authTransport(base http.RoundTripper) http.RoundTripper {
+	if where.Token != "" {
+		return &bearerTransport{token: where.Token, base: base}
+	}
+	t := httpDigestAuthentication.NewTransport(base, where.Username, where.Password)
+	if where.Password == "" {
+		t.PasswordHashes = map[string]string{httpDigestAuthentication.AlgorithmMD5: where.PasswordHash}
+		for alg, h := range where.PasswordHashes {
+			t.PasswordHashes[alg] = h
+		}
+	}
+	return t
+}
+
+// bearerTransport authorizes requests with an API token.
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	areq := req.Clone(req.Context()) // a RoundTripper must not modify a request
+	areq.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(areq)
+}
+
+// constMinRangeLen is the smallest range of a file sent in a parallel request.
+const constMinRangeLen = 16 * 1024 * 1024
+
 func redirectPolicyFunc(_ *http.Request, _ []*http.Request) error {
 
 	return nil
 }
 
 // FtpAFile send file to a ftp server.
-func FtpAFile(ctx context.Context, where *ConnectConfig, fullfilename string, bsha1 []byte) error {
+// bhash is a hash of the file computed with where.HashAlgorithm.
+func FtpAFile(ctx context.Context, where *ConnectConfig, fullfilename string, bhash []byte) error {
 	const op = "uploadclient.FtpAFile"
 	// TODO(zavla): make use of connections pool
 	serviceURL, _ := url.ParseRequestURI(where.ToURL) // error checked early already in main
@@ -130,11 +191,11 @@ func FtpAFile(ctx context.Context, where *ConnectConfig, fullfilename string, bs
 		log.Printf("goftp.MkDir failed: %s\r\n", err)
 	}
 	if err == nil {
-		// additinally send a file with sha1 in filename
-		ssha1 := make([]byte, hex.EncodedLen(len(bsha1)))
-		_ = hex.Encode(ssha1, bsha1)
+		// additinally send a file with a hash in filename, e.x. name.sha1_XXXX or name.sha256_XXXX
+		shash := make([]byte, hex.EncodedLen(len(bhash)))
+		_ = hex.Encode(shash, bhash)
 		pbf := bytes.NewBuffer([]byte{})
-		err = cftp.Store(filepath.Join(".sha1", remotefilename+".sha1_"+string(ssha1)), pbf)
+		err = cftp.Store(filepath.Join(".sha1", remotefilename+"."+where.HashAlgorithm.String()+"_"+string(shash)), pbf)
 		if err != nil {
 			log.Printf("gotftp.Store failed: %s\r\n", err)
 
@@ -166,12 +227,13 @@ func ftpDirExistsOrCreateDir(cftp *goftp.Client, dir string) error {
 
 // SendAFile sends file to a service Upload.
 // jar holds cookies from server http.Responses and use them in http.Requests
-func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, jar *cookiejar.Jar, bsha1 []byte) error {
+// bhash is a hash of the file computed with where.HashAlgorithm.
+func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, jar *cookiejar.Jar, bhash []byte) error {
 	// I use op as the first argument to Error.E()
 	const op = "uploadclient.sendAFile()"
 
 	// opens the file
-	_, name := filepath.Split(fullfilename)
+	name := where.nameOnService(fullfilename)
 	f, err := os.OpenFile(fullfilename, os.O_RDONLY, 0400)
 	if err != nil {
 		// let it be an error because the first time we send a file we should know its size.
@@ -210,10 +272,15 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 	req.Header.Add("Expect", "100-continue")   // client will not send body at once, it will wait for server response status "100-continue"
 	req.Header.Add("Connection", "keep-alive") // as we have at least two roundtrips for authorization
 
-	req.Header.Add("sha1", fmt.Sprintf("%x", bsha1))
+	req.Header.Add("Hash-Algorithm", where.HashAlgorithm.String())
+	req.Header.Add("Hash", fmt.Sprintf("%x", bhash))
+	if where.HashAlgorithm == fsdriver.SHA1 {
+		req.Header.Add("sha1", fmt.Sprintf("%x", bhash)) // old services know only this header
+	}
 
 	query := req.URL.Query()
 	query.Add("filename", name) // url parameter &filename
+	query.Add("filesize", strconv.FormatInt(filesize, 10))
 	req.URL.RawQuery = query.Encode()
 
 	// Use TLS if caller supplied us with root CA certificates and optional user certificates.
@@ -250,8 +317,8 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 		// Timeout > 0 do not allow client to upload big files.
 		// Timeout - we connected to ip port but didn't manage to read the whole response (headers and body) within Timeout
 		// I set timeout in every http.Request in the code above
-		Transport: tr,  // I don't use http.DefaultTransport
-		Jar:       jar, // http.Request uses jar to keep cookies (to hold sessionID)
+		Transport: where.authTransport(tr), // authorizes requests, I don't use http.DefaultTransport
+		Jar:       jar,                     // http.Request uses jar to keep cookies (to hold sessionID)
 	}
 
 	waitBeforeRetry := time.Duration(10) * time.Second
@@ -259,10 +326,9 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 	//waitForFileToBecomeAvailable := time.Duration(24) * time.Hour
 
 	ret := Error.E(op, err, errNumberOfRetriesExceeded, 0, "")
-	authorizationsent := false
 	// we expect from server to send a hash of passwordhash and our Response HTTP digest authorization header.
-	oneResponseFromServerHasAProveOfRightPasswordhash := false
-	savedProveServerHasRightPasswordhash := ""
+	// A token or a client certificate is not a password, a service has nothing to prove, its certificate is checked by TLS.
+	oneResponseFromServerHasAProveOfRightPasswordhash := where.Token != "" || len(where.Certs) > 0
 
 	log.Printf("sending %s\r\n", fullfilename)
 	// currentfilestatus holds last sent state, on error client retries again with this file state.
@@ -298,6 +364,10 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 
 		if err != nil || resp == nil {
 			// here response body is already closed by underlying http.Transport
+			var errProve *Error.Error
+			if errors.As(err, &errProve) && errProve.Code == httpDigestAuthentication.ErrServerDidntProvePasswordhash {
+				return Error.E(op, err, errServerDidntProveItHasPasswordhash, Error.ErrKindInfoForUsers, "")
+			}
 			// response may be nil when transport fails with timeout (it may timeout while i am debugging the upload server)
 			if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
 				// err by timeout on client side. That is http.Client() fired a timeout.
@@ -350,12 +420,9 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 		// DEBUG !!! //log.Printf("%s", resp.Status)
 
 		// Here client extracts a prove from server that it has the right password hash.
-		// Any response from server will hold a prove.
-		if authorizationsent {
-			aprove := resp.Header.Get(httpDigestAuthentication.KeyProvePeerHasRightPasswordhash)
-			if aprove != "" && savedProveServerHasRightPasswordhash == aprove {
-				oneResponseFromServerHasAProveOfRightPasswordhash = true
-			}
+		// Any response to an authorized request holds a prove, the transport has checked it.
+		if resp.Header.Get(httpDigestAuthentication.KeyProvePeerHasRightPasswordhash) != "" {
+			oneResponseFromServerHasAProveOfRightPasswordhash = true
 		}
 		liteimp.Debugprint("%s\n", resp.Status)
 		//-------decoding status
@@ -370,71 +437,37 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 			// server actively denies upload. Changes to the file are forbidden.
 			return Error.E(op, nil, errServerForbiddesUpload, Error.ErrKindInfoForUsers, tomsg(bodybytes))
 		}
-		if resp.StatusCode == http.StatusUnauthorized && authorizationsent {
-			log.Printf("Username or password is incorrect.\r\n")
-			return Error.E(op, nil, ErrAuthorizationFailed, 0, "")
+		if resp.StatusCode == http.StatusInsufficientStorage {
+			// no space for the file, retries will not help
+			msg := tomsg(bodybytes)
+			code := int16(liteimp.ErrQuotaExceeded)
+			var jsonerr liteimp.JsonError
+			if json.Unmarshal(bodybytes, &jsonerr) == nil && jsonerr.Error != "" {
+				msg = jsonerr.Error
+				if jsonerr.Code == liteimp.ErrNoFreeSpace {
+					code = jsonerr.Code
+				}
+			}
+			return Error.E(op, nil, code, Error.ErrKindInfoForUsers, msg)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// the service refuses the login after failed logins, for a delay or a lockout
+			log.Printf("Too many failed logins of the username, retry after %s seconds.\r\n", resp.Header.Get("Retry-After"))
+			return Error.E(op, nil, ErrAuthorizationFailed, 0, tomsg(bodybytes))
 		}
 		if resp.StatusCode == http.StatusUnauthorized {
-			wwwauthstr := resp.Header.Get("WWW-Authenticate")
-			if wwwauthstr == "" || !strings.HasPrefix(wwwauthstr, "Digest") {
+			// the transport has answered a challenge already, we support Digest http authentication and tokens only
+			// a refused password gets no challenge
+			if wwwauthstr := resp.Header.Get("WWW-Authenticate"); where.Token == "" && wwwauthstr != "" && !strings.HasPrefix(wwwauthstr, "Digest") {
 				return Error.E(op, nil, errBadHTTPAuthanticationMethod, 0, "")
-
 			}
-			challengeAndCredentials, err := httpDigestAuthentication.ParseStringIntoStruct(wwwauthstr)
-			if err != nil {
-				return Error.E(op, err, errBadHTTPAuthenticationChellenge, 0, "")
-			}
-			// we support Digest http authentication only
-
-			// check for supported by us digest mode
-			if challengeAndCredentials.Algorithm != "MD5" {
-				return Error.E(op, nil, errBadHTTPAuthenticationChellenge, 0, "")
-			}
-			if challengeAndCredentials.Qop != "auth" {
-				return Error.E(op, nil, errBadHTTPAuthenticationChellenge, 0, "")
-
-			}
-			// client must supply its cnonce value
-			challengeAndCredentials.Cnonce = uuid.New().String()
-			// don't forget to fill challengeAndCredentials.Method
-			challengeAndCredentials.Method = req.Method
-			challengeAndCredentials.URI = req.URL.RawQuery
-			challengeAndCredentials.NonceCount = "00000001"
-
-			// next lets construct a 'response' parameter for the HTTP Authorization cookie.
-			hashUsernameRealmPassword := ""
-			if where.Password != "" {
-				hashUsernameRealmPassword = httpDigestAuthentication.HashUsernameRealmPassword(where.Username, challengeAndCredentials.Realm, where.Password)
-			} else {
-				hashUsernameRealmPassword = where.PasswordHash
+			challenge, err := httpDigestAuthentication.StrongestChallenge(resp.Header.Values("WWW-Authenticate"), func(string) bool { return true })
+			if err == nil && challenge.Stale == "true" {
+				// the nonce has expired while a body was sent, the transport has a new one
+				continue
 			}
-			responseParam, err := httpDigestAuthentication.GenerateResponseAuthorizationParameter(hashUsernameRealmPassword, challengeAndCredentials)
-			// this saved prove will be used later
-			savedProveServerHasRightPasswordhash = httpDigestAuthentication.ProveThatPeerHasRightPasswordhash(hashUsernameRealmPassword, responseParam)
-
-			challengeAndCredentials.Username = where.Username
-			challengeAndCredentials.Response = responseParam
-
-			req.Header.Set("Authorization", httpDigestAuthentication.GenerateAuthorization(challengeAndCredentials))
-			authorizationsent = true
-
-			// TODO(zavla): decide if this IF is needed
-			// if oneResponseFromServerHasAProveOfRightPasswordhash {
-			// 	f, err = openandseekRO(fullfilename, currentfilestatus.Startoffset)
-			// 	if err != nil {
-			// 		// file may appear again any time and we will continue upload
-			// 		// TODO(zavla): save filename to queue!!!
-
-			// 		ret = Error.E(op, err, errFileSeekErrorOffset, 0, "")
-			// 		log.Printf("%s", ret)
-			// 		return ret
-			// 	}
-			// 	req.Body = f
-			// 	req.ContentLength = currentfilestatus.Count // file size
-			// }
-
-			continue // this time with Authorization cookie
-
+			log.Printf("Username or password is incorrect.\r\n")
+			return Error.E(op, nil, ErrAuthorizationFailed, 0, "")
 		}
 		// DEBUG !!!
 		//time.Sleep(1 * time.Second)
@@ -452,6 +485,23 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 			}
 			// server sent a proper json response
 
+			if ranges := splitRanges(filestatus.Missing, where.Parallel, constMinRangeLen); len(ranges) > 1 {
+				completed, err := sendRanges(cli, req, fullfilename, filesize, ranges)
+				if completed {
+					if oneResponseFromServerHasAProveOfRightPasswordhash {
+						return nil // upload completed successfully
+					}
+					return Error.E(op, nil, errServerDidntProveItHasPasswordhash, Error.ErrKindInfoForUsers, "")
+				}
+				if err != nil {
+					ret = err
+					log.Printf("%s\r\n", ret)
+					time.Sleep(waitBeforeRetry)
+				}
+				// a request without a body gets the new state of the file
+				continue
+			}
+
 			startfrom := filestatus.Startoffset
 
 			f, err = openandseekRO(fullfilename, startfrom) // garanties starfrom to be a new offset
@@ -498,6 +548,98 @@ func SendAFile(ctx context.Context, where *ConnectConfig, fullfilename string, j
 	return ret
 
 }
+
+// splitRanges splits missing ranges of a file into ranges for n parallel requests.
+// Ranges are not shorter then minlen, unless a missing range is shorter.
+// Returns nil when a file is to be sent sequentially.
+func splitRanges(missing []liteimp.Range, n int, minlen int64) []liteimp.Range {
+	if n < 2 {
+		return nil
+	}
+	total := int64(0)
+	for _, r := range missing {
+		total += r.Count
+	}
+	part := (total + int64(n) - 1) / int64(n)
+	if part < minlen {
+		part = minlen
+	}
+	var ret []liteimp.Range
+	for _, r := range missing {
+		for r.Count > 0 {
+			count := part
+			if r.Count < count || r.Count-count < minlen {
+				// the tail of a range goes with the last part
+				count = r.Count
+			}
+			ret = append(ret, liteimp.Range{Startoffset: r.Startoffset, Count: count})
+			r.Startoffset += count
+			r.Count -= count
+		}
+	}
+	return ret
+}
+
+// sendRanges sends ranges of a file in requests like req, up to len(ranges) requests at a time.
+// Returns true when the service has completed the upload.
+func sendRanges(cli *http.Client, req *http.Request, fullfilename string, filesize int64, ranges []liteimp.Range) (bool, error) {
+	const op = "uploadclient.sendRanges()"
+	var (
+		mu        sync.Mutex
+		completed bool
+		reterr    error
+		wg        sync.WaitGroup
+	)
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(r liteimp.Range) {
+			defer wg.Done()
+			status, err := sendRange(cli, req, fullfilename, filesize, r)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				reterr = Error.E(op, err, errWhileSendingARequestToServer, 0, "")
+			case status == http.StatusAccepted:
+				completed = true
+			case status == http.StatusUnauthorized:
+				// a nonce has expired, the next request gets a new one
+			case status != http.StatusConflict && reterr == nil:
+				reterr = Error.E(op, nil, errWhileSendingARequestToServer, 0, fmt.Sprintf("range %d-%d: HTTP status %d", r.Startoffset, r.Startoffset+r.Count, status))
+			}
+		}(r)
+	}
+	wg.Wait()
+	return completed, reterr
+}
+
+// sendRange sends one range of a file in a copy of req. Returns the HTTP status of the response.
+func sendRange(cli *http.Client, req *http.Request, fullfilename string, filesize int64, r liteimp.Range) (int, error) {
+	f, err := os.Open(fullfilename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rreq := req.Clone(req.Context())
+	rreq.Header.Del("Cookie") // cookies come from cli.Jar
+	rreq.Body = ioutil.NopCloser(io.NewSectionReader(f, r.Startoffset, r.Count))
+	rreq.ContentLength = r.Count
+	query := rreq.URL.Query()
+	query.Set("startoffset", strconv.FormatInt(r.Startoffset, 10))
+	query.Set("count", strconv.FormatInt(r.Count, 10))
+	query.Set("filesize", strconv.FormatInt(filesize, 10))
+	rreq.URL.RawQuery = query.Encode()
+
+	resp, err := cli.Do(rreq)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
 func openandseekRO(fullfilename string, offset int64) (*os.File, error) {
 	f, err := os.OpenFile(fullfilename, os.O_RDONLY, 0400)
 	if err != nil {
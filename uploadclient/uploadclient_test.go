@@ -0,0 +1,52 @@
+package uploadclient
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zavla/upload/liteimp"
+)
+
+func Test_splitRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []liteimp.Range
+		n       int
+		want    []liteimp.Range
+	}{
+		{"sequential", []liteimp.Range{{Startoffset: 0, Count: 1000}}, 1, nil},
+		{"small file", []liteimp.Range{{Startoffset: 0, Count: 150}}, 4, []liteimp.Range{{Startoffset: 0, Count: 150}}},
+		{"even parts", []liteimp.Range{{Startoffset: 0, Count: 400}}, 4, []liteimp.Range{{Startoffset: 0, Count: 100}, {Startoffset: 100, Count: 100}, {Startoffset: 200, Count: 100}, {Startoffset: 300, Count: 100}}},
+		{"short tail joins the last part", []liteimp.Range{{Startoffset: 0, Count: 450}}, 3, []liteimp.Range{{Startoffset: 0, Count: 150}, {Startoffset: 150, Count: 150}, {Startoffset: 300, Count: 150}}},
+		{"tail shorter then minlen", []liteimp.Range{{Startoffset: 0, Count: 250}}, 3, []liteimp.Range{{Startoffset: 0, Count: 100}, {Startoffset: 100, Count: 150}}},
+		{"holes", []liteimp.Range{{Startoffset: 100, Count: 300}, {Startoffset: 1000, Count: 100}}, 4, []liteimp.Range{{Startoffset: 100, Count: 100}, {Startoffset: 200, Count: 100}, {Startoffset: 300, Count: 100}, {Startoffset: 1000, Count: 100}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitRanges(tt.missing, tt.n, 100); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nameOnService(t *testing.T) {
+	base := filepath.Join("backups", "dir")
+	tests := []struct {
+		basedir string
+		file    string
+		want    string
+	}{
+		{"", filepath.Join(base, "sub", "a.bak"), "a.bak"},
+		{base, filepath.Join(base, "a.bak"), "a.bak"},
+		{base, filepath.Join(base, "sub", "deeper", "a.bak"), "sub/deeper/a.bak"},
+		{base, filepath.Join("backups", "other", "a.bak"), "a.bak"},
+	}
+	for _, tt := range tests {
+		where := &ConnectConfig{BaseDir: tt.basedir}
+		if got := where.nameOnService(tt.file); got != tt.want {
+			t.Errorf("nameOnService(%s) with BaseDir %q = %s, want %s", tt.file, tt.basedir, got, tt.want)
+		}
+	}
+}
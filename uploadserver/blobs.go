@@ -0,0 +1,29 @@
+package uploadserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+// RunBlobsSweeper removes stored blobs no file of users is a link to every interval until stop is closed.
+// Deleted files release their blobs at once, files replaced by new uploads leave blobs for the sweeper.
+func RunBlobsSweeper(storageroot string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			removed, err := fsdriver.SweepBlobs(storageroot)
+			if err != nil {
+				log.Printf("sweeping of stored blobs failed: %s\r\n", err)
+			}
+			for _, b := range removed {
+				log.Printf("blob %s is removed, no files link to it\r\n", b)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package uploadserver
+
+import "sync"
+
+// The length of a block of the recieve pipeline, it is a write block of fsdriver.
+const constRecieveBlockLen = 2 * 65535
+
+// The default count of blocks all uploads of the service share.
+const constRecievePoolBlocks = 256
+
+// bufferPool is a bounded pool of blocks of bytes.
+// Blocks are allocated at first use, at most count of them.
+// When every block is in use get waits for a block to be put back.
+type bufferPool struct {
+	free     chan []byte   // blocks put back
+	tokens   chan struct{} // a token for every block that is not allocated yet
+	blocklen int
+}
+
+func newBufferPool(count, blocklen int) *bufferPool {
+	p := &bufferPool{
+		free:     make(chan []byte, count),
+		tokens:   make(chan struct{}, count),
+		blocklen: blocklen,
+	}
+	for i := 0; i < count; i++ {
+		p.tokens <- struct{}{}
+	}
+	return p
+}
+
+// get returns a block of blocklen bytes. Returns nil when done is closed while it waits.
+func (p *bufferPool) get(done <-chan struct{}) []byte {
+	select {
+	case b := <-p.free:
+		return b
+	default:
+	}
+	select {
+	case b := <-p.free:
+		return b
+	case <-p.tokens:
+		return make([]byte, p.blocklen)
+	case <-done:
+		return nil
+	}
+}
+
+// put gives a block back to the pool. Blocks not from the pool are dropped.
+// It is safe to put to a nil pool.
+func (p *bufferPool) put(b []byte) {
+	if p == nil || cap(b) != p.blocklen {
+		return
+	}
+	select {
+	case p.free <- b[:p.blocklen]:
+	default: // not a block of this pool
+	}
+}
+
+var (
+	recievePool     *bufferPool
+	recievePoolOnce sync.Once
+)
+
+// getRecievePool returns a pool of blocks shared by all uploads of the service.
+// Its size is ConfigThisService.RecieveBuffer.
+func getRecievePool() *bufferPool {
+	recievePoolOnce.Do(func() {
+		n := int(ConfigThisService.RecieveBuffer / constRecieveBlockLen)
+		if n <= 0 {
+			n = constRecievePoolBlocks
+		}
+		recievePool = newBufferPool(n, constRecieveBlockLen)
+	})
+	return recievePool
+}
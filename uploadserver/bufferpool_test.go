@@ -0,0 +1,47 @@
+package uploadserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_bufferPool(t *testing.T) {
+	p := newBufferPool(2, 10)
+	done := make(chan struct{})
+	b1, b2 := p.get(done), p.get(done)
+	if len(b1) != 10 || len(b2) != 10 {
+		t.Fatalf("get() = %d and %d bytes, want 10", len(b1), len(b2))
+	}
+	p.put(make([]byte, 5)) // not a block of the pool
+	close(done)
+	if b := p.get(done); b != nil {
+		t.Errorf("get() of an exhausted pool = %d bytes, want nil after done", len(b))
+	}
+	p.put(b1[:3])
+	if b := p.get(nil); &b[0] != &b1[0] || len(b) != 10 {
+		t.Errorf("get() after put() must return the block put back with its full length")
+	}
+	var nilpool *bufferPool
+	nilpool.put(b2)
+}
+
+func Test_fillRecieverChannel(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 2*constRecieveBlockLen/10+7)
+	p := newBufferPool(2, constRecieveBlockLen)
+	ch := make(chan []byte)
+	got := make(chan []byte)
+	go func() {
+		var all []byte
+		for b := range ch {
+			all = append(all, b...)
+			p.put(b)
+		}
+		got <- all
+	}()
+	err := fillRecieverChannel(ioutil.NopCloser(iotest.HalfReader(bytes.NewReader(content))), ch, make(chan struct{}), p)
+	if all := <-got; err != nil || !bytes.Equal(all, content) {
+		t.Errorf("fillRecieverChannel() sent %d bytes of %d, %v", len(all), len(content), err)
+	}
+}
@@ -0,0 +1,66 @@
+package uploadserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ClientCerts tells whether an interface asks clients for TLS certificates.
+type ClientCerts int
+
+const (
+	// ClientCertsNone doesn't ask clients for certificates.
+	ClientCertsNone ClientCerts = iota
+	// ClientCertsAccept verifies a certificate if a client sends one, other clients use passwords or tokens.
+	ClientCertsAccept
+	// ClientCertsRequire refuses TLS connections without a verified client certificate.
+	ClientCertsRequire
+)
+
+var clientCertsNames = [...]string{"none", "accept", "require"}
+
+func (m ClientCerts) String() string {
+	if m < 0 || int(m) >= len(clientCertsNames) {
+		return fmt.Sprintf("ClientCerts(%d)", int(m))
+	}
+	return clientCertsNames[m]
+}
+
+// ParseClientCerts returns a mode by its name: none, accept or require.
+func ParseClientCerts(s string) (ClientCerts, error) {
+	for i, n := range clientCertsNames {
+		if strings.EqualFold(s, n) {
+			return ClientCerts(i), nil
+		}
+	}
+	return ClientCertsNone, fmt.Errorf("unknown client certificates mode %q, use one of %s", s, strings.Join(clientCertsNames[:], ", "))
+}
+
+// ClientCAFile is a file in Config.Configdir with PEM certificates of CAs that sign client certificates.
+const ClientCAFile = "clientCA.pem"
+
+// TLSConfig returns a TLS configuration of an interface, nil when it doesn't ask for client certificates.
+func (ic interfaceconfig) TLSConfig() (*tls.Config, error) {
+	if ic.ClientCerts == ClientCertsNone {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(ic.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", ic.ClientCAFile)
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if ic.ClientCerts == ClientCertsRequire {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		ClientAuth: clientAuth,
+		ClientCAs:  pool,
+	}, nil
+}
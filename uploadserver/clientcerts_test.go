@@ -0,0 +1,84 @@
+package uploadserver
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testCA is a self signed CA certificate.
+const testCA = `-----BEGIN CERTIFICATE-----
+MIIBhTCCASugAwIBAgIQIRi6zePL6mKjOipn+dNuaTAKBggqhkjOPQQDAjASMRAw
+DgYDVQQKEwdBY21lIENvMB4XDTE3MTAyMDE5NDMwNloXDTE4MTAyMDE5NDMwNlow
+EjEQMA4GA1UEChMHQWNtZSBDbzBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABD0d
+7VNhbWvZLWPuj/RtHFjvtJBEwOkhbN/BnnE8rnZR8+sbwnc/KhCk3FhnpHZnQz7B
+5aETbbIgmuvewdjvSBSjYzBhMA4GA1UdDwEB/wQEAwICpDATBgNVHSUEDDAKBggr
+BgEFBQcDATAPBgNVHRMBAf8EBTADAQH/MCkGA1UdEQQiMCCCDmxvY2FsaG9zdDo1
+NDUzgg4xMjcuMC4wLjE6NTQ1MzAKBggqhkjOPQQDAgNIADBFAiEA2zpJEPQyz6/l
+Wf86aX6PepsntZv2GYlA5UpabfT2EZICICpJ5h/iI+i341gBmLiAFQOyTDT+/wQc
+6MF9+Yw1Yy0t
+-----END CERTIFICATE-----
+`
+
+func TestParseClientCerts(t *testing.T) {
+	for _, m := range []ClientCerts{ClientCertsNone, ClientCertsAccept, ClientCertsRequire} {
+		if got, err := ParseClientCerts(m.String()); err != nil || got != m {
+			t.Errorf("ParseClientCerts(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseClientCerts("optional"); err == nil {
+		t.Errorf("ParseClientCerts(\"optional\") must fail")
+	}
+}
+
+func TestInterfaceTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientcerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"127.0.0.1.pem", "127.0.0.1-key.pem"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+	config := Config{
+		Configdir:   dir,
+		BindAddress: []string{"127.0.0.1:64000", "127.0.0.1:64001", "127.0.0.1:64002"},
+		ClientCerts: map[string]ClientCerts{"127.0.0.1:64001": ClientCertsAccept, "127.0.0.1:64002": ClientCertsRequire},
+	}
+	if err := config.UpdateInterfacesConfigs(""); err == nil {
+		t.Errorf("UpdateInterfacesConfigs() without %s must fail", ClientCAFile)
+	}
+	if err := config.UpdateInterfacesConfigs("127.0.0.1:64000"); err != nil {
+		t.Errorf("UpdateInterfacesConfigs() of an interface without client certificates = %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ClientCAFile), []byte(testCA), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.UpdateInterfacesConfigs(""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		listenon string
+		want     tls.ClientAuthType
+	}{
+		{"127.0.0.1:64001", tls.VerifyClientCertIfGiven},
+		{"127.0.0.1:64002", tls.RequireAndVerifyClientCert},
+	}
+	for _, tt := range tests {
+		tlsConfig, err := config.IfConfigs[tt.listenon].TLSConfig()
+		if err != nil || tlsConfig == nil || tlsConfig.ClientAuth != tt.want || tlsConfig.ClientCAs == nil {
+			t.Errorf("TLSConfig() of %s = %+v, %v, want ClientAuth %v", tt.listenon, tlsConfig, err, tt.want)
+		}
+	}
+	if tlsConfig, err := config.IfConfigs["127.0.0.1:64000"].TLSConfig(); tlsConfig != nil || err != nil {
+		t.Errorf("TLSConfig() of an interface without client certificates = %+v, %v", tlsConfig, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, ClientCAFile), []byte("no certificates"), 0600)
+	if _, err := config.IfConfigs["127.0.0.1:64002"].TLSConfig(); err == nil {
+		t.Errorf("TLSConfig() with a bad %s must fail", ClientCAFile)
+	}
+}
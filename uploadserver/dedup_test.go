@@ -0,0 +1,84 @@
+package uploadserver
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/fsdriver"
+)
+
+func Test_linkStoredContent(t *testing.T) {
+	root, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	former := ConfigThisService
+	defer func() { ConfigThisService = former }()
+	ConfigThisService.Storageroot = root
+	ConfigThisService.Dedup = true
+
+	content := []byte("the same nightly dump")
+	h := fsdriver.SHA1.New()
+	h.Write(content)
+	hash := h.Sum(nil)
+	dir := filepath.Join(root, "user1")
+	os.MkdirAll(dir, 0700)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.bak"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsdriver.StoreBlob(root, filepath.Join(dir, "a.bak"), loginOfDir(dir), fsdriver.SHA1, hash); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, ".sha1"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, ".sha1", "a.bak.sha1-"+hex.EncodeToString(hash)), nil, 0600)
+
+	c := &gin.Context{Request: httptest.NewRequest(http.MethodPost, "/upload/user2?filename=b.bak", nil)}
+	q2 := userquery{storagepath: filepath.Join(root, "user2"), name: "b.bak", nameNotComplete: "b.bak.part", username: "user2",
+		strhash: hex.EncodeToString(hash), algorithm: fsdriver.SHA1}
+	os.MkdirAll(q2.storagepath, 0700)
+	if linkStoredContent(c, q2, int64(len(content))) {
+		t.Errorf("linkStoredContent() of a content of another login = true, the login must upload it")
+	}
+	if _, err := os.Stat(filepath.Join(q2.storagepath, "b.bak")); !os.IsNotExist(err) {
+		t.Errorf("a content of another login is linked")
+	}
+
+	c = &gin.Context{Request: httptest.NewRequest(http.MethodPost, "/upload/user1?filename=b.bak", nil)}
+	q := userquery{storagepath: dir, name: "b.bak", nameNotComplete: "b.bak.part", username: "user1",
+		strhash: hex.EncodeToString(hash), algorithm: fsdriver.SHA1}
+	if !linkStoredContent(c, q, int64(len(content))) {
+		t.Fatalf("linkStoredContent() of a stored content = false")
+	}
+	name := filepath.Join(dir, "b.bak")
+	if got, _ := ioutil.ReadFile(name); string(got) != string(content) {
+		t.Errorf("linked file content = %q", got)
+	}
+	if etag, err := etagOfCompletedFile(name); err != nil || etag != `"sha1-`+q.strhash+`"` {
+		t.Errorf("etagOfCompletedFile() of a linked file = %s, %v", etag, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fsdriver.GetPartialJournalFileName(q.nameNotComplete))); !os.IsNotExist(err) {
+		t.Errorf("a journal of a linked file is left near it")
+	}
+	// fsck checks the linked file by its journal
+	os.Remove(name)
+	ioutil.WriteFile(name, []byte("another content"), 0600)
+	if r := fsckCompleted(dir, "b.bak", FsckResult{}); r.State != FsckHashDiffers {
+		t.Errorf("fsckCompleted() of a changed linked file = %v", r)
+	}
+
+	// a deleted file releases its blob
+	os.Remove(name)
+	if err := removeWithJournals(filepath.Join(dir, "a.bak")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fsdriver.BlobName(root, fsdriver.SHA1, hash)); !os.IsNotExist(err) {
+		t.Errorf("a blob of a deleted file is not removed")
+	}
+}
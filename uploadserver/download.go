@@ -0,0 +1,86 @@
+package uploadserver
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// isIncomplete says name is a file being uploaded or its journal.
+func isIncomplete(name string) bool {
+	return strings.HasSuffix(name, ".part") || strings.HasSuffix(name, fsdriver.GetPartialJournalFileName(""))
+}
+
+// etagOfCompletedFile returns a strong ETag of a completed file made of a hash from its newest journal in .sha1,
+// ex. "sha1-00ff..". A file uploaded again with another content has several journals,
+// it gets no ETag when the newest one can't be told, clients use Last-Modified then.
+// Returns "" when the file has no journal.
+func etagOfCompletedFile(name string) (string, error) {
+	journals, err := journalsOfCompletedFile(name)
+	if err != nil {
+		return "", err
+	}
+	newest := ""
+	var newestTime time.Time
+	for _, j := range journals {
+		stat, err := fsdriver.Store.Stat(j)
+		if err != nil {
+			return "", err
+		}
+		switch mtime := stat.ModTime(); {
+		case newest == "" || mtime.After(newestTime):
+			newest, newestTime = j, mtime
+		case mtime.Equal(newestTime):
+			return "", nil // journals of different contents of the same time
+		}
+	}
+	if newest == "" {
+		return "", nil
+	}
+	// .sha1/NAME.<algorithm>-<hash>
+	suffix := filepath.Base(newest)[len(filepath.Base(name))+1:]
+	return `"` + suffix + `"`, nil
+}
+
+// serveStoredFile writes a completed file name of the user to the response.
+// http.ServeContent serves HEAD, Range, If-Range and If-None-Match requests,
+// so an interrupted download may be continued.
+// Files being uploaded are not served.
+func serveStoredFile(c *gin.Context, name string) {
+	const op = "uploadserver.serveStoredFile()"
+	if isIncomplete(name) {
+		c.JSON(http.StatusForbidden,
+			gin.H{"error": Error.ToUser(op, errFileIsIncomplete, filepath.Base(name)).Error()})
+		return
+	}
+	f, err := fsdriver.Store.OpenFile(name, 0, 0) // O_RDONLY
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't open a file to download %s: %s", name, err)))
+		c.JSON(http.StatusNotFound, gin.H{"error": Error.ToUser(op, errPathError, filepath.Base(name)).Error()})
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't stat a file to download %s: %s", name, err)))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	etag, err := etagOfCompletedFile(name)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't read journals of %s: %s", name, err)))
+	}
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+	http.ServeContent(c.Writer, c.Request, filepath.Base(name), stat.ModTime(), f)
+}
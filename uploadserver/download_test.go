@@ -0,0 +1,112 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_serveStoredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, ".sha1"), 0700)
+	for name, content := range map[string]string{
+		"a.bak":                   "0123456789",
+		".sha1/a.bak.sha1-00ff":   "",
+		"b.bak.part":              "01234",
+		"b.bak.part.partialinfo":  "",
+		".sha1/nojournal.txt.bad": "",
+		"nojournal.txt":           "abc",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name       string
+		file       string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+		wantETag   string
+	}{
+		{"whole file", "a.bak", nil, http.StatusOK, "0123456789", `"sha1-00ff"`},
+		{"range", "a.bak", map[string]string{"Range": "bytes=4-"}, http.StatusPartialContent, "456789", `"sha1-00ff"`},
+		{"if-range of the same file", "a.bak", map[string]string{"Range": "bytes=4-", "If-Range": `"sha1-00ff"`},
+			http.StatusPartialContent, "456789", `"sha1-00ff"`},
+		{"if-range of a changed file", "a.bak", map[string]string{"Range": "bytes=4-", "If-Range": `"sha1-0000"`},
+			http.StatusOK, "0123456789", `"sha1-00ff"`},
+		{"not modified", "a.bak", map[string]string{"If-None-Match": `"sha1-00ff"`}, http.StatusNotModified, "", `"sha1-00ff"`},
+		{"without a journal", "nojournal.txt", nil, http.StatusOK, "abc", ""},
+		{"incomplete", "b.bak.part", nil, http.StatusForbidden, "", ""},
+		{"journal", "b.bak.part.partialinfo", nil, http.StatusForbidden, "", ""},
+		{"absent", "c.bak", nil, http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/upload/zahar/"+tt.file, nil)
+			for k, v := range tt.header {
+				c.Request.Header.Set(k, v)
+			}
+			serveStoredFile(c, filepath.Join(dir, tt.file))
+			c.Writer.WriteHeaderNow() // as gin does after handlers
+			if w.Code != tt.wantStatus || w.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("serveStoredFile() = %d, ETag %s, want %d, ETag %s", w.Code, w.Header().Get("ETag"), tt.wantStatus, tt.wantETag)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("serveStoredFile() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_etagOfCompletedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, ".sha1"), 0700)
+	now := time.Now().Truncate(time.Second)
+	// journals by name order differ from their time order
+	for name, mtime := range map[string]time.Time{
+		"a.bak":                 now,
+		".sha1/a.bak.sha1-00ff": now,
+		".sha1/a.bak.sha1-ff00": now.Add(-time.Hour),
+		"b.bak":                 now,
+		".sha1/b.bak.sha1-00ff": now,
+		".sha1/b.bak.sha1-ff00": now,
+		"c.bak":                 now,
+		".sha1/c.bak.sha1-":     now,
+	} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, mtime, mtime)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.bak", `"sha1-00ff"`},
+		{"b.bak", ""}, // the newest journal can't be told
+		{"c.bak", ""}, // an empty hash
+	}
+	for _, tt := range tests {
+		if got, err := etagOfCompletedFile(filepath.Join(dir, tt.name)); err != nil || got != tt.want {
+			t.Errorf("etagOfCompletedFile(%s) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/zavla/upload/fsdriver"
 	"github.com/zavla/upload/liteimp"
 
 	"github.com/gin-gonic/gin"
@@ -24,16 +25,15 @@ type smallinf struct {
 	Size     int64
 	DateTime time.Time
 	Date     string
+	Versions []smallinf // former versions of a file in VersionsDir
 }
 
 // GetFileList is a gin.HandlerFunc.
-// Returns a response with html page "list of files"
+// Returns a response with html page "list of files",
+// or the content of a completed file when the path is a file.
 func GetFileList(c *gin.Context) {
 	username := c.Param("login")
-	urlpath := c.Param("path")
-	if len(urlpath) == 0 {
-		urlpath += "/"
-	}
+	urlpath := path.Clean("/" + c.Param("path")) // no way out of the user's directory with ..
 	urlpathtousername := "upload/" + username
 
 	storagepath := GetPathWhereToStoreByUsername(username)
@@ -61,7 +61,7 @@ func GetFileList(c *gin.Context) {
 		isnamefilter = true
 
 	}
-	stat, err := os.Stat(fullfspath)
+	stat, err := fsdriver.Store.Stat(fullfspath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			c.JSON(http.StatusOK, gin.H{"error": "no files yet"})
@@ -73,8 +73,7 @@ func GetFileList(c *gin.Context) {
 
 	}
 	if !stat.IsDir() {
-		log.Printf("For user %s, error while reading his directory: not a directory: %s\r\n", username, fullfspath)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unexpected directory structure"})
+		serveStoredFile(c, filepath.Clean(fullfspath))
 		return
 	}
 
@@ -171,36 +170,39 @@ func GetLogContent(c *gin.Context) {
 
 func fillnameslist(storagepath string, isnamefilter bool, reg *regexp.Regexp) []smallinf {
 	nameslist := make([]smallinf, 0, 200)
-	_ = filepath.Walk(storagepath, func(path string, info os.FileInfo, errinfile error) error {
-		if errinfile != nil {
-			return filepath.SkipDir
-		}
-		if info.IsDir() && path == storagepath {
-			return nil //next file
-		}
-		if info.IsDir() {
-			nameslist = append(nameslist, smallinf{
-				Name:     info.Name(),
-				Size:     info.Size(),
-				DateTime: info.ModTime(),
-				Date:     info.ModTime().Format(http.TimeFormat),
-			})
-			return filepath.SkipDir
-		}
-		if isnamefilter {
-			is := reg.FindString(path)
+	infos, err := fsdriver.Store.ReadDir(storagepath)
+	if err != nil {
+		return nameslist
+	}
+	versions, err := versionsOf(storagepath)
+	if err != nil {
+		log.Printf("can't read versions of files in %s: %s\r\n", storagepath, err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() && isnamefilter {
+			is := reg.FindString(filepath.Join(storagepath, info.Name()))
 			if is == "" {
-				return nil // next file please
+				continue // next file please
 			}
 		}
-		nameslist = append(nameslist, smallinf{
+		inf := smallinf{
 			Name:     info.Name(),
 			Size:     info.Size(),
 			DateTime: info.ModTime(),
 			Date:     info.ModTime().Format(http.TimeFormat),
-		})
-		return nil
-	})
+		}
+		if !info.IsDir() {
+			for _, v := range versions[info.Name()] {
+				inf.Versions = append(inf.Versions, smallinf{
+					Name:     v.Name(),
+					Size:     v.Size(),
+					DateTime: v.ModTime(),
+					Date:     v.ModTime().Format(http.TimeFormat),
+				})
+			}
+		}
+		nameslist = append(nameslist, inf)
+	}
 	return nameslist
 
 }
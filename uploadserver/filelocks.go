@@ -0,0 +1,55 @@
+package uploadserver
+
+import (
+	"math"
+	"sync"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+// fileLocks holds ranges of files being uploaded at the moment.
+// Different ranges of a file may be uploaded in parallel, the same bytes may not.
+type fileLocks struct {
+	mu     sync.Mutex
+	locked map[string][]fsdriver.Range
+}
+
+// wholeFile is a range that overlaps any range of a file.
+var wholeFile = fsdriver.Range{Startoffset: 0, Count: math.MaxInt64}
+
+// lock locks a range r of a file lockobject.
+// Returns ok == false when some bytes of the range are locked already.
+// unlock may be called more than once.
+func (l *fileLocks) lock(lockobject string, r fsdriver.Range) (unlock func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, used := range l.locked[lockobject] {
+		if used.Overlaps(r) {
+			return func() {}, false
+		}
+	}
+	if l.locked == nil {
+		l.locked = make(map[string][]fsdriver.Range)
+	}
+	l.locked[lockobject] = append(l.locked[lockobject], r)
+
+	var once sync.Once
+	return func() { once.Do(func() { l.unlock(lockobject, r) }) }, true
+}
+
+func (l *fileLocks) unlock(lockobject string, r fsdriver.Range) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ranges := l.locked[lockobject]
+	for i, used := range ranges {
+		if used == r {
+			ranges = append(ranges[:i], ranges[i+1:]...)
+			break
+		}
+	}
+	if len(ranges) == 0 {
+		delete(l.locked, lockobject)
+		return
+	}
+	l.locked[lockobject] = ranges
+}
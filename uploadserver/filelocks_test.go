@@ -0,0 +1,36 @@
+package uploadserver
+
+import (
+	"testing"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+func Test_fileLocks(t *testing.T) {
+	var l fileLocks
+	unlock1, ok := l.lock("f", fsdriver.Range{Startoffset: 0, Count: 100})
+	if !ok {
+		t.Fatal("lock() of a free range failed")
+	}
+	if _, ok := l.lock("f", fsdriver.Range{Startoffset: 50, Count: 100}); ok {
+		t.Error("lock() of an overlapping range succeeded")
+	}
+	unlock2, ok := l.lock("f", fsdriver.Range{Startoffset: 100, Count: 100})
+	if !ok {
+		t.Error("lock() of a neighbour range failed")
+	}
+	if _, ok := l.lock("f", wholeFile); ok {
+		t.Error("lock() of a whole file with locked ranges succeeded")
+	}
+	if _, ok := l.lock("g", wholeFile); !ok {
+		t.Error("lock() of another file failed")
+	}
+	unlock1()
+	unlock1() // unlock may be called twice
+	unlock2()
+	unlock, ok := l.lock("f", wholeFile)
+	if !ok {
+		t.Error("lock() of a whole file after unlock failed")
+	}
+	unlock()
+}
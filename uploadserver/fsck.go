@@ -0,0 +1,257 @@
+package uploadserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// States of files found by Fsck.
+const (
+	FsckResumable   = "resumable"   // an upload may continue
+	FsckRepairable  = "repairable"  // a journal or a file must be truncated to its last verified record
+	FsckComplete    = "complete"    // all bytes are written, the file was not renamed
+	FsckCorrupt     = "corrupt"     // a journal can't be trusted or a complete file has a wrong hash
+	FsckNoJournal   = "nojournal"   // a partial file without its journal, it can't be resumed
+	FsckNoPart      = "nopart"      // a journal without its partial file
+	FsckHashDiffers = "hashdiffers" // a completed file differs from its journals in .sha1
+)
+
+// FsckResult is a state of a partial upload or of a bad completed file.
+type FsckResult struct {
+	Name     string `json:"name"` // relative to a storage root
+	State    string `json:"state"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+func (r FsckResult) String() string {
+	s := fmt.Sprintf("%-11s %s", r.State, r.Name)
+	if r.Detail != "" {
+		s += ": " + r.Detail
+	}
+	if r.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// auditStorage records attempts to change files, a readonly one denies them.
+type auditStorage struct {
+	fsdriver.Storage
+	readonly bool
+	changed  bool
+}
+
+func (s *auditStorage) change() error {
+	s.changed = true
+	if s.readonly {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (s *auditStorage) OpenFile(name string, flag int, perm os.FileMode) (fsdriver.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := s.change(); err != nil {
+			return nil, err
+		}
+	}
+	return s.Storage.OpenFile(name, flag, perm)
+}
+
+func (s *auditStorage) Rename(oldname, newname string) error {
+	if err := s.change(); err != nil {
+		return err
+	}
+	return s.Storage.Rename(oldname, newname)
+}
+
+func (s *auditStorage) Remove(name string) error {
+	if err := s.change(); err != nil {
+		return err
+	}
+	return s.Storage.Remove(name)
+}
+
+func (s *auditStorage) MkdirAll(path string, perm os.FileMode) error {
+	if err := s.change(); err != nil {
+		return err
+	}
+	return s.Storage.MkdirAll(path, perm)
+}
+
+// Fsck checks partial uploads and completed files of every user in storageroot.
+// Partial uploads are checked with fsdriver.MayUpload, completed files are checked against their journals in .sha1.
+// Without repair nothing is changed, files MayUpload would truncate are reported as FsckRepairable.
+// With repair journals and files are truncated as MayUpload does, complete files are renamed
+// as after an upload and journals without partial files are removed.
+// Fsck replaces fsdriver.Store while it works, so it must not run in a working service.
+func Fsck(storageroot string, repair bool) ([]FsckResult, error) {
+	const op = "uploadserver.Fsck()"
+	users, err := fsdriver.Store.ReadDir(storageroot)
+	if err != nil {
+		return nil, Error.E(op, err, Error.ErrFileIO, 0, storageroot)
+	}
+	audit := &auditStorage{Storage: fsdriver.Store, readonly: !repair}
+	fsdriver.Store = audit
+	defer func() { fsdriver.Store = audit.Storage }()
+
+	var results []FsckResult
+	for _, u := range users {
+		if !u.IsDir() || strings.HasPrefix(u.Name(), ".") {
+			continue
+		}
+		if err := fsckDir(audit, storageroot, filepath.Join(storageroot, u.Name()), repair, &results); err != nil {
+			return results, Error.E(op, err, Error.ErrFileIO, 0, u.Name())
+		}
+	}
+	return results, nil
+}
+
+func fsckDir(audit *auditStorage, storageroot, dir string, repair bool, results *[]FsckResult) error {
+	infos, err := audit.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(infos))
+	for _, fi := range infos {
+		names[fi.Name()] = true
+	}
+	journalsuffix := fsdriver.GetPartialJournalFileName(".part")
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if fi.IsDir() {
+			if err := fsckDir(audit, storageroot, filepath.Join(dir, name), repair, results); err != nil {
+				return err
+			}
+			continue
+		}
+		rel, _ := filepath.Rel(storageroot, filepath.Join(dir, name))
+		r := FsckResult{Name: filepath.ToSlash(rel)}
+		switch {
+		case strings.HasSuffix(name, journalsuffix):
+			if names[strings.TrimSuffix(name, fsdriver.GetPartialJournalFileName(""))] {
+				continue // checked with its partial file
+			}
+			r.State = FsckNoPart
+			if repair {
+				err := audit.Remove(filepath.Join(dir, name))
+				r.Repaired = err == nil
+			}
+		case strings.HasSuffix(name, ".part"):
+			if !names[fsdriver.GetPartialJournalFileName(name)] {
+				r.State, r.Detail = FsckNoJournal, "upload of this file is not allowed until it is removed"
+				break
+			}
+			r = fsckPartial(audit, dir, strings.TrimSuffix(name, ".part"), repair, r)
+		default:
+			r = fsckCompleted(dir, name, r)
+		}
+		if r.State != "" {
+			*results = append(*results, r)
+		}
+	}
+	return nil
+}
+
+// fsckPartial checks a partial file nameNotComplete of the completed file name.
+func fsckPartial(audit *auditStorage, dir, name string, repair bool, r FsckResult) FsckResult {
+	nameNotComplete := name + ".part"
+	audit.changed = false
+	state, err := fsdriver.MayUpload(dir, name, nameNotComplete)
+	truncated := audit.changed
+
+	switch {
+	case err == nil:
+		r.State, r.Detail = FsckResumable, fmt.Sprintf("%d of %d bytes", state.Startoffset, state.FileSize)
+		if len(state.Missing) > 0 {
+			r.Detail += fmt.Sprintf(", %d missing ranges", len(state.Missing))
+		}
+	case fsdriver.MayRepare(err):
+		fact, errhash := fsdriver.GetFileHash(dir, nameNotComplete, state.Algorithm)
+		if errhash != nil {
+			r.State, r.Detail = FsckCorrupt, errhash.Error()
+			break
+		}
+		if !fsdriver.IsEmptyHash(state.Hash) && !bytes.Equal(fact, state.Hash) {
+			r.State, r.Detail = FsckCorrupt, fmt.Sprintf("%s is %x, want %x", state.Algorithm, fact, state.Hash)
+			break
+		}
+		r.State, r.Detail = FsckComplete, fmt.Sprintf("%s %x", state.Algorithm, fact)
+		if repair {
+			r.Repaired = eventOnSuccess(nil, dir, name, nameNotComplete, state.Algorithm, fact) == nil
+		}
+	default:
+		r.State, r.Detail = FsckCorrupt, err.Error()
+	}
+	if truncated {
+		if !repair {
+			// MayUpload was denied to truncate files, its verdict is about not truncated files
+			r.State, r.Detail = FsckRepairable, ""
+		} else {
+			r.Detail = "now " + r.State + ": " + r.Detail
+			r.State, r.Repaired = FsckRepairable, true
+		}
+	}
+	return r
+}
+
+// fsckCompleted checks a completed file against its journals in .sha1.
+// A file without journals is not checked. Any journal with the hash of the file is enough,
+// as a file may be uploaded again with another content.
+func fsckCompleted(dir, name string, r FsckResult) FsckResult {
+	journals, err := fsdriver.Store.ReadDir(filepath.Join(dir, ".sha1"))
+	if err != nil {
+		return r
+	}
+	facthashes := make(map[fsdriver.HashAlgorithm][]byte)
+	for _, j := range journals {
+		alg, want, ok := hashOfJournal(name, j.Name())
+		if !ok {
+			continue
+		}
+		fact, ok := facthashes[alg]
+		if !ok {
+			fact, err = fsdriver.GetFileHash(dir, name, alg)
+			if err != nil {
+				r.State, r.Detail = FsckHashDiffers, err.Error()
+				return r
+			}
+			facthashes[alg] = fact
+		}
+		if bytes.Equal(fact, want) {
+			return r
+		}
+		r.State, r.Detail = FsckHashDiffers, fmt.Sprintf("%s is %x, want %x", alg, fact, want)
+	}
+	return r
+}
+
+// PrintFsckReport writes results one per line or as a JSON array.
+func PrintFsckReport(w io.Writer, results []FsckResult, asJSON bool) error {
+	if asJSON {
+		if results == nil {
+			results = []FsckResult{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	for _, r := range results {
+		if _, err := fmt.Fprintln(w, r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
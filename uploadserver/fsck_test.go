@@ -0,0 +1,141 @@
+package uploadserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+// writeTestUpload creates an upload of content and writes its first n bytes.
+func writeTestUpload(t *testing.T, dir, name string, content []byte, n int) {
+	hash := sha256.Sum256(content)
+	if err := fsdriver.CreateNewPartialJournalFile(dir, name+".part", int64(len(content)), fsdriver.SHA256, hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	ver, wp, wa, errwp, errwa := fsdriver.OpenTwoCorrespondentFiles(dir, name+".part", fsdriver.GetPartialJournalFileName(name+".part"), nil)
+	if errwp != nil || errwa != nil {
+		t.Fatal(errwp, errwa)
+	}
+	defer wp.Close()
+	defer wa.Close()
+	if _, err := fsdriver.AddBytesToFile(wa, wp, content[:n], ver, &fsdriver.JournalRecord{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "zahar")
+	os.MkdirAll(filepath.Join(dir, ".sha1"), 0700)
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	hash := sha256.Sum256(content)
+
+	writeTestUpload(t, dir, "resumable.bin", content, 100)
+	writeTestUpload(t, dir, "complete.bin", content, len(content))
+	writeTestUpload(t, dir, "damaged.bin", content, 5000)
+	// the last written block is damaged
+	if f, err := os.OpenFile(filepath.Join(dir, "damaged.bin.part"), os.O_RDWR, 0); err == nil {
+		f.WriteAt([]byte("x"), 4999)
+		f.Close()
+	}
+	files := map[string][]byte{
+		"orphan.bin.part":              content,
+		"lost.bin.part.partialinfo":    nil,
+		"done.bin":                     content[1:],
+		"good.bin":                     content,
+		".sha1/good.bin.old.sha1-00ff": nil,
+	}
+	// journals of completed files
+	for _, name := range []string{"done.bin", "good.bin"} {
+		files[fmt.Sprintf(".sha1/%s.sha256-%x", name, hash)] = nil
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	states := func(results []FsckResult) map[string]string {
+		ret := make(map[string]string)
+		for _, r := range results {
+			ret[r.Name] = fmt.Sprintf("%s %v", r.State, r.Repaired)
+		}
+		return ret
+	}
+	listing := func() []string {
+		var ret []string
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err == nil {
+				ret = append(ret, fmt.Sprintf("%s %d", path, fi.Size()))
+			}
+			return nil
+		})
+		return ret
+	}
+
+	before := listing()
+	results, err := Fsck(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"zahar/complete.bin.part":         "complete false",
+		"zahar/damaged.bin.part":          "repairable false",
+		"zahar/done.bin":                  "hashdiffers false",
+		"zahar/lost.bin.part.partialinfo": "nopart false",
+		"zahar/orphan.bin.part":           "nojournal false",
+		"zahar/resumable.bin.part":        "resumable false",
+	}
+	if got := states(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fsck() = %v, want %v", got, want)
+	}
+	if after := listing(); !reflect.DeepEqual(before, after) {
+		t.Errorf("Fsck() without repair changed files:\n%v\n%v", before, after)
+	}
+
+	results, err = Fsck(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"zahar/complete.bin.part":         "complete true",
+		"zahar/damaged.bin.part":          "repairable true",
+		"zahar/done.bin":                  "hashdiffers false",
+		"zahar/lost.bin.part.partialinfo": "nopart true",
+		"zahar/orphan.bin.part":           "nojournal false",
+		"zahar/resumable.bin.part":        "resumable false",
+	}
+	if got := states(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fsck(repair) = %v, want %v", got, want)
+	}
+	for _, name := range []string{"complete.bin", fmt.Sprintf(".sha1/complete.bin.sha256-%x", hash)} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Fsck(repair) didn't complete an upload: %s", err)
+		}
+	}
+
+	// repaired files are good now
+	results, err = Fsck(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"zahar/damaged.bin.part":   "resumable false",
+		"zahar/done.bin":           "hashdiffers false",
+		"zahar/orphan.bin.part":    "nojournal false",
+		"zahar/resumable.bin.part": "resumable false",
+	}
+	if got := states(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fsck() after repair = %v, want %v", got, want)
+	}
+}
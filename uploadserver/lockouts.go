@@ -0,0 +1,206 @@
+package uploadserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lockouts of the service, its settings come from the command line.
+var Lockouts = NewFailedLogins()
+
+// FailedLogins counts failed logins of a login and from a source IP.
+// Every failure in a row doubles a delay before the next attempt, attempts during it are refused at once,
+// so failed logins hold no requests of the service.
+// After a threshold of failures a login or an IP is locked out for a time that doubles with every next failure.
+type FailedLogins struct {
+	// LoginThreshold and IPThreshold are counts of failures in a row that lock a login or an IP out, 0 never locks.
+	LoginThreshold int
+	IPThreshold    int
+	// Lockout is the first lockout, it doubles up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	// Delay is a delay before the next attempt after the first failure, it doubles up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Forget is a time after the last failure or the end of a lockout when failures are forgotten.
+	Forget time.Duration
+
+	mu       sync.Mutex
+	failures map[lockoutKey]*failures
+}
+
+// lockoutKey is either a login or an IP.
+type lockoutKey struct {
+	login, ip string
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time // the end of a lockout
+	next  time.Time // the end of a delay after the last failure
+}
+
+// constSweepLockoutsAt is a count of tracked logins and IPs when forgotten ones are removed.
+const constSweepLockoutsAt = 4096
+
+// NewFailedLogins returns FailedLogins with default settings.
+func NewFailedLogins() *FailedLogins {
+	return &FailedLogins{
+		LoginThreshold: 5,
+		IPThreshold:    20,
+		Lockout:        time.Minute,
+		MaxLockout:     time.Hour,
+		Delay:          500 * time.Millisecond,
+		MaxDelay:       8 * time.Second,
+		Forget:         time.Hour,
+		failures:       make(map[lockoutKey]*failures),
+	}
+}
+
+// Lockout is a locked out login or IP.
+type Lockout struct {
+	Login    string    `json:"login,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// doubled returns d doubled n times, but no more than max.
+func doubled(d, max time.Duration, n int) time.Duration {
+	for ; n > 0 && d < max; n-- {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func (l *FailedLogins) forgotten(f *failures, now time.Time) bool {
+	end := f.last
+	if f.until.After(end) {
+		end = f.until
+	}
+	return now.Sub(end) > l.Forget
+}
+
+// Locked returns the end of a lockout or of a delay after a failure of a login or an IP,
+// zero time when both may try now.
+func (l *FailedLogins) Locked(login, ip string, now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var until time.Time
+	for _, k := range []lockoutKey{{login: login}, {ip: ip}} {
+		f, ok := l.failures[k]
+		if !ok {
+			continue
+		}
+		for _, t := range []time.Time{f.until, f.next} {
+			if t.After(now) && t.After(until) {
+				until = t
+			}
+		}
+	}
+	return until
+}
+
+// fail counts a failure of a login and from an IP, an empty login counts the IP only.
+// It returns a delay before the next attempt and lockouts it has started.
+func (l *FailedLogins) fail(login, ip string, now time.Time) (time.Duration, []Lockout) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.failures) >= constSweepLockoutsAt {
+		for k, f := range l.failures {
+			if l.forgotten(f, now) {
+				delete(l.failures, k)
+			}
+		}
+	}
+	var delay time.Duration
+	var locked []Lockout
+	keys := []lockoutKey{{ip: ip}}
+	if login != "" {
+		keys = append(keys, lockoutKey{login: login})
+	}
+	for _, k := range keys {
+		threshold := l.IPThreshold
+		if k.login != "" {
+			threshold = l.LoginThreshold
+		}
+		f, ok := l.failures[k]
+		if !ok || l.forgotten(f, now) {
+			f = &failures{}
+			l.failures[k] = f
+		}
+		f.count++
+		f.last = now
+		d := doubled(l.Delay, l.MaxDelay, f.count-1)
+		f.next = now.Add(d)
+		if d > delay {
+			delay = d
+		}
+		if threshold > 0 && f.count >= threshold {
+			f.until = now.Add(doubled(l.Lockout, l.MaxLockout, f.count-threshold))
+			locked = append(locked, Lockout{Login: k.login, IP: k.ip, Failures: f.count, Until: f.until})
+		}
+	}
+	return delay, locked
+}
+
+// Fail counts a failed login of a request and returns a delay before the next attempt.
+// An empty login counts the source IP only. Lockouts go to the log.
+func (l *FailedLogins) Fail(c *gin.Context, login string) time.Duration {
+	now := time.Now()
+	delay, locked := l.fail(login, c.ClientIP(), now)
+	for _, lo := range locked {
+		who := "login " + lo.Login
+		if lo.Login == "" {
+			who = "IP " + lo.IP
+		}
+		log.Println(logline(c, fmt.Sprintf("%s is locked out until %s after %d failed logins", who, lo.Until.Format(time.RFC3339), lo.Failures)))
+	}
+	return delay
+}
+
+// Succeed forgets failures of a login after a successful login.
+// Failures from an IP are forgotten in time only, one good login must not clear guesses of other logins.
+func (l *FailedLogins) Succeed(login string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, lockoutKey{login: login})
+}
+
+// LockedOut returns logins and IPs locked out now, logins first.
+func (l *FailedLogins) LockedOut(now time.Time) []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make([]Lockout, 0)
+	for k, f := range l.failures {
+		if f.until.After(now) {
+			ret = append(ret, Lockout{Login: k.login, IP: k.ip, Failures: f.count, Until: f.until})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if (a.Login == "") != (b.Login == "") {
+			return a.Login != ""
+		}
+		if a.Login != b.Login {
+			return a.Login < b.Login
+		}
+		return a.IP < b.IP
+	})
+	return ret
+}
+
+// GetLockouts is a http request handler that shows locked out logins and IPs to the administrator.
+func GetLockouts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"lockouts": Lockouts.LockedOut(time.Now())})
+}
@@ -0,0 +1,87 @@
+package uploadserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockouts(t *testing.T) {
+	l := NewFailedLogins()
+	l.LoginThreshold, l.IPThreshold = 3, 5
+	l.Lockout, l.MaxLockout = time.Minute, 3*time.Minute
+	l.Delay, l.MaxDelay = time.Second, 3*time.Second
+	now := time.Now()
+
+	tests := []struct {
+		login, ip string
+		delay     time.Duration
+		locked    []Lockout // started lockouts, without Until
+	}{
+		{"zahar", "10.0.0.1", time.Second, nil},
+		{"zahar", "10.0.0.2", 2 * time.Second, nil},
+		{"", "10.0.0.1", 2 * time.Second, nil}, // an unknown login
+		{"zahar", "10.0.0.1", 3 * time.Second, []Lockout{{Login: "zahar", Failures: 3}}},
+		{"other", "10.0.0.1", 3 * time.Second, nil},
+		{"other", "10.0.0.1", 3 * time.Second, []Lockout{{IP: "10.0.0.1", Failures: 5}}},
+	}
+	for i, tt := range tests {
+		delay, locked := l.fail(tt.login, tt.ip, now)
+		if delay != tt.delay || len(locked) != len(tt.locked) {
+			t.Fatalf("%d: fail(%q, %q) = %v, %+v, want %v, %+v", i, tt.login, tt.ip, delay, locked, tt.delay, tt.locked)
+		}
+		for j := range locked {
+			if w := tt.locked[j]; locked[j].Login != w.Login || locked[j].IP != w.IP || locked[j].Failures != w.Failures {
+				t.Errorf("%d: fail(%q, %q) locked %+v, want %+v", i, tt.login, tt.ip, locked[j], w)
+			}
+		}
+	}
+
+	if until := l.Locked("zahar", "10.0.0.3", now); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("Locked() of a locked login = %v", until)
+	}
+	if until := l.Locked("other", "10.0.0.1", now); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("Locked() from a locked IP = %v", until)
+	}
+	// the next attempt waits for the longest delay of the login and the IP
+	if until := l.Locked("other", "10.0.0.2", now); !until.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("Locked() during a delay = %v, want %v", until.Sub(now), 2*time.Second)
+	}
+	if until := l.Locked("other", "10.0.0.2", now.Add(l.MaxDelay)); !until.IsZero() {
+		t.Errorf("Locked() of an unlocked login and IP after delays = %v", until)
+	}
+	if got := l.LockedOut(now); len(got) != 2 || got[0].Login != "zahar" || got[1].IP != "10.0.0.1" {
+		t.Errorf("LockedOut() = %+v", got)
+	}
+
+	// a failure after the lockout doubles it, up to MaxLockout
+	later := now.Add(2 * time.Minute)
+	if until := l.Locked("zahar", "10.0.0.3", later); !until.IsZero() {
+		t.Errorf("Locked() after the end of the lockout = %v", until)
+	}
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		l.fail("zahar", "10.0.0.3", later)
+		if until := l.Locked("zahar", "10.0.0.3", later); !until.Equal(later.Add(want)) {
+			t.Errorf("Locked() after a next failure = %v, want %v", until.Sub(later), want)
+		}
+	}
+
+	l.Succeed("zahar")
+	if got := l.LockedOut(later); len(got) != 0 {
+		t.Errorf("LockedOut() after Succeed() = %+v", got)
+	}
+	// a good login of an attacker doesn't clear guesses of other logins from its IP
+	for i := 0; i < l.IPThreshold-1; i++ {
+		l.fail(fmt.Sprintf("guess%d", i), "10.0.0.5", later)
+	}
+	l.Succeed("attacker")
+	if _, locked := l.fail("guess", "10.0.0.5", later); len(locked) != 1 || locked[0].IP != "10.0.0.5" {
+		t.Errorf("fail() after Succeed() of another login locked %+v, want IP 10.0.0.5", locked)
+	}
+
+	// failures are forgotten
+	l.fail("third", "10.0.0.4", now)
+	if delay, _ := l.fail("third", "10.0.0.4", now.Add(l.Forget+time.Second)); delay != time.Second {
+		t.Errorf("fail() after Forget delays %v, want %v", delay, time.Second)
+	}
+}
@@ -0,0 +1,140 @@
+package uploadserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// userFileName returns a full name of a file of a user by its path in the URL.
+// Files being uploaded and journals in .sha1 may not be managed by users.
+// Returns the error as a response code and a text for the user.
+func userFileName(username, urlpath string) (name string, status int, err error) {
+	const op = "uploadserver.userFileName()"
+	urlpath = path.Clean("/" + urlpath) // no way out of the user's directory with ..
+	if urlpath == "/" {
+		return "", http.StatusBadRequest, Error.ToUser(op, errPathError, "a file name is expected")
+	}
+	for _, dir := range strings.Split(path.Dir(urlpath), "/") {
+		if dir == ".sha1" {
+			return "", http.StatusForbidden, Error.ToUser(op, errPathError, "journals are managed by the service")
+		}
+	}
+	if isIncomplete(urlpath) {
+		return "", http.StatusForbidden, Error.ToUser(op, errFileIsIncomplete, path.Base(urlpath))
+	}
+	return filepath.Join(GetPathWhereToStoreByUsername(username), filepath.FromSlash(urlpath)), http.StatusOK, nil
+}
+
+// completedFileOfUser returns a full name of an existing completed file of a user by its path in the URL.
+func completedFileOfUser(username, urlpath string) (name string, status int, err error) {
+	const op = "uploadserver.completedFileOfUser()"
+	name, status, err = userFileName(username, urlpath)
+	if err != nil {
+		return "", status, err
+	}
+	stat, err := fsdriver.Store.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", http.StatusNotFound, Error.ToUser(op, errPathError, "no such file "+path.Clean("/"+urlpath))
+		}
+		return "", http.StatusInternalServerError, Error.ToUser(op, errInternalServiceError, "")
+	}
+	if stat.IsDir() {
+		return "", http.StatusForbidden, Error.ToUser(op, errPathError, "directories are not managed")
+	}
+	return name, http.StatusOK, nil
+}
+
+// DeleteStoredFile is a gin.HandlerFunc.
+// Removes a completed file of the user with its journals in .sha1.
+func DeleteStoredFile(c *gin.Context) {
+	const op = "uploadserver.DeleteStoredFile()"
+	name, status, err := completedFileOfUser(c.Param("login"), c.Param("path"))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	unlock, ok := usedfiles.lock(name, wholeFile)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": Error.ToUser(op, errRequestedFileIsBusy, filepath.Base(name)).Error()})
+		return
+	}
+	defer unlock()
+	if err := removeWithJournals(name); err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't delete %s: %s", name, err)))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	log.Println(logline(c, fmt.Sprintf("file %s is deleted by the user", name)))
+	c.Status(http.StatusNoContent)
+}
+
+// MoveStoredFile is a gin.HandlerFunc of the WebDAV method MOVE.
+// Renames a completed file of the user to a path from the Destination header,
+// ex. "Destination: /upload/zahar/dir/newname". Journals in .sha1 are moved with the file.
+// An existing destination is not overwritten.
+func MoveStoredFile(c *gin.Context) {
+	const op = "uploadserver.MoveStoredFile()"
+	username := c.Param("login")
+	name, status, err := completedFileOfUser(username, c.Param("path"))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	// Destination is an absolute URL or a path
+	prefix := "/upload/" + username + "/"
+	dest, err := url.Parse(c.GetHeader("Destination"))
+	if err != nil || !strings.HasPrefix(dest.Path, prefix) {
+		c.JSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "expecting a header Destination: "+prefix+"newname").Error()})
+		return
+	}
+	newname, status, err := userFileName(username, dest.Path[len(prefix):])
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if newname == name {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	for _, lockobject := range []string{name, newname} {
+		unlock, ok := usedfiles.lock(lockobject, wholeFile)
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": Error.ToUser(op, errRequestedFileIsBusy, filepath.Base(lockobject)).Error()})
+			return
+		}
+		defer unlock()
+	}
+	if _, err := fsdriver.Store.Stat(newname); err == nil {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": Error.ToUser(op, errDestinationExists, dest.Path).Error()})
+		return
+	} else if !os.IsNotExist(err) {
+		log.Println(logline(c, fmt.Sprintf("can't stat %s: %s", newname, err)))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	if err := fsdriver.Store.MkdirAll(filepath.Dir(newname), 0700); err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't create a directory of %s: %s", newname, err)))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	if err := renameWithJournals(name, newname); err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't move %s to %s: %s", name, newname, err)))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	log.Println(logline(c, fmt.Sprintf("file %s is moved by the user to %s", name, newname)))
+	c.Status(http.StatusCreated)
+}
@@ -0,0 +1,89 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeleteAndMoveStoredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := ConfigThisService.Storageroot
+	ConfigThisService.Storageroot = dir
+	defer func() { ConfigThisService.Storageroot = saved }()
+
+	userdir := filepath.Join(dir, "zahar")
+	os.MkdirAll(filepath.Join(userdir, ".sha1"), 0700)
+	for _, name := range []string{"a.bak", ".sha1/a.bak.sha1-00ff", "b.bak", "c.bak", "c.bak.part", "busy.bak"} {
+		if err := ioutil.WriteFile(filepath.Join(userdir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(userdir, name))
+		return err == nil
+	}
+	unlock, _ := usedfiles.lock(filepath.Join(userdir, "busy.bak"), wholeFile)
+	defer unlock()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		destination string
+		wantStatus  int
+		wantExist   []string
+		wantAbsent  []string
+	}{
+		{"move with journal", "MOVE", "/a.bak", "https://host:64000/upload/zahar/sub/new.bak", http.StatusCreated,
+			[]string{"sub/new.bak", "sub/.sha1/new.bak.sha1-00ff"}, []string{"a.bak", ".sha1/a.bak.sha1-00ff"}},
+		{"move over a file", "MOVE", "/b.bak", "/upload/zahar/c.bak", http.StatusPreconditionFailed, []string{"b.bak", "c.bak"}, nil},
+		{"move to another user", "MOVE", "/b.bak", "/upload/other/b.bak", http.StatusBadRequest, []string{"b.bak"}, nil},
+		{"move out of the user directory", "MOVE", "/b.bak", "/upload/zahar/../other/b.bak", http.StatusCreated,
+			[]string{"other/b.bak"}, []string{"../other/b.bak"}},
+		{"move to journals", "MOVE", "/c.bak", "/upload/zahar/.sha1/c.bak", http.StatusForbidden, []string{"c.bak"}, nil},
+		{"move of a busy file", "MOVE", "/busy.bak", "/upload/zahar/d.bak", http.StatusForbidden, []string{"busy.bak"}, nil},
+		{"delete of a busy file", "DELETE", "/busy.bak", "", http.StatusForbidden, []string{"busy.bak"}, nil},
+		{"delete of an incomplete file", "DELETE", "/c.bak.part", "", http.StatusForbidden, []string{"c.bak.part"}, nil},
+		{"delete of a directory", "DELETE", "/sub", "", http.StatusForbidden, []string{"sub"}, nil},
+		{"delete of an absent file", "DELETE", "/absent.bak", "", http.StatusNotFound, nil, nil},
+		{"delete with journal", "DELETE", "/sub/new.bak", "", http.StatusNoContent, nil, []string{"sub/new.bak", "sub/.sha1/new.bak.sha1-00ff"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, "/upload/zahar"+tt.path, nil)
+			c.Request.Header.Set("Destination", tt.destination)
+			c.Params = gin.Params{{Key: "login", Value: "zahar"}, {Key: "path", Value: tt.path}}
+			if tt.method == "DELETE" {
+				DeleteStoredFile(c)
+			} else {
+				MoveStoredFile(c)
+			}
+			c.Writer.WriteHeaderNow()
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, w.Code, tt.wantStatus, w.Body.String())
+			}
+			for _, name := range tt.wantExist {
+				if !exists(name) {
+					t.Errorf("%s %s: %s must exist", tt.method, tt.path, name)
+				}
+			}
+			for _, name := range tt.wantAbsent {
+				if exists(name) {
+					t.Errorf("%s %s: %s must be absent", tt.method, tt.path, name)
+				}
+			}
+		})
+	}
+}
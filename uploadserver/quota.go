@@ -0,0 +1,104 @@
+package uploadserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+	"github.com/zavla/upload/liteimp"
+	"github.com/zavla/upload/logins"
+)
+
+// KeyQuota is a key in gin.Context of a logins.Quota of an authorized user.
+const KeyQuota = "quota"
+
+// storageUsage counts bytes and files in a user storage directory.
+// Service directories, their names start with a dot, and journals are not counted.
+// Versions of files in VersionsDir are counted.
+func storageUsage(dir string) (bytes, files int64, err error) {
+	infos, err := fsdriver.Store.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") && name != VersionsDir {
+			continue
+		}
+		if fi.IsDir() {
+			b, f, err := storageUsage(filepath.Join(dir, name))
+			if err != nil {
+				return 0, 0, err
+			}
+			bytes += b
+			files += f
+			continue
+		}
+		if strings.HasSuffix(name, fsdriver.GetPartialJournalFileName("")) {
+			continue
+		}
+		bytes += fi.Size()
+		files++
+	}
+	return bytes, files, nil
+}
+
+// checkQuota says a new file of size filesize fits into a quota of the user.
+// Otherwise it responds with http.StatusInsufficientStorage and liteimp.ErrQuotaExceeded.
+func checkQuota(c *gin.Context, q userquery, filesize int64) bool {
+	const op = "uploadserver.checkQuota()"
+	v, _ := c.Get(KeyQuota)
+	quota, _ := v.(logins.Quota)
+	if quota == (logins.Quota{}) {
+		return true
+	}
+	usedbytes, usedfiles, err := storageUsage(GetPathWhereToStoreByUsername(q.username))
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't count storage usage of %s: %s", q.username, err)))
+		c.JSON(http.StatusInternalServerError,
+			gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return false
+	}
+	if quota.Allows(usedbytes, usedfiles, filesize) {
+		return true
+	}
+	log.Println(logline(c, fmt.Sprintf("quota of %s is exceeded: %d bytes in %d files, a new file of %d bytes", q.username, usedbytes, usedfiles, filesize)))
+	descr := Error.I18text("used %d of %d bytes, %d of %d files", usedbytes, quota.Bytes, usedfiles, quota.Files)
+	c.JSON(http.StatusInsufficientStorage, liteimp.JsonError{
+		Error: Error.E(op, nil, liteimp.ErrQuotaExceeded, Error.ErrKindInfoForUsers, descr).Error(),
+		Code:  liteimp.ErrQuotaExceeded,
+	})
+	return false
+}
+
+// checkFreeSpace says a new file of size filesize fits into a free space of the volume of a user storage
+// and leaves ConfigThisService.FreeSpaceReserve bytes free.
+// Otherwise it responds with http.StatusInsufficientStorage and liteimp.ErrNoFreeSpace.
+func checkFreeSpace(c *gin.Context, q userquery, filesize int64) bool {
+	const op = "uploadserver.checkFreeSpace()"
+	free, err := fsdriver.FreeSpace(q.storagepath)
+	if err != nil {
+		// the upload will fail later if there is no space
+		log.Println(logline(c, fmt.Sprintf("can't get free space of %s: %s", q.storagepath, err)))
+		return true
+	}
+	if free < 0 || filesize+ConfigThisService.FreeSpaceReserve <= free {
+		return true
+	}
+	log.Println(logline(c, fmt.Sprintf("no free space for a new file of %d bytes of %s: %d bytes are free, %d are reserved", filesize, q.username, free, ConfigThisService.FreeSpaceReserve)))
+	available := free - ConfigThisService.FreeSpaceReserve
+	if available < 0 {
+		available = 0
+	}
+	descr := Error.I18text("the file needs %d bytes, %d bytes are free", filesize, available)
+	c.JSON(http.StatusInsufficientStorage, liteimp.JsonError{
+		Error: Error.E(op, nil, liteimp.ErrNoFreeSpace, Error.ErrKindInfoForUsers, descr).Error(),
+		Code:  liteimp.ErrNoFreeSpace,
+	})
+	return false
+}
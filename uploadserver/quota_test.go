@@ -0,0 +1,34 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_storageUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]int{
+		"a.bak":                   100,
+		"sub/b.bak":               20,
+		"c.bak.part":              7, // a partial file counts
+		"c.bak.part.partialinfo":  50,
+		".sha1/a.bak.sha1-00ff00": 50,
+	}
+	for name, size := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := ioutil.WriteFile(name, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bytes, count, err := storageUsage(dir)
+	if err != nil || bytes != 127 || count != 3 {
+		t.Errorf("storageUsage() = %d bytes, %d files, %v, want 127 bytes, 3 files", bytes, count, err)
+	}
+}
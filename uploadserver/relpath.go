@@ -0,0 +1,65 @@
+package uploadserver
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	Error "github.com/zavla/upload/errstr"
+)
+
+// constmaxdepth is a maximum count of directories in a relative path of a file from a client.
+const constmaxdepth = 32
+
+// windowsDevices are names Windows reserves for devices in every directory, with any extension.
+var windowsDevices = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// placeOfFile returns a directory in a user storage userdir and a name for a file from a client.
+// The path part of filename is dropped unless ConfigThisService.KeepDirs is set, the user is logged in
+// and filename is a relative path, then its directories are recreated beneath userdir.
+func placeOfFile(userdir, username, filename string) (storagepath, name string, err error) {
+	if username == "" || !ConfigThisService.KeepDirs {
+		return userdir, filepath.Base(filepath.Clean(filename)), nil
+	}
+	dir, name, err := splitRelativePath(filename)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(userdir, dir), name, nil
+}
+
+// splitRelativePath splits a file path from a client into a directory and a name.
+// Paths may have slashes and backslashes. An absolute path, with a drive letter as well, gives an empty directory,
+// as old clients send full paths.
+// Components that may lead out of the user directory or somewhere else than they say are errors:
+// empty ones, . and .., names of directories starting with a dot (the service keeps its files there),
+// names with a colon (NTFS alternate data streams), names ending with a dot or a space and device names, Windows changes them.
+func splitRelativePath(filename string) (dir, name string, err error) {
+	const op = "uploadserver.splitRelativePath()"
+	p := strings.ReplaceAll(filename, `\`, "/")
+	if len(p) >= 2 && p[1] == ':' && (('a' <= p[0] && p[0] <= 'z') || ('A' <= p[0] && p[0] <= 'Z')) {
+		p = "/" + p[2:] // C:/backups/a.bak or C:a.bak
+	}
+	if strings.HasPrefix(p, "/") {
+		p = strings.TrimPrefix(path.Base(path.Clean(p)), "/") // "/" becomes an empty name
+	}
+	parts := strings.Split(p, "/")
+	if len(parts)-1 > constmaxdepth {
+		return "", "", Error.E(op, nil, errPathError, 0, "too many directories")
+	}
+	for i, part := range parts {
+		isdir := i < len(parts)-1
+		if part == "" || part == "." || part == ".." ||
+			(isdir && strings.HasPrefix(part, ".")) ||
+			strings.Contains(part, ":") ||
+			strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") ||
+			windowsDevices[strings.ToUpper(strings.SplitN(part, ".", 2)[0])] {
+			return "", "", Error.E(op, nil, errPathError, 0, part)
+		}
+	}
+	return filepath.Join(parts[:len(parts)-1]...), parts[len(parts)-1], nil
+}
@@ -0,0 +1,75 @@
+package uploadserver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_splitRelativePath(t *testing.T) {
+	tests := []struct {
+		filename string
+		wantDir  string
+		wantName string
+		wantErr  bool
+	}{
+		{"a.bak", "", "a.bak", false},
+		{"sub/deeper/a.bak", filepath.Join("sub", "deeper"), "a.bak", false},
+		{`sub\deeper\a.bak`, filepath.Join("sub", "deeper"), "a.bak", false},
+		{"sub/.profile", "sub", ".profile", false},
+		{"/srv/backups/a.bak", "", "a.bak", false},
+		{`\srv\backups\a.bak`, "", "a.bak", false},
+		{`C:\backups\a.bak`, "", "a.bak", false},
+		{"c:/backups/a.bak", "", "a.bak", false},
+		{"C:a.bak", "", "a.bak", false},
+		{`\\server\share\a.bak`, "", "a.bak", false},
+		{"C:", "", "", true},
+		{"/srv/..", "", "", true},
+		{"/", "", "", true},
+		{"../a.bak", "", "", true},
+		{"sub/../../a.bak", "", "", true},
+		{"sub/./a.bak", "", "", true},
+		{"sub//a.bak", "", "", true},
+		{"sub/", "", "", true},
+		{".sha1/a.bak.sha1-00", "", "", true},
+		{".versions/a.bak", "", "", true},
+		{"a.bak:stream", "", "", true},
+		{"sub:stream/a.bak", "", "", true},
+		{"sub/C:/a.bak", "", "", true},
+		{"sub./a.bak", "", "", true},
+		{"sub /a.bak", "", "", true},
+		{"nul/a.bak", "", "", true},
+		{"sub/Con.txt", "", "", true},
+		{strings.Repeat("d/", constmaxdepth+1) + "a.bak", "", "", true},
+		{strings.Repeat("d/", constmaxdepth) + "a.bak", filepath.Join(strings.Split(strings.Repeat("d/", constmaxdepth-1)+"d", "/")...), "a.bak", false},
+	}
+	for _, tt := range tests {
+		dir, name, err := splitRelativePath(tt.filename)
+		if (err != nil) != tt.wantErr || dir != tt.wantDir || name != tt.wantName {
+			t.Errorf("splitRelativePath(%q) = %q, %q, %v, want %q, %q, error %v", tt.filename, dir, name, err, tt.wantDir, tt.wantName, tt.wantErr)
+		}
+	}
+}
+
+func Test_placeOfFile(t *testing.T) {
+	defer func(saved bool) { ConfigThisService.KeepDirs = saved }(ConfigThisService.KeepDirs)
+	userdir := filepath.Join("root", "zahar")
+	tests := []struct {
+		keepdirs bool
+		username string
+		filename string
+		wantDir  string
+		wantName string
+	}{
+		{false, "zahar", "sub/a.bak", userdir, "a.bak"},
+		{true, "zahar", "sub/a.bak", filepath.Join(userdir, "sub"), "a.bak"},
+		{true, "", "sub/a.bak", userdir, "a.bak"},
+	}
+	for _, tt := range tests {
+		ConfigThisService.KeepDirs = tt.keepdirs
+		dir, name, err := placeOfFile(userdir, tt.username, tt.filename)
+		if err != nil || dir != tt.wantDir || name != tt.wantName {
+			t.Errorf("placeOfFile(%q) with KeepDirs %v = %q, %q, %v, want %q, %q", tt.filename, tt.keepdirs, dir, name, err, tt.wantDir, tt.wantName)
+		}
+	}
+}
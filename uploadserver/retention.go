@@ -0,0 +1,392 @@
+package uploadserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// RetentionRulesFile is a file name in a config directory with retention rules.
+const RetentionRulesFile = "retention.json"
+
+// RetentionRule selects completed files of a user by a name pattern and says which of them to keep.
+// Files of a rule in one directory are a series of backups. A pattern with a group splits files into
+// series by the first group, ex. `^(.+)_\d{4}-\d{2}-\d{2}\.bak$` is a series per database.
+// In a series the newest KeepLast files are kept, and the newest file of every day for Daily days,
+// of every week for Weekly weeks, of every month for Monthly months (grandfather-father-son).
+// Files matching no rule are kept.
+type RetentionRule struct {
+	User     string `json:"user"`    // a login, empty means every login
+	Pattern  string `json:"pattern"` // a regexp of file names, empty means every file
+	KeepLast int    `json:"keeplast"`
+	Daily    int    `json:"daily"`
+	Weekly   int    `json:"weekly"`
+	Monthly  int    `json:"monthly"`
+
+	re *regexp.Regexp
+}
+
+// RetentionRules are rules in the order of priority, the first matching rule is applied to a file.
+type RetentionRules struct {
+	Rules []RetentionRule `json:"rules"`
+}
+
+// ReadRetentionRules reads and validates rules from a JSON file.
+func ReadRetentionRules(filename string) (RetentionRules, error) {
+	const op = "uploadserver.ReadRetentionRules()"
+	var rules RetentionRules
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return rules, Error.E(op, err, Error.ErrFileIO, 0, filename)
+	}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return rules, Error.E(op, err, errRetentionRules, 0, filename)
+	}
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+		if r.KeepLast <= 0 && r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0 {
+			// a rule that keeps nothing is a mistake
+			return rules, Error.E(op, nil, errRetentionRules, 0, fmt.Sprintf("rule %d keeps no files", i+1))
+		}
+		r.re, err = regexp.Compile(r.Pattern)
+		if err != nil {
+			return rules, Error.E(op, err, errRetentionRules, 0, fmt.Sprintf("rule %d", i+1))
+		}
+	}
+	return rules, nil
+}
+
+// match returns a rule of a file of a user and a series name of the file.
+func (rules RetentionRules) match(user, name string) (int, string, bool) {
+	for i, r := range rules.Rules {
+		if r.User != "" && r.User != user {
+			continue
+		}
+		m := r.re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		series := ""
+		if len(m) > 1 {
+			series = m[1]
+		}
+		return i, series, true
+	}
+	return 0, "", false
+}
+
+// RetentionAction is a decision about one file.
+type RetentionAction struct {
+	Name    string // a full file name
+	ModTime time.Time
+	Rule    int    // a rule number from 1
+	Keep    bool   // false means the file is deleted
+	Reason  string // why the file is kept: last, daily, weekly, monthly, busy
+	Err     error  // of a deletion
+}
+
+func (a RetentionAction) String() string {
+	verb := "delete"
+	if a.Keep {
+		verb = "keep"
+	}
+	s := fmt.Sprintf("%-6s %s %s rule %d", verb, a.ModTime.Format("2006-01-02 15:04"), a.Name, a.Rule)
+	if a.Reason != "" {
+		s += " (" + a.Reason + ")"
+	}
+	if a.Err != nil {
+		s += ": " + a.Err.Error()
+	}
+	return s
+}
+
+type retentionfile struct {
+	name    string
+	modtime time.Time
+}
+
+// ApplyRetention applies rules to files of every user in storageroot at the moment now.
+// With dryrun nothing is deleted. A deleted file is removed with its journals in .sha1.
+// Returns decisions about every file matched by a rule.
+func ApplyRetention(rules RetentionRules, storageroot string, now time.Time, dryrun bool) ([]RetentionAction, error) {
+	const op = "uploadserver.ApplyRetention()"
+	users, err := fsdriver.Store.ReadDir(storageroot)
+	if err != nil {
+		return nil, Error.E(op, err, Error.ErrFileIO, 0, storageroot)
+	}
+	var actions []RetentionAction
+	for _, u := range users {
+		if !u.IsDir() || strings.HasPrefix(u.Name(), ".") {
+			continue
+		}
+		// series of files of a directory by a rule and a series name
+		series := make(map[string][]retentionfile)
+		seriesrule := make(map[string]int)
+		err := walkCompletedFiles(filepath.Join(storageroot, u.Name()), func(name, completed string, fi os.FileInfo) {
+			rule, s, ok := rules.match(u.Name(), filepath.Base(completed))
+			if !ok {
+				return
+			}
+			key := fmt.Sprintf("%d\x00%s\x00%s", rule, filepath.Dir(completed), s)
+			series[key] = append(series[key], retentionfile{name: name, modtime: fi.ModTime()})
+			seriesrule[key] = rule
+		})
+		if err != nil {
+			return actions, Error.E(op, err, Error.ErrFileIO, 0, u.Name())
+		}
+		keys := make([]string, 0, len(series))
+		for k := range series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			actions = append(actions, retentionOfSeries(rules.Rules[seriesrule[k]], seriesrule[k]+1, series[k], now)...)
+		}
+	}
+	if dryrun {
+		return actions, nil
+	}
+	for i := range actions {
+		if actions[i].Keep {
+			continue
+		}
+		// a file may be replaced by an upload or be deleted by its user right now
+		unlock, ok := usedfiles.lock(actions[i].Name, wholeFile)
+		if !ok {
+			actions[i].Keep, actions[i].Reason = true, "busy"
+			continue
+		}
+		actions[i].Err = removeWithJournals(actions[i].Name)
+		unlock()
+	}
+	return actions, nil
+}
+
+// retentionOfSeries decides which files of one series to keep.
+// Periods are calendar ones: Daily 1 is today, Weekly 1 is this week from Monday, Monthly 1 is this month.
+func retentionOfSeries(r RetentionRule, rulenumber int, files []retentionfile, now time.Time) []RetentionAction {
+	sort.Slice(files, func(i, j int) bool { return files[i].modtime.After(files[j].modtime) })
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	dailyFrom := today.AddDate(0, 0, 1-r.Daily)
+	sinceMonday := (int(today.Weekday()) + 6) % 7
+	weeklyFrom := today.AddDate(0, 0, -sinceMonday-7*(r.Weekly-1))
+	monthlyFrom := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, 1-r.Monthly, 0)
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	months := make(map[string]bool)
+	ret := make([]RetentionAction, len(files))
+	for i, f := range files {
+		a := RetentionAction{Name: f.name, ModTime: f.modtime, Rule: rulenumber}
+		t := f.modtime.In(now.Location())
+		year, week := t.ISOWeek()
+		day, wk, month := t.Format("2006-01-02"), fmt.Sprintf("%d-%d", year, week), t.Format("2006-01")
+		switch {
+		case i < r.KeepLast:
+			a.Keep, a.Reason = true, "last"
+		case r.Daily > 0 && !t.Before(dailyFrom) && !days[day]:
+			a.Keep, a.Reason = true, "daily"
+		case r.Weekly > 0 && !t.Before(weeklyFrom) && !weeks[wk]:
+			a.Keep, a.Reason = true, "weekly"
+		case r.Monthly > 0 && !t.Before(monthlyFrom) && !months[month]:
+			a.Keep, a.Reason = true, "monthly"
+		}
+		if a.Keep {
+			// a kept file is the newest one of its periods
+			days[day], weeks[wk], months[month] = true, true, true
+		}
+		ret[i] = a
+	}
+	return ret
+}
+
+// walkCompletedFiles calls fn for every completed file in dir and its subdirectories
+// and for every version of them in VersionsDir, completed is a name of a file the version was.
+// Other service directories, partial files and journals are skipped.
+func walkCompletedFiles(dir string, fn func(name, completed string, fi os.FileInfo)) error {
+	infos, err := fsdriver.Store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	versions, err := versionsOf(dir)
+	if err != nil {
+		return err
+	}
+	for completed, vv := range versions {
+		for _, fi := range vv {
+			fn(filepath.Join(dir, VersionsDir, fi.Name()), filepath.Join(dir, completed), fi)
+		}
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if fi.IsDir() {
+			if err := walkCompletedFiles(filepath.Join(dir, name), fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasSuffix(name, ".part") || strings.HasSuffix(name, fsdriver.GetPartialJournalFileName("")) {
+			continue
+		}
+		fn(filepath.Join(dir, name), filepath.Join(dir, name), fi)
+	}
+	return nil
+}
+
+// journalOfCompletedFile matches a suffix of a journal name in .sha1 after a file name: .<algorithm>-<hash>.
+var journalOfCompletedFile = regexp.MustCompile(`^\.[a-z0-9]+-[0-9a-f]+$`)
+
+// journalsOfCompletedFile returns names of journals of a completed file in the .sha1 directory near it.
+func journalsOfCompletedFile(name string) ([]string, error) {
+	journalsdir := filepath.Join(filepath.Dir(name), ".sha1")
+	journals, err := fsdriver.Store.ReadDir(journalsdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	base := filepath.Base(name)
+	var ret []string
+	for _, j := range journals {
+		if strings.HasPrefix(j.Name(), base) && journalOfCompletedFile.MatchString(j.Name()[len(base):]) {
+			ret = append(ret, filepath.Join(journalsdir, j.Name()))
+		}
+	}
+	return ret, nil
+}
+
+// hashOfJournal returns an algorithm and a hash from a name of a journal of a completed file name.
+func hashOfJournal(name, journal string) (alg fsdriver.HashAlgorithm, hash []byte, ok bool) {
+	base := filepath.Base(name)
+	suffix := strings.TrimPrefix(filepath.Base(journal), base)
+	if len(suffix) == len(filepath.Base(journal)) || !journalOfCompletedFile.MatchString(suffix) {
+		return alg, nil, false
+	}
+	dash := strings.IndexByte(suffix, '-')
+	alg, err := fsdriver.ParseHashAlgorithm(suffix[1:dash])
+	if err != nil {
+		return alg, nil, false
+	}
+	hash, err = hex.DecodeString(suffix[dash+1:])
+	if err != nil || fsdriver.IsEmptyHash(hash) {
+		return alg, nil, false
+	}
+	return alg, hash, true
+}
+
+// removeWithJournals removes a completed file and its journals in the .sha1 directory near it.
+// With deduplication a blob of the file is removed too when no other file is its link.
+func removeWithJournals(name string) error {
+	journals, err := journalsOfCompletedFile(name)
+	if err != nil {
+		return err
+	}
+	if err := fsdriver.Store.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, j := range journals {
+		if err := fsdriver.Store.Remove(j); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if alg, hash, ok := hashOfJournal(name, j); ok && ConfigThisService.Dedup {
+			if _, err := fsdriver.ReleaseBlob(ConfigThisService.Storageroot, alg, hash); err != nil {
+				log.Printf("a blob of a removed file %s is kept: %s\r\n", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeJournals removes journals of a completed file.
+func removeJournals(name string) error {
+	journals, err := journalsOfCompletedFile(name)
+	if err != nil {
+		return err
+	}
+	for _, j := range journals {
+		if err := fsdriver.Store.Remove(j); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameWithJournals renames a completed file and moves its journals to the .sha1 directory near the new name.
+// The directory of newname must exist.
+func renameWithJournals(oldname, newname string) error {
+	journals, err := journalsOfCompletedFile(oldname)
+	if err != nil {
+		return err
+	}
+	newjournalsdir := filepath.Join(filepath.Dir(newname), ".sha1")
+	if len(journals) > 0 {
+		if err := fsdriver.Store.MkdirAll(newjournalsdir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := fsdriver.Store.Rename(oldname, newname); err != nil {
+		return err
+	}
+	for _, j := range journals {
+		// .sha1/OLDNAME.<algorithm>-<hash> becomes .sha1/NEWNAME.<algorithm>-<hash>
+		nj := filepath.Join(newjournalsdir, filepath.Base(newname)+filepath.Base(j)[len(filepath.Base(oldname)):])
+		if err := fsdriver.Store.Rename(j, nj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintRetentionReport writes decisions, one per line.
+func PrintRetentionReport(w io.Writer, actions []RetentionAction) {
+	for _, a := range actions {
+		fmt.Fprintln(w, a.String())
+	}
+}
+
+// RunRetention applies rules from a file every interval until stop is closed.
+// Rules are reread every time, so an administrator may change them without a restart.
+func RunRetention(rulesfile, storageroot string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if _, err := os.Stat(rulesfile); os.IsNotExist(err) {
+				continue // no rules yet
+			}
+			rules, err := ReadRetentionRules(rulesfile)
+			if err != nil {
+				log.Printf("retention rules are not applied: %s\r\n", err)
+				continue
+			}
+			actions, err := ApplyRetention(rules, storageroot, now, false)
+			if err != nil {
+				log.Printf("retention failed: %s\r\n", err)
+			}
+			for _, a := range actions {
+				if !a.Keep {
+					log.Printf("retention: %s\r\n", a)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_retentionOfSeries(t *testing.T) {
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+	// a backup every day at 01:00 and at 13:00 for 100 days, the last one is 2020-03-31_01.bak
+	files := []retentionfile{{name: "2020-03-31_01.bak", modtime: time.Date(2020, 3, 31, 1, 0, 0, 0, time.UTC)}}
+	for d := 1; d < 100; d++ {
+		day := time.Date(2020, 3, 31, 1, 0, 0, 0, time.UTC).AddDate(0, 0, -d)
+		files = append(files,
+			retentionfile{name: day.Format("2006-01-02") + "_01.bak", modtime: day},
+			retentionfile{name: day.Format("2006-01-02") + "_13.bak", modtime: day.Add(12 * time.Hour)},
+		)
+	}
+	tests := []struct {
+		name string
+		rule RetentionRule
+		want map[string]string // kept files and reasons
+	}{
+		{
+			name: "last",
+			rule: RetentionRule{KeepLast: 3},
+			want: map[string]string{"2020-03-31_01.bak": "last", "2020-03-30_13.bak": "last", "2020-03-30_01.bak": "last"},
+		},
+		{
+			name: "daily",
+			rule: RetentionRule{Daily: 3},
+			want: map[string]string{"2020-03-31_01.bak": "daily", "2020-03-30_13.bak": "daily", "2020-03-29_13.bak": "daily"},
+		},
+		{
+			name: "last and daily",
+			rule: RetentionRule{KeepLast: 2, Daily: 2},
+			want: map[string]string{"2020-03-31_01.bak": "last", "2020-03-30_13.bak": "last"},
+		},
+		{
+			name: "weekly",
+			rule: RetentionRule{Weekly: 2},
+			// 2020-03-31 is Tuesday, weeks start on Monday
+			want: map[string]string{"2020-03-31_01.bak": "weekly", "2020-03-29_13.bak": "weekly"},
+		},
+		{
+			name: "monthly",
+			rule: RetentionRule{Monthly: 3},
+			want: map[string]string{"2020-03-31_01.bak": "monthly", "2020-02-29_13.bak": "monthly", "2020-01-31_13.bak": "monthly"},
+		},
+		{
+			name: "GFS",
+			rule: RetentionRule{KeepLast: 1, Daily: 2, Weekly: 2, Monthly: 2},
+			want: map[string]string{
+				"2020-03-31_01.bak": "last",
+				"2020-03-30_13.bak": "daily",
+				"2020-03-29_13.bak": "weekly",
+				"2020-02-29_13.bak": "monthly",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := retentionOfSeries(tt.rule, 1, append([]retentionfile(nil), files...), now)
+			if len(actions) != len(files) {
+				t.Fatalf("retentionOfSeries() returned %d actions, want %d", len(actions), len(files))
+			}
+			got := make(map[string]string)
+			for _, a := range actions {
+				if a.Keep {
+					got[a.Name] = a.Reason
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retentionOfSeries() keeps %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+	files := map[string]int{ // name and age in days
+		"zahar/db1_2020-03-31.bak":                              0,
+		"zahar/db1_2020-03-30.bak":                              1,
+		"zahar/db1_2020-03-29.bak":                              2,
+		"zahar/db2_2020-03-29.bak":                              2, // another series
+		"zahar/notes.txt":                                       2, // no rule
+		"zahar/db1_2020-03-28.bak.part":                         3, // being uploaded
+		"zahar/.sha1/db1_2020-03-29.bak.sha1-00ff":              2,
+		"zahar/.sha1/db1_2020-03-29.bak.sha256-00ff":            2,
+		"zahar/.sha1/db1_2020-03-29.bak.old.sha1-00ff":          2, // a journal of another file
+		"zahar/sub/db1_2020-03-29.bak":                          2, // another directory
+		"other/db1_2020-03-29.bak":                              2, // another user
+		".blobs/sha1/00/00ff":                                   2,
+		"zahar/db1_2020-03-28.bak.part.partialinfo":             3,
+		"zahar/sub/.sha1/db1_2020-03-29.bak.blake2b-00ff":       2,
+		"zahar/.versions/db1_2020-03-31.bak;v1":                 5, // a former version is in the series
+		"zahar/.versions/.sha1/db1_2020-03-31.bak;v1.sha1-00ff": 5,
+	}
+	for name, age := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.AddDate(0, 0, -age)
+		os.Chtimes(name, mtime, mtime)
+	}
+	rules := RetentionRules{Rules: []RetentionRule{
+		{User: "zahar", Pattern: `^(.+)_\d{4}-\d{2}-\d{2}\.bak$`, KeepLast: 1},
+	}}
+	for i := range rules.Rules {
+		rules.Rules[i].re = regexp.MustCompile(rules.Rules[i].Pattern)
+	}
+
+	deleted := []string{"zahar/db1_2020-03-30.bak", "zahar/db1_2020-03-29.bak", "zahar/.versions/db1_2020-03-31.bak;v1"}
+	gone := append(deleted, "zahar/.sha1/db1_2020-03-29.bak.sha1-00ff", "zahar/.sha1/db1_2020-03-29.bak.sha256-00ff",
+		"zahar/.versions/.sha1/db1_2020-03-31.bak;v1.sha1-00ff")
+
+	actions, err := ApplyRetention(rules, dir, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range actions {
+		if !a.Keep {
+			rel, _ := filepath.Rel(dir, a.Name)
+			got = append(got, filepath.ToSlash(rel))
+		}
+	}
+	if !reflect.DeepEqual(got, deleted) {
+		t.Errorf("ApplyRetention() deletes %v, want %v", got, deleted)
+	}
+	if len(actions) != 6 {
+		t.Errorf("ApplyRetention() returned %d actions, want 6", len(actions))
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("dry run deleted %s", name)
+		}
+	}
+
+	// a file being replaced or deleted is skipped
+	busy := filepath.Join(dir, deleted[0])
+	unlock, _ := usedfiles.lock(busy, wholeFile)
+	actions, err = ApplyRetention(rules, dir, now, false)
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range actions {
+		if a.Name == busy && (!a.Keep || a.Reason != "busy") {
+			t.Errorf("ApplyRetention() of a busy file = %v", a)
+		}
+	}
+	if _, err := os.Stat(busy); err != nil {
+		t.Errorf("ApplyRetention() deleted a busy file")
+	}
+
+	if _, err := ApplyRetention(rules, dir, now, false); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		wantgone := false
+		for _, g := range gone {
+			wantgone = wantgone || g == name
+		}
+		if wantgone != os.IsNotExist(err) {
+			t.Errorf("%s exists %v, want %v", name, err == nil, !wantgone)
+		}
+	}
+}
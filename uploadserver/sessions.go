@@ -0,0 +1,212 @@
+package uploadserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// constSessionLifetime is a lifetime of a session and of its cookie.
+const constSessionLifetime = 8 * time.Hour
+
+// Session is a state of an upload of one file, a client holds its ID in a cookie.
+type Session struct {
+	Username  string
+	Fullpath  string                 // a file name from a client
+	Hash      string                 // hex of a hash from a client, may be empty
+	Algorithm fsdriver.HashAlgorithm // of Hash
+	Filesize  int64                  // from a client, 0 when not given
+	Expires   time.Time
+}
+
+// Expired says the session has ended at the moment now.
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// SessionStore holds sessions by their IDs.
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Get returns a not expired session.
+	Get(id string) (Session, bool)
+	Put(id string, s Session) error
+	Delete(id string) error
+	// Sweep deletes sessions expired at the moment now.
+	Sweep(now time.Time) error
+}
+
+// Sessions holds upload sessions of this service.
+// The default keeps sessions in memory, a service may keep them on disk to survive restarts.
+var Sessions SessionStore = NewMemorySessions()
+
+// SweepSessions deletes expired sessions every interval until stop is closed.
+func SweepSessions(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if err := Sessions.Sweep(now); err != nil {
+				log.Printf("sweeping of expired sessions failed: %s\r\n", err)
+			}
+		}
+	}
+}
+
+// MemorySessions is a SessionStore in memory.
+type MemorySessions struct {
+	mu sync.Mutex
+	m  map[string]Session
+}
+
+// NewMemorySessions creates an empty MemorySessions.
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{m: make(map[string]Session)}
+}
+
+// Get implements SessionStore.
+func (ms *MemorySessions) Get(id string) (Session, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.m[id]
+	if !ok || s.Expired(time.Now()) {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// Put implements SessionStore.
+func (ms *MemorySessions) Put(id string, s Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.m[id] = s
+	return nil
+}
+
+// Delete implements SessionStore.
+func (ms *MemorySessions) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.m, id)
+	return nil
+}
+
+// Sweep implements SessionStore.
+func (ms *MemorySessions) Sweep(now time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, s := range ms.m {
+		if s.Expired(now) {
+			delete(ms.m, id)
+		}
+	}
+	return nil
+}
+
+// DiskSessions is a SessionStore with a JSON file per session in Dir.
+// Dir is created at the first Put, so a storage root may be attached later.
+type DiskSessions struct {
+	Dir string
+}
+
+// validSessionID says id may be a file name. IDs are uuids.
+func validSessionID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	return strings.Trim(id, "0123456789abcdefABCDEF-") == ""
+}
+
+func (ds *DiskSessions) filename(id string) string {
+	return filepath.Join(ds.Dir, id+".json")
+}
+
+// Get implements SessionStore.
+func (ds *DiskSessions) Get(id string) (Session, bool) {
+	if !validSessionID(id) {
+		return Session{}, false
+	}
+	b, err := ioutil.ReadFile(ds.filename(id))
+	if err != nil {
+		return Session{}, false
+	}
+	var s Session
+	if err := json.Unmarshal(b, &s); err != nil || s.Expired(time.Now()) {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// Put implements SessionStore.
+// A session file is written to a temporary file and renamed, so Get never reads a part of it.
+func (ds *DiskSessions) Put(id string, s Session) error {
+	const op = "uploadserver.DiskSessions.Put()"
+	if !validSessionID(id) {
+		return Error.E(op, nil, errWrongFuncParameters, 0, id)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return Error.E(op, err, errInternalServiceError, 0, "")
+	}
+	if err := os.MkdirAll(ds.Dir, 0700); err != nil {
+		return Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	tmp := ds.filename(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	if err := os.Rename(tmp, ds.filename(id)); err != nil {
+		os.Remove(tmp)
+		return Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	return nil
+}
+
+// Delete implements SessionStore.
+func (ds *DiskSessions) Delete(id string) error {
+	const op = "uploadserver.DiskSessions.Delete()"
+	if !validSessionID(id) {
+		return nil
+	}
+	if err := os.Remove(ds.filename(id)); err != nil && !os.IsNotExist(err) {
+		return Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	return nil
+}
+
+// Sweep implements SessionStore. Unreadable session files are deleted too.
+func (ds *DiskSessions) Sweep(now time.Time) error {
+	const op = "uploadserver.DiskSessions.Sweep()"
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(ds.Dir, name))
+		var s Session
+		if err == nil {
+			err = json.Unmarshal(b, &s)
+		}
+		if err != nil || s.Expired(now) {
+			os.Remove(filepath.Join(ds.Dir, name))
+		}
+	}
+	return nil
+}
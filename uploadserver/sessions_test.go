@@ -0,0 +1,70 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+func TestSessionStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	live := Session{Username: "user", Fullpath: "dir/f.bak", Hash: "00ff", Algorithm: fsdriver.SHA256, Filesize: 10, Expires: now.Add(time.Hour)}
+	expired := Session{Username: "user", Fullpath: "g.bak", Expires: now.Add(-time.Second)}
+	stores := []struct {
+		name  string
+		store SessionStore
+	}{
+		{"memory", NewMemorySessions()},
+		{"disk", &DiskSessions{Dir: filepath.Join(dir, ".sessions")}},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			const id1, id2 = "1b4e28ba-2fa1-11d2-883f-0016d3cca427", "2b4e28ba-2fa1-11d2-883f-0016d3cca427"
+			if _, ok := tt.store.Get(id1); ok {
+				t.Error("Get() of an absent session succeeded")
+			}
+			if err := tt.store.Put(id1, live); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.store.Put(id2, expired); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := tt.store.Get(id1); !ok || got.Fullpath != live.Fullpath || got.Algorithm != live.Algorithm || got.Filesize != live.Filesize {
+				t.Errorf("Get() = %v, %v, want %v", got, ok, live)
+			}
+			if _, ok := tt.store.Get(id2); ok {
+				t.Error("Get() of an expired session succeeded")
+			}
+			if err := tt.store.Sweep(now); err != nil {
+				t.Error(err)
+			}
+			if _, ok := tt.store.Get(id1); !ok {
+				t.Error("Sweep() deleted a live session")
+			}
+			if err := tt.store.Delete(id1); err != nil {
+				t.Error(err)
+			}
+			if _, ok := tt.store.Get(id1); ok {
+				t.Error("Get() of a deleted session succeeded")
+			}
+		})
+	}
+	// expired session files are removed
+	files, _ := ioutil.ReadDir(filepath.Join(dir, ".sessions"))
+	if len(files) != 0 {
+		t.Errorf("DiskSessions.Sweep() left %d files", len(files))
+	}
+	if err := (&DiskSessions{Dir: dir}).Put("../escape", live); err == nil {
+		t.Error("DiskSessions.Put() accepted a path as a session ID")
+	}
+}
@@ -1,8 +1,15 @@
 package uploadserver
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/fsdriver"
 )
 
 func producer(chI1 chan []byte, n int) {
@@ -67,3 +74,142 @@ func BenchmarkArrayIntoChannel(b *testing.B) {
 		consumer2(chI2)
 	}
 }
+
+// benchmarkDurability uploads 10MB files through consumeSourceChannel with durability d.
+func benchmarkDurability(b *testing.B, d fsdriver.Durability) {
+	dir, err := ioutil.TempDir("", "durability")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const n = 160
+	filesize := int64(n * 65535)
+	b.SetBytes(filesize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("f%d", i)
+		b.StopTimer()
+		if err := fsdriver.CreateNewPartialJournalFile(dir, name, filesize, fsdriver.SHA1, nil); err != nil {
+			b.Fatal(err)
+		}
+		chSource := make(chan []byte, constChRecieverBufferLen)
+		chResult := make(chan writeresult)
+		b.StartTimer()
+		go consumeSourceChannel(&gin.Context{}, chSource, chResult, dir, name, fsdriver.JournalRecord{}, d, nil, make(chan struct{}))
+		go producer(chSource, n)
+		if res, ok := waitForWriteToFinish(chResult, filesize); !ok {
+			b.Fatalf("write failed: %v", res.err)
+		}
+	}
+}
+
+func BenchmarkDurabilityNone(b *testing.B) {
+	benchmarkDurability(b, fsdriver.Durability{Mode: fsdriver.DurabilityNone})
+}
+
+func BenchmarkDurabilityBlock(b *testing.B) {
+	benchmarkDurability(b, fsdriver.Durability{Mode: fsdriver.DurabilityBlock})
+}
+
+func BenchmarkDurabilityPeriodic(b *testing.B) {
+	benchmarkDurability(b, fsdriver.Durability{Mode: fsdriver.DurabilityPeriodic, EveryBytes: 4 << 20, Every: time.Second})
+}
+
+func BenchmarkDurabilityDsync(b *testing.B) {
+	benchmarkDurability(b, fsdriver.Durability{Mode: fsdriver.DurabilityDsync})
+}
+
+var segment = getbytes(1, 4096)
+
+// segmentReader reads like a connection does, at most 4096 bytes at a time.
+type segmentReader struct {
+	left int
+}
+
+func (r *segmentReader) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if n > 4096 {
+		n = 4096
+	}
+	if n > r.left {
+		n = r.left
+	}
+	r.left -= n
+	return copy(b, segment[:n]), nil
+}
+
+func (r *segmentReader) Close() error { return nil }
+
+// fillRecieverChannelCopying is the former reciever, it copies every block into a new slice.
+func fillRecieverChannelCopying(c io.ReadCloser, chReciever chan []byte, done <-chan struct{}, blocklen int) error {
+	defer close(chReciever)
+	bigBuffer := make([]byte, blocklen)
+	bigBufLen := 0
+	b := make([]byte, blocklen)
+	for {
+		n, err := c.Read(b)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for ncopied := 0; ncopied < n; {
+			m := copy(bigBuffer[bigBufLen:], b[ncopied:n])
+			ncopied += m
+			bigBufLen += m
+			if bigBufLen == blocklen {
+				bigBufferEscapes := make([]byte, bigBufLen)
+				copy(bigBufferEscapes, bigBuffer)
+				select {
+				case <-done:
+					return nil
+				case chReciever <- bigBufferEscapes:
+				}
+				bigBufLen = 0
+			}
+		}
+		if err == io.EOF {
+			if bigBufLen > 0 {
+				chReciever <- bigBuffer[:bigBufLen]
+			}
+			return nil
+		}
+	}
+}
+
+const benchUploadLen = 64 << 20
+
+// benchmarkRecieve runs uploads in parallel through a reciever and a consumer that puts blocks back to pool.
+func benchmarkRecieve(b *testing.B, recieve func(r io.ReadCloser, ch chan []byte, done chan struct{}) error, pool *bufferPool) {
+	b.ReportAllocs()
+	b.SetBytes(benchUploadLen)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ch := make(chan []byte, constChRecieverBufferLen)
+			done := make(chan struct{})
+			go func() {
+				for block := range ch {
+					_ = block[len(block)-1]
+					pool.put(block)
+				}
+			}()
+			if err := recieve(&segmentReader{left: benchUploadLen}, ch, done); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRecieveCopying(b *testing.B) {
+	benchmarkRecieve(b, func(r io.ReadCloser, ch chan []byte, done chan struct{}) error {
+		return fillRecieverChannelCopying(r, ch, done, constRecieveBlockLen)
+	}, nil)
+}
+
+func BenchmarkRecievePool(b *testing.B) {
+	pool := newBufferPool(constRecievePoolBlocks, constRecieveBlockLen)
+	benchmarkRecieve(b, func(r io.ReadCloser, ch chan []byte, done chan struct{}) error {
+		return fillRecieverChannel(r, ch, done, pool)
+	}, pool)
+}
@@ -0,0 +1,143 @@
+package uploadserver
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+)
+
+// QuarantineDir is a directory in a storage root where stale partial uploads are moved to.
+const QuarantineDir = ".quarantine"
+
+// StalePartials is a policy of removal of partial uploads whose clients never came back.
+// An age of a partial upload is the time since the last write to its journal or to its partial file.
+type StalePartials struct {
+	After time.Duration // 0 keeps partial uploads forever
+	// Users overrides After for logins, 0 keeps partial uploads of a login forever.
+	Users map[string]time.Duration
+	// Quarantine moves stale files to QuarantineDir/<date>/ instead of deleting them.
+	Quarantine bool
+}
+
+// after returns an age of stale partial uploads of a user.
+func (p StalePartials) after(user string) time.Duration {
+	if d, ok := p.Users[user]; ok {
+		return d
+	}
+	return p.After
+}
+
+// SweepStalePartials removes partial uploads older than the policy allows at the moment now.
+// Files being uploaded at the moment are skipped.
+// Returns names of removed files.
+func SweepStalePartials(p StalePartials, storageroot string, now time.Time) ([]string, error) {
+	const op = "uploadserver.SweepStalePartials()"
+	users, err := fsdriver.Store.ReadDir(storageroot)
+	if err != nil {
+		return nil, Error.E(op, err, Error.ErrFileIO, 0, storageroot)
+	}
+	var removed []string
+	for _, u := range users {
+		if !u.IsDir() || strings.HasPrefix(u.Name(), ".") {
+			continue
+		}
+		after := p.after(u.Name())
+		if after <= 0 {
+			continue
+		}
+		err := sweepStalePartialsDir(p, storageroot, filepath.Join(storageroot, u.Name()), now.Add(-after), now, &removed)
+		if err != nil {
+			return removed, Error.E(op, err, Error.ErrFileIO, 0, u.Name())
+		}
+	}
+	return removed, nil
+}
+
+func sweepStalePartialsDir(p StalePartials, storageroot, dir string, olderthan, now time.Time, removed *[]string) error {
+	infos, err := fsdriver.Store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// the last write to a partial upload by a name of its completed file
+	lastwrite := make(map[string]time.Time)
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if fi.IsDir() {
+			if err := sweepStalePartialsDir(p, storageroot, filepath.Join(dir, name), olderthan, now, removed); err != nil {
+				return err
+			}
+			continue
+		}
+		name = strings.TrimSuffix(name, fsdriver.GetPartialJournalFileName(""))
+		if !strings.HasSuffix(name, ".part") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".part")
+		if t, ok := lastwrite[name]; !ok || fi.ModTime().After(t) {
+			lastwrite[name] = fi.ModTime()
+		}
+	}
+	for name, t := range lastwrite {
+		if !t.Before(olderthan) {
+			continue
+		}
+		// a client may come back right now
+		unlock, ok := usedfiles.lock(filepath.Join(dir, name), wholeFile)
+		if !ok {
+			continue
+		}
+		for _, f := range []string{name + ".part", fsdriver.GetPartialJournalFileName(name + ".part")} {
+			f = filepath.Join(dir, f)
+			if err := removeStalePartial(p, storageroot, f, now); err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("stale partial upload %s is not removed: %s\r\n", f, err)
+				}
+				continue
+			}
+			log.Printf("stale partial upload %s is removed, last write at %s\r\n", f, t.Format(time.RFC3339))
+			*removed = append(*removed, f)
+		}
+		unlock()
+	}
+	return nil
+}
+
+// removeStalePartial deletes a file or moves it to the quarantine.
+func removeStalePartial(p StalePartials, storageroot, name string, now time.Time) error {
+	if !p.Quarantine {
+		return fsdriver.Store.Remove(name)
+	}
+	rel, err := filepath.Rel(storageroot, name)
+	if err != nil {
+		return err
+	}
+	newname := filepath.Join(storageroot, QuarantineDir, now.Format("2006-01-02"), rel)
+	if err := fsdriver.Store.MkdirAll(filepath.Dir(newname), 0700); err != nil {
+		return err
+	}
+	return fsdriver.Store.Rename(name, newname)
+}
+
+// RunStalePartialsSweeper applies the policy every interval until stop is closed.
+func RunStalePartialsSweeper(p StalePartials, storageroot string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if _, err := SweepStalePartials(p, storageroot, now); err != nil {
+				log.Printf("sweeping of stale partial uploads failed: %s\r\n", err)
+			}
+		}
+	}
+}
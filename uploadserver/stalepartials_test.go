@@ -0,0 +1,96 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zavla/upload/fsdriver"
+)
+
+func TestSweepStalePartials(t *testing.T) {
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+	files := map[string]time.Duration{ // name and age
+		"zahar/old.bak.part":                    10 * 24 * time.Hour,
+		"zahar/old.bak.part.partialinfo":        10 * 24 * time.Hour,
+		"zahar/sub/old.bak.part":                10 * 24 * time.Hour,
+		"zahar/sub/old.bak.part.partialinfo":    10 * 24 * time.Hour,
+		"zahar/journal.bak.part":                10 * 24 * time.Hour,
+		"zahar/journal.bak.part.partialinfo":    time.Hour, // written recently
+		"zahar/busy.bak.part":                   10 * 24 * time.Hour,
+		"zahar/busy.bak.part.partialinfo":       10 * 24 * time.Hour,
+		"zahar/new.bak.part":                    time.Hour,
+		"zahar/new.bak.part.partialinfo":        time.Hour,
+		"zahar/complete.bak":                    10 * 24 * time.Hour,
+		"keeper/old.bak.part":                   100 * 24 * time.Hour,
+		"keeper/old.bak.part.partialinfo":       100 * 24 * time.Hour,
+		"patient/old.bak.part":                  10 * 24 * time.Hour,
+		"patient/old.bak.part.partialinfo":      10 * 24 * time.Hour,
+		"patient/older.bak.part":                40 * 24 * time.Hour,
+		"patient/older.bak.part.partialinfo":    40 * 24 * time.Hour,
+		"zahar/.sha1/gone.bak.part.partialinfo": 10 * 24 * time.Hour,
+	}
+	policy := StalePartials{
+		After: 7 * 24 * time.Hour,
+		Users: map[string]time.Duration{"keeper": 0, "patient": 30 * 24 * time.Hour},
+	}
+	want := []string{
+		"patient/older.bak.part",
+		"patient/older.bak.part.partialinfo",
+		"zahar/old.bak.part",
+		"zahar/old.bak.part.partialinfo",
+		"zahar/sub/old.bak.part",
+		"zahar/sub/old.bak.part.partialinfo",
+	}
+
+	for _, quarantine := range []bool{false, true} {
+		root, err := ioutil.TempDir("", "stalepartials")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for name, age := range files {
+			name = filepath.Join(root, name)
+			os.MkdirAll(filepath.Dir(name), 0700)
+			if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(name, now.Add(-age), now.Add(-age))
+		}
+		unlock, _ := usedfiles.lock(filepath.Join(root, "zahar", "busy.bak"), fsdriver.Range{Startoffset: 0, Count: 1})
+
+		policy.Quarantine = quarantine
+		removed, err := SweepStalePartials(policy, root, now)
+		unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, name := range removed {
+			rel, _ := filepath.Rel(root, name)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SweepStalePartials(quarantine=%v) = %v, want %v", quarantine, got, want)
+		}
+		for name := range files {
+			_, err := os.Stat(filepath.Join(root, name))
+			isremoved := false
+			for _, w := range want {
+				isremoved = isremoved || w == name
+			}
+			if isremoved != os.IsNotExist(err) {
+				t.Errorf("SweepStalePartials(quarantine=%v): %s exists %v", quarantine, name, err == nil)
+			}
+			_, err = os.Stat(filepath.Join(root, QuarantineDir, now.Format("2006-01-02"), name))
+			if (isremoved && quarantine) != (err == nil) {
+				t.Errorf("SweepStalePartials(quarantine=%v): %s in quarantine %v", quarantine, name, err == nil)
+			}
+		}
+	}
+}
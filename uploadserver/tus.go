@@ -0,0 +1,484 @@
+package uploadserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Error "github.com/zavla/upload/errstr"
+	"github.com/zavla/upload/fsdriver"
+	"github.com/zavla/upload/liteimp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// This file implements a tus.io resumable upload protocol 1.0.0 endpoint.
+// Supported extensions are: creation, checksum, termination.
+// It lets off-the-shelf clients (rclone, tus-js-client, Uppy) upload files
+// into the same per-user storage and through the same fsdriver journal as ServeAnUpload does.
+//
+// Routes are:
+// OPTIONS /files/:login          - server capabilities
+// POST    /files/:login          - creation, Upload-Length and Upload-Metadata 'filename' are required
+// HEAD    /files/:login/:id      - current Upload-Offset
+// PATCH   /files/:login/:id      - appends bytes at Upload-Offset
+// DELETE  /files/:login/:id      - termination of an incomplete upload
+//
+// An upload id is a base64url representation of a filename,
+// so an upload survives restarts of the service and needs no server side sessions.
+
+const (
+	tusResumable  = "1.0.0"
+	tusExtensions = "creation,checksum,termination"
+	// tusChecksumAlgorithms is a list of algorithms for the Upload-Checksum header.
+	tusChecksumAlgorithms = "sha1,sha256,blake2b"
+	// tusContentType is the only Content-Type allowed in PATCH requests.
+	tusContentType = "application/offset+octet-stream"
+	// tusStatusChecksumMismatch is a tus specific http status.
+	tusStatusChecksumMismatch = 460
+)
+
+// TusBasePath is a path prefix of tus endpoint. Location header of a new upload begins with it.
+const TusBasePath = "/files/"
+
+// tusHeaders sets headers that every tus response must have.
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumable)
+	c.Header("Cache-Control", "no-store")
+}
+
+// tusCheckVersion checks the Tus-Resumable header of a request.
+// It writes a response and returns false when the client speaks unsupported version.
+func tusCheckVersion(c *gin.Context) bool {
+	if c.GetHeader("Tus-Resumable") != tusResumable {
+		c.Header("Tus-Version", tusResumable)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusEncodeID makes an upload id from a filename.
+func tusEncodeID(filename string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(filename))
+}
+
+// tusDecodeID extracts a filename from an upload id.
+func tusDecodeID(id string) (string, error) {
+	const op = "uploadserver.tusDecodeID()"
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(b) == 0 {
+		return "", Error.E(op, err, errPathError, 0, "bad upload id")
+	}
+	return string(b), nil
+}
+
+// tusParseMetadata parses the Upload-Metadata header.
+// It is a comma separated list of 'key base64value' pairs, a value is optional.
+func tusParseMetadata(s string) (map[string]string, error) {
+	const op = "uploadserver.tusParseMetadata()"
+	ret := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		fields := strings.Fields(kv)
+		switch len(fields) {
+		case 1:
+			ret[fields[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return ret, Error.E(op, err, errWrongURLParameters, 0, "Upload-Metadata value is not base64")
+			}
+			ret[fields[0]] = string(v)
+		default:
+			return ret, Error.E(op, nil, errWrongURLParameters, 0, "Upload-Metadata is malformed")
+		}
+	}
+	return ret, nil
+}
+
+// tusParseChecksum parses the Upload-Checksum header: 'algorithm base64value'.
+func tusParseChecksum(s string) (hash.Hash, []byte, error) {
+	const op = "uploadserver.tusParseChecksum()"
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, nil, Error.E(op, nil, errWrongURLParameters, 0, "Upload-Checksum is malformed")
+	}
+	alg, err := fsdriver.ParseHashAlgorithm(fields[0])
+	if err != nil {
+		return nil, nil, Error.E(op, err, errWrongURLParameters, 0, "unsupported checksum algorithm")
+	}
+	want, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, Error.E(op, err, errWrongURLParameters, 0, "Upload-Checksum value is not base64")
+	}
+	return alg.New(), want, nil
+}
+
+// tusUserquery makes a userquery from the :id URL parameter.
+func tusUserquery(c *gin.Context) (userquery, bool) {
+	const op = "uploadserver.tusUserquery()"
+	filename, err := tusDecodeID(c.Param("id"))
+	if err == nil {
+		var q userquery
+		q, err = userqueryFromFilename(c, filename)
+		if err == nil {
+			return q, true
+		}
+	}
+	log.Println(logline(c, fmt.Sprintf("tus upload id is bad: %s", err)))
+	c.AbortWithStatusJSON(http.StatusNotFound,
+		gin.H{"error": Error.ToUser(op, errPathError, "no such upload").Error()})
+	return userquery{}, false
+}
+
+// tusLock locks a file the same way ServeAnUpload does.
+// Returns a function to unlock.
+func tusLock(c *gin.Context, q userquery) (func(), bool) {
+	const op = "uploadserver.tusLock()"
+	unlock, ok := usedfiles.lock(q.lockobject(), wholeFile)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusLocked,
+			gin.H{"error": Error.ToUser(op, errRequestedFileIsBusy, q.fullpath).Error()})
+		return nil, false
+	}
+	return unlock, true
+}
+
+// tusIsComplete returns the size of a completely uploaded file.
+// A file with an upload of its new version is not complete.
+func tusIsComplete(q userquery) (int64, bool) {
+	stat, err := fsdriver.Store.Stat(filepath.Join(q.storagepath, q.name))
+	if err != nil {
+		return 0, false
+	}
+	if _, err := fsdriver.Store.Stat(filepath.Join(q.storagepath, fsdriver.GetPartialJournalFileName(q.nameNotComplete))); err == nil {
+		return 0, false
+	}
+	return stat.Size(), true
+}
+
+// TusOptions is a gin.HandlerFunc. It reports the server capabilities.
+func TusOptions(c *gin.Context) {
+	tusHeaders(c)
+	c.Header("Tus-Version", tusResumable)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	c.Status(http.StatusNoContent)
+}
+
+// TusCreate is a gin.HandlerFunc for the 'creation' extension.
+// It creates a journal file and an empty actual file and responds with a Location of the new upload.
+// If an upload of the same file with the same length already exists it responds with its Location.
+func TusCreate(c *gin.Context) {
+	const op = "uploadserver.TusCreate()"
+	tusHeaders(c)
+	if !tusCheckVersion(c) {
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "Upload-Length header is required").Error()})
+		return
+	}
+	meta, err := tusParseMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filename := meta["filename"]
+	if filename == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "Upload-Metadata must have a 'filename'").Error()})
+		return
+	}
+	q, err := userqueryFromFilename(c, filename)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errPathError, filename).Error()})
+		return
+	}
+	// a hash of the whole file is in 'hash_algorithm' and 'hash', old clients give 'sha1'
+	q.algorithm, err = fsdriver.ParseHashAlgorithm(meta["hash_algorithm"])
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "hash_algorithm may be one of: "+strings.Join(fsdriver.HashAlgorithms, ", ")).Error()})
+		return
+	}
+	q.strhash = meta["hash"]
+	if q.strhash == "" && q.algorithm == fsdriver.SHA1 {
+		q.strhash = meta["sha1"]
+	}
+	hashfromclient := hashFromClient(c, q)
+
+	unlock, ok := tusLock(c, q)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	location := TusBasePath + c.Param("login") + "/" + tusEncodeID(q.fullpath)
+
+	whatIsInFile, err := mayUpload(c, q)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("upload is not allowed %s: %s", q.name, err)))
+		c.AbortWithStatusJSON(http.StatusForbidden,
+			gin.H{"error": Error.ToUser(op, liteimp.ErrUploadIsNotAllowed, q.fullpath).Error()})
+		return
+	}
+	if whatIsInFile.Startoffset != 0 || whatIsInFile.FileSize != 0 {
+		// an upload already exists
+		if whatIsInFile.FileSize != length {
+			c.AbortWithStatusJSON(http.StatusConflict,
+				gin.H{"error": Error.ToUser(op, liteimp.ErrUploadIsNotAllowed, "an upload of this file with another Upload-Length exists").Error()})
+			return
+		}
+		c.Header("Location", location)
+		c.Header("Upload-Offset", strconv.FormatInt(whatIsInFile.Startoffset, 10))
+		c.Status(http.StatusCreated)
+		return
+	}
+
+	if !checkQuota(c, q, length) || !checkFreeSpace(c, q, length) {
+		return
+	}
+	if length > 0 && linkStoredContent(c, q, length) {
+		// the service has this content already, the upload is complete
+		c.Header("Location", location)
+		c.Header("Upload-Offset", strconv.FormatInt(length, 10))
+		c.Status(http.StatusCreated)
+		return
+	}
+
+	_, err = createUpload(c, q, length, hashfromclient)
+	if length == 0 && fsdriver.MayRepare(err) {
+		// an empty file is complete at once
+		err = nil
+	}
+	if err != nil {
+		log.Println(logline(c, err.Error()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError,
+			gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+		return
+	}
+	log.Println(logline(c, fmt.Sprintf("tus upload created: %s, %d bytes", q.name, length)))
+
+	if length == 0 {
+		// nothing to wait for
+		if err := finishUpload(c, q, q.algorithm, hashfromclient, nil); err != nil {
+			c.AbortWithStatusJSON(http.StatusExpectationFailed,
+				gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "").Error()})
+			return
+		}
+	}
+	c.Header("Location", location)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+// TusHead is a gin.HandlerFunc. It responds with Upload-Offset and Upload-Length of an upload.
+func TusHead(c *gin.Context) {
+	tusHeaders(c)
+	if !tusCheckVersion(c) {
+		return
+	}
+	q, ok := tusUserquery(c)
+	if !ok {
+		return
+	}
+	if size, complete := tusIsComplete(q); complete {
+		c.Header("Upload-Offset", strconv.FormatInt(size, 10))
+		c.Header("Upload-Length", strconv.FormatInt(size, 10))
+		c.Status(http.StatusOK)
+		return
+	}
+	whatIsInFile, err := mayUpload(c, q)
+	if err != nil || whatIsInFile.FileSize == 0 {
+		// HEAD responses have no body
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(whatIsInFile.Startoffset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(whatIsInFile.FileSize, 10))
+	c.Status(http.StatusOK)
+}
+
+// TusPatch is a gin.HandlerFunc. It appends the request body to an upload at Upload-Offset.
+// With Upload-Checksum header the body is verified and on mismatch the written bytes are reverted.
+func TusPatch(c *gin.Context) {
+	const op = "uploadserver.TusPatch()"
+	tusHeaders(c)
+	if !tusCheckVersion(c) {
+		return
+	}
+	if c.GetHeader("Content-Type") != tusContentType {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "Upload-Offset header is required").Error()})
+		return
+	}
+	var h hash.Hash
+	var wantchecksum []byte
+	if s := c.GetHeader("Upload-Checksum"); s != "" {
+		h, wantchecksum, err = tusParseChecksum(s)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	q, ok := tusUserquery(c)
+	if !ok {
+		return
+	}
+	unlock, ok := tusLock(c, q)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if _, complete := tusIsComplete(q); complete {
+		c.AbortWithStatusJSON(http.StatusForbidden,
+			gin.H{"error": Error.ToUser(op, liteimp.ErrUploadIsNotAllowed, "upload is complete").Error()})
+		return
+	}
+	whatIsInFile, err := mayUpload(c, q)
+	if err != nil || whatIsInFile.FileSize == 0 {
+		log.Println(logline(c, fmt.Sprintf("upload is not allowed %s: %v", q.name, err)))
+		c.AbortWithStatusJSON(http.StatusNotFound,
+			gin.H{"error": Error.ToUser(op, liteimp.ErrUploadIsNotAllowed, q.fullpath).Error()})
+		return
+	}
+	if offset != whatIsInFile.Startoffset {
+		c.Header("Upload-Offset", strconv.FormatInt(whatIsInFile.Startoffset, 10))
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+	rest := whatIsInFile.FileSize - whatIsInFile.Startoffset
+	count := rest
+	if c.Request.ContentLength >= 0 {
+		count = c.Request.ContentLength
+	}
+	if count > rest {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge,
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, "the body exceeds Upload-Length").Error()})
+		return
+	}
+
+	// the journal size allows to revert this PATCH
+	journalstat, err := fsdriver.Store.Stat(filepath.Join(q.storagepath, fsdriver.GetPartialJournalFileName(q.nameNotComplete)))
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("journal stat failed: %s", err)))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var body io.ReadCloser = c.Request.Body
+	if h != nil {
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(c.Request.Body, h), c.Request.Body}
+	}
+	chReciever := make(chan []byte, constChRecieverBufferLen)
+	chWriteResult := make(chan writeresult)
+	writeresult, errreciver := startWriteStartRecieveAndWait(c, body,
+		chReciever,
+		chWriteResult,
+		q.storagepath,
+		q.nameNotComplete,
+		fsdriver.JournalRecord{Startoffset: offset, Count: count})
+	if writeresult.err != nil {
+		log.Println(logline(c, fmt.Sprintf("service can't write, writeresult.err == %s", writeresult.err)))
+		c.AbortWithStatusJSON(http.StatusInternalServerError,
+			gin.H{"error": Error.ToUser(op, errInternalServiceError, "write error").Error()})
+		return
+	}
+	newoffset := offset + writeresult.count
+
+	if h != nil && (errreciver != nil || !bytes.Equal(h.Sum(nil), wantchecksum)) {
+		// the checksum covers the whole body, we can't keep a part of it
+		err = tusRevert(q, offset, journalstat.Size())
+		if err != nil {
+			log.Println(logline(c, fmt.Sprintf("can't revert a PATCH of %s: %s", q.name, err)))
+		}
+		c.AbortWithStatusJSON(tusStatusChecksumMismatch,
+			gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "Upload-Checksum mismatch").Error()})
+		return
+	}
+	if errreciver != nil {
+		log.Println(logline(c, fmt.Sprintf("tus PATCH recieved %d bytes: %s", writeresult.count, errreciver)))
+	}
+
+	if newoffset == whatIsInFile.FileSize {
+		if err := finishUpload(c, q, whatIsInFile.Algorithm, whatIsInFile.Hash, writeresult.hash); err != nil {
+			c.AbortWithStatusJSON(http.StatusExpectationFailed,
+				gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "A file is complete but its hash is incorrect. It's an error.").Error()})
+			return
+		}
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(newoffset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusRevert truncates an actual file and its journal to the state before a PATCH.
+func tusRevert(q userquery, filesize, journalsize int64) error {
+	err := fsdriver.Truncate(filepath.Join(q.storagepath, fsdriver.GetPartialJournalFileName(q.nameNotComplete)), journalsize)
+	if err != nil {
+		return err
+	}
+	return fsdriver.Truncate(filepath.Join(q.storagepath, q.nameNotComplete), filesize)
+}
+
+// TusDelete is a gin.HandlerFunc for the 'termination' extension.
+// It removes an incomplete upload: the actual file and its journal.
+func TusDelete(c *gin.Context) {
+	const op = "uploadserver.TusDelete()"
+	tusHeaders(c)
+	if !tusCheckVersion(c) {
+		return
+	}
+	q, ok := tusUserquery(c)
+	if !ok {
+		return
+	}
+	unlock, ok := tusLock(c, q)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if _, complete := tusIsComplete(q); complete {
+		c.AbortWithStatusJSON(http.StatusForbidden,
+			gin.H{"error": Error.ToUser(op, liteimp.ErrUploadIsNotAllowed, "upload is complete").Error()})
+		return
+	}
+	journal := filepath.Join(q.storagepath, fsdriver.GetPartialJournalFileName(q.nameNotComplete))
+	if _, err := fsdriver.Store.Stat(journal); os.IsNotExist(err) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	errActual := fsdriver.Store.Remove(filepath.Join(q.storagepath, q.nameNotComplete))
+	errJournal := fsdriver.Store.Remove(journal)
+	if (errActual != nil && !os.IsNotExist(errActual)) || errJournal != nil {
+		log.Println(logline(c, fmt.Sprintf("tus termination of %s failed: %v, %v", q.name, errActual, errJournal)))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	log.Println(logline(c, fmt.Sprintf("tus upload terminated: %s", q.name)))
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package uploadserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zavla/upload/fsdriver"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_tusParseMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"filename", "filename c2VuZGZpbGUucmFy", map[string]string{"filename": "sendfile.rar"}, false},
+		{"two keys and a key without value", "filename c2VuZGZpbGUucmFy,is_confidential, sha1 YWJj",
+			map[string]string{"filename": "sendfile.rar", "is_confidential": "", "sha1": "abc"}, false},
+		{"not base64", "filename ###", map[string]string{}, true},
+		{"too many fields", "filename a b", map[string]string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tusParseMetadata(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("tusParseMetadata() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tusParseMetadata() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tusID(t *testing.T) {
+	for _, filename := range []string{"sendfile.rar", `/dir/long path$/file name.bak`, `\c\long path$\f i l e.ext`} {
+		got, err := tusDecodeID(tusEncodeID(filename))
+		if err != nil || got != filename {
+			t.Errorf("tusDecodeID(tusEncodeID(%s)) got = %s, err = %v", filename, got, err)
+		}
+	}
+	if _, err := tusDecodeID("*"); err == nil {
+		t.Errorf("tusDecodeID() wants an error on a bad id")
+	}
+}
+
+func Test_tusParseChecksum(t *testing.T) {
+	// sha1 of 'abc'
+	_, want, err := tusParseChecksum("sha1 qZk+NkcGgWq6PiVxeFDCbJzQ2J0=")
+	if err != nil || len(want) != 20 {
+		t.Errorf("tusParseChecksum() got = %x, err = %v", want, err)
+	}
+	// sha256 of 'abc'
+	h, want, err := tusParseChecksum("sha256 ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=")
+	if err == nil {
+		h.Write([]byte("abc"))
+	}
+	if err != nil || !bytes.Equal(h.Sum(nil), want) {
+		t.Errorf("tusParseChecksum() sha256 got = %x, err = %v", want, err)
+	}
+	if _, _, err := tusParseChecksum("md5 qZk+NkcGgWq6PiVxeFDCbJzQ2J0="); err == nil {
+		t.Errorf("tusParseChecksum() wants an error on unsupported algorithm")
+	}
+}
+
+func TestTusHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := ConfigThisService.Storageroot
+	ConfigThisService.Storageroot = dir
+	defer func() { ConfigThisService.Storageroot = saved }()
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(gin.AuthUserKey, c.Param("login")) })
+	router.Handle("POST", "/files/:login", TusCreate)
+	router.Handle("HEAD", "/files/:login/:id", TusHead)
+	router.Handle("PATCH", "/files/:login/:id", TusPatch)
+	router.Handle("DELETE", "/files/:login/:id", TusDelete)
+	do := func(method, path string, body []byte, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Tus-Resumable", tusResumable)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	checksum := func(b []byte) string {
+		h := sha1.Sum(b)
+		return "sha1 " + b64(h[:])
+	}
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	whole := sha1.Sum(content)
+	userdir := filepath.Join(dir, "zahar")
+	sizeOf := func(name string) int64 {
+		fi, err := os.Stat(filepath.Join(userdir, name))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+
+	w := do("POST", "/files/zahar", nil, "Upload-Length", "100",
+		"Upload-Metadata", "filename "+b64([]byte("a.bak"))+",sha1 "+b64([]byte(hex.EncodeToString(whole[:]))))
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || location != TusBasePath+"zahar/"+tusEncodeID("a.bak") {
+		t.Fatalf("POST = %d, Location %q: %s", w.Code, location, w.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		offset     string
+		body       []byte
+		checksum   string
+		wantStatus int
+		wantOffset string
+	}{
+		{"first part", "PATCH", "0", content[:40], checksum(content[:40]), http.StatusNoContent, "40"},
+		{"head", "HEAD", "", nil, "", http.StatusOK, "40"},
+		{"wrong offset", "PATCH", "10", content[10:20], "", http.StatusConflict, "40"},
+		{"bad checksum", "PATCH", "40", content[40:70], checksum([]byte("other")), tusStatusChecksumMismatch, ""},
+		{"head after a bad checksum", "HEAD", "", nil, "", http.StatusOK, "40"},
+		{"last part", "PATCH", "40", content[40:], checksum(content[40:]), http.StatusNoContent, "100"},
+		{"head of a complete file", "HEAD", "", nil, "", http.StatusOK, "100"},
+		{"patch of a complete file", "PATCH", "100", content[:1], "", http.StatusForbidden, ""},
+		{"delete of a complete file", "DELETE", "", nil, "", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		headers := []string{"Upload-Offset", tt.offset, "Content-Type", tusContentType}
+		if tt.checksum != "" {
+			headers = append(headers, "Upload-Checksum", tt.checksum)
+		}
+		var journalsize int64
+		if tt.wantStatus == tusStatusChecksumMismatch {
+			journalsize = sizeOf(fsdriver.GetPartialJournalFileName("a.bak.part"))
+		}
+		w := do(tt.method, location, tt.body, headers...)
+		if w.Code != tt.wantStatus || w.Header().Get("Upload-Offset") != tt.wantOffset {
+			t.Errorf("%s: %s = %d, Upload-Offset %q, want %d, %q: %s",
+				tt.name, tt.method, w.Code, w.Header().Get("Upload-Offset"), tt.wantStatus, tt.wantOffset, w.Body.String())
+		}
+		if tt.wantStatus == tusStatusChecksumMismatch {
+			// the written bytes and their journal records are reverted
+			if got := sizeOf("a.bak.part"); got != 40 {
+				t.Errorf("%s: the actual file has %d bytes, want 40", tt.name, got)
+			}
+			if got := sizeOf(fsdriver.GetPartialJournalFileName("a.bak.part")); got != journalsize {
+				t.Errorf("%s: the journal has %d bytes, want %d", tt.name, got, journalsize)
+			}
+		}
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(userdir, "a.bak")); !bytes.Equal(got, content) {
+		t.Errorf("a complete file has %q", got)
+	}
+
+	// termination of an incomplete upload
+	w = do("POST", "/files/zahar", nil, "Upload-Length", "100", "Upload-Metadata", "filename "+b64([]byte("b.bak")))
+	location = w.Header().Get("Location")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST = %d: %s", w.Code, w.Body.String())
+	}
+	do("PATCH", location, content[:10], "Upload-Offset", "0", "Content-Type", tusContentType)
+	if w := do("DELETE", location, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d: %s", w.Code, w.Body.String())
+	}
+	if sizeOf("b.bak.part") != -1 || sizeOf(fsdriver.GetPartialJournalFileName("b.bak.part")) != -1 {
+		t.Errorf("DELETE left files of the upload")
+	}
+	if w := do("HEAD", location, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE = %d", w.Code)
+	}
+	if w := do("DELETE", location, nil); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a deleted upload = %d", w.Code)
+	}
+}
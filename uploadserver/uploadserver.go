@@ -16,7 +16,6 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	Error "github.com/zavla/upload/errstr"
@@ -28,23 +27,15 @@ import (
 	"github.com/google/uuid"
 )
 
-type stateOfFileUpload struct {
-	userquery
-	good bool
-	// name       string
-	// path       string
-	filestatus liteimp.JsonFileStatus
-}
-
-var clientsstates map[string]stateOfFileUpload
-
-var usedfiles sync.Map
-var emptysha1 [20]byte
+// usedfiles prevents uploading the same bytes of a file in parallel.
+var usedfiles fileLocks
 
 type interfaceconfig struct {
-	Listenon string
-	CertFile string
-	KeyFile  string
+	Listenon     string
+	CertFile     string
+	KeyFile      string
+	ClientCerts  ClientCerts
+	ClientCAFile string
 }
 
 // Config is a type that hold all the configuration of this service.
@@ -56,7 +47,9 @@ type Config struct {
 	BindAddress []string
 	//BindAddress2 string
 	IfConfigs map[string]interfaceconfig
-	LoginsMap map[string]logins.Login
+	// ClientCerts are modes of TLS client certificates by BindAddress, absent is ClientCertsNone.
+	ClientCerts map[string]ClientCerts
+	LoginsMap   map[string]logins.Login
 	// Storageroot holds path to file store for this instance.
 	// Must be absolute.
 	Storageroot string
@@ -71,13 +64,32 @@ type Config struct {
 
 	// Usepprof will show /debug/pprof/* URLS
 	Usepprof bool
+
+	// Dedup keeps completed files in fsdriver.BlobsDir of Storageroot once, user files become hard links.
+	// A new upload of a stored content completes without a body.
+	Dedup bool
+
+	// Durability tells when written blocks are synced to disk. Each upload gets a copy.
+	Durability fsdriver.Durability
+
+	// FreeSpaceReserve is a count of bytes of the volume of Storageroot new uploads must leave free.
+	FreeSpaceReserve int64
+	// Preallocate reserves disk space for the whole file of a new upload.
+	Preallocate bool
+
+	// RecieveBuffer is a size of memory for recieved bytes all uploads share, 0 is a default of 32MB.
+	RecieveBuffer int64
+
+	// KeepDirs recreates directories of relative file names from clients beneath user storage directories.
+	// Otherwise only base names of files are used.
+	KeepDirs bool
 }
 
 // ConfigThisService for config
 var ConfigThisService Config
 
 // The size of buffered channel that holds recieved slices of bytes.
-// Its a count of constrecieveblocklen blocks.
+// Its a count of constRecieveBlockLen blocks.
 const constChRecieverBufferLen = 10
 
 const constmaxpath = 32767 - 6000 // reserve space for the service storage root
@@ -86,6 +98,7 @@ type writeresult struct {
 	count    int64
 	err      error
 	slerrors []error
+	hash     []byte // hash of the whole actual file, nil if unknown
 }
 
 func stackPrintOnPanic(c *gin.Context, where string) {
@@ -158,7 +171,8 @@ func (config *Config) FilenamefromNetInterface(netinterface string) string {
 }
 
 // UpdateInterfacesConfigs creates configurations for every interface the service is listenning to.
-// It checks if certificates files for every interface exists.
+// It checks if certificates files for every interface exists,
+// and ClientCAFile for interfaces that ask for client certificates.
 func (config *Config) UpdateInterfacesConfigs(selectinterface string) error {
 	//var tlsConfig *tls.Config
 	if config.IfConfigs == nil {
@@ -176,30 +190,35 @@ func (config *Config) UpdateInterfacesConfigs(selectinterface string) error {
 		}
 		certFile := filepath.Join(config.Configdir, ipS1+".pem")
 		keyFile := filepath.Join(config.Configdir, ipS1+"-key.pem")
+		clientCAFile := ""
+		if config.ClientCerts[v] != ClientCertsNone {
+			clientCAFile = filepath.Join(config.Configdir, ClientCAFile)
+			if _, err := os.Stat(clientCAFile); err != nil {
+				return os.ErrNotExist
+			}
+		}
 		config.IfConfigs[v] = interfaceconfig{
-			Listenon: v,
-			CertFile: certFile,
-			KeyFile:  keyFile,
+			Listenon:     v,
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCerts:  config.ClientCerts[v],
+			ClientCAFile: clientCAFile,
 		}
 	}
 
 	return nil
 }
 
-type bufferConfig struct {
-	Multiplicity int
-	BlocksCount  int
-}
-
 // fillRecieverChannel reads blocks from io.ReaderCloser until io.EOF or timeout.
 // Expects large Gb files from http.Request.Boby.
-// Sends bytes to chReciever.
+// Reads directly into blocks of the pool and sends them to chReciever,
+// a consumer of chReciever puts blocks back to the pool.
 // Suppose to work within a thread that reads connection.
 // Exits when error or EOF.
 func fillRecieverChannel(c io.ReadCloser,
 	chReciever chan []byte,
 	done <-chan struct{},
-	bufConfig bufferConfig,
+	pool *bufferPool,
 ) error {
 	const op = "uploadserver.recieveAndSendToChan()"
 	// timeout is set via http.Server{Timeout...}
@@ -210,89 +229,44 @@ func fillRecieverChannel(c io.ReadCloser,
 
 	nbytessent := int64(0)
 
-	// this makes sure bigBufferCap is bigger then bufConfig.SizeOfRecieverBuffer
-	bigBufferCap := bufConfig.BlocksCount * bufConfig.Multiplicity
-	bigBufLen := 0
-
-	// bigBuffer escapes
-	bigBuffer := make([]byte, bigBufferCap) // allocate
-
-	// b is a buffer for current read. there may be many reads. b is noescape.
-	b := make([]byte, bufConfig.Multiplicity)
-
-	i := 0
-
 	for { // endless recieve loop
-
-		n, err := c.Read(b) // usually reads Request.Body
-		// looks like n is mostly always 4096. tcp segment size?
-
+		// waits for a free block when all the blocks of the service are in use
+		block := pool.get(done)
+		if block == nil {
+			return Error.E(op, nil, 0, 0, "chReciever is ordered to close")
+		}
+		n, err := io.ReadFull(c, block) // usually reads Request.Body
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF // the last block is not full
+		}
 		if err != nil && err != io.EOF {
-
+			pool.put(block)
 			return Error.E(op, err, errConnectionReadError, 0, "") // or timeout?
 		}
-		if n > 0 {
-
-			freespace := bigBufferCap - bigBufLen
-			ncopied := 0
-
-			// if bigBuffer is not full
-			if freespace > 0 {
-				nallowed := n
-				if freespace < n {
-					nallowed = freespace
-				}
-
-				ncopied = copy(bigBuffer[bigBufLen:], b[:nallowed])
-				bigBufLen += ncopied
-				freespace -= ncopied
-			}
-			if freespace == 0 {
-
-				bigBufferEscapes := make([]byte, bigBufLen)   // allocate because it goes into another goroutine
-				copy(bigBufferEscapes, bigBuffer[:bigBufLen]) // copy
-
-				// if write to disk in neigbour goroutine failed that goroutine closes chReciever
-				// and allows us to know there is no need to recieve more from connection.
-				select {
-				case <-done:
-					return Error.E(op, nil, 0, 0, "chReciever is ordered to close")
-				case chReciever <- bigBufferEscapes[:bigBufLen]: // buffered chReciever
-					nbytessent += int64(bigBufLen)
-				}
-
-				bigBufLen = 0
-				leftinb := len(b) - ncopied
-				if leftinb > 0 {
-					// if in b left something
-					ncopied2 := copy(bigBuffer, b[ncopied:n])
-					bigBufLen = ncopied2
-				}
+		if n == 0 {
+			pool.put(block)
+		} else {
+			// if write to disk in neigbour goroutine failed that goroutine closes done
+			// and allows us to know there is no need to recieve more from connection.
+			select {
+			case <-done:
+				pool.put(block)
+				return Error.E(op, nil, 0, 0, "chReciever is ordered to close")
+			case chReciever <- block[:n]: // buffered chReciever
+				nbytessent += int64(n)
 			}
-
 		}
-		// DEBUG!!! //time.Sleep(2 * time.Millisecond)
 
 		if err == io.EOF {
-			if bigBufLen > 0 {
-				select {
-				case <-done:
-				case chReciever <- bigBuffer[:bigBufLen]:
-					nbytessent += int64(bigBufLen)
-				}
-			}
-
 			Debugprint("in fillRecieverChannel() nbytessent = %d", nbytessent)
 			return nil // success reading
 		}
-
-		i++
 	}
 
 }
 
 // consumeSourceChannel runs in background as a goroutine. Waits for input bytes in input channel.
-// Adds bytes[] to a file using transaction log file.
+// Adds bytes[] to a file using transaction log file, puts written blocks back to the pool.
 // Closes files at the return.
 func consumeSourceChannel(
 	c *gin.Context,
@@ -300,20 +274,31 @@ func consumeSourceChannel(
 	chResult chan<- writeresult,
 	storagepath, name string,
 	destination fsdriver.JournalRecord,
+	durability fsdriver.Durability,
+	pool *bufferPool,
 	done chan struct{}) {
 
 	const op = "uploadserver.consumeSourceChannel"
 
 	defer stackPrintOnPanic(c, op)
 
+	// stopReciever makes the reciever give up and gives its queued blocks back to the pool.
+	stopReciever := func() {
+		close(done)
+		for b := range chSource {
+			pool.put(b)
+		}
+	}
+
 	// to begin open both destination files: the journal file and the actual file
 	namelog := fsdriver.GetPartialJournalFileName(name)
-	ver, wp, wa, errp, erra := fsdriver.OpenTwoCorrespondentFiles(storagepath, name, namelog)
+	ver, wp, wa, errp, erra := fsdriver.OpenTwoCorrespondentFiles(storagepath, name, namelog, &durability)
 	// wp = transaction log file
 	// wa = actual file
 	if errp != nil {
 		// files were not opened
-		chResult <- writeresult{0, errp, nil}
+		stopReciever()
+		chResult <- writeresult{0, errp, nil, nil}
 		return
 	}
 	// (os.File).Close may return err, that means disk failure after File System Driver got bytes into its
@@ -324,10 +309,11 @@ func consumeSourceChannel(
 	if erra != nil {
 		wp.Close() // wp was opened, close it
 		// wa was not opened
-		chResult <- writeresult{0, Error.E(op, erra, 0, Error.ErrUseKindFromBaseError, "from fsdriver.OpenTwoCorrespondentFiles"), nil}
+		stopReciever()
+		chResult <- writeresult{0, Error.E(op, erra, 0, Error.ErrUseKindFromBaseError, "from fsdriver.OpenTwoCorrespondentFiles"), nil, nil}
 		return
 	}
-	// second (defered) call to Close(). It is safe to call Close() twice on *os.File.
+	// second (defered) call to Close(). It is safe to call Close() twice on a fsdriver.File.
 	defer wa.Close()
 
 	// make sure file size equals to destination.startoffset
@@ -335,50 +321,43 @@ func consumeSourceChannel(
 	if err != nil {
 		// some error, even can't get stats of a file
 		closeFiles(wa, wp)
-		chResult <- writeresult{0, err, nil}
+		stopReciever()
+		chResult <- writeresult{0, err, nil, nil}
 		return
 	}
-	if wastat.Size() != destination.Startoffset {
+	if !fsdriver.WritesAtOffsets(ver) && wastat.Size() != destination.Startoffset {
 		closeFiles(wa, wp)
-		chResult <- writeresult{0, errors.New("startoffset not equal to existing file size"), nil}
+		stopReciever()
+		chResult <- writeresult{0, errors.New("startoffset not equal to existing file size"), nil, nil}
 		return
 	}
-	nextWrite := int64(1000000)
+	// running hash of the actual file continues from a checkpoint in the journal
+	h, err := fsdriver.RestoreHash(storagepath, name, ver, destination.Startoffset)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't restore a hash from the journal, file %s will be reread at the end: %s", name, err)))
+		h = nil
+	}
+
 	nbyteswritten := int64(0) // returns nbyteswritten to chResult channel
 	for b := range chSource {
 
 		// ACTUAL WRITE
-		successbytescount, err := fsdriver.AddBytesToFile(wa, wp, b, ver, &destination)
+		successbytescount, err := fsdriver.AddBytesToFile(wa, wp, b, ver, &destination, h, &durability)
+		pool.put(b)
 
 		nbyteswritten += successbytescount
 
-		if nbyteswritten > nextWrite {
-			nextWrite *= 2
-			errp = wp.Sync() // journal file sync
-			erra = wa.Sync() // actual file sync
-
-		}
-
-		if err != nil || errp != nil || erra != nil {
+		if err != nil {
 			// Here we have Disk failure while Write().
 			// Make explicit Close(), close receiver's 'done' channel.
 
-			close(done) // indicate to receiver give up receiving
-
-			if err != nil {
-				log.Println(logline(c, fmt.Sprintf("disk error in AddBytesToFile(), err=%s", err)))
-			}
-			if errp != nil {
-				log.Println(logline(c, fmt.Sprintf("disk error in AddBytesToFile(), errp=%s", errp)))
-			}
-			if erra != nil {
-				log.Println(logline(c, fmt.Sprintf("disk error in AddBytesToFile(), erra=%s", erra)))
-			}
+			log.Println(logline(c, fmt.Sprintf("disk error in AddBytesToFile(), err=%s", err)))
 
 			slerrors := closeFiles(wa, wp)
+			stopReciever() // indicate to receiver give up receiving
 			// Here we are not sure how much File System Driver has written on disk.
 			// We need to reread existing file to see what it has inside.
-			chResult <- writeresult{nbyteswritten, err, slerrors}
+			chResult <- writeresult{nbyteswritten, err, slerrors, nil}
 			return
 
 		}
@@ -401,7 +380,11 @@ func consumeSourceChannel(
 
 	slerrors := closeFiles(wa, wp)
 
-	chResult <- writeresult{nbyteswritten, nil, slerrors}
+	var facthash []byte
+	if h != nil {
+		facthash = h.Sum(nil)
+	}
+	chResult <- writeresult{nbyteswritten, nil, slerrors, facthash}
 	runtime.UnlockOSThread()
 }
 
@@ -435,14 +418,13 @@ func startWriteStartRecieveAndWait(c *gin.Context, cRequestBody io.ReadCloser,
 
 	// Starts goroutine in background for write operations for this connection.
 	// writeChanTo will write while we are recieving.
-	go consumeSourceChannel(c, chReciever, chWriteResult, dir, name, whatwhere, done)
-
-	bufferProperties := bufferConfig{Multiplicity: 65535, BlocksCount: 1}
+	pool := getRecievePool()
+	go consumeSourceChannel(c, chReciever, chWriteResult, dir, name, whatwhere, ConfigThisService.Durability, pool, done)
 
 	// Reciever works in current goroutine, sends bytes to chReciever.
 	// Reciever may end with error, by timeout with error, or by EOF with nil error.
 	// First wait: for end of recieve
-	errRecieve := fillRecieverChannel(cRequestBody, chReciever, done, bufferProperties) // exits when error or EOF
+	errRecieve := fillRecieverChannel(cRequestBody, chReciever, done, pool) // exits when error or EOF
 
 	// here reciever has ended.
 
@@ -467,9 +449,21 @@ func convertFileStateToJSONFileStatus(state fsdriver.FileState) *liteimp.JsonFil
 			Startoffset: state.Startoffset,
 			Count:       state.FileSize,
 		},
+		Missing: convertRanges(state.Missing),
 	}
 }
 
+func convertRanges(ranges []fsdriver.Range) []liteimp.Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	ret := make([]liteimp.Range, len(ranges))
+	for i, r := range ranges {
+		ret[i] = liteimp.Range{Startoffset: r.Startoffset, Count: r.Count}
+	}
+	return ret
+}
+
 // logLine Has String() method to be witten to log.
 type logLine struct {
 	gin.LogFormatterParams
@@ -477,7 +471,13 @@ type logLine struct {
 
 // logline creates gin.LogFromatterParams.
 // logline.String() prints.
+// A nil c is the service itself, ex. Fsck.
 func logline(c *gin.Context, msg string) (ret logLine) {
+	if c == nil {
+		ret.TimeStamp = time.Now()
+		ret.ErrorMessage = msg
+		return // named
+	}
 	ret = logLine{
 		gin.LogFormatterParams{
 			Request: c.Request,
@@ -558,37 +558,36 @@ func ServeAnUpload(c *gin.Context) {
 			return // we dont create a session
 		}
 
-		// sync.Map to prevent uploading the same file in parallel.
+		// prevents uploading the same file in parallel.
 		// usedfiles is global for this service.
-		lockobject := filepath.Join(userquery.username, userquery.fullpath)
-		_, loaded := usedfiles.LoadOrStore(lockobject, true) // equal to ReadOrStore
-
-		if loaded {
+		lockobject := userquery.lockobject()
+		unlock, ok := usedfiles.lock(lockobject, wholeFile)
+		if !ok {
 			// file is already busy at the moment
 			c.JSON(http.StatusForbidden,
 				gin.H{"error": Error.ToUser(op, errRequestedFileIsBusy, userquery.fullpath).Error()})
 			return
 		}
-		defer usedfiles.Delete(lockobject) // clears sync.Map after this func exits.
+		defer unlock()
 
 		// Get a struct with the file current size and state.
 		// File may be partially uploaded.
 		// MayUpload returns info about existing file.
 
-		whatIsInFile, err := fsdriver.MayUpload(userquery.storagepath, userquery.name, userquery.nameNotComplete)
+		whatIsInFile, err := mayUpload(c, userquery)
 		if err != nil {
 
 			if fsdriver.MayRepare(err) {
-				ok, errComp := fsdriver.CompareSha1(userquery.storagepath, userquery.nameNotComplete, whatIsInFile.Sha1, emptysha1[:])
+				ok, errComp := fsdriver.CompareHash(userquery.storagepath, userquery.nameNotComplete, whatIsInFile.Algorithm, whatIsInFile.Hash)
 				if errComp == nil && ok {
 					// on success event
-					err = eventOnSuccess(c, userquery.storagepath, userquery.name, userquery.nameNotComplete, whatIsInFile.Sha1)
+					err = eventOnSuccess(c, userquery.storagepath, userquery.name, userquery.nameNotComplete, whatIsInFile.Algorithm, whatIsInFile.Hash)
 					if err != nil {
 						log.Println(logline(c, fmt.Sprintf("event 'onSuccess' failed: %s", err)))
 					}
 
 				} else {
-					log.Println(logline(c, fmt.Sprintf("SHA1 BAD, expected SHA1 %x, error: %s", whatIsInFile.Sha1, err)))
+					log.Println(logline(c, fmt.Sprintf("%s BAD, expected %x, error: %s", whatIsInFile.Algorithm, whatIsInFile.Hash, err)))
 
 				}
 
@@ -604,6 +603,30 @@ func ServeAnUpload(c *gin.Context) {
 		}
 		// here we allow upload!
 
+		expectedsize := userquery.filesize
+		if expectedsize == 0 {
+			expectedsize = lcontent
+		}
+		if whatIsInFile.FileSize == 0 && (!checkQuota(c, userquery, expectedsize) || !checkFreeSpace(c, userquery, expectedsize)) {
+			return
+		}
+		if whatIsInFile.FileSize == 0 && linkStoredContent(c, userquery, userquery.filesize) {
+			// the service has this content already
+			c.JSON(http.StatusAccepted, gin.H{"error": liteimp.ErrSuccessfullUpload})
+			return
+		}
+
+		if whatIsInFile.FileSize == 0 && userquery.filesize > 0 {
+			// a client gave the file size, so ranges of the file may be uploaded in parallel
+			whatIsInFile, err = createUpload(c, userquery, userquery.filesize, hashFromClient(c, userquery))
+			if err != nil {
+				log.Println(logline(c, err.Error()))
+				c.JSON(http.StatusInternalServerError,
+					gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+				return
+			}
+		}
+
 		// We set a NEW cookie , next request from this client will come with this session cookie.
 		// Generate new cookie that represents session number for current file upload. New file means new ID.
 		newsessionID := uuid.New().String()
@@ -613,36 +636,32 @@ func ServeAnUpload(c *gin.Context) {
 		// httpOnly==true for the cookie to be unavailable for javascript api.
 		// path=="/upload" means "/upload" should be in URL path for this cookie to be sent to client.
 		// TODO(zavla): 300 => 5000 ?>?. what is SameSiteStrictMode, read https://tools.ietf.org/html/draft-ietf-httpbis-cookie-same-site-00
-		c.SetCookie(liteimp.KeysessionID, newsessionID, 3600*8, "/upload", "", true, true)
+		// Sessions hold clients' state, next requests come with the session ID.
+		err = Sessions.Put(newsessionID, userquery.session(time.Now()))
+		if err != nil {
+			log.Println(logline(c, fmt.Sprintf("can't save a session: %s", err)))
+			c.JSON(http.StatusInternalServerError,
+				gin.H{"error": Error.ToUser(op, errInternalServiceError, "").Error()})
+			return
+		}
+		c.SetCookie(liteimp.KeysessionID, newsessionID, int(constSessionLifetime.Seconds()), "/upload", "", true, true)
 
 		// c holds in its Context a session ID in KeyValue pair
 		c.Set(liteimp.KeysessionID, newsessionID)
 
-		// Fill a package level variable, a map, to hold clients' state.
-		clientsstates = make(map[string]stateOfFileUpload)
-
-		clientsstates[newsessionID] = stateOfFileUpload{
-			userquery: userquery,
-			good:      true,
-			// name:       name,
-			// path:       storagepath,
-			filestatus: *convertFileStateToJSONFileStatus(whatIsInFile),
-		}
 		c.Request.Body.Close() // try to free a connection because client may be sending a big file?
 		c.JSON(http.StatusConflict, *convertFileStateToJSONFileStatus(whatIsInFile))
 
 	} else { // a client has send a session cookie
 		// lets find current client session state by session cookie
-		if state, found := clientsstates[strSessionID]; found {
+		// a session belongs to the user who started it
+		if session, found := Sessions.Get(strSessionID); found && session.Username == c.GetString(gin.AuthUserKey) {
+			//log.Println(logline(c, fmt.Sprintf("continue upload")))
 
-			if state.good {
-				//log.Println(logline(c, fmt.Sprintf("continue upload")))
+			// c holds session ID in KeyValue pair
+			c.Set(liteimp.KeysessionID, strSessionID)
 
-				// c holds session ID in KeyValue pair
-				c.Set(liteimp.KeysessionID, strSessionID)
-
-				requestedAnUploadContinueUpload(c, state, lcontent) // continue upload
-			}
+			requestedAnUploadContinueUpload(c, userqueryFromSession(session), lcontent) // continue upload
 			return
 
 		}
@@ -668,24 +687,44 @@ func ServeAnUpload(c *gin.Context) {
 // requestedAnUploadContinueUpload continues an upload of a partially uploaded (not complete) file.
 // Expects in request from client a liteimp.QueryParamsToContinueUpload with data
 // correspondend to server's state of the file.
-func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUpload, lcontent int64) {
+func requestedAnUploadContinueUpload(c *gin.Context, savedstate userquery, lcontent int64) {
 	const op = "uploadserver.requestedAnUploadContinueUpload()"
 	//name := savedstate.name
 	//storagepath := savedstate.storagepath
 	// we extract session ID from context.
 	strSessionID := c.GetString(liteimp.KeysessionID)
 
-	// Uses sync.Map to prevent uploading the same file in concurrent http handlers.
-	// usedfiles is global for http server.
-	lockobject := filepath.Join(savedstate.username, savedstate.fullpath)
-	_, loaded := usedfiles.LoadOrStore(lockobject, true) // equals to ReadOrStore
+	// This client request must have fromClient.Startoffset == whatIsInFile.Startoffset
+	// or must be a missing range of the file.
+	var fromClient liteimp.QueryParamsToContinueUpload
 
-	if loaded {
+	// Client sends startoffset, count, filеname in URL parameters
+	err := c.ShouldBindQuery(&fromClient)
+	if err != nil {
+		// Сlient didn't request with proper params.
+		// We expecting URL parametres.
+		jsonbytes, _ := json.MarshalIndent(&fromClient, "", " ")
+		helpmessage := "service expects from you JSON " + string(jsonbytes)
+		//
+		c.SetCookie(liteimp.KeysessionID, "", -1, "/upload", "", true, true) // clear cookie
+		c.JSON(http.StatusBadRequest, gin.H{"error": Error.ToUser(op, errClientRequestShouldBindToJSON, helpmessage).Error()})
+		return
+	}
+
+	// Prevents uploading the same bytes of the file in concurrent http handlers.
+	// usedfiles is global for http server.
+	lockobject := savedstate.lockobject()
+	requested := fsdriver.Range{Startoffset: fromClient.Startoffset, Count: fromClient.Count}
+	if requested.Count <= 0 {
+		requested = wholeFile
+	}
+	unlock, ok := usedfiles.lock(lockobject, requested)
+	if !ok {
 		// file is already busy at the moment
 		c.JSON(http.StatusForbidden, gin.H{"error": Error.E(op, nil, errRequestedFileIsBusy, Error.ErrKindInfoForUsers, savedstate.name)})
 		return
 	}
-	defer usedfiles.Delete(lockobject) // clears sync.Map after this func exits.
+	defer unlock()
 
 	// Creates reciever channel to hold read bytes in this connection.
 	// Bytes from chReciever will be written to file.
@@ -697,10 +736,10 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 	// Prevents another client update content of the file in between our requests.
 	// Gets a struct with the file current size and state.
 	//nameNotComplete := name + ".part"
-	whatIsInFile, err := fsdriver.MayUpload(savedstate.storagepath, savedstate.name, savedstate.nameNotComplete)
+	whatIsInFile, err := mayUpload(c, savedstate)
 	if err != nil {
 		// Here err!=nil means upload is now allowed
-		delete(clientsstates, strSessionID)
+		deleteSession(c, strSessionID)
 
 		// c.Error(err)
 		log.Println(logline(c, fmt.Sprintf("upload is not allowed %s", savedstate.name)))
@@ -710,48 +749,26 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 
 	}
 
-	// This client request must have fromClient.Startoffset == whatIsInFile.Startoffset
-	var fromClient liteimp.QueryParamsToContinueUpload
-
-	// Client sends startoffset, count, filеname in URL parameters
-	err = c.ShouldBindQuery(&fromClient)
-	if err != nil {
-		// Сlient didn't request with proper params.
-		// We expecting URL parametres.
-		jsonbytes, _ := json.MarshalIndent(&fromClient, "", " ")
-		helpmessage := "service expects from you JSON " + string(jsonbytes)
-		//
-		c.SetCookie(liteimp.KeysessionID, "", -1, "/upload", "", true, true) // clear cookie
-		c.JSON(http.StatusBadRequest, gin.H{"error": Error.ToUser(op, errClientRequestShouldBindToJSON, helpmessage).Error()})
-		return
-	}
-
-	if whatIsInFile.Startoffset == 0 { // Startoffset == 0 means such file is not exist yet.
-		filesize := fromClient.Count
+	if whatIsInFile.FileSize == 0 && fromClient.Startoffset == 0 { // FileSize == 0 means such file is not exist yet.
+		filesize := fromClient.Filesize
 		if filesize == 0 {
-			filesize = lcontent
+			// old clients send the whole file at once
+			filesize = fromClient.Count
+			if filesize == 0 {
+				filesize = lcontent
+			}
+			fromClient.Count = filesize
 		}
 		// for a new file the first client request defines the file size
-		whatIsInFile.FileSize = filesize
-		fromClient.Count = filesize
 
 		// Expects from client a file length if this is a new file.
-		// But client has passed the authorization, so we add him to the clientsstates map.
 		// Client doesn't send file at once, it waits from server a httpDigestAuthentication.KeyProvePeerHasRightPasswordhash header.
 
-		// A new file to upload, no need for json in request.
-		var sha1fromclient []byte
-		if savedstate.strsha1 != "" {
-			sha1fromclient = make([]byte, hex.DecodedLen(len(savedstate.strsha1)))
-			_, err := hex.Decode(sha1fromclient, []byte(savedstate.strsha1))
-			if err != nil {
-				log.Println(logline(c, fmt.Sprintf("string representation of sha1 %s is invalid", savedstate.strsha1)))
-			}
+		if !checkQuota(c, savedstate, filesize) || !checkFreeSpace(c, savedstate, filesize) {
+			return
 		}
-		whatIsInFile.Sha1 = sha1fromclient
-		// next create and fill a header of new journal file
-
-		err := fsdriver.CreateNewPartialJournalFile(savedstate.storagepath, savedstate.nameNotComplete, filesize, sha1fromclient)
+		// A new file to upload, no need for json in request.
+		whatIsInFile, err = createUpload(c, savedstate, filesize, hashFromClient(c, savedstate))
 		if err != nil {
 			log.Println(logline(c, err.Error()))
 			c.JSON(http.StatusInternalServerError,
@@ -760,9 +777,10 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 		}
 	}
 
-	if fromClient.Startoffset == whatIsInFile.Startoffset {
+	if whatIsInFile.FileSize != 0 &&
+		(fromClient.Startoffset == whatIsInFile.Startoffset || whatIsInFile.InMissing(requested)) {
 
-		// client sends propper rest of the file
+		// client sends propper rest of the file or a missing range of it
 		writeresult, errreciver := startWriteStartRecieveAndWait(c, c.Request.Body,
 			chReciever,
 			chWriteResult,
@@ -770,6 +788,7 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 			savedstate.nameNotComplete,
 			fsdriver.JournalRecord{Startoffset: fromClient.Startoffset, Count: fromClient.Count})
 		if errreciver != nil || writeresult.err != nil ||
+			fromClient.Startoffset != whatIsInFile.Startoffset ||
 			(whatIsInFile.Startoffset+writeresult.count) != whatIsInFile.FileSize {
 
 			// log.Println(logline(c, fmt.Sprintf("startWriteStartRecieveAndWait returned errreciver = %s", errreciver)))
@@ -781,14 +800,33 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 				return
 			}
 			// OR reciever failed to recieve all the bytes
-			// OR recieved bytea are not the exact end of file
+			// OR recieved bytes are not the exact end of file
+			// OR a range of the file was written, it may be the last missing range.
+			unlock()
+			unlockWhole, locked := usedfiles.lock(lockobject, wholeFile)
+			defer unlockWhole()
 
 			// update state of the file after failed upload
-			whatIsInFile, err = fsdriver.MayUpload(savedstate.storagepath, savedstate.name, savedstate.nameNotComplete)
+			whatIsInFile, err = mayUpload(c, savedstate)
+			if err != nil && fsdriver.MayRepare(err) {
+				if !locked {
+					// another request still holds its range, it will finish the upload
+					c.JSON(http.StatusConflict, *convertFileStateToJSONFileStatus(whatIsInFile))
+					return
+				}
+				// every range is written, no running hash for the whole file
+				err = finishUpload(c, savedstate, whatIsInFile.Algorithm, whatIsInFile.Hash, nil)
+				if err != nil {
+					c.JSON(http.StatusExpectationFailed, gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "A file is complete but its hash is incorrect. It's an error.").Error()})
+					return
+				}
+				c.JSON(http.StatusAccepted, gin.H{"error": liteimp.ErrSuccessfullUpload})
+				return
+			}
 			if err != nil {
 				// Here err!=nil means upload is now allowed
 
-				delete(clientsstates, strSessionID)
+				deleteSession(c, strSessionID)
 				c.SetCookie(liteimp.KeysessionID, "", -1, "/upload", "", true, true) // clear cookie
 				// c.Error(err)
 				log.Println(logline(c, fmt.Sprintf("upload is not allowed %s", savedstate.name)))
@@ -804,30 +842,12 @@ func requestedAnUploadContinueUpload(c *gin.Context, savedstate stateOfFileUploa
 		}
 
 		// SUCCESS!!!
-		// Next check fact sha1 with expected sha1 if it was given.
-		factsha1, err := fsdriver.GetFileSha1(savedstate.storagepath, savedstate.nameNotComplete)
+		// Next check fact hash with expected hash if it was given.
+		err = finishUpload(c, savedstate, whatIsInFile.Algorithm, whatIsInFile.Hash, writeresult.hash)
 		if err != nil {
-			log.Println(logline(c, fmt.Sprintf("Error while computing SHA1 for the file %s, error %s.", savedstate.nameNotComplete, err)))
-		}
-		wantsha1 := whatIsInFile.Sha1
-		if !bytes.Equal(wantsha1, emptysha1[:]) {
-			// we may check correctness
-
-			if !bytes.Equal(factsha1, wantsha1) {
-				// sha1 differs!!!
-				log.Println(logline(c, fmt.Sprintf("SHA1 failed, want = %x, has = %x, file %s", wantsha1, factsha1, savedstate.nameNotComplete)))
-				c.JSON(http.StatusExpectationFailed, gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "A file is complete but SHA1 is incorrect. It's an error.").Error()})
-				return
-			}
-		}
-
-		// Rename journal file. Add string representation of sha1 to the journal filename.
-
-		err = eventOnSuccess(c, savedstate.storagepath, savedstate.name, savedstate.nameNotComplete, factsha1)
-		if err != nil {
-			log.Println(logline(c, fmt.Sprintf("event 'onSuccess' failed: %s", err)))
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": Error.ToUser(op, errSha1CheckFailed, "A file is complete but its hash is incorrect. It's an error.").Error()})
+			return
 		}
-		log.Println(logline(c, fmt.Sprintf("successfull upload: %s", savedstate.name)))
 
 		c.JSON(http.StatusAccepted, gin.H{"error": liteimp.ErrSuccessfullUpload})
 		return
@@ -846,10 +866,18 @@ type userquery struct {
 	name            string
 	username        string
 	storagepath     string
-	strsha1         string
+	strhash         string                 // hex of a hash from a client, may be empty
+	algorithm       fsdriver.HashAlgorithm // of strhash
+	filesize        int64                  // from a client, 0 when not given
 	nameNotComplete string
 }
 
+// lockobject is a key of the file in usedfiles.
+// It is a path in the storage, clients may name the same file with different paths.
+func (q userquery) lockobject() string {
+	return filepath.Join(q.storagepath, q.name)
+}
+
 func getUserquery(c *gin.Context) (userquery, error) {
 	const op = "uploadserver.firstActionOnRequest()"
 	errStopwork := errors.New("StopWork")
@@ -868,42 +896,216 @@ func getUserquery(c *gin.Context) (userquery, error) {
 		return userquery{}, errStopwork
 	}
 
-	// A filename may be from another OS: c:\windows\filename, \\?\c:\windows, \filename, /filename, \\computer\dir\filename, /../../filename.
-	// Validate user supplied input.
-	if validatefilepath(req.Filename, constmaxpath) != nil {
+	q, err := userqueryFromFilename(c, req.Filename)
+	if err != nil {
+		if myError, ok := err.(*Error.Error); ok && myError.Code == errPathError {
+			c.JSON(http.StatusBadRequest,
+				gin.H{"error": Error.ToUser(op, errPathError, Error.I18text(`you specified a wrong path in parameter 'filename' %s`, req.Filename)).Error()})
+			return userquery{}, errStopwork
+		}
+		log.Println(logline(c, fmt.Sprintf("can't create storage root directory: %s", err)))
+		c.JSON(http.StatusInternalServerError,
+			gin.H{"error": Error.ToUser(op, Error.ErrFileIO, Error.I18text(`service can't create root storage directory.`)).Error()})
+		return userquery{}, errStopwork
+	}
+	// unnecessary file checksum. Old clients send only a "sha1" header.
+	q.algorithm, err = fsdriver.ParseHashAlgorithm(c.GetHeader("Hash-Algorithm"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest,
-			gin.H{"error": Error.ToUser(op, errPathError, Error.I18text(`you specified a wrong path in parameter 'filename' %s`, req.Filename)).Error()})
+			gin.H{"error": Error.ToUser(op, errWrongURLParameters, Error.I18text("Hash-Algorithm may be one of: %s", strings.Join(fsdriver.HashAlgorithms, ", "))).Error()})
 		return userquery{}, errStopwork
 	}
-	fullpath := filepath.Clean(req.Filename) // work about ../../
+	q.strhash = c.GetHeader("Hash")
+	if q.strhash == "" && q.algorithm == fsdriver.SHA1 {
+		q.strhash = c.GetHeader("Sha1")
+	}
+	q.filesize = req.Filesize
+	return q, nil
+}
 
-	name := filepath.Base(fullpath) // drop the path part from user supplied input
+// session returns a Session of an upload of q that starts at the moment now.
+func (q userquery) session(now time.Time) Session {
+	return Session{
+		Username:  q.username,
+		Fullpath:  q.fullpath,
+		Hash:      q.strhash,
+		Algorithm: q.algorithm,
+		Filesize:  q.filesize,
+		Expires:   now.Add(constSessionLifetime),
+	}
+}
 
-	storagepath := GetPathWhereToStore(c)
-	// storagepath must exist. mkdirAll will create all the path.
-	err = os.MkdirAll(storagepath, 0700)
+// userqueryFromSession restores a userquery of an upload session.
+// A file name of a session was checked when the session started.
+func userqueryFromSession(s Session) userquery {
+	storagepath, name, err := placeOfFile(GetPathWhereToStoreByUsername(s.Username), s.Username, s.Fullpath)
 	if err != nil {
-		log.Println(logline(c, fmt.Sprintf("can't create storage root directory: %s", err)))
-		c.JSON(http.StatusInternalServerError,
-			gin.H{"error": Error.ToUser(op, Error.ErrFileIO, Error.I18text(`service can't create root storage directory.`)).Error()})
-		return userquery{}, errStopwork
+		storagepath, name = GetPathWhereToStoreByUsername(s.Username), filepath.Base(s.Fullpath)
+	}
+	return userquery{
+		fullpath:        s.Fullpath,
+		name:            name,
+		username:        s.Username,
+		storagepath:     storagepath,
+		strhash:         s.Hash,
+		algorithm:       s.Algorithm,
+		filesize:        s.Filesize,
+		nameNotComplete: name + ".part",
+	}
+}
+
+// deleteSession ends a session when an upload is not allowed anymore.
+func deleteSession(c *gin.Context, id string) {
+	if err := Sessions.Delete(id); err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't delete a session: %s", err)))
+	}
+}
+
+// linkStoredContent creates a new file of q as a link to a stored blob with the hash from a client.
+// A hash proves nothing, so the blob must be uploaded by the same login before.
+// filesize <= 0 means a size is unknown.
+// Returns true when the client needs not send the file.
+func linkStoredContent(c *gin.Context, q userquery, filesize int64) bool {
+	if !ConfigThisService.Dedup {
+		return false
+	}
+	hash := hashFromClient(c, q)
+	if hash == nil {
+		return false
+	}
+	stat, err := fsdriver.StatBlob(ConfigThisService.Storageroot, q.username, q.algorithm, hash)
+	if err != nil || (filesize > 0 && stat.Size() != filesize) {
+		return false
+	}
+	if err := retireCompletedFile(c, q.storagepath, q.name); err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't replace a former file %s: %s", q.name, err)))
+		return false
+	}
+	err = fsdriver.LinkBlob(ConfigThisService.Storageroot, filepath.Join(q.storagepath, q.name), q.username, q.algorithm, hash)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("can't link a stored blob to %s: %s", q.name, err)))
+		return false
 	}
+	// the linked file gets a journal in .sha1 as an uploaded one
+	journalName := fsdriver.GetPartialJournalFileName(q.nameNotComplete)
+	err = fsdriver.CreateNewPartialJournalFile(q.storagepath, q.nameNotComplete, stat.Size(), q.algorithm, hash)
+	if err == nil {
+		err = moveJournalOfCompletedFile(c, q.storagepath, journalName, fsdriver.GetPartialJournalFileName(q.name), q.algorithm, hash)
+	}
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("file %s has no journal: %s", q.name, err)))
+	}
+	log.Println(logline(c, fmt.Sprintf("OK %s %x, file %s is a link to a stored blob", q.algorithm, hash, q.name)))
+	return true
+}
+
+// hashFromClient decodes a hash from a client. An invalid hash is ignored.
+func hashFromClient(c *gin.Context, q userquery) []byte {
+	if q.strhash == "" {
+		return nil
+	}
+	h, err := hex.DecodeString(q.strhash)
+	if err != nil || len(h) != q.algorithm.Size() {
+		log.Println(logline(c, fmt.Sprintf("string representation of %s %s is invalid", q.algorithm, q.strhash)))
+		return nil
+	}
+	return h
+}
+
+// createUpload creates a journal and an empty actual file of a new upload.
+// Returns a state of the new upload.
+func createUpload(c *gin.Context, q userquery, filesize int64, hash []byte) (fsdriver.FileState, error) {
+	err := fsdriver.CreateNewPartialJournalFile(q.storagepath, q.nameNotComplete, filesize, q.algorithm, hash)
+	if err != nil {
+		return fsdriver.FileState{}, err
+	}
+	// an empty actual file makes MayUpload read the journal header
+	f, err := fsdriver.Store.OpenFile(filepath.Join(q.storagepath, q.nameNotComplete), os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return fsdriver.FileState{}, err
+	}
+	if ConfigThisService.Preallocate {
+		if err := fsdriver.Preallocate(f, filesize); err != nil {
+			// the upload still may succeed
+			log.Println(logline(c, fmt.Sprintf("can't preallocate %d bytes for %s: %s", filesize, q.nameNotComplete, err)))
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fsdriver.FileState{}, err
+	}
+	return mayUpload(c, q)
+}
+
+// userqueryFromFilename validates a user supplied filename and fills a userquery for the current user.
+// It creates the user storage directory. It doesn't write a response.
+func userqueryFromFilename(c *gin.Context, filename string) (userquery, error) {
+	const op = "uploadserver.userqueryFromFilename()"
+
+	// A filename may be from another OS: c:\windows\filename, \\?\c:\windows, \filename, /filename, \\computer\dir\filename, /../../filename.
+	// Validate user supplied input.
+	if err := validatefilepath(filename, constmaxpath); err != nil {
+		return userquery{}, err
+	}
+	fullpath := filepath.Clean(filename) // work about ../../
+
 	username := c.GetString(gin.AuthUserKey) // used in sync.Map usedfiles.
+	// drops the path part from user supplied input or keeps its relative directories
+	storagepath, name, err := placeOfFile(GetPathWhereToStore(c), username, filename)
+	if err != nil {
+		return userquery{}, err
+	}
+	// storagepath must exist. mkdirAll will create all the path.
+	err = fsdriver.Store.MkdirAll(storagepath, 0700)
+	if err != nil {
+		return userquery{}, Error.E(op, err, Error.ErrFileIO, 0, "")
+	}
 	if username == "" {
 		// anonymous users are not allowed to upload to a full path of the file.
 		fullpath = name
 	}
-	strsha1 := c.GetHeader("Sha1") // unnecessary file checksum.
 	return userquery{
 		fullpath:        fullpath,
 		storagepath:     storagepath,
 		name:            name,
 		username:        username,
-		strsha1:         strsha1,
 		nameNotComplete: name + ".part",
 	}, nil
 }
 
+// finishUpload is called when the last byte of a file has been written.
+// It checks the actual hash against want (if it was given) and calls eventOnSuccess.
+// fact is a running hash from writing, nil means the file is read to compute it.
+// Returns errSha1CheckFailed when the file content is not the expected one.
+func finishUpload(c *gin.Context, q userquery, alg fsdriver.HashAlgorithm, want, fact []byte) error {
+	const op = "uploadserver.finishUpload()"
+	var err error
+	if fact == nil {
+		// no running hash from writing, reads the file
+		fact, err = fsdriver.GetFileHash(q.storagepath, q.nameNotComplete, alg)
+		if err != nil {
+			log.Println(logline(c, fmt.Sprintf("Error while computing %s for the file %s, error %s.", alg, q.nameNotComplete, err)))
+		}
+	}
+	if !fsdriver.IsEmptyHash(want) {
+		// we may check correctness
+
+		if !bytes.Equal(fact, want) {
+			// hash differs!!!
+			log.Println(logline(c, fmt.Sprintf("%s failed, want = %x, has = %x, file %s", alg, want, fact, q.nameNotComplete)))
+			return Error.E(op, nil, errSha1CheckFailed, 0, q.nameNotComplete)
+		}
+	}
+
+	// Rename journal file. Add string representation of the hash to the journal filename.
+
+	err = eventOnSuccess(c, q.storagepath, q.name, q.nameNotComplete, alg, fact)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("event 'onSuccess' failed: %s", err)))
+	}
+	log.Println(logline(c, fmt.Sprintf("successfull upload: %s", q.name)))
+	return nil
+}
+
 // waitForWriteToFinish waits for the end of write operation.
 // Returns: ok == true when there was written an expected count of bytes.
 func waitForWriteToFinish(chWriteResult chan writeresult, expectednbytes int64) (retwriteresult writeresult, ok bool) {
@@ -946,16 +1148,25 @@ func GetPathWhereToStoreByUsername(username string) string {
 	return filepath.Join(ConfigThisService.Storageroot, filepath.Base(username))
 }
 
+// loginOfDir returns a login of a user storage directory dir or of its subdirectory, "" for other directories.
+func loginOfDir(dir string) string {
+	rel, err := filepath.Rel(ConfigThisService.Storageroot, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
 // getFinalNameOfJournalFile return the journal file name when its upload successfully completes.
-// e.x. abcd.partialinfo -> abcd.sha-XXXX... . XXXX is the hex of the actual file hash.
-func getFinalNameOfJournalFile(namepart string, factsha1 []byte) string {
+// e.x. abcd.partialinfo -> abcd.sha1-XXXX... or abcd.sha256-XXXX... . XXXX is the hex of the actual file hash.
+func getFinalNameOfJournalFile(namepart string, alg fsdriver.HashAlgorithm, facthash []byte) string {
 	nopartial := strings.Replace(namepart, ".partialinfo", "", 1)
-	return fmt.Sprintf("%s.sha1-%x", nopartial, factsha1)
+	return fmt.Sprintf("%s.%s-%x", nopartial, alg, facthash)
 }
 
 // closeFiles deals with errors while closing.
 // Close() with an error means no guarantie for how much has been written.
-func closeFiles(wa, wp *os.File) []error {
+func closeFiles(wa, wp fsdriver.File) []error {
 	err1 := wa.Close()
 	err2 := wp.Close()
 	if err1 != nil || err2 != nil {
@@ -969,32 +1180,31 @@ func closeFiles(wa, wp *os.File) []error {
 
 // eventOnSuccess is called on successfull upload of the file with name 'name'.
 // Currently it moves journal file to a .sha1 directory.
-func eventOnSuccess(c *gin.Context, storagepath, name string, nameNotComplete string, factsha1 []byte) (err error) {
+func eventOnSuccess(c *gin.Context, storagepath, name string, nameNotComplete string, alg fsdriver.HashAlgorithm, facthash []byte) (err error) {
 	journalName := fsdriver.GetPartialJournalFileName(nameNotComplete)
 	newjournalName := fsdriver.GetPartialJournalFileName(name)
 	err = nil
 	if ConfigThisService.ActionOnCompleteFile == nil {
 		// default action == move to .sha1
-		journalNewName := getFinalNameOfJournalFile(newjournalName, factsha1)
-		journalNewPath := storagepath + "/.sha1" // all journals we will store in a directory
-		newabsfilename := filepath.Join(journalNewPath, journalNewName)
-		// actual action on the journal file: journal is renamed and moved to .sha1 dir.
-		mkerr := os.MkdirAll(journalNewPath, 0700) // makes .sha1 dir
-		if mkerr != nil {
-			log.Println(logline(c, fmt.Sprintf("mkdir failed %s: %s", journalNewPath, mkerr)))
-
-		}
-		// rename a journal file
-		err = os.Rename(filepath.Join(storagepath, journalName), newabsfilename)
-		if err != nil {
-			log.Println(logline(c, fmt.Sprintf("rename failed from %s to %s: %s", journalName, journalNewName, err)))
+		// a former file with the same name is kept as a version or overwritten
+		if errretire := retireCompletedFile(c, storagepath, name); errretire != nil {
+			log.Println(logline(c, fmt.Sprintf("can't replace a former file %s: %s", name, errretire)))
 		}
+		err = moveJournalOfCompletedFile(c, storagepath, journalName, newjournalName, alg, facthash)
 		// rename actual file
-		err = os.Rename(filepath.Join(storagepath, nameNotComplete), filepath.Join(storagepath, name))
+		err = fsdriver.Store.Rename(filepath.Join(storagepath, nameNotComplete), filepath.Join(storagepath, name))
 		if err != nil {
 			log.Println(logline(c, fmt.Sprintf("rename failed from %s to %s: %s", nameNotComplete, name, err)))
 		}
-		log.Println(logline(c, fmt.Sprintf("OK SHA1 %x, file %s", factsha1, name)))
+		log.Println(logline(c, fmt.Sprintf("OK %s %x, file %s", alg, facthash, name)))
+		if ConfigThisService.Dedup && err == nil {
+			dedup, errblob := fsdriver.StoreBlob(ConfigThisService.Storageroot, filepath.Join(storagepath, name), loginOfDir(storagepath), alg, facthash)
+			if errblob != nil {
+				log.Println(logline(c, fmt.Sprintf("file %s is not deduplicated: %s", name, errblob)))
+			} else if dedup {
+				log.Println(logline(c, fmt.Sprintf("file %s is a link to a stored blob", name)))
+			}
+		}
 
 	} else {
 		// user supplied action
@@ -1007,6 +1217,26 @@ func eventOnSuccess(c *gin.Context, storagepath, name string, nameNotComplete st
 	return //named
 }
 
+// moveJournalOfCompletedFile renames a journal of a completed file and moves it to a .sha1 directory
+// as NAME.<algorithm>-<hash>, newjournalName is a journal name of the completed file.
+func moveJournalOfCompletedFile(c *gin.Context, storagepath, journalName, newjournalName string, alg fsdriver.HashAlgorithm, facthash []byte) error {
+	journalNewName := getFinalNameOfJournalFile(newjournalName, alg, facthash)
+	journalNewPath := storagepath + "/.sha1" // all journals we will store in a directory
+	newabsfilename := filepath.Join(journalNewPath, journalNewName)
+	// actual action on the journal file: journal is renamed and moved to .sha1 dir.
+	mkerr := fsdriver.Store.MkdirAll(journalNewPath, 0700) // makes .sha1 dir
+	if mkerr != nil {
+		log.Println(logline(c, fmt.Sprintf("mkdir failed %s: %s", journalNewPath, mkerr)))
+
+	}
+	// rename a journal file
+	err := fsdriver.Store.Rename(filepath.Join(storagepath, journalName), newabsfilename)
+	if err != nil {
+		log.Println(logline(c, fmt.Sprintf("rename failed from %s to %s: %s", journalName, journalNewName, err)))
+	}
+	return err
+}
+
 // validatefilepath allows "/path1/long path$~123/../filename.ext"
 func validatefilepath(pathstr string, maxlen int) (err error) {
 	const op = "uploadserver.validatefilepath()"
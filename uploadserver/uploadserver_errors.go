@@ -18,6 +18,9 @@ const (
 	errInternalServiceError
 	// ErrAuthorizationFailed is used in cmd/uploadserver.main()
 	ErrAuthorizationFailed
+	errRetentionRules
+	errFileIsIncomplete
+	errDestinationExists
 )
 
 func init() {
@@ -35,4 +38,7 @@ func init() {
 	Error.I18[errPathError] = "Error in a path."
 	Error.I18[errInternalServiceError] = "Service internal error."
 	Error.I18[ErrAuthorizationFailed] = "Authorization failed (package uploadserver)."
+	Error.I18[errRetentionRules] = "Wrong retention rules."
+	Error.I18[errFileIsIncomplete] = "The file is being uploaded, it is incomplete."
+	Error.I18[errDestinationExists] = "A file with the destination name already exists."
 }
@@ -1,6 +1,7 @@
 package uploadserver
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -57,6 +58,9 @@ func Test_consumeSourceChannel(t *testing.T) {
 	// end case
 
 	// RUN tests
+	if err := os.MkdirAll(storagepath, 0700); err != nil {
+		t.Fatal(err)
+	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,7 +71,7 @@ func Test_consumeSourceChannel(t *testing.T) {
 			// fsdriver.OpenTwoCorrespondentFiles(tt.args.storagepath, tt.args.name, journalname)
 			ctx := &gin.Context{}
 			go consumeSourceChannel(ctx, tt.args.chSource, tt.args.chResult, tt.args.storagepath, tt.args.name,
-				tt.args.destination,
+				tt.args.destination, fsdriver.Durability{}, nil,
 				done)
 			go tt.args.funcproducer(tt.args.chSource)
 			get, ok := waitForWriteToFinish(tt.args.chResult, tt.args.expectcount)
@@ -78,6 +82,11 @@ func Test_consumeSourceChannel(t *testing.T) {
 			if get.err != nil {
 				t.Errorf("want writeresult.err==nil, get==%s", get.err)
 			}
+			// running sha1 must be the sha1 of the written file
+			want, err := fsdriver.GetFileSha1(tt.args.storagepath, tt.args.name)
+			if err != nil || !bytes.Equal(get.hash, want) {
+				t.Errorf("writeresult.hash = %x, want %x, err = %v", get.hash, want, err)
+			}
 
 		})
 	}
@@ -132,3 +141,20 @@ func Test_validatefilepath(t *testing.T) {
 		})
 	}
 }
+
+func Test_getFinalNameOfJournalFile(t *testing.T) {
+	tests := []struct {
+		alg  fsdriver.HashAlgorithm
+		hash []byte
+		want string
+	}{
+		{fsdriver.SHA1, []byte{0xab, 0x01}, "f.rar.sha1-ab01"},
+		{fsdriver.SHA256, []byte{0xab, 0x01}, "f.rar.sha256-ab01"},
+		{fsdriver.BLAKE2b, []byte{0xab, 0x01}, "f.rar.blake2b-ab01"},
+	}
+	for _, tt := range tests {
+		if got := getFinalNameOfJournalFile("f.rar.partialinfo", tt.alg, tt.hash); got != tt.want {
+			t.Errorf("getFinalNameOfJournalFile(%s) = %s, want %s", tt.alg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package uploadserver
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/fsdriver"
+	"github.com/zavla/upload/logins"
+)
+
+// KeyVersions is a key in gin.Context of a logins.Versions policy of an authorized user.
+const KeyVersions = "versions"
+
+// VersionsDir is a directory near completed files that keeps their former versions as NAME;vN,
+// journals of versions are in its .sha1 directory.
+const VersionsDir = ".versions"
+
+// versionSep separates a file name and a number of its version.
+const versionSep = ";v"
+
+// versionsPolicy returns a policy of uploads of existing files of the current user.
+func versionsPolicy(c *gin.Context) logins.Versions {
+	if c == nil {
+		return logins.VersionsReject
+	}
+	v, _ := c.Get(KeyVersions)
+	policy, _ := v.(logins.Versions)
+	return policy
+}
+
+// mayUpload is fsdriver.MayUpload that allows a new upload of a complete file
+// when the user keeps versions or overwrites files.
+func mayUpload(c *gin.Context, q userquery) (fsdriver.FileState, error) {
+	switch versionsPolicy(c) {
+	case logins.VersionsKeep, logins.VersionsOverwrite:
+		return fsdriver.MayUploadOver(q.storagepath, q.name, q.nameNotComplete)
+	}
+	return fsdriver.MayUpload(q.storagepath, q.name, q.nameNotComplete)
+}
+
+// versionName returns a name of version n of a file name.
+func versionName(name string, n int) string {
+	return name + versionSep + strconv.Itoa(n)
+}
+
+// splitVersionName returns a file name and a number of a version from a name in VersionsDir.
+func splitVersionName(vname string) (string, int, bool) {
+	i := strings.LastIndex(vname, versionSep)
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(vname[i+len(versionSep):])
+	if err != nil || n <= 0 {
+		return "", 0, false
+	}
+	return vname[:i], n, true
+}
+
+// versionsOf returns versions of files of dir by their names, versions are ordered by numbers.
+func versionsOf(dir string) (map[string][]os.FileInfo, error) {
+	infos, err := fsdriver.Store.ReadDir(filepath.Join(dir, VersionsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ret := make(map[string][]os.FileInfo)
+	for _, fi := range infos {
+		name, _, ok := splitVersionName(fi.Name())
+		if ok && !fi.IsDir() {
+			ret[name] = append(ret[name], fi)
+		}
+	}
+	for _, versions := range ret {
+		// ReadDir sorts by names, v10 goes before v2
+		sort.Slice(versions, func(i, j int) bool { return versionNumber(versions[i]) < versionNumber(versions[j]) })
+	}
+	return ret, nil
+}
+
+func versionNumber(fi os.FileInfo) int {
+	_, n, _ := splitVersionName(fi.Name())
+	return n
+}
+
+// keepVersion moves a complete file name of dir to VersionsDir as name;vN with the next N,
+// its journals are moved to .sha1 of VersionsDir.
+// Returns a name of the version.
+func keepVersion(dir, name string) (string, error) {
+	vdir := filepath.Join(dir, VersionsDir)
+	if err := fsdriver.Store.MkdirAll(vdir, 0700); err != nil {
+		return "", err
+	}
+	versions, err := versionsOf(dir)
+	if err != nil {
+		return "", err
+	}
+	n := 1
+	if v := versions[name]; len(v) > 0 {
+		n = versionNumber(v[len(v)-1]) + 1
+	}
+	vname := versionName(name, n)
+	// .sha1/NAME.<algorithm>-<hash> becomes .versions/.sha1/NAME;vN.<algorithm>-<hash>
+	return vname, renameWithJournals(filepath.Join(dir, name), filepath.Join(vdir, vname))
+}
+
+// retireCompletedFile makes room for a new version of a complete file name of dir by a policy.
+// VersionsKeep keeps the file as a version, VersionsOverwrite removes its journals
+// and the file is replaced by a rename of the new one.
+func retireCompletedFile(c *gin.Context, dir, name string) error {
+	if _, err := fsdriver.Store.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+		return nil
+	}
+	switch versionsPolicy(c) {
+	case logins.VersionsKeep:
+		vname, err := keepVersion(dir, name)
+		if err == nil {
+			log.Println(logline(c, fmt.Sprintf("former file %s is kept as %s", name, filepath.Join(VersionsDir, vname))))
+		}
+		return err
+	case logins.VersionsOverwrite:
+		return removeJournals(filepath.Join(dir, name))
+	}
+	return nil
+}
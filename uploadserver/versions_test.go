@@ -0,0 +1,99 @@
+package uploadserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zavla/upload/logins"
+)
+
+func Test_retireCompletedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	q := userquery{storagepath: dir, name: "a.bak", nameNotComplete: "a.bak.part"}
+	c := &gin.Context{Request: httptest.NewRequest(http.MethodPost, "/upload/zahar?filename=a.bak", nil)}
+
+	write("a.bak", "first")
+	write(".sha1/a.bak.sha1-01", "")
+	if _, err := mayUpload(c, q); err == nil {
+		t.Errorf("mayUpload() of an existing file must fail by default")
+	}
+	c.Set(KeyVersions, logins.VersionsKeep)
+	if _, err := mayUpload(c, q); err != nil {
+		t.Errorf("mayUpload() of an existing file with versions = %s", err)
+	}
+
+	for i, want := range []string{"a.bak;v1", "a.bak;v2"} {
+		if err := retireCompletedFile(c, dir, "a.bak"); err != nil {
+			t.Fatal(err)
+		}
+		if exists("a.bak") || !exists(filepath.Join(VersionsDir, want)) ||
+			!exists(filepath.Join(VersionsDir, ".sha1", want+".sha1-01")) || exists(".sha1/a.bak.sha1-01") {
+			t.Errorf("retireCompletedFile() #%d didn't keep %s with its journal", i, want)
+		}
+		write("a.bak", "next")
+		write(".sha1/a.bak.sha1-01", "")
+	}
+	write(filepath.Join(VersionsDir, "a.bak;v10"), "")
+	versions, err := versionsOf(dir)
+	if err != nil || len(versions["a.bak"]) != 3 || versions["a.bak"][2].Name() != "a.bak;v10" {
+		t.Errorf("versionsOf() = %v, %v", versions, err)
+	}
+
+	c.Set(KeyVersions, logins.VersionsOverwrite)
+	if err := retireCompletedFile(c, dir, "a.bak"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a.bak") || exists(".sha1/a.bak.sha1-01") || exists(filepath.Join(VersionsDir, "a.bak;v11")) {
+		t.Errorf("retireCompletedFile() must remove journals of an overwritten file only")
+	}
+
+	bytes, files, err := storageUsage(dir)
+	if err != nil || files != 4 || bytes != int64(len("first")+len("next")*2) {
+		t.Errorf("storageUsage() = %d bytes, %d files, %v, versions must be counted", bytes, files, err)
+	}
+}
+
+func Test_splitVersionName(t *testing.T) {
+	tests := []struct {
+		vname string
+		name  string
+		n     int
+		ok    bool
+	}{
+		{"a.bak;v1", "a.bak", 1, true},
+		{"a;v2.bak;v12", "a;v2.bak", 12, true},
+		{"a.bak;v0", "", 0, false},
+		{"a.bak;vx", "", 0, false},
+		{";v1", "", 0, false},
+		{"a.bak", "", 0, false},
+	}
+	for _, tt := range tests {
+		name, n, ok := splitVersionName(tt.vname)
+		if name != tt.name || n != tt.n || ok != tt.ok {
+			t.Errorf("splitVersionName(%q) = %q, %d, %v", tt.vname, name, n, ok)
+		}
+	}
+	if got := versionName("a.bak", 3); got != "a.bak;v3" {
+		t.Errorf("versionName() = %s", got)
+	}
+}